@@ -0,0 +1,67 @@
+// Package audit keeps a persistent security audit log (signups, logins, token and password changes, role changes)
+// in audit_events, next to the stdout logs.
+package audit
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bilalabsh/zabaan_backend/internal/auth"
+	"github.com/bilalabsh/zabaan_backend/internal/clientip"
+	"github.com/bilalabsh/zabaan_backend/internal/models"
+)
+
+const maxUserAgentLength = 512
+
+// Store is the persistence needed by Recorder and Handler. Implemented by Repository.
+type Store interface {
+	Insert(e *models.AuditEvent, t time.Time) error
+	List(f Filter) ([]models.AuditEvent, error)
+}
+
+// Recorder records audit events for HTTP requests. It implements auth.AuditRecorder and user.AuditRecorder.
+type Recorder struct {
+	store      Store
+	trustProxy bool
+}
+
+// NewRecorder returns a recorder. trustProxy controls whether the client IP is taken from proxy headers
+// (the same rule as the rate limiter and sessions).
+func NewRecorder(store Store, trustProxy bool) *Recorder {
+	return &Recorder{store: store, trustProxy: trustProxy}
+}
+
+// Record stores e with the request's client IP and user agent. When e.ActorID is 0 the authenticated caller,
+// if any, is the actor; calls made with an API key note the key in the details. With an impersonation token the
+// impersonating admin is always the actor, and the impersonated user is noted in the details.
+// Failures are logged, not returned: a missing audit row must not fail the request.
+func (rec *Recorder) Record(r *http.Request, e models.AuditEvent) {
+	e.IP = clientip.FromRequest(r, rec.trustProxy)
+	e.UserAgent = r.UserAgent()
+	if len(e.UserAgent) > maxUserAgentLength {
+		e.UserAgent = strings.ToValidUTF8(e.UserAgent[:maxUserAgentLength], "")
+	}
+	if claims := auth.ClaimsFromContext(r.Context()); claims != nil {
+		if e.ActorID == 0 {
+			e.ActorID = auth.UserIDFromClaims(claims)
+		}
+		if actorID := auth.ImpersonatorID(claims); actorID != 0 {
+			e.ActorID = actorID
+			if e.Details == nil {
+				e.Details = map[string]string{}
+			}
+			e.Details["impersonated_user_id"] = claims.Subject
+		}
+		if claims.APIKeyID != "" {
+			if e.Details == nil {
+				e.Details = map[string]string{}
+			}
+			e.Details["api_key_id"] = claims.APIKeyID
+		}
+	}
+	if err := rec.store.Insert(&e, time.Now()); err != nil {
+		slog.Error("recording audit event failed", "component", "audit", "type", e.Type, "user_id", e.UserID, "err", err)
+	}
+}
@@ -0,0 +1,139 @@
+package audit
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bilalabsh/zabaan_backend/internal/auth"
+)
+
+// Page size for event listings.
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// Handler serves the audit log.
+type Handler struct {
+	store Store
+}
+
+// NewHandler returns a new audit handler.
+func NewHandler(store Store) *Handler {
+	return &Handler{store: store}
+}
+
+// MyEvents handles GET /me/security-events (requires RequireAuth): the caller's own history, newest first.
+// Query: limit (default 50, max 200) and before (an event id, for the next page).
+// Response: {"events": [...], "next_before": 123}; next_before is omitted on the last page.
+func (h *Handler) MyEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+	userID := auth.UserIDFromClaims(auth.ClaimsFromContext(r.Context()))
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+		return
+	}
+	f, ok := parsePage(w, r)
+	if !ok {
+		return
+	}
+	f.UserID = userID
+	h.list(w, f, "MyEvents")
+}
+
+// Events handles GET /admin/security-events (admins only).
+// Query filters: user_id, actor_id, type, ip, since and until (RFC 3339), plus limit and before as for MyEvents.
+func (h *Handler) Events(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+	f, ok := parsePage(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	for _, p := range []struct {
+		name string
+		dst  *uint
+	}{{"user_id", &f.UserID}, {"actor_id", &f.ActorID}} {
+		if v := q.Get(p.name); v != "" {
+			id, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				writeBadRequest(w, "invalid "+p.name)
+				return
+			}
+			*p.dst = uint(id)
+		}
+	}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &f.Since}, {"until", &f.Until}} {
+		if v := q.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeBadRequest(w, "invalid "+p.name+"; use RFC 3339")
+				return
+			}
+			*p.dst = t
+		}
+	}
+	f.Type = q.Get("type")
+	f.IP = q.Get("ip")
+	h.list(w, f, "Events")
+}
+
+func (h *Handler) list(w http.ResponseWriter, f Filter, handler string) {
+	events, err := h.store.List(f)
+	if err != nil {
+		slog.Error("list audit events failed", "handler", handler, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		return
+	}
+	resp := map[string]interface{}{"events": events}
+	if len(events) == f.Limit {
+		resp["next_before"] = events[len(events)-1].ID
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// parsePage reads limit and before. On invalid values it writes 400 and returns false.
+func parsePage(w http.ResponseWriter, r *http.Request) (Filter, bool) {
+	f := Filter{Limit: defaultPageSize}
+	q := r.URL.Query()
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeBadRequest(w, "invalid limit")
+			return f, false
+		}
+		f.Limit = min(n, maxPageSize)
+	}
+	if v := q.Get("before"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id < 1 {
+			writeBadRequest(w, "invalid before")
+			return f, false
+		}
+		f.BeforeID = id
+	}
+	return f, true
+}
+
+func writeBadRequest(w http.ResponseWriter, msg string) {
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
@@ -0,0 +1,151 @@
+package audit
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/bilalabsh/zabaan_backend/internal/models"
+)
+
+// Filter selects audit events for List. Zero fields don't filter (a zero Limit returns all matches).
+// Results are newest first; pass the last event's id as BeforeID to get the next page.
+type Filter struct {
+	UserID   uint
+	ActorID  uint
+	Type     string
+	IP       string
+	Since    time.Time
+	Until    time.Time
+	BeforeID int64
+	Limit    int
+}
+
+// Repository stores audit events in audit_events.
+type Repository struct {
+	db *sql.DB
+}
+
+// NewRepository returns a new audit repository.
+func NewRepository(db *sql.DB) *Repository {
+	return &Repository{db: db}
+}
+
+// Insert stores e. When e.UserID is 0 and e.Email is set, the event is attached to the user with that email, if any,
+// so failed logins show up in the account's history.
+func (r *Repository) Insert(e *models.AuditEvent, t time.Time) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	var details []byte
+	if len(e.Details) > 0 {
+		var err error
+		if details, err = json.Marshal(e.Details); err != nil {
+			return err
+		}
+	}
+	_, err := r.db.Exec(`INSERT INTO audit_events (type, actor_id, user_id, email, ip, user_agent, details, created_at)
+		VALUES (?, ?, COALESCE(?, (SELECT id FROM users WHERE email = ? AND email <> '')), ?, ?, ?, ?, ?)`,
+		e.Type, nullID(e.ActorID), nullID(e.UserID), e.Email, e.Email, e.IP, e.UserAgent, string(details), t)
+	return err
+}
+
+// List returns events matching f, newest first.
+func (r *Repository) List(f Filter) ([]models.AuditEvent, error) {
+	if r.db == nil {
+		return nil, sql.ErrConnDone
+	}
+	var where []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		where = append(where, cond)
+		args = append(args, arg)
+	}
+	if f.UserID != 0 {
+		add("user_id = ?", int64(f.UserID))
+	}
+	if f.ActorID != 0 {
+		add("actor_id = ?", int64(f.ActorID))
+	}
+	if f.Type != "" {
+		add("type = ?", f.Type)
+	}
+	if f.IP != "" {
+		add("ip = ?", f.IP)
+	}
+	if !f.Since.IsZero() {
+		add("created_at >= ?", f.Since)
+	}
+	if !f.Until.IsZero() {
+		add("created_at < ?", f.Until)
+	}
+	if f.BeforeID != 0 {
+		add("id < ?", f.BeforeID)
+	}
+	q := "SELECT id, type, actor_id, user_id, email, ip, user_agent, details, created_at FROM audit_events"
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	q += " ORDER BY id DESC"
+	if f.Limit > 0 {
+		q += " LIMIT ?"
+		args = append(args, f.Limit)
+	}
+	rows, err := r.db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []models.AuditEvent{}
+	for rows.Next() {
+		var e models.AuditEvent
+		var actorID, userID sql.NullInt64
+		var details sql.NullString
+		var createdAt time.Time
+		if err := rows.Scan(&e.ID, &e.Type, &actorID, &userID, &e.Email, &e.IP, &e.UserAgent, &details, &createdAt); err != nil {
+			return nil, err
+		}
+		e.ActorID = uint(actorID.Int64)
+		e.UserID = uint(userID.Int64)
+		if details.String != "" {
+			if err := json.Unmarshal([]byte(details.String), &e.Details); err != nil {
+				return nil, err
+			}
+		}
+		e.CreatedAt = createdAt.Format(time.RFC3339)
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// ExportName implements auth.UserDataStore.
+func (r *Repository) ExportName() string {
+	return "security_events"
+}
+
+// ExportUserData returns all audit events about the user (auth.UserDataStore).
+func (r *Repository) ExportUserData(userID uint) (interface{}, error) {
+	return r.List(Filter{UserID: userID})
+}
+
+// DeleteUserData anonymizes the user's audit events (auth.UserDataStore): the events stay for the security
+// record, without the user id, email, IP or user agent.
+func (r *Repository) DeleteUserData(userID uint) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	if _, err := r.db.Exec("UPDATE audit_events SET user_id = NULL, email = '', ip = '', user_agent = '' WHERE user_id = ?", int64(userID)); err != nil {
+		return err
+	}
+	_, err := r.db.Exec("UPDATE audit_events SET actor_id = NULL, ip = '', user_agent = '' WHERE actor_id = ?", int64(userID))
+	return err
+}
+
+// nullID maps 0 to NULL.
+func nullID(id uint) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return int64(id)
+}
@@ -0,0 +1,205 @@
+package auth
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bilalabsh/zabaan_backend/internal/mailer"
+	"github.com/bilalabsh/zabaan_backend/internal/models"
+)
+
+// purgeBatch bounds how many accounts PurgeDeletedAccounts deletes per run.
+const purgeBatch = 500
+
+// UserDataStore is implemented by modules outside auth that keep rows about a user (e.g. the audit log),
+// so account exports and deletions cover them. Register them with Options.UserDataStores.
+type UserDataStore interface {
+	// ExportName is the section name of the store's data in an export (e.g. "security_events").
+	ExportName() string
+	ExportUserData(userID uint) (interface{}, error)
+	// DeleteUserData removes or anonymizes the user's rows.
+	DeleteUserData(userID uint) error
+}
+
+// ScheduleDeletion schedules the caller's account for deletion after DeletionGrace and returns when that is.
+// All tokens, sessions and API keys are revoked now; signing in again before then cancels the deletion (see IssueTokens).
+func (s *Service) ScheduleDeletion(claims *Claims) (time.Time, error) {
+	userID := UserIDFromClaims(claims)
+	u, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	now := time.Now()
+	at := now.Add(s.deletionGrace)
+	if err := s.userRepo.ScheduleDeletion(userID, at); err != nil {
+		return time.Time{}, err
+	}
+	if err := s.RevokePreviousTokensAt(userID, now); err != nil {
+		return time.Time{}, err
+	}
+	if u.Email != "" {
+		msg := mailer.Message{
+			To:      u.Email,
+			Subject: "Your Zabaan account will be deleted",
+			Body: fmt.Sprintf("Hi %s,\n\nYour Zabaan account and its data will be deleted on %s. You have been signed out everywhere.\n\nIf you want to keep your account, just sign in before then and the deletion is cancelled.\n",
+				u.FirstName, at.UTC().Format("2 January 2006 15:04 MST")),
+		}
+		go func() {
+			if err := s.mailer.Send(msg); err != nil {
+				slog.Error("sending account deletion email failed", "component", "auth", "user_id", u.ID, "err", err)
+			}
+		}()
+	}
+	return at, nil
+}
+
+// cancelDeletion clears a scheduled deletion of u, because the user signed in during the grace period.
+// Once the grace period has ended the deletion stands, as PurgeDeletedAccounts may already be deleting the data.
+func (s *Service) cancelDeletion(u *models.User) error {
+	if u.DeletionScheduledAt == "" {
+		return nil
+	}
+	ok, err := s.userRepo.CancelDeletion(u.ID, time.Now())
+	if err != nil || !ok {
+		return err
+	}
+	u.DeletionScheduledAt = ""
+	slog.Info("account deletion cancelled by sign-in", "component", "auth", "user_id", u.ID)
+	return nil
+}
+
+// PurgeDeletedAccounts deletes accounts whose grace period has ended, with everything stored about them,
+// and returns how many were deleted. The data goes first and the users row last, so an account whose data
+// couldn't be deleted stays due and is retried on the next run. A due deletion can't be cancelled (see cancelDeletion).
+func (s *Service) PurgeDeletedAccounts() (int, error) {
+	now := time.Now()
+	users, err := s.userRepo.ListDueDeletions(now, purgeBatch)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, u := range users {
+		if err := s.deleteUserData(u.ID); err != nil {
+			return deleted, err
+		}
+		ok, err := s.userRepo.DeleteScheduled(u.ID, now)
+		if err != nil {
+			return deleted, err
+		}
+		if !ok {
+			continue
+		}
+		if u.Email != "" {
+			s.resetLoginAttempts(u.Email)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// deleteUserData removes the rows of a user being deleted from the auth tables and every UserDataStore.
+// Callers delete the users row afterwards, once this succeeded, so a failure is retried rather than orphaning the rows.
+func (s *Service) deleteUserData(userID uint) error {
+	for _, store := range s.userDataStores {
+		if err := store.DeleteUserData(userID); err != nil {
+			return err
+		}
+	}
+	return s.tokenRepo.DeleteUserAuthData(userID)
+}
+
+// exportedSession is a Session as it appears in a data export.
+type exportedSession struct {
+	ID         string     `json:"id"`
+	DeviceName string     `json:"device_name"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// exportedEmailChange is an EmailChange as it appears in a data export.
+type exportedEmailChange struct {
+	OldEmail    string     `json:"old_email"`
+	NewEmail    string     `json:"new_email"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ConfirmedAt *time.Time `json:"confirmed_at,omitempty"`
+	CancelledAt *time.Time `json:"cancelled_at,omitempty"`
+}
+
+// ExportUserData returns everything stored about the user, by section: "user", "sessions", "identities", "api_keys",
+// "passkeys", "consents", "email_changes" and one section per UserDataStore. Secrets (password hash, TOTP secret, recovery codes, token hashes) are left out.
+func (s *Service) ExportUserData(userID uint) (map[string]interface{}, error) {
+	u, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := s.tokenRepo.ListAllSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+	exported := make([]exportedSession, 0, len(sessions))
+	for _, sess := range sessions {
+		e := exportedSession{ID: sess.ID, DeviceName: sess.DeviceName, UserAgent: sess.UserAgent, IP: sess.IP, CreatedAt: sess.CreatedAt, LastSeenAt: sess.LastSeenAt}
+		if !sess.RevokedAt.IsZero() {
+			revokedAt := sess.RevokedAt
+			e.RevokedAt = &revokedAt
+		}
+		exported = append(exported, e)
+	}
+	identities, err := s.tokenRepo.ListIdentities(userID)
+	if err != nil {
+		return nil, err
+	}
+	if identities == nil {
+		identities = []Identity{}
+	}
+	keys, err := s.tokenRepo.ListAPIKeys(userID)
+	if err != nil {
+		return nil, err
+	}
+	passkeys, err := s.tokenRepo.ListPasskeys(userID)
+	if err != nil {
+		return nil, err
+	}
+	consents, err := s.tokenRepo.ListConsents(userID)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := s.tokenRepo.ListEmailChanges(userID)
+	if err != nil {
+		return nil, err
+	}
+	exportedChanges := make([]exportedEmailChange, 0, len(changes))
+	for _, c := range changes {
+		e := exportedEmailChange{OldEmail: c.OldEmail, NewEmail: c.NewEmail, CreatedAt: c.CreatedAt}
+		if !c.ConfirmedAt.IsZero() {
+			confirmedAt := c.ConfirmedAt
+			e.ConfirmedAt = &confirmedAt
+		}
+		if !c.CancelledAt.IsZero() {
+			cancelledAt := c.CancelledAt
+			e.CancelledAt = &cancelledAt
+		}
+		exportedChanges = append(exportedChanges, e)
+	}
+	data := map[string]interface{}{
+		"user":          u,
+		"sessions":      exported,
+		"identities":    identities,
+		"api_keys":      keys,
+		"passkeys":      passkeys,
+		"consents":      consents,
+		"email_changes": exportedChanges,
+	}
+	for _, store := range s.userDataStores {
+		section, err := store.ExportUserData(userID)
+		if err != nil {
+			return nil, err
+		}
+		data[store.ExportName()] = section
+	}
+	return data, nil
+}
@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bilalabsh/zabaan_backend/internal/models"
+)
+
+// apiKeyPrefix starts every API key, so leaked keys are easy to recognize (and to scan for in repositories).
+const apiKeyPrefix = "zbk_"
+
+// API key scopes. A key may only call routes that require one of its scopes, and never more than its user's roles allow.
+const (
+	ScopeUsersRead        = "users:read"
+	ScopeUsersWrite       = "users:write"
+	ScopeTokensIntrospect = "tokens:introspect" // POST /oauth/introspect, for internal services; admins only
+)
+
+// APIKeyScopes lists the scopes a key can be created with.
+var APIKeyScopes = []string{ScopeUsersRead, ScopeUsersWrite, ScopeTokensIntrospect}
+
+// adminOnlyScopes can only be granted by admins, to keys of admins, since they aren't limited by the key owner's
+// roles. Where they are used, they also require the owner to still be an admin (ValidateAPIKey reads the current roles).
+var adminOnlyScopes = map[string]bool{ScopeTokensIntrospect: true}
+
+const (
+	maxAPIKeyNameLength = 100
+	maxAPIKeysPerUser   = 25
+	apiKeyTouchInterval = time.Minute // last_used_at is written at most this often per key
+)
+
+// ErrAPIKeyInvalid is returned when an API key is unknown, revoked, or expired.
+var ErrAPIKeyInvalid = errors.New("invalid api key")
+
+// ErrAPIKeyNotFound is returned when revoking a key that doesn't exist or isn't the caller's.
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// ErrInvalidScope is returned when creating a key with an unknown scope.
+var ErrInvalidScope = errors.New("invalid scope")
+
+// ErrAPIKeyLimit is returned when the user already has maxAPIKeysPerUser active keys.
+var ErrAPIKeyLimit = errors.New("too many api keys")
+
+// ErrAPIKeyForbidden is returned when a non-admin creates a key for another user.
+var ErrAPIKeyForbidden = errors.New("not allowed to create api keys for other users")
+
+// ErrScopeForbidden is returned when a non-admin creates a key with an admin-only scope, or gives one to a non-admin's key.
+var ErrScopeForbidden = errors.New("scope requires admin")
+
+// CreateAPIKey creates an API key owned by userID and returns it with the secret, which is only available here.
+// Admins may create keys for other users (e.g. a service account for the content pipeline); others only for themselves.
+// A nil expiresAt creates a key that doesn't expire.
+func (s *Service) CreateAPIKey(creator *Claims, userID uint, name string, scopes []string, expiresAt *time.Time) (*APIKey, string, error) {
+	creatorID := UserIDFromClaims(creator)
+	if userID == 0 {
+		userID = creatorID
+	}
+	if userID != creatorID && !creator.HasRole(models.RoleAdmin) {
+		return nil, "", ErrAPIKeyForbidden
+	}
+	for _, scope := range scopes {
+		if !validAPIKeyScope(scope) {
+			return nil, "", ErrInvalidScope
+		}
+		if adminOnlyScopes[scope] && !creator.HasRole(models.RoleAdmin) {
+			return nil, "", ErrScopeForbidden
+		}
+	}
+	owner, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, scope := range scopes {
+		if adminOnlyScopes[scope] && !slices.Contains(owner.Roles, models.RoleAdmin) {
+			return nil, "", ErrScopeForbidden
+		}
+	}
+	existing, err := s.tokenRepo.ListAPIKeys(userID)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(existing) >= maxAPIKeysPerUser {
+		return nil, "", ErrAPIKeyLimit
+	}
+	id, err := newRandomID()
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := newOpaqueToken()
+	if err != nil {
+		return nil, "", err
+	}
+	key := apiKeyPrefix + secret
+	k := &APIKey{
+		ID:        id,
+		UserID:    userID,
+		Name:      truncate(strings.TrimSpace(name), maxAPIKeyNameLength),
+		Prefix:    key[:len(apiKeyPrefix)+6],
+		Scopes:    scopes,
+		CreatedBy: creatorID,
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+	if k.Scopes == nil {
+		k.Scopes = []string{}
+	}
+	if err := s.tokenRepo.CreateAPIKey(k, hashToken(key)); err != nil {
+		return nil, "", err
+	}
+	return k, key, nil
+}
+
+func validAPIKeyScope(scope string) bool {
+	for _, s := range APIKeyScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ListAPIKeys returns the user's active (not revoked) API keys, without secrets.
+func (s *Service) ListAPIKeys(userID uint) ([]APIKey, error) {
+	return s.tokenRepo.ListAPIKeys(userID)
+}
+
+// RevokeAPIKey revokes one of the caller's keys and returns it; admins may revoke any key.
+func (s *Service) RevokeAPIKey(claims *Claims, id string) (*APIKey, error) {
+	k, err := s.tokenRepo.GetAPIKey(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrAPIKeyNotFound
+		}
+		return nil, err
+	}
+	if !k.RevokedAt.IsZero() || (k.UserID != UserIDFromClaims(claims) && !claims.HasRole(models.RoleAdmin)) {
+		return nil, ErrAPIKeyNotFound
+	}
+	if err := s.tokenRepo.RevokeAPIKey(id, time.Now()); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// ValidateAPIKey checks an API key and returns a principal equivalent to an access token of its user
+// (subject, email, roles), limited to the key's scopes.
+func (s *Service) ValidateAPIKey(key string) (*Claims, error) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return nil, ErrAPIKeyInvalid
+	}
+	k, err := s.tokenRepo.GetAPIKeyByHash(hashToken(key))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrAPIKeyInvalid
+		}
+		return nil, err
+	}
+	now := time.Now()
+	if !k.RevokedAt.IsZero() || (k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)) {
+		return nil, ErrAPIKeyInvalid
+	}
+	u, err := s.userRepo.GetByID(k.UserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrAPIKeyInvalid
+		}
+		return nil, err
+	}
+	if err := s.tokenRepo.TouchAPIKey(k.ID, now, now.Add(-apiKeyTouchInterval)); err != nil {
+		slog.Error("recording api key use failed", "component", "auth", "api_key_id", k.ID, "err", err)
+	}
+	claims := &Claims{
+		Email:         u.Email,
+		EmailVerified: u.EmailVerified,
+		PhoneVerified: u.Phone != "",
+		Roles:         u.Roles,
+		APIKeyID:      k.ID,
+		Scopes:        k.Scopes,
+	}
+	claims.Subject = fmt.Sprintf("%d", u.ID)
+	return claims, nil
+}
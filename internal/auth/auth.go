@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"time"
@@ -11,55 +12,138 @@ import (
 // ErrTokenInvalid is returned when the token is malformed, expired, or otherwise invalid (not revocation).
 var ErrTokenInvalid = errors.New("invalid token")
 
-// Claims holds JWT claims (sub = user id, email, exp).
+// PurposeTokenType is the "typ" header of single-purpose tokens (see SignPurposeToken).
+const PurposeTokenType = "purpose+jwt"
+
+// Claims holds JWT claims (sub = user id, jti = token id, email, exp, sid = session id, roles).
+// Purpose is empty for access tokens; single-purpose tokens (e.g. email verification) set it and are never accepted as
+// access tokens: they are signed with a separate server-only key (see SignPurposeToken).
 type Claims struct {
 	jwt.RegisteredClaims
-	Email string `json:"email"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	PhoneVerified bool     `json:"phone_verified,omitempty"` // the user has a phone number, which is only stored once verified by SMS
+	SessionID     string   `json:"sid,omitempty"`
+	Roles         []string `json:"roles,omitempty"`
+	Purpose       string   `json:"purpose,omitempty"`
+	Guest         bool     `json:"guest,omitempty"` // guest account without email or password; see Service.CreateGuest
+	Actor         *Actor   `json:"act,omitempty"`   // admin impersonating the subject; see Service.Impersonate
+
+	// Set only for principals authenticated with an API key (never part of a JWT).
+	APIKeyID string   `json:"-"`
+	Scopes   []string `json:"-"`
+}
+
+// HasScope reports whether the principal may use scope. Access tokens act with the user's full rights;
+// API keys only with the scopes they were created with.
+func (c *Claims) HasScope(scope string) bool {
+	if c.APIKeyID == "" {
+		return true
+	}
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRole reports whether the claims carry any of the given roles.
+func (c *Claims) HasRole(roles ...string) bool {
+	for _, have := range c.Roles {
+		for _, want := range roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // CreateToken signs a new JWT for the user. Expiry is the token lifetime from now.
-func CreateToken(secret string, userID uint, email string, expiry time.Duration) (string, error) {
-	return CreateTokenWithIssuedAt(secret, userID, email, time.Now(), expiry)
+func CreateToken(keys *KeySet, userID uint, email string, expiry time.Duration) (string, error) {
+	return CreateTokenWithIssuedAt(keys, userID, email, time.Now(), expiry)
 }
 
 // CreateTokenWithIssuedAt signs a JWT with a specific IssuedAt (so token_valid_after and iat stay in sync). Expiry is the token lifetime from issuedAt.
-func CreateTokenWithIssuedAt(secret string, userID uint, email string, issuedAt time.Time, expiry time.Duration) (string, error) {
-	if secret == "" {
-		return "", errors.New("JWT secret is empty")
-	}
-	claims := Claims{
+func CreateTokenWithIssuedAt(keys *KeySet, userID uint, email string, issuedAt time.Time, expiry time.Duration) (string, error) {
+	return SignToken(keys, NewClaims(userID, email, issuedAt, expiry))
+}
+
+// NewClaims returns claims for the user with a random token ID, IssuedAt and ExpiresAt set.
+// Callers may set optional claims (e.g. SessionID) before signing.
+func NewClaims(userID uint, email string, issuedAt time.Time, expiry time.Duration) *Claims {
+	return &Claims{
 		Email: email,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        rand.Text(),
 			Subject:   fmt.Sprintf("%d", userID),
 			ExpiresAt: jwt.NewNumericDate(issuedAt.Add(expiry)),
 			IssuedAt:  jwt.NewNumericDate(issuedAt),
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(secret))
 }
 
-// ValidateToken parses and validates the token, returns claims or error.
-func ValidateToken(secret string, tokenString string) (*Claims, error) {
-	if secret == "" {
-		return nil, errors.New("JWT secret is empty")
+// SignToken signs the claims with the key set's active signing key.
+func SignToken(keys *KeySet, claims *Claims) (string, error) {
+	if keys == nil {
+		return "", errors.New("JWT keys not configured")
 	}
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(t *jwt.Token) (interface{}, error) {
-		if t.Method != jwt.SigningMethodHS256 {
-			return nil, errors.New("invalid signing method")
-		}
-		return []byte(secret), nil
-	})
+	return keys.Sign(claims)
+}
+
+// SignPurposeToken signs single-purpose claims (Purpose set, e.g. an mfa_token or an email verification link) with the
+// key set's purpose key. That HMAC key is never published in the JWKS, so services verifying access tokens on their
+// own can't mistake a purpose token for an access token.
+func SignPurposeToken(keys *KeySet, claims *Claims) (string, error) {
+	if keys == nil {
+		return "", errors.New("JWT keys not configured")
+	}
+	if claims.Purpose == "" {
+		return "", errors.New("purpose token without purpose")
+	}
+	return keys.SignPurpose(claims)
+}
+
+// ValidateToken parses and validates an access token against the key set, returns claims or error.
+// Purpose tokens are rejected.
+func ValidateToken(keys *KeySet, tokenString string) (*Claims, error) {
+	if keys == nil {
+		return nil, errors.New("JWT keys not configured")
+	}
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, keys.keyFunc)
 	if err != nil {
 		return nil, fmt.Errorf("%w: %v", ErrTokenInvalid, err)
 	}
 	claims, ok := token.Claims.(*Claims)
-	if !ok || !token.Valid {
+	if !ok || !token.Valid || claims.Purpose != "" {
 		return nil, ErrTokenInvalid
 	}
 	return claims, nil
 }
 
+// ValidatePurposeToken parses and validates a token made by SignPurposeToken and returns its claims if its Purpose
+// is one of purposes.
+func ValidatePurposeToken(keys *KeySet, tokenString string, purposes ...string) (*Claims, error) {
+	if keys == nil {
+		return nil, errors.New("JWT keys not configured")
+	}
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, keys.purposeKeyFunc, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTokenInvalid, err)
+	}
+	claims, ok := token.Claims.(*Claims)
+	if !ok || !token.Valid {
+		return nil, ErrTokenInvalid
+	}
+	for _, p := range purposes {
+		if claims.Purpose == p {
+			return claims, nil
+		}
+	}
+	return nil, ErrTokenInvalid
+}
+
 // UserIDFromClaims returns the user ID from claims.Subject, or 0 if invalid.
 func UserIDFromClaims(claims *Claims) uint {
 	if claims == nil {
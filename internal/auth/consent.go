@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrConsentRequired is returned when the current version of a legal document hasn't been accepted.
+var ErrConsentRequired = errors.New("consent required")
+
+// ErrLegalDocumentNotCurrent is returned when accepting a document kind or version that isn't the current one,
+// e.g. because a newer version was published after the client loaded it.
+var ErrLegalDocumentNotCurrent = errors.New("legal document version is not current")
+
+// legalDocumentsCacheTTL is how long the current legal documents are kept in memory. RequireConsent checks them on
+// every request; a version published (or coming into effect) is required at most this long after.
+const legalDocumentsCacheTTL = time.Minute
+
+// legalDocumentsCache holds the current legal documents until expiresAt.
+type legalDocumentsCache struct {
+	mu        sync.Mutex
+	docs      []LegalDocument
+	expiresAt time.Time
+}
+
+// ConsentStatus is where a user stands with the legal documents: the current versions, those of them the user
+// hasn't accepted yet, and every version the user accepted, newest first.
+type ConsentStatus struct {
+	Current  []LegalDocument `json:"current"`
+	Pending  []LegalDocument `json:"pending"`
+	Accepted []Consent       `json:"accepted"`
+}
+
+// LegalDocuments returns the current version of each legal document. Empty when none has been published.
+// The list is cached for legalDocumentsCacheTTL; callers must not modify it.
+func (s *Service) LegalDocuments() ([]LegalDocument, error) {
+	c := &s.legalDocuments
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Before(c.expiresAt) {
+		return c.docs, nil
+	}
+	docs, err := s.tokenRepo.ListCurrentLegalDocuments(now)
+	if err != nil {
+		return nil, err
+	}
+	c.docs, c.expiresAt = docs, now.Add(legalDocumentsCacheTTL)
+	return docs, nil
+}
+
+// CheckConsents returns the current legal documents, with ErrConsentRequired unless accepted (kind → version)
+// names the current version of each. Signup calls it before creating the account.
+func (s *Service) CheckConsents(accepted map[string]string) ([]LegalDocument, error) {
+	docs, err := s.LegalDocuments()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range docs {
+		if accepted[d.Kind] != d.Version {
+			return docs, ErrConsentRequired
+		}
+	}
+	return docs, nil
+}
+
+// AcceptLegalDocuments records that the user accepted the given versions (kind → version) from the client in info
+// and returns the documents. Each must be the current version of its kind, otherwise nothing is recorded and
+// ErrLegalDocumentNotCurrent is returned. Accepting a version again keeps the first acceptance.
+func (s *Service) AcceptLegalDocuments(userID uint, accepted map[string]string, info SessionInfo) ([]LegalDocument, error) {
+	docs, err := s.LegalDocuments()
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]LegalDocument, len(docs))
+	for _, d := range docs {
+		current[d.Kind] = d
+	}
+	var ids []int64
+	var acceptedDocs []LegalDocument
+	for kind, version := range accepted {
+		d, ok := current[kind]
+		if !ok || d.Version != version {
+			return nil, ErrLegalDocumentNotCurrent
+		}
+		ids = append(ids, d.ID)
+		acceptedDocs = append(acceptedDocs, d)
+	}
+	if err := s.tokenRepo.CreateConsents(userID, ids, time.Now(), info.IP, truncate(info.UserAgent, maxUserAgentLength)); err != nil {
+		return nil, err
+	}
+	return acceptedDocs, nil
+}
+
+// ConsentStatus returns the user's ConsentStatus.
+func (s *Service) ConsentStatus(userID uint) (*ConsentStatus, error) {
+	docs, err := s.LegalDocuments()
+	if err != nil {
+		return nil, err
+	}
+	consents, err := s.tokenRepo.ListConsents(userID)
+	if err != nil {
+		return nil, err
+	}
+	return &ConsentStatus{Current: docs, Pending: pendingDocuments(docs, consents), Accepted: consents}, nil
+}
+
+// HasCurrentConsents reports whether the user accepted the current version of every legal document.
+// Implements ConsentChecker. With the documents cached, it costs one indexed count of the user's consents, and
+// nothing while no document is published.
+func (s *Service) HasCurrentConsents(userID uint) (bool, error) {
+	docs, err := s.LegalDocuments()
+	if err != nil || len(docs) == 0 {
+		return err == nil, err
+	}
+	ids := make([]int64, len(docs))
+	for i, d := range docs {
+		ids[i] = d.ID
+	}
+	n, err := s.tokenRepo.CountConsents(userID, ids)
+	if err != nil {
+		return false, err
+	}
+	return n == len(ids), nil
+}
+
+// pendingDocuments returns the documents in docs that have no consent in consents.
+func pendingDocuments(docs []LegalDocument, consents []Consent) []LegalDocument {
+	accepted := make(map[int64]bool, len(consents))
+	for _, c := range consents {
+		accepted[c.DocumentID] = true
+	}
+	pending := []LegalDocument{}
+	for _, d := range docs {
+		if !accepted[d.ID] {
+			pending = append(pending, d)
+		}
+	}
+	return pending
+}
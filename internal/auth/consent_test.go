@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHasCurrentConsents(t *testing.T) {
+	svc, _, tokens := newTestService(t, nil)
+	const userID = 7
+	if ok, err := svc.HasCurrentConsents(userID); err != nil || !ok {
+		t.Fatalf("HasCurrentConsents with no documents = %v, %v, want true", ok, err)
+	}
+
+	// A document published while the list is cached is required once the cache expires.
+	tokens.legalDocuments = []LegalDocument{{ID: 1, Kind: "terms", Version: "2026-10"}, {ID: 2, Kind: "privacy", Version: "2026-10"}}
+	if ok, err := svc.HasCurrentConsents(userID); err != nil || !ok {
+		t.Fatalf("HasCurrentConsents with cached documents = %v, %v, want true", ok, err)
+	}
+	svc.legalDocuments.expiresAt = time.Now()
+	if ok, err := svc.HasCurrentConsents(userID); err != nil || ok {
+		t.Fatalf("HasCurrentConsents = %v, %v, want false", ok, err)
+	}
+	if _, err := svc.AcceptLegalDocuments(userID, map[string]string{"terms": "2026-10"}, SessionInfo{}); err != nil {
+		t.Fatalf("AcceptLegalDocuments: %v", err)
+	}
+	if ok, err := svc.HasCurrentConsents(userID); err != nil || ok {
+		t.Fatalf("HasCurrentConsents with one of two accepted = %v, %v, want false", ok, err)
+	}
+	if _, err := svc.AcceptLegalDocuments(userID, map[string]string{"privacy": "2026-09"}, SessionInfo{}); !errors.Is(err, ErrLegalDocumentNotCurrent) {
+		t.Fatalf("AcceptLegalDocuments(old version) err = %v, want ErrLegalDocumentNotCurrent", err)
+	}
+	if _, err := svc.AcceptLegalDocuments(userID, map[string]string{"privacy": "2026-10"}, SessionInfo{}); err != nil {
+		t.Fatalf("AcceptLegalDocuments: %v", err)
+	}
+	if ok, err := svc.HasCurrentConsents(userID); err != nil || !ok {
+		t.Fatalf("HasCurrentConsents = %v, %v, want true", ok, err)
+	}
+	if tokens.legalQueries != 2 {
+		t.Fatalf("legal document queries = %d, want 2", tokens.legalQueries)
+	}
+}
@@ -0,0 +1,18 @@
+package auth
+
+import "context"
+
+type contextKey string
+
+const claimsContextKey contextKey = "claims"
+
+// WithClaims returns a copy of ctx carrying the authenticated token's claims.
+func WithClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsContextKey, claims)
+}
+
+// ClaimsFromContext returns the claims stored by WithClaims, or nil if the request is not authenticated.
+func ClaimsFromContext(ctx context.Context) *Claims {
+	c, _ := ctx.Value(claimsContextKey).(*Claims)
+	return c
+}
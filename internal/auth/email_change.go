@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"time"
+
+	"github.com/bilalabsh/zabaan_backend/internal/mailer"
+	"github.com/bilalabsh/zabaan_backend/internal/user"
+)
+
+// ErrEmailChangeTokenInvalid is returned when an email change link is unknown, expired, already used,
+// or belongs to a change that was undone or replaced by a newer one.
+var ErrEmailChangeTokenInvalid = errors.New("invalid email change token")
+
+// ErrEmailUnchanged is returned when the requested email is the account's current email.
+var ErrEmailUnchanged = errors.New("email unchanged")
+
+// RequestEmailChange starts changing the email of the token's user after checking the current password (with
+// checkCurrentPassword, like ChangePassword). Nothing changes yet: the new address gets a confirmation link, and the old one a notice with a link
+// that cancels the change, or reverts it once confirmed, for EmailChangeUndoExpiry. A newer request replaces an
+// unconfirmed one. If the new email has an account, ErrEmailExists is returned, or with AntiEnumeration its owner is
+// emailed about it and nil is returned.
+func (s *Service) RequestEmailChange(claims *Claims, currentPassword, newEmail string) error {
+	userID := UserIDFromClaims(claims)
+	if err := s.checkCurrentPassword(userID, currentPassword); err != nil {
+		return err
+	}
+	newEmail = NormalizeEmail(newEmail)
+	if err := ValidateEmail(newEmail); err != nil {
+		return err
+	}
+	if len(newEmail) > maxEmailLength {
+		return ErrEmailTooLong
+	}
+	u, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return err
+	}
+	if newEmail == u.Email {
+		return ErrEmailUnchanged
+	}
+	if _, _, err := s.userRepo.GetByEmail(newEmail); err == nil {
+		if s.antiEnumeration {
+			s.sendAccountExistsEmail(newEmail)
+			return nil
+		}
+		return ErrEmailExists
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	confirmToken, err := newOpaqueToken()
+	if err != nil {
+		return err
+	}
+	undoToken, err := newOpaqueToken()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	c := &EmailChange{
+		UserID:        userID,
+		OldEmail:      u.Email,
+		NewEmail:      newEmail,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(s.emailChangeExpiry),
+		UndoExpiresAt: now.Add(s.emailChangeUndoExpiry),
+	}
+	if err := s.tokenRepo.CreateEmailChange(c, hashToken(confirmToken), hashToken(undoToken)); err != nil {
+		return err
+	}
+	msgs := []mailer.Message{{
+		To:      newEmail,
+		Subject: "Confirm your new Zabaan email",
+		Body: fmt.Sprintf("Hi %s,\n\nTo use this address for your Zabaan account, open this link:\n\n%s\n\nThe link expires in %s and works once. Until then your account keeps its current email. If you did not ask for this, you can ignore this email.\n",
+			u.FirstName, s.appBaseURL+"/confirm-email-change?token="+url.QueryEscape(confirmToken), s.emailChangeExpiry),
+	}}
+	if u.Email != "" {
+		msgs = append(msgs, mailer.Message{
+			To:      u.Email,
+			Subject: "Your Zabaan email is being changed",
+			Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to change the email of your Zabaan account to %s. The change applies once the new address is confirmed.\n\nIf it wasn't you, open this link to cancel the change (or undo it, if it was already confirmed) and sign out every device, then reset your password:\n\n%s\n\nThe link works until %s.\n",
+				u.FirstName, newEmail, s.appBaseURL+"/undo-email-change?token="+url.QueryEscape(undoToken), c.UndoExpiresAt.UTC().Format(time.RFC1123)),
+		})
+	}
+	go func() {
+		for _, msg := range msgs {
+			if err := s.mailer.Send(msg); err != nil {
+				slog.Error("sending email change email failed", "component", "auth", "user_id", userID, "err", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// ConfirmEmailChange applies the email change of a confirmation link and returns the user's id. The new email is
+// marked verified. Whether it is still free is checked again, since it may have been taken since the request.
+// Outstanding password reset links (sent to the old address) are invalidated, and every existing token and session is
+// revoked, so no token carries the old email.
+func (s *Service) ConfirmEmailChange(token string) (uint, error) {
+	c, err := s.tokenRepo.GetEmailChangeByConfirmHash(hashToken(token))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrEmailChangeTokenInvalid
+		}
+		return 0, err
+	}
+	now := time.Now()
+	if !c.ConfirmedAt.IsZero() || !c.CancelledAt.IsZero() || !now.Before(c.ExpiresAt) {
+		return 0, ErrEmailChangeTokenInvalid
+	}
+	ok, err := s.tokenRepo.MarkEmailChangeConfirmed(c.ID, now)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, ErrEmailChangeTokenInvalid
+	}
+	if err := s.applyEmail(c.UserID, c.NewEmail, now); err != nil {
+		return 0, err
+	}
+	return c.UserID, nil
+}
+
+// UndoEmailChange cancels the email change of an undo link, restoring the old email if the change was already
+// confirmed, and returns the user's id. Like ConfirmEmailChange it signs the account out everywhere when the email
+// changes back.
+func (s *Service) UndoEmailChange(token string) (uint, error) {
+	c, err := s.tokenRepo.GetEmailChangeByUndoHash(hashToken(token))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrEmailChangeTokenInvalid
+		}
+		return 0, err
+	}
+	now := time.Now()
+	if !c.CancelledAt.IsZero() || !now.Before(c.UndoExpiresAt) {
+		return 0, ErrEmailChangeTokenInvalid
+	}
+	ok, err := s.tokenRepo.MarkEmailChangeCancelled(c.ID, now)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, ErrEmailChangeTokenInvalid
+	}
+	if c.ConfirmedAt.IsZero() || c.OldEmail == "" {
+		return c.UserID, nil
+	}
+	if err := s.applyEmail(c.UserID, c.OldEmail, now); err != nil {
+		return 0, err
+	}
+	return c.UserID, nil
+}
+
+// applyEmail sets the user's (verified) email, invalidates password reset links and revokes every token and session.
+func (s *Service) applyEmail(userID uint, email string, now time.Time) error {
+	if err := s.userRepo.UpdateEmail(userID, email, now); err != nil {
+		if errors.Is(err, user.ErrDuplicateEmail) {
+			return ErrEmailExists
+		}
+		return err
+	}
+	if err := s.tokenRepo.InvalidateUserPasswordResetTokens(userID, now); err != nil {
+		return err
+	}
+	return s.RevokePreviousTokensAt(userID, now)
+}
@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/url"
+	"time"
+
+	"github.com/bilalabsh/zabaan_backend/internal/mailer"
+	"github.com/bilalabsh/zabaan_backend/internal/models"
+)
+
+// ErrEmailLoginCodeInvalid is returned when a login code or magic link is wrong, expired, already used,
+// or has seen too many wrong attempts.
+var ErrEmailLoginCodeInvalid = errors.New("invalid login code")
+
+const (
+	maxEmailLoginAttempts     = 5           // codes entered against a code before it stops working
+	emailLoginResendDelay     = time.Minute // a new code is not sent more often than this
+	maxEmailLoginCodesPerHour = 5           // codes an account can be sent per hour
+)
+
+// RequestEmailLogin emails a 6-digit login code and a magic link to the account of the email, if there is one.
+// Like ForgotPassword it returns nil for unknown emails and sends in the background. A new request replaces the previous
+// code, but within emailLoginResendDelay of the last one, or after maxEmailLoginCodesPerHour codes in the last hour,
+// nothing is sent, so the endpoint can't be used to flood an inbox or to get fresh codes to guess.
+func (s *Service) RequestEmailLogin(email string) error {
+	email = NormalizeEmail(email)
+	if len(email) > maxEmailLength {
+		return nil
+	}
+	u, _, err := s.userRepo.GetByEmail(email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return err
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+	link, err := newOpaqueToken()
+	if err != nil {
+		return err
+	}
+	// The limits are checked as the code is stored, so parallel requests can't all pass them.
+	now := time.Now()
+	created, err := s.tokenRepo.CreateEmailLoginCode(u.ID, hashToken(code), hashToken(link), now, now.Add(s.emailLoginCodeExpiry),
+		emailLoginResendDelay, maxEmailLoginCodesPerHour)
+	if err != nil {
+		return err
+	}
+	if !created {
+		return nil
+	}
+	msg := mailer.Message{
+		To:      u.Email,
+		Subject: "Your Zabaan login code: " + code,
+		Body: fmt.Sprintf("Hi %s,\n\nYour Zabaan login code is %s\n\nOr sign in by opening this link on this device:\n\n%s\n\nThe code and link expire in %s and work once. If you did not try to sign in, you can ignore this email.\n",
+			u.FirstName, code, s.appBaseURL+"/login/email?token="+url.QueryEscape(link), s.emailLoginCodeExpiry),
+	}
+	go func() {
+		if err := s.mailer.Send(msg); err != nil {
+			slog.Error("sending login code email failed", "component", "auth", "user_id", u.ID, "err", err)
+		}
+	}()
+	return nil
+}
+
+// VerifyEmailLoginCode checks a 6-digit code sent by RequestEmailLogin and returns the user. Every code entered counts
+// against the code, reserved before comparing so parallel guesses are counted too; after maxEmailLoginAttempts it stops
+// working and the user has to request a new one.
+func (s *Service) VerifyEmailLoginCode(email, code string) (*models.User, error) {
+	email = NormalizeEmail(email)
+	if len(email) > maxEmailLength {
+		return nil, ErrEmailLoginCodeInvalid
+	}
+	u, _, err := s.userRepo.GetByEmail(email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrEmailLoginCodeInvalid
+		}
+		return nil, err
+	}
+	stored, err := s.tokenRepo.GetLatestEmailLoginCode(u.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrEmailLoginCodeInvalid
+		}
+		return nil, err
+	}
+	if !emailLoginCodeUsable(stored) {
+		return nil, ErrEmailLoginCodeInvalid
+	}
+	ok, err := s.tokenRepo.ReserveEmailLoginCodeAttempt(stored.ID, maxEmailLoginAttempts)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || subtle.ConstantTimeCompare([]byte(hashToken(code)), []byte(stored.CodeHash)) != 1 {
+		return nil, ErrEmailLoginCodeInvalid
+	}
+	return s.completeEmailLogin(u, stored)
+}
+
+// VerifyEmailLoginLink checks a magic link token sent by RequestEmailLogin and returns the user.
+func (s *Service) VerifyEmailLoginLink(token string) (*models.User, error) {
+	stored, err := s.tokenRepo.GetEmailLoginCodeByLink(hashToken(token))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrEmailLoginCodeInvalid
+		}
+		return nil, err
+	}
+	if !emailLoginCodeUsable(stored) {
+		return nil, ErrEmailLoginCodeInvalid
+	}
+	u, err := s.userRepo.GetByID(stored.UserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrEmailLoginCodeInvalid
+		}
+		return nil, err
+	}
+	return s.completeEmailLogin(u, stored)
+}
+
+func emailLoginCodeUsable(c *EmailLoginCode) bool {
+	return c.UsedAt.IsZero() && time.Now().Before(c.ExpiresAt) && c.Attempts < maxEmailLoginAttempts
+}
+
+// completeEmailLogin uses up the code. Receiving it proves the user owns the address, so the email is marked verified.
+func (s *Service) completeEmailLogin(u *models.User, stored *EmailLoginCode) (*models.User, error) {
+	now := time.Now()
+	ok, err := s.tokenRepo.MarkEmailLoginCodeUsed(stored.ID, now)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrEmailLoginCodeInvalid
+	}
+	if !u.EmailVerified {
+		if err := s.userRepo.MarkEmailVerified(u.ID, now); err != nil {
+			return nil, err
+		}
+		u.EmailVerified = true
+	}
+	return u, nil
+}
@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/bilalabsh/zabaan_backend/internal/mailer"
+)
+
+// AntiEnumeration reports whether signup and login hide which emails have accounts (Options.AntiEnumeration).
+func (s *Service) AntiEnumeration() bool {
+	return s.antiEnumeration
+}
+
+// dummyVerify spends as long as checking a real password, so a login for an unknown email (or an account without
+// a password) takes as long as one with a wrong password. The dummy hash comes from the configured hasher,
+// so its cost matches newly hashed passwords.
+func (s *Service) dummyVerify(password string) {
+	s.dummyHashOnce.Do(func() {
+		hash, err := s.hasher.Hash("zabaan-dummy-password")
+		if err != nil {
+			slog.Error("creating dummy password hash failed", "component", "auth", "err", err)
+			return
+		}
+		s.dummyHash = hash
+	})
+	if s.dummyHash != "" {
+		_, _ = s.hasher.Verify(s.dummyHash, password)
+	}
+}
+
+// sendAccountExistsEmail tells the owner of email that someone tried to sign up with it. Used instead of a 409
+// when AntiEnumeration is on; sent in the background like every signup email in that mode.
+func (s *Service) sendAccountExistsEmail(email string) {
+	msg := mailer.Message{
+		To:      email,
+		Subject: "You already have a Zabaan account",
+		Body: fmt.Sprintf("Hi,\n\nSomeone tried to create a Zabaan account with this email address, but it already has one.\n\nIf it was you, sign in at %s/login, or choose a new password at %s/forgot-password if you don't remember it. If it wasn't you, you can ignore this email; nothing has changed.\n",
+			s.appBaseURL, s.appBaseURL),
+	}
+	go func() {
+		if err := s.mailer.Send(msg); err != nil {
+			slog.Error("sending account exists email failed", "component", "auth", "err", err)
+		}
+	}()
+}
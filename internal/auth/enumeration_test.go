@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Someone signs up with an email and the password they chose, then logs in with it. Whether the email was free or
+// already had an account, the answers (and the lockout counts) must be the same.
+func TestAntiEnumerationSignUpThenLogin(t *testing.T) {
+	svc, _, tokens := newTestService(t, func(o *Options) {
+		o.AntiEnumeration = true
+		o.EmailVerification = EmailVerificationLogin
+		o.Lockout = LockoutPolicy{Threshold: 5, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: time.Hour}
+	})
+	const password = "Correct horse battery 9"
+	if _, err := svc.SignUp("Owner", "", "taken@example.test", "Tamarind sunrise 42"); err != nil {
+		t.Fatalf("SignUp: %v", err)
+	}
+
+	for _, email := range []string{"taken@example.test", "free@example.test"} {
+		t.Run(email, func(t *testing.T) {
+			_, err := svc.SignUp("Attacker", "", email, password)
+			if err != nil && !errors.Is(err, ErrEmailExists) {
+				t.Fatalf("SignUp: %v", err)
+			}
+			if _, err := svc.Login(email, password); !errors.Is(err, ErrInvalidCredentials) {
+				t.Fatalf("Login err = %v, want ErrInvalidCredentials", err)
+			}
+			if n := tokens.loginAttempts(email); n != 1 {
+				t.Fatalf("login attempts = %d, want 1", n)
+			}
+		})
+	}
+}
+
+func TestLoginUnverifiedWithoutAntiEnumeration(t *testing.T) {
+	svc, users, _ := newTestService(t, func(o *Options) {
+		o.EmailVerification = EmailVerificationLogin
+	})
+	const password = "Correct horse battery 9"
+	u, err := svc.SignUp("Learner", "", "learner@example.test", password)
+	if err != nil {
+		t.Fatalf("SignUp: %v", err)
+	}
+	if _, err := svc.Login("learner@example.test", password); !errors.Is(err, ErrEmailNotVerified) {
+		t.Fatalf("Login err = %v, want ErrEmailNotVerified", err)
+	}
+	if err := users.MarkEmailVerified(u.ID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.Login("learner@example.test", password); err != nil {
+		t.Fatalf("Login after verification: %v", err)
+	}
+}
+
+// A guest upgrading to a taken or a free email gets the same answer and stays a signed-in guest; for the free one,
+// the emailed link finishes the upgrade.
+func TestAntiEnumerationGuestUpgrade(t *testing.T) {
+	mail := &fakeMailer{}
+	svc, users, _ := newTestService(t, func(o *Options) {
+		o.AntiEnumeration = true
+		o.EmailVerification = EmailVerificationLogin
+		o.Mailer = mail
+	})
+	if _, err := svc.SignUp("Owner", "", "taken@example.test", "Tamarind sunrise 42"); err != nil {
+		t.Fatalf("SignUp: %v", err)
+	}
+	const password = "Correct horse battery 9"
+
+	for _, email := range []string{"taken@example.test", "free@example.test"} {
+		guestID := users.addGuest()
+		claims := NewClaims(guestID, "", time.Now(), time.Minute)
+		claims.Guest = true
+		u, tokens, err := svc.UpgradeGuest(claims, "Learner", "Guest", email, password, SessionInfo{})
+		if err != nil || tokens != nil {
+			t.Fatalf("UpgradeGuest(%s) = %v, %v, want no tokens and no error", email, tokens, err)
+		}
+		if u.ID != guestID || u.Email != email || u.IsGuest {
+			t.Fatalf("UpgradeGuest(%s) user = %+v", email, u)
+		}
+		if g, _ := users.GetByID(guestID); !g.IsGuest || g.Email != "" {
+			t.Fatalf("guest after UpgradeGuest(%s) = %+v, want still a guest", email, g)
+		}
+		if _, ok := users.tokenValidAfter[guestID]; ok {
+			t.Fatalf("UpgradeGuest(%s) revoked the guest's tokens", email)
+		}
+	}
+
+	token := linkToken(t, mail.waitFor(t, "free@example.test", 1), "/verify-email")
+	if err := svc.VerifyEmail(token); err != nil {
+		t.Fatalf("VerifyEmail: %v", err)
+	}
+	if err := svc.VerifyEmail(token); !errors.Is(err, ErrVerificationTokenInvalid) {
+		t.Fatalf("second VerifyEmail err = %v, want ErrVerificationTokenInvalid", err)
+	}
+	u, err := svc.Login("free@example.test", password)
+	if err != nil {
+		t.Fatalf("Login after the upgrade: %v", err)
+	}
+	if u.IsGuest || !u.EmailVerified {
+		t.Fatalf("upgraded user = %+v", u)
+	}
+	if _, ok := users.tokenValidAfter[u.ID]; !ok {
+		t.Fatal("the guest's tokens were not revoked by the upgrade")
+	}
+}
@@ -0,0 +1,521 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bilalabsh/zabaan_backend/internal/mailer"
+	"github.com/bilalabsh/zabaan_backend/internal/models"
+	"github.com/bilalabsh/zabaan_backend/internal/user"
+)
+
+// fakeUserRepo keeps users in memory. Methods the tests don't reach are left to the embedded nil interface and panic.
+type fakeUserRepo struct {
+	UserRepository
+	mu              sync.Mutex
+	users           map[uint]*models.User
+	hashes          map[uint]string
+	tokenValidAfter map[uint]time.Time
+	nextID          uint
+}
+
+func newFakeUserRepo() *fakeUserRepo {
+	return &fakeUserRepo{users: make(map[uint]*models.User), hashes: make(map[uint]string), tokenValidAfter: make(map[uint]time.Time)}
+}
+
+// addGuest stores a new guest user and returns its id.
+func (r *fakeUserRepo) addGuest() uint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	r.users[r.nextID] = &models.User{ID: r.nextID, Username: fmt.Sprintf("guest_%d", r.nextID), IsGuest: true, Roles: []string{models.RoleLearner}}
+	return r.nextID
+}
+
+func (r *fakeUserRepo) CreateWithPassword(email, username, firstName, lastName, passwordHash string) (*models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, u := range r.users {
+		if u.Email == email || u.Username == username {
+			return nil, user.ErrDuplicateEmail
+		}
+	}
+	r.nextID++
+	u := &models.User{ID: r.nextID, Email: email, Username: username, FirstName: firstName, LastName: lastName, Roles: []string{models.RoleLearner}}
+	r.users[u.ID] = u
+	r.hashes[u.ID] = passwordHash
+	copied := *u
+	return &copied, nil
+}
+
+func (r *fakeUserRepo) GetByID(id uint) (*models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.users[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	copied := *u
+	return &copied, nil
+}
+
+func (r *fakeUserRepo) GetByEmail(email string) (*models.User, string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, u := range r.users {
+		if u.Email == email {
+			copied := *u
+			return &copied, r.hashes[id], nil
+		}
+	}
+	return nil, "", sql.ErrNoRows
+}
+
+func (r *fakeUserRepo) GetPasswordHash(userID uint) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.users[userID]; !ok {
+		return "", sql.ErrNoRows
+	}
+	return r.hashes[userID], nil
+}
+
+func (r *fakeUserRepo) UpdatePassword(userID uint, passwordHash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hashes[userID] = passwordHash
+	return nil
+}
+
+func (r *fakeUserRepo) UpgradeGuest(id uint, email, username, firstName, lastName, passwordHash string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, u := range r.users {
+		if u.ID != id && (u.Email == email || u.Username == username) {
+			return false, user.ErrDuplicateEmail
+		}
+	}
+	u, ok := r.users[id]
+	if !ok || !u.IsGuest {
+		return false, nil
+	}
+	u.Email, u.Username, u.FirstName, u.LastName, u.IsGuest = email, username, firstName, lastName, false
+	r.hashes[id] = passwordHash
+	return true, nil
+}
+
+func (r *fakeUserRepo) SetGuestProfile(id uint, firstName, lastName, passwordHash string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.users[id]
+	if !ok || !u.IsGuest {
+		return false, nil
+	}
+	u.FirstName, u.LastName = firstName, lastName
+	r.hashes[id] = passwordHash
+	return true, nil
+}
+
+func (r *fakeUserRepo) GetTokenValidAfter(userID uint) (time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tokenValidAfter[userID], nil
+}
+
+func (r *fakeUserRepo) UpdateTokenValidAfter(userID uint, t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tokenValidAfter[userID] = t
+	return nil
+}
+
+func (r *fakeUserRepo) MarkEmailVerified(userID uint, t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if u, ok := r.users[userID]; ok {
+		u.EmailVerified = true
+	}
+	return nil
+}
+
+// fakeTokenRepo keeps refresh tokens, sessions, password reset tokens, linked identities, login attempt counts, revoked token ids, legal documents and
+// consents in memory, with the semantics of their queries. API key revocation is a no-op.
+type fakeTokenRepo struct {
+	TokenRepository
+	mu            sync.Mutex
+	refreshTokens map[string]*RefreshToken // by hash
+	sessions      map[string]*Session
+	resetTokens   map[string]*PasswordResetToken // by hash
+	identities    map[string]uint                // user by provider and subject
+	attempts      map[string]*fakeLoginAttempts
+	revoked       map[string]bool
+
+	legalDocuments []LegalDocument
+	consents       map[uint][]int64
+	legalQueries   int
+}
+
+type fakeLoginAttempts struct {
+	failedCount  int
+	lastFailedAt time.Time
+	lockedUntil  time.Time
+}
+
+func newFakeTokenRepo() *fakeTokenRepo {
+	return &fakeTokenRepo{
+		refreshTokens: make(map[string]*RefreshToken),
+		sessions:      make(map[string]*Session),
+		resetTokens:   make(map[string]*PasswordResetToken),
+		identities:    make(map[string]uint),
+		attempts:      make(map[string]*fakeLoginAttempts),
+		revoked:       make(map[string]bool),
+		consents:      make(map[uint][]int64),
+	}
+}
+
+func (r *fakeTokenRepo) CreateRefreshToken(userID uint, familyID, tokenHash string, createdAt, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refreshTokens[tokenHash] = &RefreshToken{ID: int64(len(r.refreshTokens) + 1), UserID: userID, FamilyID: familyID, CreatedAt: createdAt, ExpiresAt: expiresAt}
+	return nil
+}
+
+func (r *fakeTokenRepo) GetRefreshTokenByHash(tokenHash string) (*RefreshToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.refreshTokens[tokenHash]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	copied := *t
+	return &copied, nil
+}
+
+func (r *fakeTokenRepo) MarkRefreshTokenRotated(id int64, t time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rt := range r.refreshTokens {
+		if rt.ID == id && rt.RotatedAt.IsZero() {
+			rt.RotatedAt = t
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *fakeTokenRepo) RevokeRefreshTokenFamily(familyID string, t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rt := range r.refreshTokens {
+		if rt.FamilyID == familyID && rt.RevokedAt.IsZero() {
+			rt.RevokedAt = t
+		}
+	}
+	return nil
+}
+
+func (r *fakeTokenRepo) CreateSession(sess *Session) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	copied := *sess
+	r.sessions[sess.ID] = &copied
+	return nil
+}
+
+func (r *fakeTokenRepo) GetSession(id string) (*Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sess, ok := r.sessions[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	copied := *sess
+	return &copied, nil
+}
+
+func (r *fakeTokenRepo) TouchSession(id string, t, staleBefore time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if sess, ok := r.sessions[id]; ok && sess.LastSeenAt.Before(staleBefore) {
+		sess.LastSeenAt = t
+	}
+	return nil
+}
+
+func (r *fakeTokenRepo) CreatePasswordResetToken(userID uint, tokenHash string, createdAt, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resetTokens[tokenHash] = &PasswordResetToken{ID: int64(len(r.resetTokens) + 1), UserID: userID, ExpiresAt: expiresAt}
+	return nil
+}
+
+func (r *fakeTokenRepo) GetPasswordResetToken(tokenHash string) (*PasswordResetToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.resetTokens[tokenHash]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	copied := *t
+	return &copied, nil
+}
+
+func (r *fakeTokenRepo) MarkPasswordResetTokenUsed(id int64, t time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rt := range r.resetTokens {
+		if rt.ID == id && rt.UsedAt.IsZero() {
+			rt.UsedAt = t
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *fakeTokenRepo) InvalidateUserPasswordResetTokens(userID uint, t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rt := range r.resetTokens {
+		if rt.UserID == userID && rt.UsedAt.IsZero() {
+			rt.UsedAt = t
+		}
+	}
+	return nil
+}
+
+func (r *fakeTokenRepo) GetIdentityUserID(provider, subject string, t time.Time) (uint, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	userID, ok := r.identities[provider+" "+subject]
+	if !ok {
+		return 0, sql.ErrNoRows
+	}
+	return userID, nil
+}
+
+func (r *fakeTokenRepo) CreateIdentity(userID uint, provider, subject, email string, t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.identities[provider+" "+subject]; ok {
+		return ErrIdentityExists
+	}
+	r.identities[provider+" "+subject] = userID
+	return nil
+}
+
+// expireRefreshTokens makes every stored refresh token expired.
+func (r *fakeTokenRepo) expireRefreshTokens() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rt := range r.refreshTokens {
+		rt.ExpiresAt = time.Now().Add(-time.Second)
+	}
+}
+
+func (r *fakeTokenRepo) ListCurrentLegalDocuments(now time.Time) ([]LegalDocument, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.legalQueries++
+	return slices.Clone(r.legalDocuments), nil
+}
+
+func (r *fakeTokenRepo) CountConsents(userID uint, documentIDs []int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, id := range documentIDs {
+		if slices.Contains(r.consents[userID], id) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *fakeTokenRepo) CreateConsents(userID uint, documentIDs []int64, t time.Time, ip, userAgent string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, id := range documentIDs {
+		if !slices.Contains(r.consents[userID], id) {
+			r.consents[userID] = append(r.consents[userID], id)
+		}
+	}
+	return nil
+}
+
+func (r *fakeTokenRepo) RevokeTokenID(jti string, userID uint, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.revoked[jti] = true
+	return nil
+}
+
+func (r *fakeTokenRepo) IsTokenIDRevoked(jti string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.revoked[jti], nil
+}
+
+func (r *fakeTokenRepo) RevokeUserSessions(userID uint, exceptID string, t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, sess := range r.sessions {
+		if sess.UserID == userID && id != exceptID && sess.RevokedAt.IsZero() {
+			sess.RevokedAt = t
+		}
+	}
+	return nil
+}
+
+func (r *fakeTokenRepo) RevokeUserAPIKeys(userID uint, t time.Time) error {
+	return nil
+}
+
+func (r *fakeTokenRepo) ReserveLoginAttempt(email string, threshold int, baseDelay, maxDelay time.Duration, t, windowStart time.Time) (bool, time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a, ok := r.attempts[email]
+	if !ok {
+		a = &fakeLoginAttempts{lastFailedAt: t}
+		r.attempts[email] = a
+	}
+	if a.lockedUntil.After(t) {
+		return false, a.lockedUntil, nil
+	}
+	if a.lastFailedAt.Before(windowStart) {
+		a.failedCount = 0
+	}
+	a.failedCount++
+	a.lastFailedAt = t
+	if a.failedCount >= threshold {
+		delay := baseDelay
+		for i := threshold; i < a.failedCount && delay < maxDelay; i++ {
+			delay *= 2
+		}
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+		a.lockedUntil = t.Add(delay)
+	}
+	return true, time.Time{}, nil
+}
+
+func (r *fakeTokenRepo) ResetLoginAttempts(email string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.attempts, email)
+	return nil
+}
+
+// expireLoginLock ends the lock of email as if its time had passed.
+func (r *fakeTokenRepo) expireLoginLock(email string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if a, ok := r.attempts[email]; ok {
+		a.lockedUntil = time.Now().Add(-time.Second)
+	}
+}
+
+// loginAttempts returns the attempt count recorded for email.
+func (r *fakeTokenRepo) loginAttempts(email string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if a, ok := r.attempts[email]; ok {
+		return a.failedCount
+	}
+	return 0
+}
+
+// fakeMailer records sent messages; signup emails are sent from goroutines.
+type fakeMailer struct {
+	mu   sync.Mutex
+	sent []mailer.Message
+}
+
+func (m *fakeMailer) Send(msg mailer.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// waitFor returns the nth message (from 1) sent to addr, waiting up to a second for background sends.
+func (m *fakeMailer) waitFor(t *testing.T, addr string, n int) mailer.Message {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		m.mu.Lock()
+		seen := 0
+		for _, msg := range m.sent {
+			if msg.To == addr {
+				if seen++; seen == n {
+					m.mu.Unlock()
+					return msg
+				}
+			}
+		}
+		m.mu.Unlock()
+	}
+	t.Fatalf("email %d to %s not sent", n, addr)
+	return mailer.Message{}
+}
+
+// count returns how many messages were sent to addr so far.
+func (m *fakeMailer) count(addr string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, msg := range m.sent {
+		if msg.To == addr {
+			n++
+		}
+	}
+	return n
+}
+
+// linkToken returns the token query parameter of the first link to path in the message body.
+func linkToken(t *testing.T, msg mailer.Message, path string) string {
+	t.Helper()
+	i := strings.Index(msg.Body, path+"?token=")
+	if i < 0 {
+		t.Fatalf("no %s link in %q", path, msg.Body)
+	}
+	raw, _, _ := strings.Cut(msg.Body[i+len(path+"?token="):], "\n")
+	token, err := url.QueryUnescape(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// newTestService returns a service on in-memory repositories with a cheap hasher. opts may adjust the options.
+func newTestService(t *testing.T, opts func(o *Options)) (*Service, *fakeUserRepo, *fakeTokenRepo) {
+	t.Helper()
+	keys, err := NewHMACKeySet("test-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hasher, err := NewPasswordHasher(HasherConfig{Algorithm: HashBcrypt, BcryptCost: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := Options{
+		Keys:                    keys,
+		TokenExpiry:             15 * time.Minute,
+		RefreshTokenExpiry:      24 * time.Hour,
+		Mailer:                  &fakeMailer{},
+		AppBaseURL:              "https://app.example.test",
+		EmailVerification:       EmailVerificationOff,
+		VerificationTokenExpiry: time.Hour,
+		Hasher:                  hasher,
+	}
+	if opts != nil {
+		opts(&o)
+	}
+	users, tokens := newFakeUserRepo(), newFakeTokenRepo()
+	return NewService(users, tokens, o), users, tokens
+}
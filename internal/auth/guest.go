@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"time"
+
+	"github.com/bilalabsh/zabaan_backend/internal/mailer"
+	"github.com/bilalabsh/zabaan_backend/internal/models"
+	"github.com/bilalabsh/zabaan_backend/internal/user"
+)
+
+// ErrNotGuest is returned when upgrading an account that is not (or no longer) a guest.
+var ErrNotGuest = errors.New("not a guest account")
+
+// pruneGuestsBatch bounds how many stale guests PruneGuests deletes per run.
+const pruneGuestsBatch = 500
+
+// CreateGuest creates a user without email or password and starts a session for it, so learners can use the
+// app before signing up. The access token carries "guest": true.
+func (s *Service) CreateGuest(info SessionInfo) (*models.User, *TokenPair, error) {
+	id, err := newRandomID()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	u, err := s.userRepo.CreateGuest("guest_"+id[:16], now)
+	if err != nil {
+		return nil, nil, err
+	}
+	tokens, err := s.IssueTokens(u, now, info)
+	if err != nil {
+		return nil, nil, err
+	}
+	return u, tokens, nil
+}
+
+// PurposeGuestUpgrade is the Purpose claim of the links that finish a guest upgrade with AntiEnumeration.
+const PurposeGuestUpgrade = "guest_upgrade"
+
+// UpgradeGuest attaches email, password and names to the guest's existing user row, so everything keyed by the
+// user id is kept. Fields are validated like SignUp and a verification email is sent. The guest's tokens are
+// revoked; the returned pair is nil when EMAIL_VERIFICATION=login requires verifying first (like SignUp).
+// With AntiEnumeration the upgrade waits for the address to be confirmed (requestGuestUpgrade): the guest stays a
+// guest, still signed in, and the user is returned as it will look once upgraded, without tokens, whether or not
+// the email has an account.
+func (s *Service) UpgradeGuest(claims *Claims, firstName, lastName, email, password string, info SessionInfo) (*models.User, *TokenPair, error) {
+	if !claims.Guest {
+		return nil, nil, ErrNotGuest
+	}
+	userID := UserIDFromClaims(claims)
+	email, hash, err := s.prepareSignUp(firstName, lastName, email, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.antiEnumeration {
+		u, err := s.requestGuestUpgrade(userID, email, firstName, lastName, hash)
+		return u, nil, err
+	}
+	ok, err := s.userRepo.UpgradeGuest(userID, email, email, firstName, lastName, hash)
+	if err != nil {
+		if errors.Is(err, user.ErrDuplicateEmail) {
+			return nil, nil, ErrEmailExists
+		}
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, nil, ErrNotGuest
+	}
+	u, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.sendSignUpVerificationEmail(u)
+	now := time.Now()
+	if err := s.RevokePreviousTokensAt(userID, now); err != nil {
+		return nil, nil, err
+	}
+	tokens, err := s.IssueTokens(u, now, info)
+	if errors.Is(err, ErrEmailNotVerified) {
+		return u, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return u, tokens, nil
+}
+
+// requestGuestUpgrade is UpgradeGuest with AntiEnumeration. Upgrading at once would show whether the email was
+// free, and revoking the guest's tokens for a taken one would lose its progress. Instead the names and password are
+// stored on the guest, and a link that finishes the upgrade (VerifyEmail) is mailed to a free address; the owner of
+// a taken one gets the account-exists email. Either way the guest keeps working as before.
+func (s *Service) requestGuestUpgrade(userID uint, email, firstName, lastName, hash string) (*models.User, error) {
+	ok, err := s.userRepo.SetGuestProfile(userID, firstName, lastName, hash)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotGuest
+	}
+	u, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := s.userRepo.GetByEmail(email); err == nil {
+		s.sendAccountExistsEmail(email)
+	} else if errors.Is(err, sql.ErrNoRows) {
+		go s.sendGuestUpgradeEmail(u, email)
+	} else {
+		return nil, err
+	}
+	u.Email, u.Username = email, email
+	u.IsGuest, u.EmailVerified = false, false
+	return u, nil
+}
+
+// sendGuestUpgradeEmail emails a signed, single-use link that upgrades the guest to email, logging failures.
+func (s *Service) sendGuestUpgradeEmail(u *models.User, email string) {
+	claims := NewClaims(u.ID, email, time.Now(), s.verificationTokenExpiry)
+	claims.Purpose = PurposeGuestUpgrade
+	token, err := SignPurposeToken(s.keys, claims)
+	if err == nil {
+		err = s.mailer.Send(mailer.Message{
+			To:      email,
+			Subject: "Verify your email for Zabaan",
+			Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address to finish creating your Zabaan account by opening this link:\n\n%s\n\nThe link expires in %s. If you did not sign up for Zabaan, you can ignore this email.\n",
+				u.FirstName, s.appBaseURL+"/verify-email?token="+url.QueryEscape(token), s.verificationTokenExpiry),
+		})
+	}
+	if err != nil {
+		slog.Error("sending guest upgrade email failed", "component", "auth", "user_id", u.ID, "err", err)
+	}
+}
+
+// completeGuestUpgrade upgrades the guest of a PurposeGuestUpgrade link to the link's email, verified, with the
+// names and password stored by requestGuestUpgrade. The guest's tokens are revoked; it signs in with the password.
+func (s *Service) completeGuestUpgrade(u *models.User, claims *Claims) error {
+	if !u.IsGuest {
+		return ErrVerificationTokenInvalid
+	}
+	hash, err := s.userRepo.GetPasswordHash(u.ID)
+	if err != nil {
+		return err
+	}
+	ok, err := s.userRepo.UpgradeGuest(u.ID, claims.Email, claims.Email, u.FirstName, u.LastName, hash)
+	if err != nil {
+		if errors.Is(err, user.ErrDuplicateEmail) {
+			return ErrVerificationTokenInvalid
+		}
+		return err
+	}
+	if !ok {
+		return ErrVerificationTokenInvalid
+	}
+	now := time.Now()
+	if err := s.userRepo.MarkEmailVerified(u.ID, now); err != nil {
+		return err
+	}
+	return s.RevokePreviousTokensAt(u.ID, now)
+}
+
+// PruneGuests deletes guests not seen for GuestAccountTTL, with their data, and returns how many were deleted.
+// It does nothing when the TTL is 0. As in PurgeDeletedAccounts, the users row is deleted last so a failure is retried;
+// a guest seen again in between keeps its row but, its sessions being gone, has to start over.
+func (s *Service) PruneGuests() (int, error) {
+	if s.guestAccountTTL <= 0 {
+		return 0, nil
+	}
+	before := time.Now().Add(-s.guestAccountTTL)
+	ids, err := s.userRepo.ListStaleGuests(before, pruneGuestsBatch)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, id := range ids {
+		if err := s.deleteUserData(id); err != nil {
+			return deleted, err
+		}
+		ok, err := s.userRepo.DeleteStaleGuest(id, before)
+		if err != nil {
+			return deleted, err
+		}
+		if !ok {
+			continue
+		}
+		deleted++
+	}
+	return deleted, nil
+}
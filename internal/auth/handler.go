@@ -1,36 +1,114 @@
 package auth
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/bilalabsh/zabaan_backend/internal/clientip"
 	"github.com/bilalabsh/zabaan_backend/internal/models"
+	"github.com/bilalabsh/zabaan_backend/internal/webauthn"
 )
 
 // AuthService is the subset of auth operations needed by the HTTP handler. Accepting an interface allows tests to use a mock.
 type AuthService interface {
 	SignUp(firstName, lastName, email, password string) (*models.User, error)
 	Login(email, password string) (*models.User, error)
-	CreateToken(userID uint, email string) (string, error)
-	CreateTokenWithIssuedAt(userID uint, email string, issuedAt time.Time) (string, error)
+	IssueTokens(u *models.User, issuedAt time.Time, info SessionInfo) (*TokenPair, error)
+	Refresh(refreshToken string) (*TokenPair, error)
 	RevokePreviousTokensAt(userID uint, t time.Time) error
 	ValidateTokenFull(tokenString string) (*Claims, error)
+	ListSessions(userID uint, currentID string) ([]Session, error)
+	RevokeSession(userID uint, sessionID string) error
+	RevokeOtherSessions(userID uint, keepID string) error
+	Logout(claims *Claims) error
+	JWKS() JWKS
+	VerifyEmail(token string) error
+	ResendVerification(email string) error
+	ForgotPassword(email string) error
+	ResetPassword(token, newPassword string) (uint, error)
+	ChangePassword(claims *Claims, currentPassword, newPassword string, info SessionInfo) (*TokenPair, error)
+	SetupTOTP(userID uint) (secret, uri string, err error)
+	ConfirmTOTP(userID uint, code string) ([]string, error)
+	CreateMFAToken(u *models.User, purpose string) (string, error)
+	CompleteMFALogin(mfaToken, code, recoveryCode string) (*models.User, string, error)
+	LoginWithOIDC(ctx context.Context, provider, idToken, firstName, lastName string) (*models.User, error)
+	RequestEmailLogin(email string) error
+	VerifyEmailLoginCode(email, code string) (*models.User, error)
+	VerifyEmailLoginLink(token string) (*models.User, error)
+	RequestEmailChange(claims *Claims, currentPassword, newEmail string) error
+	ConfirmEmailChange(token string) (uint, error)
+	UndoEmailChange(token string) (uint, error)
+	RequestPhoneSignup(phone string) error
+	VerifyPhoneSignup(phone, code, firstName, lastName string) (*models.User, error)
+	RequestPhoneLogin(phone string) error
+	VerifyPhoneLogin(phone, code string) (*models.User, error)
+	CreateAPIKey(creator *Claims, userID uint, name string, scopes []string, expiresAt *time.Time) (*APIKey, string, error)
+	ListAPIKeys(userID uint) ([]APIKey, error)
+	RevokeAPIKey(claims *Claims, id string) (*APIKey, error)
+	CreateGuest(info SessionInfo) (*models.User, *TokenPair, error)
+	UpgradeGuest(claims *Claims, firstName, lastName, email, password string, info SessionInfo) (*models.User, *TokenPair, error)
+	ValidateAPIKey(key string) (*Claims, error)
+	IntrospectToken(token string) (*Introspection, error)
+	AuthenticateIntrospectionClient(clientID, secret string) bool
+	ScheduleDeletion(claims *Claims) (time.Time, error)
+	ExportUserData(userID uint) (map[string]interface{}, error)
+	Impersonate(admin *Claims, userID uint) (*models.User, string, time.Time, error)
+	LegalDocuments() ([]LegalDocument, error)
+	CheckConsents(accepted map[string]string) ([]LegalDocument, error)
+	AcceptLegalDocuments(userID uint, accepted map[string]string, info SessionInfo) ([]LegalDocument, error)
+	ConsentStatus(userID uint) (*ConsentStatus, error)
+	AntiEnumeration() bool
+	BeginPasskeyRegistration(userID uint) (*webauthn.CreationOptions, error)
+	FinishPasskeyRegistration(userID uint, name string, cred *PasskeyCredential) (*Passkey, error)
+	BeginPasskeyLogin() (*webauthn.RequestOptions, error)
+	FinishPasskeyLogin(cred *PasskeyCredential) (*models.User, error)
+	ListPasskeys(userID uint) ([]Passkey, error)
+	DeletePasskey(userID uint, id string) error
 }
 
-// Handler handles auth HTTP endpoints (signup, login, getToken).
+// Handler handles auth HTTP endpoints (signup, login, getToken, two-factor, Google/Apple, email code, phone and passkey login, token refresh, logout, sessions,
+// email verification, password reset and change, email change, 2FA enrollment, passkeys, API keys, token introspection, account deletion and export, impersonation, legal consents).
 // All responses are JSON; handlers set Content-Type: application/json at the start.
 type Handler struct {
-	svc AuthService
+	svc        AuthService
+	trustProxy bool
+	audit      AuditRecorder
 }
 
-// NewHandler returns a new auth handler.
-func NewHandler(svc AuthService) *Handler {
-	return &Handler{svc: svc}
+// AuditRecorder records security events with the request's client IP and user agent. Implemented by audit.Recorder.
+type AuditRecorder interface {
+	Record(r *http.Request, e models.AuditEvent)
+}
+
+type noopAuditRecorder struct{}
+
+func (noopAuditRecorder) Record(*http.Request, models.AuditEvent) {}
+
+// NewHandler returns a new auth handler. trustProxy controls whether the client IP recorded on sessions is taken from proxy headers.
+// audit receives signups, logins, token and password events; nil records nothing.
+func NewHandler(svc AuthService, trustProxy bool, audit AuditRecorder) *Handler {
+	if audit == nil {
+		audit = noopAuditRecorder{}
+	}
+	return &Handler{svc: svc, trustProxy: trustProxy, audit: audit}
+}
+
+// recordLogin records a successful sign-in of u; method is how ("password", "email_code", "oidc:google", ...).
+func (h *Handler) recordLogin(r *http.Request, u *models.User, method string) {
+	h.audit.Record(r, models.AuditEvent{Type: models.AuditLoginSucceeded, ActorID: u.ID, UserID: u.ID, Details: map[string]string{"method": method}})
+}
+
+// recordLoginFailure records a rejected sign-in. userID may be 0 when only the email is known.
+func (h *Handler) recordLoginFailure(r *http.Request, userID uint, email, method, reason string) {
+	h.audit.Record(r, models.AuditEvent{Type: models.AuditLoginFailed, UserID: userID, Email: email, Details: map[string]string{"method": method, "reason": reason}})
 }
 
 // maxRequestBodyBytes is the maximum size of request body for auth endpoints (1MB).
@@ -38,8 +116,104 @@ const maxRequestBodyBytes = 1 << 20
 
 // loginRequestBody is the JSON body for Login and GetToken.
 type loginRequestBody struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email      string `json:"email"`
+	Password   string `json:"password"`
+	DeviceName string `json:"device_name"`
+}
+
+// sessionInfo describes the requesting device for a new session.
+func (h *Handler) sessionInfo(r *http.Request, deviceName string) SessionInfo {
+	return SessionInfo{
+		DeviceName: strings.TrimSpace(deviceName),
+		UserAgent:  r.UserAgent(),
+		IP:         clientip.FromRequest(r, h.trustProxy),
+	}
+}
+
+// decodeJSONBody decodes the (size-limited) request body into v. On failure it writes 413 or 400 and returns false.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodyBytes)
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			json.NewEncoder(w).Encode(map[string]string{"error": "request body too large"})
+			return false
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid JSON"})
+		return false
+	}
+	return true
+}
+
+// writePasswordError writes 400 and returns true if err is a password policy error; otherwise returns false.
+// Policy failures list their reasons, e.g. {"error": "password does not meet requirements", "reasons": ["too_short", "common_password"]}.
+func writePasswordError(w http.ResponseWriter, err error) bool {
+	var policyErr *PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "password does not meet requirements", "reasons": policyErr.Reasons})
+		return true
+	}
+	if errors.Is(err, ErrWeakPassword) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "password does not meet requirements"})
+		return true
+	}
+	if errors.Is(err, ErrPasswordTooLong) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "password too long"})
+		return true
+	}
+	return false
+}
+
+// writeCurrentPasswordLocked writes 423 with Retry-After if err is a *LockedError from too many wrong current
+// passwords, and reports whether it did.
+func writeCurrentPasswordLocked(w http.ResponseWriter, err error) bool {
+	var locked *LockedError
+	if !errors.As(err, &locked) {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(locked.RetryAfter.Seconds()))))
+	w.WriteHeader(http.StatusLocked)
+	json.NewEncoder(w).Encode(map[string]string{"error": "too many wrong passwords, try again later"})
+	return true
+}
+
+// writeSignUpError writes 400/409 and returns true if err is a signup validation error (also used by guest upgrade);
+// otherwise returns false.
+func writeSignUpError(w http.ResponseWriter, err error) bool {
+	if errors.Is(err, ErrInvalidEmail) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid email format"})
+		return true
+	}
+	if errors.Is(err, ErrEmailTooLong) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "email too long"})
+		return true
+	}
+	if errors.Is(err, ErrFirstNameTooLong) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "first_name too long"})
+		return true
+	}
+	if errors.Is(err, ErrLastNameTooLong) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "last_name too long"})
+		return true
+	}
+	if writePasswordError(w, err) {
+		return true
+	}
+	if errors.Is(err, ErrEmailExists) {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "email already exists"})
+		return true
+	}
+	return false
 }
 
 // methodNotAllowed writes 405 and returns true if r.Method != method; otherwise returns false.
@@ -54,16 +228,20 @@ func methodNotAllowed(w http.ResponseWriter, r *http.Request, method string) boo
 }
 
 // Signup handles POST /signup.
+// Once legal documents are published, the body must accept the current version of each (GET /legal-documents):
+// "consents": {"terms": "2026-10", "privacy": "2026-10"}; otherwise 400 with code "consent_required" and the documents.
 func (h *Handler) Signup(w http.ResponseWriter, r *http.Request) {
 	if methodNotAllowed(w, r, http.MethodPost) {
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	var body struct {
-		FirstName string `json:"first_name"`
-		LastName  string `json:"last_name"`
-		Email     string `json:"email"`
-		Password  string `json:"password"`
+		FirstName  string            `json:"first_name"`
+		LastName   string            `json:"last_name"`
+		Email      string            `json:"email"`
+		Password   string            `json:"password"`
+		DeviceName string            `json:"device_name"`
+		Consents   map[string]string `json:"consents"`
 	}
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodyBytes)
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
@@ -82,41 +260,32 @@ func (h *Handler) Signup(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{"error": "first_name, last_name, email and password required"})
 		return
 	}
-	user, err := h.svc.SignUp(body.FirstName, body.LastName, body.Email, body.Password)
+	docs, err := h.svc.CheckConsents(body.Consents)
 	if err != nil {
-		if errors.Is(err, ErrInvalidEmail) {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "invalid email format"})
-			return
-		}
-		if errors.Is(err, ErrEmailTooLong) {
+		if errors.Is(err, ErrConsentRequired) {
 			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "email too long"})
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "the current legal documents must be accepted", "code": ConsentRequiredCode, "documents": docs})
 			return
 		}
-		if errors.Is(err, ErrFirstNameTooLong) {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "first_name too long"})
-			return
-		}
-		if errors.Is(err, ErrLastNameTooLong) {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "last_name too long"})
-			return
-		}
-		if errors.Is(err, ErrWeakPassword) {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "password must be at least 8 characters and contain a letter and a number"})
-			return
-		}
-		if errors.Is(err, ErrPasswordTooLong) {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "password must be at most 72 characters"})
-			return
+		slog.Error("signup consent check failed", "handler", "Signup", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		return
+	}
+	user, err := h.svc.SignUp(body.FirstName, body.LastName, body.Email, body.Password)
+	if h.svc.AntiEnumeration() && (err == nil || errors.Is(err, ErrEmailExists)) {
+		// New and existing emails get the same answer (the service emails the address either way); the new
+		// account's tokens come from logging in.
+		if err == nil {
+			h.audit.Record(r, models.AuditEvent{Type: models.AuditSignup, ActorID: user.ID, UserID: user.ID})
+			h.recordSignupConsents(r, user.ID, docs)
 		}
-		if errors.Is(err, ErrEmailExists) {
-			w.WriteHeader(http.StatusConflict)
-			json.NewEncoder(w).Encode(map[string]string{"error": "email already exists"})
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"message": "check your email to continue"})
+		return
+	}
+	if err != nil {
+		if writeSignUpError(w, err) {
 			return
 		}
 		slog.Error("signup failed", "handler", "Signup", "err", err)
@@ -124,16 +293,24 @@ func (h *Handler) Signup(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
 		return
 	}
-	token, err := h.svc.CreateToken(user.ID, user.Email)
+	h.audit.Record(r, models.AuditEvent{Type: models.AuditSignup, ActorID: user.ID, UserID: user.ID})
+	h.recordSignupConsents(r, user.ID, docs)
+	tokens, err := h.svc.IssueTokens(user, time.Now(), h.sessionInfo(r, body.DeviceName))
+	if errors.Is(err, ErrEmailNotVerified) {
+		// Login requires a verified email: the account is created, tokens come after the user follows the emailed link.
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"user": user, "verification_required": true})
+		return
+	}
 	if err != nil {
 		slog.Error("signup create token failed", "handler", "Signup", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": "failed to create token"})
 		return
 	}
-	w.Header().Set("Authorization", "Bearer "+token)
+	w.Header().Set("Authorization", "Bearer "+tokens.AccessToken)
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]interface{}{"user": user, "token": token})
+	json.NewEncoder(w).Encode(map[string]interface{}{"user": user, "token": tokens.AccessToken, "refresh_token": tokens.RefreshToken})
 }
 
 // bearerResult holds the result of validating an optional Bearer token.
@@ -175,11 +352,12 @@ func (h *Handler) ensureBearerMatchesUser(w http.ResponseWriter, bearerClaims *C
 }
 
 // authenticateWithCredentials validates method, optional Bearer, body (email/password), runs Login, and ensures Bearer matches user.
-// Returns (user, true) when the handler should return (error or mismatch already written); (user, false) to continue.
-func (h *Handler) authenticateWithCredentials(w http.ResponseWriter, r *http.Request, logLabel string) (*models.User, bool) {
+// Returns (user, info, true) when the handler should return (error or mismatch already written); (user, info, false) to continue.
+// info describes the device for the session the caller creates.
+func (h *Handler) authenticateWithCredentials(w http.ResponseWriter, r *http.Request, logLabel string) (*models.User, SessionInfo, bool) {
 	ber := h.rejectInvalidBearer(w, r)
 	if ber.Rejected {
-		return nil, true
+		return nil, SessionInfo{}, true
 	}
 	var body loginRequestBody
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodyBytes)
@@ -189,75 +367,101 @@ func (h *Handler) authenticateWithCredentials(w http.ResponseWriter, r *http.Req
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusRequestEntityTooLarge)
 			json.NewEncoder(w).Encode(map[string]string{"error": "request body too large"})
-			return nil, true
+			return nil, SessionInfo{}, true
 		}
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{"error": "invalid JSON"})
-		return nil, true
+		return nil, SessionInfo{}, true
 	}
 	if body.Email == "" || body.Password == "" {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{"error": "email and password required"})
-		return nil, true
+		return nil, SessionInfo{}, true
 	}
 	user, err := h.svc.Login(body.Email, body.Password)
 	if err != nil {
 		if errors.Is(err, ErrInvalidCredentials) {
+			h.recordLoginFailure(r, 0, NormalizeEmail(body.Email), "password", "invalid_credentials")
 			w.WriteHeader(http.StatusUnauthorized)
 			json.NewEncoder(w).Encode(map[string]string{"error": "invalid email or password"})
-			return nil, true
+			return nil, SessionInfo{}, true
 		}
 		if errors.Is(err, ErrEmailTooLong) {
 			w.WriteHeader(http.StatusBadRequest)
 			json.NewEncoder(w).Encode(map[string]string{"error": "email too long"})
-			return nil, true
+			return nil, SessionInfo{}, true
+		}
+		if errors.Is(err, ErrEmailNotVerified) {
+			h.recordLoginFailure(r, 0, NormalizeEmail(body.Email), "password", "email_not_verified")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "email not verified"})
+			return nil, SessionInfo{}, true
+		}
+		var locked *LockedError
+		if errors.As(err, &locked) {
+			h.recordLoginFailure(r, 0, NormalizeEmail(body.Email), "password", "locked")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(locked.RetryAfter.Seconds()))))
+			w.WriteHeader(http.StatusLocked)
+			json.NewEncoder(w).Encode(map[string]string{"error": "account temporarily locked"})
+			return nil, SessionInfo{}, true
 		}
 		slog.Error("login failed", "handler", logLabel, "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
-		return nil, true
+		return nil, SessionInfo{}, true
 	}
 	if h.ensureBearerMatchesUser(w, ber.Claims, user.ID) {
-		return nil, true
+		return nil, SessionInfo{}, true
 	}
-	return user, false
+	return user, h.sessionInfo(r, body.DeviceName), false
 }
 
 // Login handles POST /login.
 // Bearer is optional. If sent, it must be valid (not tampered/expired) and must refer to the same user as the credentials in the body; otherwise 401.
+// When the user has 2FA enabled the response is {"mfa_required": true, "mfa_token": "..."} instead of tokens; see LoginTwoFactor.
 func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
 	if methodNotAllowed(w, r, http.MethodPost) {
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	user, done := h.authenticateWithCredentials(w, r, "Login")
+	user, info, done := h.authenticateWithCredentials(w, r, "Login")
 	if done {
 		return
 	}
-	token, err := h.svc.CreateToken(user.ID, user.Email)
+	if user.TwoFactorEnabled {
+		h.writeMFAChallenge(w, user, PurposeMFALogin, "Login")
+		return
+	}
+	tokens, err := h.svc.IssueTokens(user, time.Now(), info)
 	if err != nil {
 		slog.Error("login create token failed", "handler", "Login", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": "failed to create token"})
 		return
 	}
-	w.Header().Set("Authorization", "Bearer "+token)
+	h.recordLogin(r, user, "password")
+	w.Header().Set("Authorization", "Bearer "+tokens.AccessToken)
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{"user": user, "token": token})
+	json.NewEncoder(w).Encode(map[string]interface{}{"user": user, "token": tokens.AccessToken, "refresh_token": tokens.RefreshToken})
 }
 
 // GetToken handles POST /getToken.
-// Exchanges email and password for a new token and invalidates all previously issued tokens for that user.
+// Exchanges email and password for a new token and invalidates all previously issued tokens and sessions for that user.
 // Bearer is optional; if sent, must be valid and for the same user as the credentials.
+// With 2FA enabled nothing is revoked yet: an mfa_token is returned and /login/2fa finishes the exchange.
 func (h *Handler) GetToken(w http.ResponseWriter, r *http.Request) {
 	if methodNotAllowed(w, r, http.MethodPost) {
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	user, done := h.authenticateWithCredentials(w, r, "GetToken login")
+	user, info, done := h.authenticateWithCredentials(w, r, "GetToken login")
 	if done {
 		return
 	}
+	if user.TwoFactorEnabled {
+		h.writeMFAChallenge(w, user, PurposeMFAGetToken, "GetToken")
+		return
+	}
 	issuedAt := time.Now()
 	if err := h.svc.RevokePreviousTokensAt(user.ID, issuedAt); err != nil {
 		slog.Error("getToken revoke previous tokens failed", "handler", "GetToken", "err", err)
@@ -265,14 +469,336 @@ func (h *Handler) GetToken(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{"error": "failed to revoke previous tokens"})
 		return
 	}
-	token, err := h.svc.CreateTokenWithIssuedAt(user.ID, user.Email, issuedAt)
+	tokens, err := h.svc.IssueTokens(user, issuedAt, info)
 	if err != nil {
 		slog.Error("getToken create token failed", "handler", "GetToken", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": "failed to create token"})
 		return
 	}
-	w.Header().Set("Authorization", "Bearer "+token)
+	h.audit.Record(r, models.AuditEvent{Type: models.AuditTokensRevoked, ActorID: user.ID, UserID: user.ID, Details: map[string]string{"reason": "get_token"}})
+	h.recordLogin(r, user, "password")
+	w.Header().Set("Authorization", "Bearer "+tokens.AccessToken)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"token": tokens.AccessToken, "refresh_token": tokens.RefreshToken})
+}
+
+// Refresh handles POST /token/refresh.
+// Exchanges a refresh token for a new access token and a new refresh token; the presented refresh token is rotated
+// and can't be used again. Reusing a rotated refresh token revokes the whole family and all of the user's tokens.
+func (h *Handler) Refresh(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+	if body.RefreshToken == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "refresh_token required"})
+		return
+	}
+	tokens, err := h.svc.Refresh(body.RefreshToken)
+	if err != nil {
+		if errors.Is(err, ErrRefreshTokenReused) {
+			slog.Warn("refresh token reuse detected", "handler", "Refresh")
+			h.audit.Record(r, models.AuditEvent{Type: models.AuditTokenReuseDetected, UserID: ErrorUserID(err)})
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "refresh token already used; please log in again"})
+			return
+		}
+		if errors.Is(err, ErrRefreshTokenInvalid) {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired refresh token"})
+			return
+		}
+		slog.Error("refresh failed", "handler", "Refresh", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		return
+	}
+	h.audit.Record(r, models.AuditEvent{Type: models.AuditTokenRefreshed, ActorID: tokens.UserID, UserID: tokens.UserID})
+	w.Header().Set("Authorization", "Bearer "+tokens.AccessToken)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"token": tokens.AccessToken, "refresh_token": tokens.RefreshToken})
+}
+
+// Logout handles POST /logout (requires RequireAuth).
+// Revokes only the presented token and its session; the user's other devices stay signed in.
+func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	claims := ClaimsFromContext(r.Context())
+	if claims == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+		return
+	}
+	if err := h.svc.Logout(claims); err != nil {
+		if errors.Is(err, ErrTokenNotRevocable) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "token cannot be revoked individually; use /getToken to revoke all tokens"})
+			return
+		}
+		slog.Error("logout failed", "handler", "Logout", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		return
+	}
+	h.audit.Record(r, models.AuditEvent{Type: models.AuditSessionRevoked, UserID: UserIDFromClaims(claims), Details: map[string]string{"session_id": claims.SessionID, "reason": "logout"}})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Sessions handles /sessions and /sessions/:id (requires RequireAuth).
+// GET /sessions lists the caller's signed-in devices; DELETE /sessions/:id signs out one of them;
+// DELETE /sessions?others=true signs out every device except the current one, DELETE /sessions signs out all of them.
+func (h *Handler) Sessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	claims := ClaimsFromContext(r.Context())
+	userID := UserIDFromClaims(claims)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+		return
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/sessions"), "/")
+	if id != "" {
+		if methodNotAllowed(w, r, http.MethodDelete) {
+			return
+		}
+		if err := h.svc.RevokeSession(userID, id); err != nil {
+			if errors.Is(err, ErrSessionNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string]string{"error": "session not found"})
+				return
+			}
+			slog.Error("revoke session failed", "handler", "Sessions", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+			return
+		}
+		h.audit.Record(r, models.AuditEvent{Type: models.AuditSessionRevoked, UserID: userID, Details: map[string]string{"session_id": id}})
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		sessions, err := h.svc.ListSessions(userID, claims.SessionID)
+		if err != nil {
+			slog.Error("list sessions failed", "handler", "Sessions", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"sessions": sessions})
+	case http.MethodDelete:
+		keepID := ""
+		if r.URL.Query().Get("others") == "true" {
+			keepID = claims.SessionID
+		}
+		if err := h.svc.RevokeOtherSessions(userID, keepID); err != nil {
+			slog.Error("revoke sessions failed", "handler", "Sessions", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+			return
+		}
+		reason := "sign_out_all"
+		if keepID != "" {
+			reason = "sign_out_others"
+		}
+		h.audit.Record(r, models.AuditEvent{Type: models.AuditTokensRevoked, UserID: userID, Details: map[string]string{"reason": reason}})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+	}
+}
+
+// JWKS handles GET /.well-known/jwks.json.
+// Publishes the public keys that verify access tokens so other services can validate them without the signing key.
+func (h *Handler) JWKS(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(h.svc.JWKS())
+}
+
+// VerifyEmail handles POST /verify-email.
+// Body: {"token": "..."} from the emailed link. Each token works once.
+func (h *Handler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		Token string `json:"token"`
+	}
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+	if body.Token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "token required"})
+		return
+	}
+	if err := h.svc.VerifyEmail(body.Token); err != nil {
+		if errors.Is(err, ErrVerificationTokenInvalid) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired verification token"})
+			return
+		}
+		slog.Error("verify email failed", "handler", "VerifyEmail", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "email verified"})
+}
+
+// ResendVerification handles POST /verify-email/resend.
+// Body: {"email": "..."}. Always returns 202 so the response doesn't reveal whether the email has an account.
+func (h *Handler) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		Email string `json:"email"`
+	}
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+	if body.Email == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "email required"})
+		return
+	}
+	if err := h.svc.ResendVerification(body.Email); err != nil {
+		slog.Error("resend verification failed", "handler", "ResendVerification", "err", err)
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "if the account exists and is not verified yet, a verification email has been sent"})
+}
+
+// ForgotPassword handles POST /password/forgot.
+// Body: {"email": "..."}. Always returns 202 so the response doesn't reveal whether the email has an account.
+func (h *Handler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		Email string `json:"email"`
+	}
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+	if body.Email == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "email required"})
+		return
+	}
+	if err := h.svc.ForgotPassword(body.Email); err != nil {
+		slog.Error("forgot password failed", "handler", "ForgotPassword", "err", err)
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "if the account exists, a password reset email has been sent"})
+}
+
+// ResetPassword handles POST /password/reset.
+// Body: {"token": "...", "password": "..."}. On success every existing token and session of the user is revoked.
+func (h *Handler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+	if body.Token == "" || body.Password == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "token and password required"})
+		return
+	}
+	userID, err := h.svc.ResetPassword(body.Token, body.Password)
+	if err != nil {
+		if writePasswordError(w, err) {
+			return
+		}
+		if errors.Is(err, ErrPasswordResetTokenInvalid) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired reset token"})
+			return
+		}
+		slog.Error("reset password failed", "handler", "ResetPassword", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		return
+	}
+	h.audit.Record(r, models.AuditEvent{Type: models.AuditPasswordReset, ActorID: userID, UserID: userID})
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "password updated"})
+}
+
+// ChangePassword handles POST /me/password (requires RequireAuth).
+// Body: {"current_password": "...", "new_password": "..."}. Revokes every other token and session and returns a fresh token pair for this device.
+func (h *Handler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	claims := ClaimsFromContext(r.Context())
+	if UserIDFromClaims(claims) == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+		return
+	}
+	var body struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+		DeviceName      string `json:"device_name"`
+	}
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+	if body.CurrentPassword == "" || body.NewPassword == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "current_password and new_password required"})
+		return
+	}
+	tokens, err := h.svc.ChangePassword(claims, body.CurrentPassword, body.NewPassword, h.sessionInfo(r, body.DeviceName))
+	if err != nil {
+		if errors.Is(err, ErrInvalidCredentials) {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "current password is incorrect"})
+			return
+		}
+		if writeCurrentPasswordLocked(w, err) {
+			return
+		}
+		if writePasswordError(w, err) {
+			return
+		}
+		slog.Error("change password failed", "handler", "ChangePassword", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		return
+	}
+	h.audit.Record(r, models.AuditEvent{Type: models.AuditPasswordChanged, UserID: UserIDFromClaims(claims)})
+	w.Header().Set("Authorization", "Bearer "+tokens.AccessToken)
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{"token": token})
+	json.NewEncoder(w).Encode(map[string]interface{}{"token": tokens.AccessToken, "refresh_token": tokens.RefreshToken})
 }
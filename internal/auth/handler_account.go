@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/bilalabsh/zabaan_backend/internal/models"
+)
+
+// Me handles DELETE /me (requires RequireAuth): schedules the account for deletion after the grace period and
+// signs it out everywhere. Signing in again before then cancels the deletion.
+// Response (202): {"deletion_scheduled_at": "2026-11-15T10:00:00Z"}.
+func (h *Handler) Me(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodDelete) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	claims := ClaimsFromContext(r.Context())
+	userID := UserIDFromClaims(claims)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+		return
+	}
+	at, err := h.svc.ScheduleDeletion(claims)
+	if err != nil {
+		slog.Error("schedule deletion failed", "handler", "Me", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		return
+	}
+	h.audit.Record(r, models.AuditEvent{Type: models.AuditDeletionScheduled, UserID: userID, Details: map[string]string{"deletion_scheduled_at": at.UTC().Format(time.RFC3339)}})
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"deletion_scheduled_at": at.UTC().Format(time.RFC3339)})
+}
+
+// Export handles GET /me/export (requires RequireAuth): everything stored about the caller.
+// ?format=json (default) returns one JSON document with a key per section; ?format=zip returns a zip archive
+// with one <section>.json file per section.
+func (h *Handler) Export(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodGet) {
+		return
+	}
+	userID := UserIDFromClaims(ClaimsFromContext(r.Context()))
+	if userID == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "zip" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "format must be json or zip"})
+		return
+	}
+	data, err := h.svc.ExportUserData(userID)
+	if err != nil {
+		slog.Error("export user data failed", "handler", "Export", "err", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		return
+	}
+	h.audit.Record(r, models.AuditEvent{Type: models.AuditDataExported, UserID: userID, Details: map[string]string{"format": format}})
+	now := time.Now().UTC()
+	filename := fmt.Sprintf("zabaan-export-%d-%s", userID, now.Format("20060102"))
+	w.Header().Set("Cache-Control", "no-store")
+	if format == "json" {
+		data["exported_at"] = now.Format(time.RFC3339)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.json"`)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(data)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.zip"`)
+	names := make([]string, 0, len(data))
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	zw := zip.NewWriter(w)
+	for _, name := range names {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: name + ".json", Method: zip.Deflate, Modified: now})
+		if err != nil {
+			slog.Error("export zip failed", "handler", "Export", "err", err)
+			return
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(data[name]); err != nil {
+			slog.Error("export zip failed", "handler", "Export", "err", err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		slog.Error("export zip failed", "handler", "Export", "err", err)
+	}
+}
@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bilalabsh/zabaan_backend/internal/models"
+)
+
+// APIKeys handles /me/api-keys and /me/api-keys/:id (requires RequireAuth; API keys can't manage API keys).
+// GET lists the caller's keys; POST creates one; DELETE /me/api-keys/:id revokes one.
+// POST body: {"name": "content pipeline", "scopes": ["users:read"], "expires_at": "2027-01-01T00:00:00Z", "user_id": 42};
+// expires_at is optional (no expiry), user_id is optional and admin-only (create a key for another user or service account).
+// The response contains the key itself, which is not shown again.
+func (h *Handler) APIKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	claims := ClaimsFromContext(r.Context())
+	userID := UserIDFromClaims(claims)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+		return
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/me/api-keys"), "/")
+	if id != "" {
+		if methodNotAllowed(w, r, http.MethodDelete) {
+			return
+		}
+		key, err := h.svc.RevokeAPIKey(claims, id)
+		if err != nil {
+			if errors.Is(err, ErrAPIKeyNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string]string{"error": "api key not found"})
+				return
+			}
+			slog.Error("revoke api key failed", "handler", "APIKeys", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+			return
+		}
+		h.audit.Record(r, models.AuditEvent{Type: models.AuditAPIKeyRevoked, UserID: key.UserID, Details: map[string]string{"key_id": key.ID}})
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		keys, err := h.svc.ListAPIKeys(userID)
+		if err != nil {
+			slog.Error("list api keys failed", "handler", "APIKeys", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"api_keys": keys, "available_scopes": APIKeyScopes})
+	case http.MethodPost:
+		h.createAPIKey(w, r, claims)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+	}
+}
+
+func (h *Handler) createAPIKey(w http.ResponseWriter, r *http.Request, claims *Claims) {
+	var body struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+		UserID    uint       `json:"user_id"`
+	}
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+	if strings.TrimSpace(body.Name) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "name required"})
+		return
+	}
+	if body.ExpiresAt != nil && !body.ExpiresAt.After(time.Now()) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "expires_at must be in the future"})
+		return
+	}
+	key, secret, err := h.svc.CreateAPIKey(claims, body.UserID, body.Name, body.Scopes, body.ExpiresAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrAPIKeyForbidden):
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "only admins can create api keys for other users"})
+		case errors.Is(err, ErrScopeForbidden):
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "scope requires admin"})
+		case errors.Is(err, ErrInvalidScope):
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid scope"})
+		case errors.Is(err, ErrAPIKeyLimit):
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "too many api keys"})
+		case errors.Is(err, sql.ErrNoRows):
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "user not found"})
+		default:
+			slog.Error("create api key failed", "handler", "APIKeys", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		}
+		return
+	}
+	h.audit.Record(r, models.AuditEvent{Type: models.AuditAPIKeyCreated, UserID: key.UserID, Details: map[string]string{"key_id": key.ID, "scopes": strings.Join(key.Scopes, ",")}})
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"api_key": key, "key": secret})
+}
@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/bilalabsh/zabaan_backend/internal/models"
+)
+
+// ConsentRequiredCode is the "code" of errors answered until the user accepts the current legal documents, so
+// clients can tell them apart and show the documents (from GET /legal-documents or GET /me/consents).
+const ConsentRequiredCode = "consent_required"
+
+// LegalDocuments handles GET /legal-documents: the current version of each legal document, for the signup screen.
+// Response: {"documents": [{"kind": "terms", "version": "2026-10", "url": "...", "published_at": "..."}]}.
+func (h *Handler) LegalDocuments(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	docs, err := h.svc.LegalDocuments()
+	if err != nil {
+		slog.Error("list legal documents failed", "handler", "LegalDocuments", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"documents": docs})
+}
+
+// Consents handles /me/consents (requires RequireAuth).
+// GET returns {"current", "pending", "accepted"} (see ConsentStatus). POST records acceptance: body
+// {"consents": {"terms": "2026-10", "privacy": "2026-10"}}, kind → version; each version must be the current one,
+// else 409 and the client reloads the documents.
+func (h *Handler) Consents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	claims := ClaimsFromContext(r.Context())
+	userID := UserIDFromClaims(claims)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		status, err := h.svc.ConsentStatus(userID)
+		if err != nil {
+			slog.Error("consent status failed", "handler", "Consents", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+			return
+		}
+		json.NewEncoder(w).Encode(status)
+	case http.MethodPost:
+		var body struct {
+			Consents map[string]string `json:"consents"`
+		}
+		if !decodeJSONBody(w, r, &body) {
+			return
+		}
+		if len(body.Consents) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "consents required"})
+			return
+		}
+		if !h.acceptLegalDocuments(w, r, userID, body.Consents) {
+			return
+		}
+		status, err := h.svc.ConsentStatus(userID)
+		if err != nil {
+			slog.Error("consent status failed", "handler", "Consents", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(status)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+	}
+}
+
+// acceptLegalDocuments records the user's consents and audits them. On failure it writes the error response and
+// returns false.
+func (h *Handler) acceptLegalDocuments(w http.ResponseWriter, r *http.Request, userID uint, consents map[string]string) bool {
+	docs, err := h.svc.AcceptLegalDocuments(userID, consents, h.sessionInfo(r, ""))
+	if err != nil {
+		if errors.Is(err, ErrLegalDocumentNotCurrent) {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "not the current version of the document"})
+			return false
+		}
+		slog.Error("accept legal documents failed", "handler", "Consents", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		return false
+	}
+	h.recordConsents(r, userID, docs)
+	return true
+}
+
+// recordConsents audits the acceptance of docs by the user, one detail per kind.
+func (h *Handler) recordConsents(r *http.Request, userID uint, docs []LegalDocument) {
+	if len(docs) == 0 {
+		return
+	}
+	details := make(map[string]string, len(docs))
+	for _, d := range docs {
+		details[d.Kind] = d.Version
+	}
+	h.audit.Record(r, models.AuditEvent{Type: models.AuditConsentAccepted, ActorID: userID, UserID: userID, Details: details})
+}
+
+// recordSignupConsents records that the new account accepted docs, the documents checked by CheckConsents before
+// signup. A failure (e.g. a version published meanwhile) is only logged: the account exists, and RequireConsent
+// asks the user again.
+func (h *Handler) recordSignupConsents(r *http.Request, userID uint, docs []LegalDocument) {
+	if len(docs) == 0 {
+		return
+	}
+	consents := make(map[string]string, len(docs))
+	for _, d := range docs {
+		consents[d.Kind] = d.Version
+	}
+	accepted, err := h.svc.AcceptLegalDocuments(userID, consents, h.sessionInfo(r, ""))
+	if err != nil {
+		slog.Error("recording signup consents failed", "handler", "Signup", "user_id", userID, "err", err)
+		return
+	}
+	h.recordConsents(r, userID, accepted)
+}
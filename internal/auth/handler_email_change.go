@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/bilalabsh/zabaan_backend/internal/models"
+)
+
+// EmailChange handles POST /me/email (requires RequireAuth).
+// Body: {"current_password": "...", "new_email": "..."}. Answers 202: the change applies when the link emailed to the
+// new address is opened; the old address gets a link to undo it.
+func (h *Handler) EmailChange(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	claims := ClaimsFromContext(r.Context())
+	userID := UserIDFromClaims(claims)
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+		return
+	}
+	var body struct {
+		CurrentPassword string `json:"current_password"`
+		NewEmail        string `json:"new_email"`
+	}
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+	if body.CurrentPassword == "" || body.NewEmail == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "current_password and new_email required"})
+		return
+	}
+	if err := h.svc.RequestEmailChange(claims, body.CurrentPassword, body.NewEmail); err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidCredentials):
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "current password is incorrect"})
+		case errors.Is(err, ErrEmailUnchanged):
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "new_email is the current email"})
+		default:
+			if writeCurrentPasswordLocked(w, err) || writeSignUpError(w, err) {
+				return
+			}
+			slog.Error("email change request failed", "handler", "EmailChange", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		}
+		return
+	}
+	h.audit.Record(r, models.AuditEvent{Type: models.AuditEmailChangeStarted, ActorID: userID, UserID: userID})
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "check the new email to confirm the change"})
+}
+
+// ConfirmEmailChange handles POST /email-change/confirm.
+// Body: {"token": "..."} from the link sent to the new address. Applies the change and signs the account out
+// everywhere; the user logs in again with the new email.
+func (h *Handler) ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		Token string `json:"token"`
+	}
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+	if body.Token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "token required"})
+		return
+	}
+	userID, err := h.svc.ConfirmEmailChange(body.Token)
+	if err != nil {
+		h.writeEmailChangeError(w, err, "ConfirmEmailChange")
+		return
+	}
+	h.audit.Record(r, models.AuditEvent{Type: models.AuditEmailChanged, UserID: userID})
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "email changed; log in again"})
+}
+
+// UndoEmailChange handles POST /email-change/undo.
+// Body: {"token": "..."} from the notice sent to the old address. Cancels the change, or restores the old email and
+// signs the account out everywhere if it was already confirmed.
+func (h *Handler) UndoEmailChange(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		Token string `json:"token"`
+	}
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+	if body.Token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "token required"})
+		return
+	}
+	userID, err := h.svc.UndoEmailChange(body.Token)
+	if err != nil {
+		h.writeEmailChangeError(w, err, "UndoEmailChange")
+		return
+	}
+	h.audit.Record(r, models.AuditEvent{Type: models.AuditEmailChangeUndone, UserID: userID})
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "email change undone"})
+}
+
+// writeEmailChangeError writes the response for an error from ConfirmEmailChange or UndoEmailChange.
+func (h *Handler) writeEmailChangeError(w http.ResponseWriter, err error, logLabel string) {
+	switch {
+	case errors.Is(err, ErrEmailChangeTokenInvalid):
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired token"})
+	case errors.Is(err, ErrEmailExists):
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "email already exists"})
+	default:
+		slog.Error("email change failed", "handler", logLabel, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+	}
+}
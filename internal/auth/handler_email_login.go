@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/bilalabsh/zabaan_backend/internal/models"
+)
+
+// EmailLoginRequest handles POST /login/email-code.
+// Body: {"email": "..."}. Always answers 202 so the response doesn't reveal whether the email has an account.
+func (h *Handler) EmailLoginRequest(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		Email string `json:"email"`
+	}
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+	if body.Email == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "email required"})
+		return
+	}
+	if err := h.svc.RequestEmailLogin(body.Email); err != nil {
+		slog.Error("email login request failed", "handler", "EmailLoginRequest", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "if the email has an account, a login code has been sent"})
+}
+
+// EmailLoginVerify handles POST /login/email-code/verify.
+// Body: {"email": "...", "code": "123456"} or {"token": "..."} (from the magic link), optional "device_name".
+// Responds like Login: the user and a token pair, or an mfa_token when 2FA is enabled.
+func (h *Handler) EmailLoginVerify(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		Email      string `json:"email"`
+		Code       string `json:"code"`
+		Token      string `json:"token"`
+		DeviceName string `json:"device_name"`
+	}
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+	var user *models.User
+	var err error
+	method := "email_code"
+	switch {
+	case body.Token != "":
+		method = "email_link"
+		user, err = h.svc.VerifyEmailLoginLink(body.Token)
+	case body.Email != "" && body.Code != "":
+		user, err = h.svc.VerifyEmailLoginCode(body.Email, body.Code)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "email and code, or token, required"})
+		return
+	}
+	if err != nil {
+		if errors.Is(err, ErrEmailLoginCodeInvalid) {
+			h.recordLoginFailure(r, 0, NormalizeEmail(body.Email), method, "invalid_code")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired code"})
+			return
+		}
+		slog.Error("email login verify failed", "handler", "EmailLoginVerify", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		return
+	}
+	if user.TwoFactorEnabled {
+		h.writeMFAChallenge(w, user, PurposeMFALogin, "EmailLoginVerify")
+		return
+	}
+	tokens, err := h.svc.IssueTokens(user, time.Now(), h.sessionInfo(r, body.DeviceName))
+	if err != nil {
+		slog.Error("email login create token failed", "handler", "EmailLoginVerify", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to create token"})
+		return
+	}
+	h.recordLogin(r, user, method)
+	w.Header().Set("Authorization", "Bearer "+tokens.AccessToken)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"user": user, "token": tokens.AccessToken, "refresh_token": tokens.RefreshToken})
+}
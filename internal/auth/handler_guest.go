@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/bilalabsh/zabaan_backend/internal/models"
+)
+
+// Guest handles POST /guest: creates a guest account (no email or password) and returns its tokens.
+// Optional body: {"device_name": "Pixel 8"}. Response (201): {"user", "token", "refresh_token"}; the token has "guest": true.
+func (h *Handler) Guest(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		DeviceName string `json:"device_name"`
+	}
+	if r.ContentLength != 0 && !decodeJSONBody(w, r, &body) {
+		return
+	}
+	user, tokens, err := h.svc.CreateGuest(h.sessionInfo(r, body.DeviceName))
+	if err != nil {
+		slog.Error("create guest failed", "handler", "Guest", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		return
+	}
+	h.audit.Record(r, models.AuditEvent{Type: models.AuditSignup, ActorID: user.ID, UserID: user.ID, Details: map[string]string{"guest": "true"}})
+	w.Header().Set("Authorization", "Bearer "+tokens.AccessToken)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"user": user, "token": tokens.AccessToken, "refresh_token": tokens.RefreshToken})
+}
+
+// GuestUpgrade handles POST /guest/upgrade (requires RequireAuth with a guest token).
+// Body like /signup: {"first_name", "last_name", "email", "password", "device_name"}. The guest keeps its user id;
+// its old tokens are revoked and a new pair is returned, or {"user", "verification_required": true} when login
+// requires a verified email. With ANTI_ENUMERATION it always answers the latter and the guest stays signed in as a
+// guest: the upgrade happens when the link emailed to a free address is followed (POST /verify-email), and the owner
+// of an email that already has an account is emailed instead.
+func (h *Handler) GuestUpgrade(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	claims := ClaimsFromContext(r.Context())
+	if claims == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+		return
+	}
+	var body struct {
+		FirstName  string `json:"first_name"`
+		LastName   string `json:"last_name"`
+		Email      string `json:"email"`
+		Password   string `json:"password"`
+		DeviceName string `json:"device_name"`
+	}
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+	if body.FirstName == "" || body.LastName == "" || body.Email == "" || body.Password == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "first_name, last_name, email and password required"})
+		return
+	}
+	user, tokens, err := h.svc.UpgradeGuest(claims, body.FirstName, body.LastName, body.Email, body.Password, h.sessionInfo(r, body.DeviceName))
+	if err != nil {
+		if errors.Is(err, ErrNotGuest) {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "account is not a guest"})
+			return
+		}
+		if writeSignUpError(w, err) {
+			return
+		}
+		slog.Error("guest upgrade failed", "handler", "GuestUpgrade", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		return
+	}
+	if h.svc.AntiEnumeration() {
+		// Nothing is upgraded until the emailed link is followed, whether or not the email had an account.
+		json.NewEncoder(w).Encode(map[string]interface{}{"user": user, "verification_required": true})
+		return
+	}
+	h.audit.Record(r, models.AuditEvent{Type: models.AuditGuestUpgraded, UserID: user.ID})
+	if tokens == nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{"user": user, "verification_required": true})
+		return
+	}
+	w.Header().Set("Authorization", "Bearer "+tokens.AccessToken)
+	json.NewEncoder(w).Encode(map[string]interface{}{"user": user, "token": tokens.AccessToken, "refresh_token": tokens.RefreshToken})
+}
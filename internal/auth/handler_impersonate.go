@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bilalabsh/zabaan_backend/internal/models"
+)
+
+const maxImpersonationReasonLength = 255
+
+// Impersonate handles POST /admin/users/{id}/impersonate (requires RequireAuth and the admin role).
+// Body (optional): {"reason": "support ticket 123"}, kept in the audit log. Returns {"token", "expires_at", "user"}:
+// a short-lived access token for the user whose "act" claim names the admin. There is no refresh token; when it
+// expires, impersonate again. Admins can't be impersonated.
+func (h *Handler) Impersonate(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	claims := ClaimsFromContext(r.Context())
+	adminID := UserIDFromClaims(claims)
+	if adminID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+		return
+	}
+	rest := strings.TrimPrefix(r.URL.Path, "/admin/users/")
+	idStr, ok := strings.CutSuffix(rest, "/impersonate")
+	userID, err := strconv.ParseUint(idStr, 10, 64)
+	if !ok || err != nil || userID == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "not found"})
+		return
+	}
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength != 0 && !decodeJSONBody(w, r, &body) {
+		return
+	}
+	user, token, expiresAt, err := h.svc.Impersonate(claims, uint(userID))
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrUserNotFound):
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "user not found"})
+		case errors.Is(err, ErrCannotImpersonate):
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "user cannot be impersonated"})
+		default:
+			slog.Error("impersonate failed", "handler", "Impersonate", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		}
+		return
+	}
+	details := map[string]string{"expires_at": expiresAt.UTC().Format(time.RFC3339)}
+	if reason := truncate(strings.TrimSpace(body.Reason), maxImpersonationReasonLength); reason != "" {
+		details["reason"] = reason
+	}
+	h.audit.Record(r, models.AuditEvent{Type: models.AuditImpersonationStarted, ActorID: adminID, UserID: user.ID, Details: details})
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"token": token, "expires_at": expiresAt.UTC().Format(time.RFC3339), "user": user})
+}
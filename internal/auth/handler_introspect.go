@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/bilalabsh/zabaan_backend/internal/models"
+)
+
+// Introspect handles POST /oauth/introspect (RFC 7662) for internal services.
+// The caller authenticates with client credentials from INTROSPECTION_CLIENTS (HTTP Basic, or client_id and
+// client_secret form fields) or with "Authorization: ApiKey ..." for a key with the tokens:introspect scope whose
+// owner is still an admin.
+// Form body: token=<access token>. Response: {"active": true, "sub", "email", "email_verified", "exp", "iat", "token_type"}
+// or {"active": false}, plus "revocation_reason" when the token was revoked.
+func (h *Handler) Introspect(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodyBytes)
+	if err := r.ParseForm(); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			json.NewEncoder(w).Encode(map[string]string{"error": "request body too large"})
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_request"})
+		return
+	}
+	if !h.introspectionCaller(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="introspect"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+	token := r.PostForm.Get("token")
+	if token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_request"})
+		return
+	}
+	result, err := h.svc.IntrospectToken(token)
+	if err != nil {
+		slog.Error("introspect failed", "handler", "Introspect", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "server_error"})
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// introspectionCaller reports whether the request carries valid client credentials or a suitable API key.
+func (h *Handler) introspectionCaller(r *http.Request) bool {
+	if key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "ApiKey "); ok {
+		claims, err := h.svc.ValidateAPIKey(key)
+		if err != nil {
+			if !errors.Is(err, ErrAPIKeyInvalid) {
+				slog.Error("introspect api key validation failed", "handler", "Introspect", "err", err)
+			}
+			return false
+		}
+		// The owner's current roles: a key stops working here once its owner is no longer an admin.
+		return claims.HasScope(ScopeTokensIntrospect) && claims.HasRole(models.RoleAdmin)
+	}
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	return clientID != "" && h.svc.AuthenticateIntrospectionClient(clientID, secret)
+}
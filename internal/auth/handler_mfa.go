@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bilalabsh/zabaan_backend/internal/models"
+)
+
+// writeMFAChallenge answers a password-verified login for a user with 2FA enabled: instead of tokens it returns an
+// mfa_token to exchange, together with a code, at POST /login/2fa.
+func (h *Handler) writeMFAChallenge(w http.ResponseWriter, user *models.User, purpose, logLabel string) {
+	mfaToken, err := h.svc.CreateMFAToken(user, purpose)
+	if err != nil {
+		slog.Error("create mfa token failed", "handler", logLabel, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to create token"})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"mfa_required": true, "mfa_token": mfaToken})
+}
+
+// TwoFactorSetup handles POST /me/2fa/setup (requires RequireAuth).
+// Returns a new TOTP secret and its otpauth:// URI. 2FA is not enabled until the first code is confirmed at /me/2fa/confirm;
+// calling setup again before that replaces the secret.
+func (h *Handler) TwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	userID := UserIDFromClaims(ClaimsFromContext(r.Context()))
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+		return
+	}
+	secret, uri, err := h.svc.SetupTOTP(userID)
+	if err != nil {
+		if errors.Is(err, ErrTOTPAlreadyEnabled) {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "two-factor authentication already enabled"})
+			return
+		}
+		slog.Error("2fa setup failed", "handler", "TwoFactorSetup", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"secret": secret, "otpauth_uri": uri})
+}
+
+// TwoFactorConfirm handles POST /me/2fa/confirm (requires RequireAuth).
+// Body: {"code": "123456"}. Enables 2FA and returns the recovery codes; they are shown only once.
+func (h *Handler) TwoFactorConfirm(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	userID := UserIDFromClaims(ClaimsFromContext(r.Context()))
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+		return
+	}
+	var body struct {
+		Code string `json:"code"`
+	}
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+	if strings.TrimSpace(body.Code) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "code required"})
+		return
+	}
+	codes, err := h.svc.ConfirmTOTP(userID, body.Code)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrTOTPAlreadyEnabled):
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "two-factor authentication already enabled"})
+		case errors.Is(err, ErrTOTPNotSetUp):
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "two-factor authentication not set up"})
+		case errors.Is(err, ErrInvalidMFACode):
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid code"})
+		default:
+			slog.Error("2fa confirm failed", "handler", "TwoFactorConfirm", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		}
+		return
+	}
+	h.audit.Record(r, models.AuditEvent{Type: models.AuditTwoFactorEnabled, UserID: userID})
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"two_factor_enabled": true, "recovery_codes": codes})
+}
+
+// LoginTwoFactor handles POST /login/2fa.
+// Body: {"mfa_token": "...", "code": "123456"} or {"mfa_token": "...", "recovery_code": "xxxxx-xxxxx"}, optional "device_name".
+// Returns the same response as the login step that issued the mfa_token (Login or GetToken).
+func (h *Handler) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+		DeviceName   string `json:"device_name"`
+	}
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+	if body.MFAToken == "" || (body.Code == "" && body.RecoveryCode == "") {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "mfa_token and code or recovery_code required"})
+		return
+	}
+	user, purpose, err := h.svc.CompleteMFALogin(body.MFAToken, body.Code, body.RecoveryCode)
+	if err != nil {
+		if errors.Is(err, ErrMFATokenInvalid) {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired mfa token"})
+			return
+		}
+		var locked *LockedError
+		if errors.As(err, &locked) {
+			h.recordLoginFailure(r, ErrorUserID(err), "", "2fa", "locked")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(locked.RetryAfter.Seconds()))))
+			w.WriteHeader(http.StatusLocked)
+			json.NewEncoder(w).Encode(map[string]string{"error": "too many two-factor attempts, try again later"})
+			return
+		}
+		if errors.Is(err, ErrInvalidMFACode) {
+			h.recordLoginFailure(r, ErrorUserID(err), "", "2fa", "invalid_code")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid code"})
+			return
+		}
+		slog.Error("2fa login failed", "handler", "LoginTwoFactor", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		return
+	}
+	issuedAt := time.Now()
+	if purpose == PurposeMFAGetToken {
+		if err := h.svc.RevokePreviousTokensAt(user.ID, issuedAt); err != nil {
+			slog.Error("2fa login revoke previous tokens failed", "handler", "LoginTwoFactor", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "failed to revoke previous tokens"})
+			return
+		}
+	}
+	tokens, err := h.svc.IssueTokens(user, issuedAt, h.sessionInfo(r, body.DeviceName))
+	if err != nil {
+		slog.Error("2fa login create token failed", "handler", "LoginTwoFactor", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to create token"})
+		return
+	}
+	if purpose == PurposeMFAGetToken {
+		h.audit.Record(r, models.AuditEvent{Type: models.AuditTokensRevoked, ActorID: user.ID, UserID: user.ID, Details: map[string]string{"reason": "get_token"}})
+	}
+	h.recordLogin(r, user, "2fa")
+	w.Header().Set("Authorization", "Bearer "+tokens.AccessToken)
+	w.WriteHeader(http.StatusOK)
+	if purpose == PurposeMFAGetToken {
+		json.NewEncoder(w).Encode(map[string]interface{}{"token": tokens.AccessToken, "refresh_token": tokens.RefreshToken})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"user": user, "token": tokens.AccessToken, "refresh_token": tokens.RefreshToken})
+}
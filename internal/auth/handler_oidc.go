@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bilalabsh/zabaan_backend/internal/oidc"
+)
+
+// OIDCLogin handles POST /auth/oidc/{provider} (provider is google or apple).
+// Body: {"id_token": "...", "first_name": "...", "last_name": "...", "device_name": "..."}; names are optional and only used
+// for a new account. Responds like Login: the user and a token pair, or an mfa_token when 2FA is enabled.
+func (h *Handler) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	provider := strings.Trim(strings.TrimPrefix(r.URL.Path, "/auth/oidc/"), "/")
+	if provider == "" || strings.Contains(provider, "/") {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unknown provider"})
+		return
+	}
+	var body struct {
+		IDToken    string `json:"id_token"`
+		FirstName  string `json:"first_name"`
+		LastName   string `json:"last_name"`
+		DeviceName string `json:"device_name"`
+	}
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+	if body.IDToken == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "id_token required"})
+		return
+	}
+	user, err := h.svc.LoginWithOIDC(r.Context(), provider, body.IDToken, strings.TrimSpace(body.FirstName), strings.TrimSpace(body.LastName))
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrOIDCDisabled), errors.Is(err, oidc.ErrUnknownProvider):
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "unknown provider"})
+		case errors.Is(err, oidc.ErrInvalidToken):
+			h.recordLoginFailure(r, 0, "", "oidc:"+provider, "invalid_token")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid id token"})
+		case errors.Is(err, ErrOIDCEmailNotVerified):
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "provider email not verified"})
+		default:
+			slog.Error("oidc login failed", "handler", "OIDCLogin", "provider", provider, "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		}
+		return
+	}
+	if user.TwoFactorEnabled {
+		h.writeMFAChallenge(w, user, PurposeMFALogin, "OIDCLogin")
+		return
+	}
+	tokens, err := h.svc.IssueTokens(user, time.Now(), h.sessionInfo(r, body.DeviceName))
+	if err != nil {
+		slog.Error("oidc login create token failed", "handler", "OIDCLogin", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to create token"})
+		return
+	}
+	h.recordLogin(r, user, "oidc:"+provider)
+	w.Header().Set("Authorization", "Bearer "+tokens.AccessToken)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"user": user, "token": tokens.AccessToken, "refresh_token": tokens.RefreshToken})
+}
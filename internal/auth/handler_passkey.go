@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bilalabsh/zabaan_backend/internal/models"
+)
+
+// writePasskeysDisabled writes 404 and returns true if err is ErrPasskeysDisabled.
+func writePasskeysDisabled(w http.ResponseWriter, err error) bool {
+	if !errors.Is(err, ErrPasskeysDisabled) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(map[string]string{"error": "passkeys not enabled"})
+	return true
+}
+
+// PasskeyRegisterBegin handles POST /me/passkeys/register/begin (requires RequireAuth).
+// Returns {"publicKey": {...}}: the options to pass to navigator.credentials.create. The challenge in them is valid for
+// the configured WebAuthn timeout and works once.
+func (h *Handler) PasskeyRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	userID := UserIDFromClaims(ClaimsFromContext(r.Context()))
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+		return
+	}
+	opts, err := h.svc.BeginPasskeyRegistration(userID)
+	if err != nil {
+		if writePasskeysDisabled(w, err) {
+			return
+		}
+		if errors.Is(err, ErrPasskeyLimit) {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "too many passkeys"})
+			return
+		}
+		slog.Error("passkey registration begin failed", "handler", "PasskeyRegisterBegin", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"publicKey": opts})
+}
+
+// PasskeyRegisterFinish handles POST /me/passkeys/register/finish (requires RequireAuth).
+// Body: {"name": "iPhone", "credential": <PublicKeyCredential.toJSON()>}. Returns the stored passkey.
+func (h *Handler) PasskeyRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	userID := UserIDFromClaims(ClaimsFromContext(r.Context()))
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+		return
+	}
+	var body struct {
+		Name       string             `json:"name"`
+		Credential *PasskeyCredential `json:"credential"`
+	}
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+	if body.Credential == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "credential required"})
+		return
+	}
+	passkey, err := h.svc.FinishPasskeyRegistration(userID, body.Name, body.Credential)
+	if err != nil {
+		if writePasskeysDisabled(w, err) {
+			return
+		}
+		switch {
+		case errors.Is(err, ErrPasskeyInvalid):
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired passkey response"})
+		case errors.Is(err, ErrPasskeyExists):
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "passkey already registered"})
+		default:
+			slog.Error("passkey registration finish failed", "handler", "PasskeyRegisterFinish", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		}
+		return
+	}
+	h.audit.Record(r, models.AuditEvent{Type: models.AuditPasskeyAdded, ActorID: userID, UserID: userID, Details: map[string]string{"passkey_id": passkey.ID}})
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"passkey": passkey})
+}
+
+// Passkeys handles /me/passkeys and /me/passkeys/:id (requires RequireAuth).
+// GET lists the caller's passkeys; DELETE /me/passkeys/:id removes one.
+func (h *Handler) Passkeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	userID := UserIDFromClaims(ClaimsFromContext(r.Context()))
+	if userID == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+		return
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/me/passkeys"), "/")
+	if id != "" {
+		if methodNotAllowed(w, r, http.MethodDelete) {
+			return
+		}
+		if err := h.svc.DeletePasskey(userID, id); err != nil {
+			if errors.Is(err, ErrPasskeyNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string]string{"error": "passkey not found"})
+				return
+			}
+			slog.Error("delete passkey failed", "handler", "Passkeys", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+			return
+		}
+		h.audit.Record(r, models.AuditEvent{Type: models.AuditPasskeyRemoved, ActorID: userID, UserID: userID, Details: map[string]string{"passkey_id": id}})
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if methodNotAllowed(w, r, http.MethodGet) {
+		return
+	}
+	passkeys, err := h.svc.ListPasskeys(userID)
+	if err != nil {
+		slog.Error("list passkeys failed", "handler", "Passkeys", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"passkeys": passkeys})
+}
+
+// PasskeyLoginBegin handles POST /login/passkey/begin.
+// Returns {"publicKey": {...}}: the options to pass to navigator.credentials.get. No email is needed.
+func (h *Handler) PasskeyLoginBegin(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	opts, err := h.svc.BeginPasskeyLogin()
+	if err != nil {
+		if writePasskeysDisabled(w, err) {
+			return
+		}
+		slog.Error("passkey login begin failed", "handler", "PasskeyLoginBegin", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"publicKey": opts})
+}
+
+// PasskeyLoginFinish handles POST /login/passkey/finish.
+// Body: {"credential": <PublicKeyCredential.toJSON()>, "device_name": "..."}. Responds like Login with the user and a
+// token pair; 2FA is not asked for, since the passkey already verified the user on their device.
+func (h *Handler) PasskeyLoginFinish(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		Credential *PasskeyCredential `json:"credential"`
+		DeviceName string             `json:"device_name"`
+	}
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+	if body.Credential == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "credential required"})
+		return
+	}
+	user, err := h.svc.FinishPasskeyLogin(body.Credential)
+	if err != nil {
+		if writePasskeysDisabled(w, err) {
+			return
+		}
+		switch {
+		case errors.Is(err, ErrPasskeyInvalid):
+			h.recordLoginFailure(r, ErrorUserID(err), "", "passkey", "invalid_passkey")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired passkey response"})
+		case errors.Is(err, ErrEmailNotVerified):
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "email not verified"})
+		default:
+			slog.Error("passkey login failed", "handler", "PasskeyLoginFinish", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		}
+		return
+	}
+	tokens, err := h.svc.IssueTokens(user, time.Now(), h.sessionInfo(r, body.DeviceName))
+	if err != nil {
+		slog.Error("passkey login create token failed", "handler", "PasskeyLoginFinish", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to create token"})
+		return
+	}
+	h.recordLogin(r, user, "passkey")
+	w.Header().Set("Authorization", "Bearer "+tokens.AccessToken)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"user": user, "token": tokens.AccessToken, "refresh_token": tokens.RefreshToken})
+}
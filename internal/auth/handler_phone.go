@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/bilalabsh/zabaan_backend/internal/models"
+)
+
+// writeInvalidPhone writes 400 and returns true if err is ErrInvalidPhone.
+func writeInvalidPhone(w http.ResponseWriter, err error) bool {
+	if !errors.Is(err, ErrInvalidPhone) {
+		return false
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": "invalid phone number"})
+	return true
+}
+
+// PhoneSignupRequest handles POST /signup/phone.
+// Body: {"phone": "+923001234567"}. Texts a signup code and answers 202; 409 if the number already has an account
+// (with ANTI_ENUMERATION, 202 as well, and the owner is texted instead).
+func (h *Handler) PhoneSignupRequest(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		Phone string `json:"phone"`
+	}
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+	if body.Phone == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "phone required"})
+		return
+	}
+	if err := h.svc.RequestPhoneSignup(body.Phone); err != nil {
+		if writeInvalidPhone(w, err) {
+			return
+		}
+		if errors.Is(err, ErrPhoneExists) {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "phone already exists"})
+			return
+		}
+		slog.Error("phone signup request failed", "handler", "PhoneSignupRequest", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "a code has been sent to the phone"})
+}
+
+// PhoneSignupVerify handles POST /signup/phone/verify.
+// Body: {"phone": "...", "code": "123456", "first_name": "...", "last_name": "...", "device_name": "..."}.
+// Creates the account and responds like Signup with the user and a token pair.
+func (h *Handler) PhoneSignupVerify(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		Phone      string `json:"phone"`
+		Code       string `json:"code"`
+		FirstName  string `json:"first_name"`
+		LastName   string `json:"last_name"`
+		DeviceName string `json:"device_name"`
+	}
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+	if body.Phone == "" || body.Code == "" || body.FirstName == "" || body.LastName == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "phone, code, first_name and last_name required"})
+		return
+	}
+	user, err := h.svc.VerifyPhoneSignup(body.Phone, body.Code, body.FirstName, body.LastName)
+	if err != nil {
+		if writeSignUpError(w, err) {
+			return
+		}
+		switch {
+		case errors.Is(err, ErrPhoneCodeInvalid):
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired code"})
+		case errors.Is(err, ErrPhoneExists):
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "phone already exists"})
+		default:
+			slog.Error("phone signup failed", "handler", "PhoneSignupVerify", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		}
+		return
+	}
+	h.audit.Record(r, models.AuditEvent{Type: models.AuditSignup, ActorID: user.ID, UserID: user.ID, Details: map[string]string{"method": "phone"}})
+	tokens, err := h.svc.IssueTokens(user, time.Now(), h.sessionInfo(r, body.DeviceName))
+	if err != nil {
+		slog.Error("phone signup create token failed", "handler", "PhoneSignupVerify", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to create token"})
+		return
+	}
+	w.Header().Set("Authorization", "Bearer "+tokens.AccessToken)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"user": user, "token": tokens.AccessToken, "refresh_token": tokens.RefreshToken})
+}
+
+// PhoneLoginRequest handles POST /login/phone.
+// Body: {"phone": "..."}. Answers 202 for any valid number so the response doesn't reveal whether it has an account.
+func (h *Handler) PhoneLoginRequest(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		Phone string `json:"phone"`
+	}
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+	if body.Phone == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "phone required"})
+		return
+	}
+	if err := h.svc.RequestPhoneLogin(body.Phone); err != nil {
+		if writeInvalidPhone(w, err) {
+			return
+		}
+		slog.Error("phone login request failed", "handler", "PhoneLoginRequest", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "if the phone has an account, a login code has been sent"})
+}
+
+// PhoneLoginVerify handles POST /login/phone/verify.
+// Body: {"phone": "...", "code": "123456", "device_name": "..."}. Responds like Login: the user and a token pair,
+// or an mfa_token when 2FA is enabled.
+func (h *Handler) PhoneLoginVerify(w http.ResponseWriter, r *http.Request) {
+	if methodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		Phone      string `json:"phone"`
+		Code       string `json:"code"`
+		DeviceName string `json:"device_name"`
+	}
+	if !decodeJSONBody(w, r, &body) {
+		return
+	}
+	if body.Phone == "" || body.Code == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "phone and code required"})
+		return
+	}
+	user, err := h.svc.VerifyPhoneLogin(body.Phone, body.Code)
+	if err != nil {
+		if errors.Is(err, ErrPhoneCodeInvalid) {
+			h.recordLoginFailure(r, ErrorUserID(err), "", "phone_code", "invalid_code")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired code"})
+			return
+		}
+		slog.Error("phone login verify failed", "handler", "PhoneLoginVerify", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		return
+	}
+	if user.TwoFactorEnabled {
+		h.writeMFAChallenge(w, user, PurposeMFALogin, "PhoneLoginVerify")
+		return
+	}
+	tokens, err := h.svc.IssueTokens(user, time.Now(), h.sessionInfo(r, body.DeviceName))
+	if err != nil {
+		if errors.Is(err, ErrEmailNotVerified) {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "email not verified"})
+			return
+		}
+		slog.Error("phone login create token failed", "handler", "PhoneLoginVerify", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to create token"})
+		return
+	}
+	h.recordLogin(r, user, "phone_code")
+	w.Header().Set("Authorization", "Bearer "+tokens.AccessToken)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"user": user, "token": tokens.AccessToken, "refresh_token": tokens.RefreshToken})
+}
@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing algorithms.
+const (
+	HashArgon2id = "argon2id"
+	HashBcrypt   = "bcrypt"
+)
+
+// bcryptMaxPasswordBytes is bcrypt's input limit; longer passwords can only be hashed with argon2id.
+const bcryptMaxPasswordBytes = 72
+
+// PasswordHasher hashes passwords into self-describing encoded strings (algorithm and parameters included),
+// so hashes made with older settings keep verifying after the configuration changes.
+type PasswordHasher interface {
+	// Hash returns the encoded hash of password using the configured algorithm and parameters.
+	Hash(password string) (string, error)
+	// Verify reports whether password matches the encoded hash, whatever algorithm produced it.
+	Verify(encoded, password string) (bool, error)
+	// NeedsRehash reports whether encoded was made with a different algorithm or parameters than Hash would use.
+	NeedsRehash(encoded string) bool
+}
+
+// HasherConfig selects the algorithm used for new hashes and its parameters.
+type HasherConfig struct {
+	Algorithm         string // HashArgon2id or HashBcrypt
+	BcryptCost        int
+	Argon2Memory      uint32 // KiB
+	Argon2Iterations  uint32
+	Argon2Parallelism uint8
+}
+
+// argon2Params are the parameters of an argon2id hash.
+type argon2Params struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	saltLength  int
+	keyLength   uint32
+}
+
+// passwordHasher implements PasswordHasher for argon2id and bcrypt.
+type passwordHasher struct {
+	algorithm  string
+	bcryptCost int
+	argon2     argon2Params
+}
+
+// NewPasswordHasher returns a hasher that creates hashes per cfg and verifies argon2id and bcrypt hashes.
+func NewPasswordHasher(cfg HasherConfig) (PasswordHasher, error) {
+	h := &passwordHasher{
+		algorithm:  cfg.Algorithm,
+		bcryptCost: cfg.BcryptCost,
+		argon2: argon2Params{
+			memory:      cfg.Argon2Memory,
+			iterations:  cfg.Argon2Iterations,
+			parallelism: cfg.Argon2Parallelism,
+			saltLength:  16,
+			keyLength:   32,
+		},
+	}
+	switch cfg.Algorithm {
+	case HashBcrypt:
+		if cfg.BcryptCost < bcrypt.MinCost || cfg.BcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case HashArgon2id:
+		if cfg.Argon2Memory < 8*uint32(cfg.Argon2Parallelism) || cfg.Argon2Iterations < 1 || cfg.Argon2Parallelism < 1 {
+			return nil, errors.New("argon2id needs iterations >= 1, parallelism >= 1 and memory >= 8*parallelism KiB")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported password hash algorithm %q", cfg.Algorithm)
+	}
+	return h, nil
+}
+
+func (h *passwordHasher) Hash(password string) (string, error) {
+	if h.algorithm == HashBcrypt {
+		if len(password) > bcryptMaxPasswordBytes {
+			return "", ErrPasswordTooLong
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.bcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	}
+	salt := make([]byte, h.argon2.saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	p := h.argon2
+	key := argon2.IDKey([]byte(password), salt, p.iterations, p.memory, p.parallelism, p.keyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.memory, p.iterations, p.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h *passwordHasher) Verify(encoded, password string) (bool, error) {
+	if isBcryptHash(encoded) {
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	p, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, p.iterations, p.memory, p.parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h *passwordHasher) NeedsRehash(encoded string) bool {
+	if h.algorithm == HashBcrypt {
+		cost, err := bcrypt.Cost([]byte(encoded))
+		return err != nil || cost != h.bcryptCost
+	}
+	p, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	want := h.argon2
+	return p.memory != want.memory || p.iterations != want.iterations || p.parallelism != want.parallelism ||
+		len(salt) != want.saltLength || uint32(len(key)) != want.keyLength
+}
+
+func isBcryptHash(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+// decodeArgon2id parses "$argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>" (PHC string format, unpadded base64).
+func decodeArgon2id(encoded string) (argon2Params, []byte, []byte, error) {
+	var p argon2Params
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != HashArgon2id {
+		return p, nil, nil, errors.New("unrecognized password hash format")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, errors.New("unsupported argon2 version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.iterations, &p.parallelism); err != nil {
+		return p, nil, nil, fmt.Errorf("invalid argon2 parameters: %w", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, err
+	}
+	if p.iterations < 1 || p.parallelism < 1 || len(key) == 0 {
+		return p, nil, nil, errors.New("invalid argon2 parameters")
+	}
+	p.saltLength = len(salt)
+	p.keyLength = uint32(len(key))
+	return p, salt, key, nil
+}
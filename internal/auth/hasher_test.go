@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testArgon2 keeps argon2id cheap for tests.
+var testArgon2 = HasherConfig{Algorithm: HashArgon2id, Argon2Memory: 64, Argon2Iterations: 1, Argon2Parallelism: 1}
+
+func newTestHasher(t *testing.T, cfg HasherConfig) PasswordHasher {
+	t.Helper()
+	h, err := NewPasswordHasher(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestPasswordHasher(t *testing.T) {
+	for name, cfg := range map[string]HasherConfig{
+		"bcrypt":   {Algorithm: HashBcrypt, BcryptCost: 4},
+		"argon2id": testArgon2,
+	} {
+		t.Run(name, func(t *testing.T) {
+			h := newTestHasher(t, cfg)
+			hash, err := h.Hash("Correct horse battery 9")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok, err := h.Verify(hash, "Correct horse battery 9"); !ok || err != nil {
+				t.Fatalf("Verify(right password) = %v, %v", ok, err)
+			}
+			if ok, err := h.Verify(hash, "Correct horse battery 8"); ok || err != nil {
+				t.Fatalf("Verify(wrong password) = %v, %v", ok, err)
+			}
+			if h.NeedsRehash(hash) {
+				t.Fatal("NeedsRehash of a fresh hash = true")
+			}
+			if other, _ := h.Hash("Correct horse battery 9"); other == hash {
+				t.Fatal("two hashes of a password are equal; the salt is missing")
+			}
+		})
+	}
+}
+
+func TestPasswordHasherNeedsRehash(t *testing.T) {
+	bcrypt4 := newTestHasher(t, HasherConfig{Algorithm: HashBcrypt, BcryptCost: 4})
+	argon := newTestHasher(t, testArgon2)
+	bcryptHash, err := bcrypt4.Hash("Correct horse battery 9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	argonHash, err := argon.Hash("Correct horse battery 9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(argonHash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("argon2id hash = %s", argonHash)
+	}
+
+	// Either hasher verifies the other's hashes, so switching algorithms keeps passwords working.
+	if ok, err := argon.Verify(bcryptHash, "Correct horse battery 9"); !ok || err != nil {
+		t.Fatalf("argon2id hasher Verify(bcrypt hash) = %v, %v", ok, err)
+	}
+	if ok, err := bcrypt4.Verify(argonHash, "Correct horse battery 9"); !ok || err != nil {
+		t.Fatalf("bcrypt hasher Verify(argon2id hash) = %v, %v", ok, err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		hasher PasswordHasher
+		hash   string
+	}{
+		{"bcrypt to argon2id", argon, bcryptHash},
+		{"argon2id to bcrypt", bcrypt4, argonHash},
+		{"bcrypt cost", newTestHasher(t, HasherConfig{Algorithm: HashBcrypt, BcryptCost: 5}), bcryptHash},
+		{"argon2id memory", newTestHasher(t, HasherConfig{Algorithm: HashArgon2id, Argon2Memory: 128, Argon2Iterations: 1, Argon2Parallelism: 1}), argonHash},
+		{"argon2id iterations", newTestHasher(t, HasherConfig{Algorithm: HashArgon2id, Argon2Memory: 64, Argon2Iterations: 2, Argon2Parallelism: 1}), argonHash},
+		{"unrecognized hash", argon, "plaintext"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if !tc.hasher.NeedsRehash(tc.hash) {
+				t.Fatal("NeedsRehash = false, want true")
+			}
+		})
+	}
+}
+
+func TestPasswordHasherRejects(t *testing.T) {
+	if _, err := newTestHasher(t, HasherConfig{Algorithm: HashBcrypt, BcryptCost: 4}).Hash(strings.Repeat("a", bcryptMaxPasswordBytes+1)); !errors.Is(err, ErrPasswordTooLong) {
+		t.Fatalf("bcrypt Hash(73 bytes) err = %v, want ErrPasswordTooLong", err)
+	}
+	if _, err := newTestHasher(t, testArgon2).Hash(strings.Repeat("a", bcryptMaxPasswordBytes+1)); err != nil {
+		t.Fatalf("argon2id Hash(73 bytes): %v", err)
+	}
+	if ok, err := newTestHasher(t, testArgon2).Verify("$argon2id$v=19$m=64,t=0,p=1$c2FsdA$a2V5", "password"); ok || err == nil {
+		t.Fatalf("Verify(zero iterations) = %v, %v, want an error", ok, err)
+	}
+	for _, cfg := range []HasherConfig{
+		{Algorithm: HashBcrypt, BcryptCost: 3},
+		{Algorithm: HashArgon2id, Argon2Memory: 4, Argon2Iterations: 1, Argon2Parallelism: 1},
+		{Algorithm: "md5"},
+	} {
+		if _, err := NewPasswordHasher(cfg); err == nil {
+			t.Errorf("NewPasswordHasher(%+v) succeeded", cfg)
+		}
+	}
+}
+
+// A successful login moves the hash to the configured algorithm; the password keeps working.
+func TestLoginRehashesPassword(t *testing.T) {
+	svc, users, _ := newTestService(t, nil)
+	const email, password = "learner@example.test", "Correct horse battery 9"
+	u, err := svc.SignUp("Learner", "", email, password)
+	if err != nil {
+		t.Fatalf("SignUp: %v", err)
+	}
+	if hash, _ := users.GetPasswordHash(u.ID); !isBcryptHash(hash) {
+		t.Fatalf("hash after SignUp = %s, want bcrypt", hash)
+	}
+
+	svc.hasher = newTestHasher(t, testArgon2)
+	if _, err := svc.Login(email, "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("Login err = %v, want ErrInvalidCredentials", err)
+	}
+	if hash, _ := users.GetPasswordHash(u.ID); !isBcryptHash(hash) {
+		t.Fatalf("hash after a failed login = %s, want it unchanged", hash)
+	}
+	if _, err := svc.Login(email, password); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if hash, _ := users.GetPasswordHash(u.ID); !strings.HasPrefix(hash, "$argon2id$") {
+		t.Fatalf("hash after login = %s, want argon2id", hash)
+	}
+	if _, err := svc.Login(email, password); err != nil {
+		t.Fatalf("Login after the rehash: %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bilalabsh/zabaan_backend/internal/models"
+)
+
+// ErrCannotImpersonate is returned when an admin tries to impersonate themselves or another admin.
+var ErrCannotImpersonate = errors.New("user cannot be impersonated")
+
+// ErrUserNotFound is returned when the user to impersonate doesn't exist.
+var ErrUserNotFound = errors.New("user not found")
+
+// Actor is the "act" claim (RFC 8693): who is acting on behalf of the token's subject.
+type Actor struct {
+	Subject string `json:"sub"`
+}
+
+// ImpersonatorID returns the id of the admin acting through claims, or 0 if they aren't from an impersonation token.
+func ImpersonatorID(claims *Claims) uint {
+	if claims == nil || claims.Actor == nil {
+		return 0
+	}
+	var id uint
+	_, _ = fmt.Sscanf(claims.Actor.Subject, "%d", &id)
+	return id
+}
+
+// Impersonate issues an access token for the user with the admin as actor, so support can see what the user sees.
+// The token lives for ImpersonationExpiry, has no session or refresh token, and stops working when either the
+// user's or the admin's tokens are revoked. Admins can't be impersonated, so it never grants more than the admin has.
+func (s *Service) Impersonate(admin *Claims, userID uint) (*models.User, string, time.Time, error) {
+	adminID := UserIDFromClaims(admin)
+	if adminID == userID {
+		return nil, "", time.Time{}, ErrCannotImpersonate
+	}
+	u, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, "", time.Time{}, ErrUserNotFound
+		}
+		return nil, "", time.Time{}, err
+	}
+	for _, role := range u.Roles {
+		if role == models.RoleAdmin {
+			return nil, "", time.Time{}, ErrCannotImpersonate
+		}
+	}
+	now := time.Now()
+	claims := NewClaims(u.ID, u.Email, now, s.impersonationExpiry)
+	claims.EmailVerified = u.EmailVerified
+	claims.PhoneVerified = u.Phone != ""
+	claims.Roles = u.Roles
+	claims.Guest = u.IsGuest
+	claims.Actor = &Actor{Subject: fmt.Sprintf("%d", adminID)}
+	token, err := SignToken(s.keys, claims)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	return u, token, claims.ExpiresAt.Time, nil
+}
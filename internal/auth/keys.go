@@ -0,0 +1,359 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Supported JWT signing algorithms.
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// KeyConfig describes where signing and verification keys come from.
+type KeyConfig struct {
+	Algorithm      string   // HS256 (shared secret), RS256 or EdDSA (PEM private key)
+	Secret         string   // HS256 only
+	PrivateKeyFile string   // RS256/EdDSA: PEM private key used to sign new tokens
+	KeyID          string   // kid of the signing key; derived from the public key (RFC 7638 thumbprint) when empty
+	VerifyKeyFiles []string // extra PEM public keys still accepted during rotation, as "path" or "kid=path"
+	LegacySecret   string   // RS256/EdDSA: HS256 secret still accepted (tokens without a kid) after switching from HS256
+}
+
+// verificationKey is a key that may verify tokens with a given kid.
+type verificationKey struct {
+	method jwt.SigningMethod
+	key    interface{}
+	public crypto.PublicKey // nil for HMAC secrets, which are never published
+}
+
+// KeySet signs tokens with one active key and verifies tokens signed by any of its keys (looked up by the "kid" header).
+// Single-purpose tokens (see SignPurposeToken) use purposeKey instead, an HMAC key derived from the signing key.
+type KeySet struct {
+	method     jwt.SigningMethod
+	keyID      string
+	signKey    interface{}
+	verify     map[string]verificationKey
+	purposeKey []byte
+}
+
+// purposeKeyLabel separates the purpose token key from the key material it is derived from.
+const purposeKeyLabel = "zabaan purpose tokens v1"
+
+// derivePurposeKey returns the HMAC key of single-purpose tokens for the given secret key material. It stays on the
+// server: services that verify access tokens with the JWKS can't verify (and so can't accept) purpose tokens.
+func derivePurposeKey(secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purposeKeyLabel))
+	return mac.Sum(nil)
+}
+
+// NewHMACKeySet returns a key set that signs and verifies HS256 tokens with a shared secret.
+func NewHMACKeySet(secret string) (*KeySet, error) {
+	if secret == "" {
+		return nil, errors.New("JWT secret is empty")
+	}
+	key := []byte(secret)
+	return &KeySet{
+		method:     jwt.SigningMethodHS256,
+		signKey:    key,
+		verify:     map[string]verificationKey{"": {method: jwt.SigningMethodHS256, key: key}},
+		purposeKey: derivePurposeKey(key),
+	}, nil
+}
+
+// LoadKeySet builds a key set from cfg, reading PEM files for asymmetric algorithms.
+func LoadKeySet(cfg KeyConfig) (*KeySet, error) {
+	alg := cfg.Algorithm
+	if alg == "" {
+		alg = AlgHS256
+	}
+	if alg == AlgHS256 {
+		return NewHMACKeySet(cfg.Secret)
+	}
+	if alg != AlgRS256 && alg != AlgEdDSA {
+		return nil, fmt.Errorf("unsupported JWT signing algorithm %q", alg)
+	}
+	if cfg.PrivateKeyFile == "" {
+		return nil, fmt.Errorf("%s requires a private key file", alg)
+	}
+	block, err := readPEM(cfg.PrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := parsePrivateKey(block)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cfg.PrivateKeyFile, err)
+	}
+	pub := priv.(crypto.Signer).Public()
+	method, err := methodForKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cfg.PrivateKeyFile, err)
+	}
+	if method.Alg() != alg {
+		return nil, fmt.Errorf("%s: key type does not match algorithm %s", cfg.PrivateKeyFile, alg)
+	}
+	kid := cfg.KeyID
+	if kid == "" {
+		if kid, err = thumbprint(pub); err != nil {
+			return nil, err
+		}
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cfg.PrivateKeyFile, err)
+	}
+	ks := &KeySet{
+		method:     method,
+		keyID:      kid,
+		signKey:    priv,
+		verify:     map[string]verificationKey{kid: {method: method, key: pub, public: pub}},
+		purposeKey: derivePurposeKey(der),
+	}
+	for _, entry := range cfg.VerifyKeyFiles {
+		if err := ks.addVerifyKeyFile(entry); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.LegacySecret != "" {
+		// HS256 tokens have no kid, and the signing and rotation keys always have one. Verify-only and unpublished.
+		ks.verify[""] = verificationKey{method: jwt.SigningMethodHS256, key: []byte(cfg.LegacySecret)}
+	}
+	return ks, nil
+}
+
+// addVerifyKeyFile adds a PEM public key (or certificate) given as "path" or "kid=path".
+func (ks *KeySet) addVerifyKeyFile(entry string) error {
+	entry = strings.TrimSpace(entry)
+	if entry == "" {
+		return nil
+	}
+	kid, path := "", entry
+	if i := strings.Index(entry, "="); i >= 0 {
+		kid, path = entry[:i], entry[i+1:]
+	}
+	block, err := readPEM(path)
+	if err != nil {
+		return err
+	}
+	pub, err := parsePublicKey(block)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	method, err := methodForKey(pub)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if kid == "" {
+		if kid, err = thumbprint(pub); err != nil {
+			return err
+		}
+	}
+	if _, exists := ks.verify[kid]; exists {
+		return fmt.Errorf("%s: duplicate key id %q", path, kid)
+	}
+	ks.verify[kid] = verificationKey{method: method, key: pub, public: pub}
+	return nil
+}
+
+// Sign signs the claims with the active key and sets the "kid" header.
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.method, claims)
+	if ks.keyID != "" {
+		token.Header["kid"] = ks.keyID
+	}
+	return token.SignedString(ks.signKey)
+}
+
+// SignPurpose signs single-purpose claims with the purpose key, typed PurposeTokenType.
+func (ks *KeySet) SignPurpose(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["typ"] = PurposeTokenType
+	return token.SignedString(ks.purposeKey)
+}
+
+// purposeKeyFunc returns the purpose key for tokens typed PurposeTokenType.
+func (ks *KeySet) purposeKeyFunc(t *jwt.Token) (interface{}, error) {
+	if typ, _ := t.Header["typ"].(string); typ != PurposeTokenType {
+		return nil, errors.New("not a purpose token")
+	}
+	return ks.purposeKey, nil
+}
+
+// keyFunc returns the verification key for the token's kid, rejecting algorithm mismatches and purpose tokens.
+func (ks *KeySet) keyFunc(t *jwt.Token) (interface{}, error) {
+	if typ, _ := t.Header["typ"].(string); typ == PurposeTokenType {
+		return nil, errors.New("purpose token")
+	}
+	kid, _ := t.Header["kid"].(string)
+	vk, ok := ks.verify[kid]
+	if !ok {
+		return nil, errors.New("unknown key id")
+	}
+	if t.Method.Alg() != vk.method.Alg() {
+		return nil, errors.New("invalid signing method")
+	}
+	return vk.key, nil
+}
+
+// JWK is a public key in JSON Web Key format.
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public verification keys. HMAC secrets are never included, so an HS256 key set publishes no keys.
+func (ks *KeySet) JWKS() JWKS {
+	set := JWKS{Keys: []JWK{}}
+	kids := make([]string, 0, len(ks.verify))
+	for kid := range ks.verify {
+		kids = append(kids, kid)
+	}
+	// Active signing key first, then the rotation keys in a stable order.
+	sort.Slice(kids, func(i, j int) bool {
+		if (kids[i] == ks.keyID) != (kids[j] == ks.keyID) {
+			return kids[i] == ks.keyID
+		}
+		return kids[i] < kids[j]
+	})
+	for _, kid := range kids {
+		vk := ks.verify[kid]
+		if vk.public == nil {
+			continue
+		}
+		jwk := publicJWK(vk.public)
+		jwk.Use = "sig"
+		jwk.Alg = vk.method.Alg()
+		jwk.Kid = kid
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+func publicJWK(pub crypto.PublicKey) JWK {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+		}
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Crv: "Ed25519", X: base64.RawURLEncoding.EncodeToString(k)}
+	}
+	return JWK{}
+}
+
+// thumbprint returns the RFC 7638 JWK thumbprint of the key, used as a stable default kid.
+func thumbprint(pub crypto.PublicKey) (string, error) {
+	jwk := publicJWK(pub)
+	var canonical []byte
+	var err error
+	switch jwk.Kty {
+	case "RSA":
+		canonical, err = json.Marshal(struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N})
+	case "OKP":
+		canonical, err = json.Marshal(struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X})
+	default:
+		return "", errors.New("unsupported key type")
+	}
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func methodForKey(pub crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < 2048 {
+			return nil, errors.New("RSA key must be at least 2048 bits")
+		}
+		return jwt.SigningMethodRS256, nil
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA, nil
+	}
+	return nil, errors.New("unsupported key type (want RSA or Ed25519)")
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	return block, nil
+}
+
+func parsePrivateKey(block *pem.Block) (crypto.PrivateKey, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := key.(crypto.Signer); !ok {
+			return nil, errors.New("unsupported private key type")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+func parsePublicKey(block *pem.Block) (crypto.PublicKey, error) {
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
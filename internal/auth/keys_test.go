@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// writeEd25519Key writes a new PEM private key to dir and returns its path and public key.
+func writeEd25519Key(t *testing.T, dir string) (string, ed25519.PublicKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "signing.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path, pub
+}
+
+func TestPurposeTokensAreNotAccessTokens(t *testing.T) {
+	hmacKeys, err := NewHMACKeySet("test-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, pub := writeEd25519Key(t, t.TempDir())
+	edKeys, err := LoadKeySet(KeyConfig{Algorithm: AlgEdDSA, PrivateKeyFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, keys := range map[string]*KeySet{"HS256": hmacKeys, "EdDSA": edKeys} {
+		t.Run(name, func(t *testing.T) {
+			claims := NewClaims(7, "learner@example.test", time.Now(), time.Minute)
+			claims.Purpose = PurposeMFALogin
+			token, err := SignPurposeToken(keys, claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ValidatePurposeToken(keys, token, PurposeMFALogin, PurposeMFAGetToken)
+			if err != nil || got.Purpose != PurposeMFALogin || UserIDFromClaims(got) != 7 {
+				t.Fatalf("ValidatePurposeToken = %+v, %v", got, err)
+			}
+			if _, err := ValidatePurposeToken(keys, token, PurposeVerifyEmail); !errors.Is(err, ErrTokenInvalid) {
+				t.Fatalf("ValidatePurposeToken for another purpose: err = %v, want ErrTokenInvalid", err)
+			}
+			if _, err := ValidateToken(keys, token); !errors.Is(err, ErrTokenInvalid) {
+				t.Fatalf("ValidateToken(purpose token): err = %v, want ErrTokenInvalid", err)
+			}
+
+			access, err := CreateToken(keys, 7, "learner@example.test", time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ValidateToken(keys, access); err != nil {
+				t.Fatalf("ValidateToken(access token): %v", err)
+			}
+			if _, err := ValidatePurposeToken(keys, access, PurposeMFALogin); !errors.Is(err, ErrTokenInvalid) {
+				t.Fatalf("ValidatePurposeToken(access token): err = %v, want ErrTokenInvalid", err)
+			}
+		})
+	}
+
+	// A service verifying access tokens with the published key can't verify a purpose token.
+	if len(edKeys.JWKS().Keys) != 1 {
+		t.Fatalf("JWKS = %+v, want the signing key only", edKeys.JWKS())
+	}
+	claims := NewClaims(7, "learner@example.test", time.Now(), time.Minute)
+	claims.Purpose = PurposeVerifyEmail
+	token, err := SignPurposeToken(edKeys, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jwt.Parse(token, func(*jwt.Token) (interface{}, error) { return pub, nil }); err == nil {
+		t.Fatal("purpose token verified with the public key")
+	}
+}
+
+func TestSignPurposeTokenRequiresPurpose(t *testing.T) {
+	keys, err := NewHMACKeySet("test-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SignPurposeToken(keys, NewClaims(7, "", time.Now(), time.Minute)); err == nil {
+		t.Fatal("SignPurposeToken without a purpose succeeded")
+	}
+}
+
+// After switching from HS256, tokens signed with the old secret keep verifying, and the secret is not published.
+func TestLegacySecretAfterSwitch(t *testing.T) {
+	oldKeys, err := NewHMACKeySet("old-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldToken, err := CreateToken(oldKeys, 7, "learner@example.test", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, _ := writeEd25519Key(t, t.TempDir())
+	keys, err := LoadKeySet(KeyConfig{Algorithm: AlgEdDSA, PrivateKeyFile: path, LegacySecret: "old-secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateToken(keys, oldToken); err != nil {
+		t.Fatalf("ValidateToken(token signed before the switch): %v", err)
+	}
+	newToken, err := CreateToken(keys, 7, "learner@example.test", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateToken(keys, newToken); err != nil {
+		t.Fatalf("ValidateToken(new token): %v", err)
+	}
+	if n := len(keys.JWKS().Keys); n != 1 {
+		t.Fatalf("JWKS has %d keys, want the signing key only", n)
+	}
+
+	otherKeys, err := NewHMACKeySet("other-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := CreateToken(otherKeys, 7, "learner@example.test", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateToken(keys, forged); !errors.Is(err, ErrTokenInvalid) {
+		t.Fatalf("ValidateToken(other secret): err = %v, want ErrTokenInvalid", err)
+	}
+	withoutLegacy, err := LoadKeySet(KeyConfig{Algorithm: AlgEdDSA, PrivateKeyFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateToken(withoutLegacy, oldToken); !errors.Is(err, ErrTokenInvalid) {
+		t.Fatalf("ValidateToken without LegacySecret: err = %v, want ErrTokenInvalid", err)
+	}
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// ErrAccountLocked is returned by Login while an email is locked after too many failed attempts.
+// The concrete error is a *LockedError carrying how long to wait.
+var ErrAccountLocked = errors.New("account temporarily locked")
+
+// LockedError is returned by Login for a locked email. errors.Is(err, ErrAccountLocked) is true.
+type LockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrAccountLocked, e.RetryAfter.Round(time.Second))
+}
+
+func (e *LockedError) Is(target error) bool { return target == ErrAccountLocked }
+
+// LockoutPolicy configures per-account login lockout. Counting is per normalized email, so it also covers
+// emails without an account and attacks spread over many IPs (which AuthRateLimiter can't see).
+type LockoutPolicy struct {
+	Threshold int           // attempts without a successful login before the first lock; 0 disables lockout
+	BaseDelay time.Duration // first lock; doubles with every further attempt
+	MaxDelay  time.Duration // upper bound of a lock
+	Window    time.Duration // attempts older than this are forgotten
+}
+
+// reserveLoginAttempt counts a login attempt for the email (or currentPasswordKey) before the password is checked, and returns a
+// *LockedError without counting while the email is locked. The attempt that reaches the threshold locks the email;
+// each one past it doubles the lock, up to MaxDelay. A successful login clears the count (resetLoginAttempts).
+func (s *Service) reserveLoginAttempt(email string) error {
+	if s.lockout.Threshold <= 0 {
+		return nil
+	}
+	now := time.Now()
+	p := s.lockout
+	ok, until, err := s.tokenRepo.ReserveLoginAttempt(email, p.Threshold, p.BaseDelay, p.MaxDelay, now, now.Add(-p.Window))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &LockedError{RetryAfter: until.Sub(now)}
+	}
+	return nil
+}
+
+// currentPasswordKey is the login_attempts key counting current-password checks of a user. It can't be an email,
+// which always contains an @.
+func currentPasswordKey(userID uint) string {
+	return "user:" + strconv.FormatUint(uint64(userID), 10)
+}
+
+// checkCurrentPassword checks the password of a signed-in user (POST /me/password, /me/email). Returns
+// ErrInvalidCredentials if it is wrong or the account has none. Checks are counted per user like Login attempts,
+// so a stolen access token can't be used to guess the password; while locked, a *LockedError is returned.
+func (s *Service) checkCurrentPassword(userID uint, password string) error {
+	key := currentPasswordKey(userID)
+	if err := s.reserveLoginAttempt(key); err != nil {
+		return err
+	}
+	hash, err := s.userRepo.GetPasswordHash(userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidCredentials
+		}
+		return err
+	}
+	if hash == "" {
+		return ErrInvalidCredentials
+	}
+	ok, err := s.hasher.Verify(hash, password)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidCredentials
+	}
+	s.resetLoginAttempts(key)
+	return nil
+}
+
+// resetLoginAttempts clears the attempt count of the email or currentPasswordKey (after a successful login or
+// password reset, or a correct current password).
+func (s *Service) resetLoginAttempts(email string) {
+	if s.lockout.Threshold <= 0 {
+		return
+	}
+	if err := s.tokenRepo.ResetLoginAttempts(email); err != nil {
+		slog.Error("resetting login attempts failed", "component", "auth", "err", err)
+	}
+}
+
+// PruneLoginAttempts deletes login attempt counts that have aged out of the window, and second-factor counts whose
+// window is over. Returns the number removed.
+func (s *Service) PruneLoginAttempts() (int64, error) {
+	now := time.Now()
+	n, err := s.tokenRepo.DeleteStaleMFAAttempts(now.Add(-mfaAttemptWindow))
+	if err != nil || s.lockout.Threshold <= 0 {
+		return n, err
+	}
+	m, err := s.tokenRepo.DeleteStaleLoginAttempts(now.Add(-s.lockout.Window), now)
+	return n + m, err
+}
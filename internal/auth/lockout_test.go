@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingHasher counts password checks.
+type countingHasher struct {
+	PasswordHasher
+	verifies atomic.Int32
+}
+
+func (h *countingHasher) Verify(encoded, password string) (bool, error) {
+	h.verifies.Add(1)
+	return h.PasswordHasher.Verify(encoded, password)
+}
+
+var testLockout = LockoutPolicy{Threshold: 3, BaseDelay: time.Minute, MaxDelay: 4 * time.Minute, Window: time.Hour}
+
+func TestLoginLockout(t *testing.T) {
+	svc, _, tokens := newTestService(t, func(o *Options) { o.Lockout = testLockout })
+	const email, password = "learner@example.test", "Correct horse battery 9"
+	if _, err := svc.SignUp("Learner", "", email, password); err != nil {
+		t.Fatalf("SignUp: %v", err)
+	}
+
+	// A success before the threshold clears the count.
+	if _, err := svc.Login(email, "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("Login err = %v, want ErrInvalidCredentials", err)
+	}
+	if _, err := svc.Login(email, password); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if n := tokens.loginAttempts(email); n != 0 {
+		t.Fatalf("login attempts after success = %d, want 0", n)
+	}
+
+	for i := 0; i < testLockout.Threshold; i++ {
+		if _, err := svc.Login(email, "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+			t.Fatalf("Login %d err = %v, want ErrInvalidCredentials", i+1, err)
+		}
+	}
+	// Locked: even the right password is refused, without counting.
+	var locked *LockedError
+	if _, err := svc.Login(email, password); !errors.As(err, &locked) || !errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("Login err = %v, want a LockedError", err)
+	}
+	if locked.RetryAfter <= 0 || locked.RetryAfter > testLockout.BaseDelay {
+		t.Fatalf("RetryAfter = %s, want at most %s", locked.RetryAfter, testLockout.BaseDelay)
+	}
+	if n := tokens.loginAttempts(email); n != testLockout.Threshold {
+		t.Fatalf("login attempts = %d, want %d", n, testLockout.Threshold)
+	}
+
+	// Each attempt after the lock ends doubles the next lock, up to MaxDelay.
+	for _, want := range []time.Duration{2 * time.Minute, 4 * time.Minute, 4 * time.Minute} {
+		tokens.expireLoginLock(email)
+		if _, err := svc.Login(email, "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+			t.Fatalf("Login err = %v, want ErrInvalidCredentials", err)
+		}
+		if _, err := svc.Login(email, password); !errors.As(err, &locked) {
+			t.Fatalf("Login err = %v, want a LockedError", err)
+		}
+		if locked.RetryAfter <= want-time.Minute || locked.RetryAfter > want {
+			t.Fatalf("RetryAfter = %s, want about %s", locked.RetryAfter, want)
+		}
+	}
+
+	tokens.expireLoginLock(email)
+	if _, err := svc.Login(email, password); err != nil {
+		t.Fatalf("Login after the lock: %v", err)
+	}
+	if n := tokens.loginAttempts(email); n != 0 {
+		t.Fatalf("login attempts after success = %d, want 0", n)
+	}
+}
+
+// Parallel guesses are counted before the password is checked, so no more than Threshold of them get checked.
+func TestLoginLockoutParallel(t *testing.T) {
+	hasher := &countingHasher{}
+	svc, _, _ := newTestService(t, func(o *Options) {
+		o.Lockout = testLockout
+		hasher.PasswordHasher = o.Hasher
+		o.Hasher = hasher
+	})
+	const email = "learner@example.test"
+	if _, err := svc.SignUp("Learner", "", email, "Correct horse battery 9"); err != nil {
+		t.Fatalf("SignUp: %v", err)
+	}
+
+	const guesses = 20
+	var wg sync.WaitGroup
+	var lockedCount atomic.Int32
+	for i := 0; i < guesses; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := svc.Login(email, "wrong")
+			if errors.Is(err, ErrAccountLocked) {
+				lockedCount.Add(1)
+			} else if !errors.Is(err, ErrInvalidCredentials) {
+				t.Errorf("Login err = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := hasher.verifies.Load(); n != int32(testLockout.Threshold) {
+		t.Fatalf("password checks = %d, want %d", n, testLockout.Threshold)
+	}
+	if n := lockedCount.Load(); n != guesses-int32(testLockout.Threshold) {
+		t.Fatalf("locked answers = %d, want %d", n, guesses-testLockout.Threshold)
+	}
+}
+
+// Current-password checks (POST /me/password, /me/email) are counted per user, apart from the email's logins.
+func TestCheckCurrentPasswordLockout(t *testing.T) {
+	svc, _, tokens := newTestService(t, func(o *Options) { o.Lockout = testLockout })
+	const email, password = "learner@example.test", "Correct horse battery 9"
+	u, err := svc.SignUp("Learner", "", email, password)
+	if err != nil {
+		t.Fatalf("SignUp: %v", err)
+	}
+	if err := svc.checkCurrentPassword(u.ID, "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("checkCurrentPassword err = %v, want ErrInvalidCredentials", err)
+	}
+	if err := svc.checkCurrentPassword(u.ID, password); err != nil {
+		t.Fatalf("checkCurrentPassword: %v", err)
+	}
+	if n := tokens.loginAttempts(currentPasswordKey(u.ID)); n != 0 {
+		t.Fatalf("attempts after success = %d, want 0", n)
+	}
+
+	for i := 0; i < testLockout.Threshold; i++ {
+		if err := svc.checkCurrentPassword(u.ID, "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+			t.Fatalf("checkCurrentPassword %d err = %v, want ErrInvalidCredentials", i+1, err)
+		}
+	}
+	if err := svc.checkCurrentPassword(u.ID, password); !errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("checkCurrentPassword err = %v, want ErrAccountLocked", err)
+	}
+	if n := tokens.loginAttempts(email); n != 0 {
+		t.Fatalf("login attempts of the email = %d, want 0", n)
+	}
+	if _, err := svc.Login(email, password); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/bilalabsh/zabaan_backend/internal/models"
+)
+
+// Purpose claims of the short-lived tokens that stand in for a password-verified login until the second factor is checked.
+// The flow is kept in the token so /login/2fa finishes the same way the first step would have (GetToken revokes other tokens).
+const (
+	PurposeMFALogin    = "mfa_login"
+	PurposeMFAGetToken = "mfa_get_token"
+)
+
+const mfaTokenExpiry = 5 * time.Minute
+
+// maxMFAAttempts second-factor codes can be tried per user in mfaAttemptWindow, whatever mfa_token they come with.
+const maxMFAAttempts = 5
+const mfaAttemptWindow = 15 * time.Minute
+const recoveryCodeCount = 10
+
+// ErrTOTPAlreadyEnabled is returned when setting up 2FA for an account that already has it enabled.
+var ErrTOTPAlreadyEnabled = errors.New("two-factor authentication already enabled")
+
+// ErrTOTPNotSetUp is returned when confirming 2FA before calling setup.
+var ErrTOTPNotSetUp = errors.New("two-factor authentication not set up")
+
+// ErrInvalidMFACode is returned when a TOTP or recovery code is wrong, expired, or already used.
+var ErrInvalidMFACode = errors.New("invalid two-factor code")
+
+// ErrMFATokenInvalid is returned when an mfa_token is malformed, expired, already used, or has seen too many wrong codes.
+var ErrMFATokenInvalid = errors.New("invalid mfa token")
+
+// SetupTOTP stores a new pending TOTP secret and returns it with its otpauth:// URI. 2FA stays off until ConfirmTOTP.
+func (s *Service) SetupTOTP(userID uint) (secret, uri string, err error) {
+	u, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return "", "", err
+	}
+	if u.TwoFactorEnabled {
+		return "", "", ErrTOTPAlreadyEnabled
+	}
+	secret, err = newTOTPSecret()
+	if err != nil {
+		return "", "", err
+	}
+	if err := s.userRepo.SetPendingTOTPSecret(userID, secret); err != nil {
+		return "", "", err
+	}
+	account := u.Email
+	if account == "" {
+		account = u.Username
+	}
+	return secret, totpURI(secret, account), nil
+}
+
+// ConfirmTOTP enables 2FA once the user proves their authenticator works, and returns one-time recovery codes.
+// The codes are only shown here; just their hashes are stored.
+func (s *Service) ConfirmTOTP(userID uint, code string) ([]string, error) {
+	secret, enabled, lastStep, err := s.userRepo.GetTOTP(userID)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+	if secret == "" {
+		return nil, ErrTOTPNotSetUp
+	}
+	step, ok := verifyTOTP(secret, code, time.Now(), lastStep)
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+	if _, err := s.userRepo.UpdateTOTPLastStep(userID, step); err != nil {
+		return nil, err
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if err := s.tokenRepo.ReplaceRecoveryCodes(userID, hashes, now); err != nil {
+		return nil, err
+	}
+	if err := s.userRepo.EnableTOTP(userID, now); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// CreateMFAToken returns the short-lived token a password-verified user exchanges, with a second factor, at /login/2fa.
+func (s *Service) CreateMFAToken(u *models.User, purpose string) (string, error) {
+	claims := NewClaims(u.ID, u.Email, time.Now(), mfaTokenExpiry)
+	claims.Purpose = purpose
+	return SignPurposeToken(s.keys, claims)
+}
+
+// CompleteMFALogin checks the mfa_token and a TOTP or recovery code. On success the mfa_token is used up, the
+// login lockout of the user's email is cleared, and the user is returned with the token's purpose (PurposeMFALogin
+// or PurposeMFAGetToken) so the caller can finish that flow. Each try is counted per user in the database before the
+// code is checked, so new mfa_tokens, parallel requests and other instances don't get more: after maxMFAAttempts
+// tries in mfaAttemptWindow a *LockedError is returned until the window ends. A success resets the count.
+func (s *Service) CompleteMFALogin(mfaToken, code, recoveryCode string) (*models.User, string, error) {
+	claims, err := ValidatePurposeToken(s.keys, mfaToken, PurposeMFALogin, PurposeMFAGetToken)
+	if err != nil || claims.ID == "" {
+		return nil, "", ErrMFATokenInvalid
+	}
+	used, err := s.tokenRepo.IsTokenIDRevoked(claims.ID)
+	if err != nil {
+		return nil, "", err
+	}
+	if used {
+		return nil, "", ErrMFATokenInvalid
+	}
+	userID := UserIDFromClaims(claims)
+	now := time.Now()
+	ok, windowStartedAt, err := s.tokenRepo.ReserveMFAAttempt(userID, maxMFAAttempts, now, now.Add(-mfaAttemptWindow))
+	if err != nil {
+		return nil, "", err
+	}
+	if !ok {
+		return nil, "", &UserError{UserID: userID, Err: &LockedError{RetryAfter: time.Until(windowStartedAt.Add(mfaAttemptWindow))}}
+	}
+	if err := s.checkSecondFactor(userID, code, recoveryCode); err != nil {
+		if errors.Is(err, ErrInvalidMFACode) {
+			return nil, "", &UserError{UserID: userID, Err: err}
+		}
+		return nil, "", err
+	}
+	if err := s.tokenRepo.ResetMFAAttempts(userID); err != nil {
+		return nil, "", err
+	}
+	if err := s.tokenRepo.RevokeTokenID(claims.ID, userID, claims.ExpiresAt.Time); err != nil {
+		return nil, "", err
+	}
+	u, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, "", ErrMFATokenInvalid
+		}
+		return nil, "", err
+	}
+	if u.Email != "" {
+		s.resetLoginAttempts(u.Email)
+	}
+	return u, claims.Purpose, nil
+}
+
+// checkSecondFactor accepts a current TOTP code (each at most once) or an unused recovery code.
+func (s *Service) checkSecondFactor(userID uint, code, recoveryCode string) error {
+	secret, enabled, lastStep, err := s.userRepo.GetTOTP(userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrMFATokenInvalid
+		}
+		return err
+	}
+	if !enabled {
+		return ErrMFATokenInvalid
+	}
+	if recoveryCode != "" {
+		ok, err := s.tokenRepo.UseRecoveryCode(userID, hashToken(normalizeRecoveryCode(recoveryCode)), time.Now())
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrInvalidMFACode
+		}
+		return nil
+	}
+	step, ok := verifyTOTP(secret, code, time.Now(), lastStep)
+	if !ok {
+		return ErrInvalidMFACode
+	}
+	ok, err = s.userRepo.UpdateTOTPLastStep(userID, step)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// recoveryCodeAlphabet avoids characters that are easy to misread (0/o, 1/l/i).
+const recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// newRecoveryCodes returns recoveryCodeCount codes formatted "xxxxx-xxxxx" and their hashes.
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		for j := range b {
+			b[j] = recoveryCodeAlphabet[int(b[j])%len(recoveryCodeAlphabet)]
+		}
+		code := string(b[:5]) + "-" + string(b[5:])
+		codes = append(codes, code)
+		hashes = append(hashes, hashToken(normalizeRecoveryCode(code)))
+	}
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode lowercases the code and drops separators so "ABCDE-FGHIJ" and "abcde fghij" match.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/bilalabsh/zabaan_backend/internal/models"
+	"github.com/bilalabsh/zabaan_backend/internal/oidc"
+	"github.com/bilalabsh/zabaan_backend/internal/user"
+)
+
+// IdentityVerifier verifies a provider ID token. Implemented by *oidc.Verifier.
+type IdentityVerifier interface {
+	Verify(ctx context.Context, provider, rawToken string) (*oidc.Identity, error)
+}
+
+// ErrOIDCDisabled is returned when no identity provider is configured.
+var ErrOIDCDisabled = errors.New("social login not configured")
+
+// ErrOIDCEmailNotVerified is returned for a first-time provider login whose email the provider hasn't verified,
+// since the account would have to be created or linked by that email.
+var ErrOIDCEmailNotVerified = errors.New("provider email not verified")
+
+// LoginWithOIDC verifies a Google/Apple ID token and returns the user linked to it, linking or creating one on first use:
+//   - an identity already in user_identities logs in its user;
+//   - otherwise a user with the same (provider-verified) email is linked, and if that account had never verified its
+//     email, its password is cleared and its tokens revoked, because whoever set that password never proved they own the email;
+//   - otherwise a new user is created with no password (password_hash empty, so password login keeps rejecting it).
+//
+// firstName and lastName are only used when creating a user (Apple sends the name to the app, not in the token).
+func (s *Service) LoginWithOIDC(ctx context.Context, provider, idToken, firstName, lastName string) (*models.User, error) {
+	if s.identityVerifier == nil {
+		return nil, ErrOIDCDisabled
+	}
+	id, err := s.identityVerifier.Verify(ctx, provider, idToken)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	userID, err := s.tokenRepo.GetIdentityUserID(id.Provider, id.Subject, now)
+	if err == nil {
+		return s.userRepo.GetByID(userID)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	email := NormalizeEmail(id.Email)
+	if email == "" || !id.EmailVerified || ValidateEmail(email) != nil || len(email) > maxEmailLength {
+		return nil, ErrOIDCEmailNotVerified
+	}
+	u, _, err := s.userRepo.GetByEmail(email)
+	switch {
+	case err == nil:
+		if !u.EmailVerified {
+			if err := s.userRepo.UpdatePassword(u.ID, ""); err != nil {
+				return nil, err
+			}
+			if err := s.RevokePreviousTokensAt(u.ID, now); err != nil {
+				return nil, err
+			}
+		}
+	case errors.Is(err, sql.ErrNoRows):
+		firstName, lastName = truncate(firstName, maxFirstNameLength), truncate(lastName, maxLastNameLength)
+		u, err = s.userRepo.CreateWithPassword(email, email, firstName, lastName, "")
+		if errors.Is(err, user.ErrDuplicateEmail) {
+			// Created concurrently by another request for the same email.
+			if u, _, err = s.userRepo.GetByEmail(email); err != nil {
+				return nil, err
+			}
+		} else if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	if !u.EmailVerified {
+		if err := s.userRepo.MarkEmailVerified(u.ID, now); err != nil {
+			return nil, err
+		}
+		u.EmailVerified = true
+	}
+	if err := s.tokenRepo.CreateIdentity(u.ID, id.Provider, id.Subject, email, now); err != nil && !errors.Is(err, ErrIdentityExists) {
+		return nil, err
+	}
+	return u, nil
+}
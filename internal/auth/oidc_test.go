@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bilalabsh/zabaan_backend/internal/oidc"
+)
+
+// fakeIdentityVerifier accepts the ID tokens it knows.
+type fakeIdentityVerifier map[string]oidc.Identity
+
+func (v fakeIdentityVerifier) Verify(ctx context.Context, provider, rawToken string) (*oidc.Identity, error) {
+	id, ok := v[rawToken]
+	if !ok || id.Provider != provider {
+		return nil, oidc.ErrInvalidToken
+	}
+	return &id, nil
+}
+
+func TestLoginWithOIDC(t *testing.T) {
+	verifier := fakeIdentityVerifier{
+		"new":          {Provider: oidc.ProviderGoogle, Subject: "g-1", Email: "New@Example.test", EmailVerified: true},
+		"new-renamed":  {Provider: oidc.ProviderGoogle, Subject: "g-1", Email: "renamed@example.test", EmailVerified: true},
+		"verified":     {Provider: oidc.ProviderApple, Subject: "a-1", Email: "verified@example.test", EmailVerified: true},
+		"squatted":     {Provider: oidc.ProviderGoogle, Subject: "g-2", Email: "squatted@example.test", EmailVerified: true},
+		"unverified":   {Provider: oidc.ProviderGoogle, Subject: "g-3", Email: "other@example.test"},
+		"invalid-mail": {Provider: oidc.ProviderGoogle, Subject: "g-4", Email: "not an email", EmailVerified: true},
+	}
+	svc, users, _ := newTestService(t, func(o *Options) { o.IdentityVerifier = verifier })
+	ctx := context.Background()
+	const password = "Correct horse battery 9"
+
+	t.Run("new user", func(t *testing.T) {
+		u, err := svc.LoginWithOIDC(ctx, oidc.ProviderGoogle, "new", "New", "Learner")
+		if err != nil {
+			t.Fatalf("LoginWithOIDC: %v", err)
+		}
+		if u.Email != "new@example.test" || !u.EmailVerified || u.FirstName != "New" {
+			t.Fatalf("user = %+v", u)
+		}
+		if hash, _ := users.GetPasswordHash(u.ID); hash != "" {
+			t.Fatalf("password hash = %q, want none", hash)
+		}
+		// Later logins find the user by the provider subject, even if the email at the provider changed.
+		again, err := svc.LoginWithOIDC(ctx, oidc.ProviderGoogle, "new-renamed", "", "")
+		if err != nil || again.ID != u.ID {
+			t.Fatalf("second LoginWithOIDC = %+v, %v, want user %d", again, err, u.ID)
+		}
+	})
+
+	t.Run("verified account is linked", func(t *testing.T) {
+		existing, err := svc.SignUp("Verified", "", "verified@example.test", password)
+		if err != nil {
+			t.Fatalf("SignUp: %v", err)
+		}
+		if err := users.MarkEmailVerified(existing.ID, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		u, err := svc.LoginWithOIDC(ctx, oidc.ProviderApple, "verified", "", "")
+		if err != nil || u.ID != existing.ID {
+			t.Fatalf("LoginWithOIDC = %+v, %v, want user %d", u, err, existing.ID)
+		}
+		if _, err := svc.Login("verified@example.test", password); err != nil {
+			t.Fatalf("Login with the password after linking: %v", err)
+		}
+	})
+
+	// Someone registered the email without proving they own it: the provider's verified owner takes the account
+	// over and the squatter's password and tokens stop working.
+	t.Run("unverified account is taken over", func(t *testing.T) {
+		squatter, err := svc.SignUp("Squatter", "", "squatted@example.test", password)
+		if err != nil {
+			t.Fatalf("SignUp: %v", err)
+		}
+		u, err := svc.LoginWithOIDC(ctx, oidc.ProviderGoogle, "squatted", "", "")
+		if err != nil || u.ID != squatter.ID || !u.EmailVerified {
+			t.Fatalf("LoginWithOIDC = %+v, %v", u, err)
+		}
+		if hash, _ := users.GetPasswordHash(u.ID); hash != "" {
+			t.Fatalf("password hash = %q, want it cleared", hash)
+		}
+		if validAfter, _ := users.GetTokenValidAfter(u.ID); validAfter.IsZero() {
+			t.Fatal("the squatter's tokens were not revoked")
+		}
+	})
+
+	for _, token := range []string{"unverified", "invalid-mail"} {
+		if _, err := svc.LoginWithOIDC(ctx, oidc.ProviderGoogle, token, "", ""); !errors.Is(err, ErrOIDCEmailNotVerified) {
+			t.Fatalf("LoginWithOIDC(%s) err = %v, want ErrOIDCEmailNotVerified", token, err)
+		}
+	}
+	if _, err := svc.LoginWithOIDC(ctx, oidc.ProviderApple, "new", "", ""); !errors.Is(err, oidc.ErrInvalidToken) {
+		t.Fatalf("LoginWithOIDC(wrong provider) err = %v, want oidc.ErrInvalidToken", err)
+	}
+}
+
+func TestLoginWithOIDCDisabled(t *testing.T) {
+	svc, _, _ := newTestService(t, nil)
+	if _, err := svc.LoginWithOIDC(context.Background(), oidc.ProviderGoogle, "token", "", ""); !errors.Is(err, ErrOIDCDisabled) {
+		t.Fatalf("LoginWithOIDC err = %v, want ErrOIDCDisabled", err)
+	}
+}
@@ -0,0 +1,288 @@
+package auth
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bilalabsh/zabaan_backend/internal/models"
+	"github.com/bilalabsh/zabaan_backend/internal/webauthn"
+)
+
+// Purposes of stored WebAuthn challenges, so a registration challenge can't be used to log in and vice versa.
+const (
+	passkeyPurposeRegister = "register"
+	passkeyPurposeLogin    = "login"
+)
+
+const (
+	maxPasskeysPerUser   = 20
+	maxPasskeyNameLength = 100
+)
+
+// ErrPasskeysDisabled is returned when no WebAuthn relying party is configured.
+var ErrPasskeysDisabled = errors.New("passkeys not configured")
+
+// ErrPasskeyInvalid is returned when a passkey response is malformed, fails verification, or answers a challenge that
+// is unknown, expired, already used, or was issued to another user.
+var ErrPasskeyInvalid = errors.New("invalid passkey response")
+
+// ErrPasskeyExists is returned when registering a credential that is already registered.
+var ErrPasskeyExists = errors.New("passkey already registered")
+
+// ErrPasskeyNotFound is returned when deleting a passkey that doesn't exist or isn't the caller's.
+var ErrPasskeyNotFound = errors.New("passkey not found")
+
+// ErrPasskeyLimit is returned when the user already has maxPasskeysPerUser passkeys.
+var ErrPasskeyLimit = errors.New("too many passkeys")
+
+// PasskeyCredential is a PublicKeyCredential as the client serializes it (PublicKeyCredential.toJSON()), with binary
+// fields base64url encoded. Registration fills AttestationObject and Transports; login fills AuthenticatorData,
+// Signature and UserHandle.
+type PasskeyCredential struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON"`
+		AttestationObject string   `json:"attestationObject"`
+		Transports        []string `json:"transports"`
+		AuthenticatorData string   `json:"authenticatorData"`
+		Signature         string   `json:"signature"`
+		UserHandle        string   `json:"userHandle"`
+	} `json:"response"`
+}
+
+// BeginPasskeyRegistration stores a registration challenge for the user and returns the options for
+// navigator.credentials.create. The user's existing passkeys are excluded.
+func (s *Service) BeginPasskeyRegistration(userID uint) (*webauthn.CreationOptions, error) {
+	if s.passkeys == nil {
+		return nil, ErrPasskeysDisabled
+	}
+	u, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := s.tokenRepo.ListPasskeys(userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) >= maxPasskeysPerUser {
+		return nil, ErrPasskeyLimit
+	}
+	exclude := make([]webauthn.CredentialDescriptor, 0, len(existing))
+	for _, p := range existing {
+		exclude = append(exclude, webauthn.NewCredentialDescriptor(p.CredentialID, p.Transports))
+	}
+	challenge, err := s.newPasskeyChallenge(userID, passkeyPurposeRegister)
+	if err != nil {
+		return nil, err
+	}
+	displayName := strings.TrimSpace(u.FirstName + " " + u.LastName)
+	if displayName == "" {
+		displayName = u.Email
+	}
+	opts := s.passkeys.CreationOptions(challenge, webauthn.User{ID: passkeyUserHandle(userID), Name: u.Email, DisplayName: displayName}, exclude)
+	return &opts, nil
+}
+
+// FinishPasskeyRegistration verifies the authenticator's answer to a challenge from BeginPasskeyRegistration for the
+// same user and stores the new passkey under name.
+func (s *Service) FinishPasskeyRegistration(userID uint, name string, cred *PasskeyCredential) (*Passkey, error) {
+	if s.passkeys == nil {
+		return nil, ErrPasskeysDisabled
+	}
+	clientDataJSON, err1 := decodeBase64URL(cred.Response.ClientDataJSON)
+	attestationObject, err2 := decodeBase64URL(cred.Response.AttestationObject)
+	if err1 != nil || err2 != nil {
+		return nil, ErrPasskeyInvalid
+	}
+	challenge, challengeUserID, err := s.usePasskeyChallenge(clientDataJSON, passkeyPurposeRegister)
+	if err != nil {
+		return nil, err
+	}
+	if challengeUserID != userID {
+		return nil, ErrPasskeyInvalid
+	}
+	verified, err := s.passkeys.VerifyRegistration(clientDataJSON, attestationObject, challenge)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrPasskeyInvalid, err)
+	}
+	id, err := newRandomID()
+	if err != nil {
+		return nil, err
+	}
+	name = truncate(strings.TrimSpace(name), maxPasskeyNameLength)
+	if name == "" {
+		name = "Passkey"
+	}
+	p := &Passkey{
+		ID:           id,
+		UserID:       userID,
+		CredentialID: verified.ID,
+		PublicKey:    verified.PublicKey,
+		SignCount:    verified.SignCount,
+		Transports:   passkeyTransports(cred.Response.Transports),
+		Name:         name,
+		AAGUID:       webauthn.FormatAAGUID(verified.AAGUID),
+		Synced:       verified.BackupEligible,
+		CreatedAt:    time.Now(),
+	}
+	if err := s.tokenRepo.CreatePasskey(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// BeginPasskeyLogin stores a login challenge and returns the options for navigator.credentials.get. No email is asked
+// for: passkeys are discoverable, and the one the user picks tells us who they are.
+func (s *Service) BeginPasskeyLogin() (*webauthn.RequestOptions, error) {
+	if s.passkeys == nil {
+		return nil, ErrPasskeysDisabled
+	}
+	challenge, err := s.newPasskeyChallenge(0, passkeyPurposeLogin)
+	if err != nil {
+		return nil, err
+	}
+	opts := s.passkeys.RequestOptions(challenge, nil)
+	return &opts, nil
+}
+
+// FinishPasskeyLogin verifies a passkey assertion for a challenge from BeginPasskeyLogin and returns the passkey's user.
+// Passkeys require user verification (PIN or biometric on the device), so no second factor is asked for afterwards.
+// Verification failures of a known passkey are returned as a *UserError so they can be audited.
+func (s *Service) FinishPasskeyLogin(cred *PasskeyCredential) (*models.User, error) {
+	if s.passkeys == nil {
+		return nil, ErrPasskeysDisabled
+	}
+	rawID := cred.RawID
+	if rawID == "" {
+		rawID = cred.ID
+	}
+	credentialID, err1 := decodeBase64URL(rawID)
+	clientDataJSON, err2 := decodeBase64URL(cred.Response.ClientDataJSON)
+	authenticatorData, err3 := decodeBase64URL(cred.Response.AuthenticatorData)
+	signature, err4 := decodeBase64URL(cred.Response.Signature)
+	userHandle, err5 := decodeBase64URL(cred.Response.UserHandle)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || err5 != nil || len(credentialID) == 0 {
+		return nil, ErrPasskeyInvalid
+	}
+	challenge, _, err := s.usePasskeyChallenge(clientDataJSON, passkeyPurposeLogin)
+	if err != nil {
+		return nil, err
+	}
+	p, err := s.tokenRepo.GetPasskeyByCredentialID(credentialID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrPasskeyInvalid
+		}
+		return nil, err
+	}
+	if len(userHandle) > 0 && !bytes.Equal(userHandle, passkeyUserHandle(p.UserID)) {
+		return nil, &UserError{UserID: p.UserID, Err: ErrPasskeyInvalid}
+	}
+	signCount, err := s.passkeys.VerifyAssertion(p.PublicKey, p.SignCount, clientDataJSON, authenticatorData, signature, challenge)
+	if err != nil {
+		return nil, &UserError{UserID: p.UserID, Err: fmt.Errorf("%w: %v", ErrPasskeyInvalid, err)}
+	}
+	ok, err := s.tokenRepo.UpdatePasskeyUse(p.ID, p.SignCount, signCount, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	// A counting authenticator's count only goes up, so a lost update means another login used a newer assertion.
+	// Synced passkeys always report 0, and the row may not change at all within the same second.
+	if !ok && signCount != 0 {
+		return nil, &UserError{UserID: p.UserID, Err: ErrPasskeyInvalid}
+	}
+	u, err := s.userRepo.GetByID(p.UserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrPasskeyInvalid
+		}
+		return nil, err
+	}
+	if s.emailVerification == EmailVerificationLogin && emailUnverified(u) {
+		return nil, ErrEmailNotVerified
+	}
+	return u, nil
+}
+
+// ListPasskeys returns the user's passkeys, without key material.
+func (s *Service) ListPasskeys(userID uint) ([]Passkey, error) {
+	return s.tokenRepo.ListPasskeys(userID)
+}
+
+// DeletePasskey deletes one of the user's passkeys.
+func (s *Service) DeletePasskey(userID uint, id string) error {
+	ok, err := s.tokenRepo.DeletePasskey(id, userID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrPasskeyNotFound
+	}
+	return nil
+}
+
+// PrunePasskeyChallenges deletes expired WebAuthn challenges and returns how many were deleted.
+func (s *Service) PrunePasskeyChallenges() (int64, error) {
+	return s.tokenRepo.DeleteExpiredPasskeyChallenges(time.Now())
+}
+
+// newPasskeyChallenge creates a challenge and stores its hash until the ceremony times out.
+func (s *Service) newPasskeyChallenge(userID uint, purpose string) (string, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	if err := s.tokenRepo.CreatePasskeyChallenge(hashToken(challenge), userID, purpose, now, now.Add(s.passkeys.Timeout)); err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+// usePasskeyChallenge uses up the challenge the client data answers and returns it with the user it was issued to
+// (0 for login challenges).
+func (s *Service) usePasskeyChallenge(clientDataJSON []byte, purpose string) (string, uint, error) {
+	challenge, err := webauthn.ChallengeOf(clientDataJSON)
+	if err != nil {
+		return "", 0, ErrPasskeyInvalid
+	}
+	userID, ok, err := s.tokenRepo.UsePasskeyChallenge(hashToken(challenge), purpose, time.Now())
+	if err != nil {
+		return "", 0, err
+	}
+	if !ok {
+		return "", 0, ErrPasskeyInvalid
+	}
+	return challenge, userID, nil
+}
+
+// passkeyUserHandle is the WebAuthn user handle of a user: the decimal user id, which is stable and not personal data.
+func passkeyUserHandle(userID uint) []byte {
+	return []byte(strconv.FormatUint(uint64(userID), 10))
+}
+
+// passkeyTransports keeps the known transport hints reported at registration; they are only passed back to clients.
+func passkeyTransports(transports []string) []string {
+	known := map[string]bool{"usb": true, "nfc": true, "ble": true, "smart-card": true, "hybrid": true, "internal": true}
+	kept := []string{}
+	for _, t := range transports {
+		if known[t] {
+			kept = append(kept, t)
+			delete(known, t)
+		}
+	}
+	return kept
+}
+
+// decodeBase64URL decodes base64url with or without padding, as clients send both.
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
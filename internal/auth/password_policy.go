@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Reasons reported in a PasswordPolicyError.
+const (
+	ReasonTooShort         = "too_short"
+	ReasonMissingLetter    = "missing_letter"
+	ReasonMissingDigit     = "missing_digit"
+	ReasonMissingUppercase = "missing_uppercase"
+	ReasonMissingLowercase = "missing_lowercase"
+	ReasonMissingSymbol    = "missing_symbol"
+	ReasonTooManyRepeats   = "too_many_repeats"
+	ReasonCommonPassword   = "common_password"
+	ReasonBreachedPassword = "breached_password"
+	ReasonPersonalInfo     = "contains_personal_info"
+)
+
+// PasswordPolicyError lists every rule a password broke. errors.Is(err, ErrWeakPassword) is true.
+type PasswordPolicyError struct {
+	Reasons []string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return ErrWeakPassword.Error() + ": " + strings.Join(e.Reasons, ", ")
+}
+
+func (e *PasswordPolicyError) Is(target error) bool { return target == ErrWeakPassword }
+
+// PasswordPolicy is the set of rules a new password must meet.
+type PasswordPolicy struct {
+	MinLength      int // in characters
+	RequireLetter  bool
+	RequireDigit   bool
+	RequireUpper   bool
+	RequireLower   bool
+	RequireSymbol  bool
+	MaxRepeats     int    // most identical characters allowed in a row; 0 means no limit
+	RejectCommon   bool   // reject passwords in the bundled common-password list
+	BreachedDir    string // optional directory of HIBP range files (<PREFIX>.txt with SUFFIX:COUNT lines)
+	RejectPersonal bool   // reject passwords containing the user's email name or first/last name
+}
+
+// DefaultPasswordPolicy is the policy used when none is configured: 8+ characters with a letter and a digit,
+// no more than 3 identical characters in a row, not a common password and not the user's own name or email.
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:      minPasswordLength,
+		RequireLetter:  true,
+		RequireDigit:   true,
+		MaxRepeats:     3,
+		RejectCommon:   true,
+		RejectPersonal: true,
+	}
+}
+
+//go:embed common_passwords.txt
+var commonPasswordsFile string
+
+// commonPasswords is the bundled list, lowercased.
+var commonPasswords = func() map[string]struct{} {
+	set := make(map[string]struct{})
+	for _, line := range strings.Split(commonPasswordsFile, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			set[strings.ToLower(line)] = struct{}{}
+		}
+	}
+	return set
+}()
+
+// ValidatePassword checks password against DefaultPasswordPolicy.
+func ValidatePassword(password string) error {
+	return DefaultPasswordPolicy().Validate(password)
+}
+
+// Validate returns ErrPasswordTooLong if the password is over maxPasswordBytes, or a *PasswordPolicyError listing
+// every broken rule. personal holds the user's email and names, which the password must not contain.
+func (p PasswordPolicy) Validate(password string, personal ...string) error {
+	if len(password) > maxPasswordBytes {
+		return ErrPasswordTooLong
+	}
+	var reasons []string
+	if len([]rune(password)) < p.MinLength {
+		reasons = append(reasons, ReasonTooShort)
+	}
+	var hasLetter, hasDigit, hasUpper, hasLower, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			hasLetter = true
+			hasUpper = hasUpper || unicode.IsUpper(r)
+			hasLower = hasLower || unicode.IsLower(r)
+		case unicode.IsNumber(r):
+			hasDigit = true
+		case !unicode.IsSpace(r):
+			hasSymbol = true
+		}
+	}
+	if p.RequireLetter && !hasLetter {
+		reasons = append(reasons, ReasonMissingLetter)
+	}
+	if p.RequireDigit && !hasDigit {
+		reasons = append(reasons, ReasonMissingDigit)
+	}
+	if p.RequireUpper && !hasUpper {
+		reasons = append(reasons, ReasonMissingUppercase)
+	}
+	if p.RequireLower && !hasLower {
+		reasons = append(reasons, ReasonMissingLowercase)
+	}
+	if p.RequireSymbol && !hasSymbol {
+		reasons = append(reasons, ReasonMissingSymbol)
+	}
+	if p.MaxRepeats > 0 && longestRun(password) > p.MaxRepeats {
+		reasons = append(reasons, ReasonTooManyRepeats)
+	}
+	if p.RejectCommon && isCommonPassword(password) {
+		reasons = append(reasons, ReasonCommonPassword)
+	}
+	if p.BreachedDir != "" && p.isBreached(password) {
+		reasons = append(reasons, ReasonBreachedPassword)
+	}
+	if p.RejectPersonal && containsPersonalInfo(password, personal) {
+		reasons = append(reasons, ReasonPersonalInfo)
+	}
+	if len(reasons) > 0 {
+		return &PasswordPolicyError{Reasons: reasons}
+	}
+	return nil
+}
+
+// longestRun returns the length of the longest run of one repeated character.
+func longestRun(s string) int {
+	longest, run := 0, 0
+	var prev rune = -1
+	for _, r := range s {
+		if r == prev {
+			run++
+		} else {
+			run = 1
+			prev = r
+		}
+		if run > longest {
+			longest = run
+		}
+	}
+	return longest
+}
+
+// isCommonPassword reports whether the password, or the password without trailing digits and symbols
+// ("Password123!" -> "password"), is in the bundled list.
+func isCommonPassword(password string) bool {
+	lower := strings.ToLower(password)
+	if _, ok := commonPasswords[lower]; ok {
+		return true
+	}
+	base := strings.TrimRightFunc(lower, func(r rune) bool { return !unicode.IsLetter(r) })
+	if len(base) < 4 {
+		return false
+	}
+	_, ok := commonPasswords[base]
+	return ok
+}
+
+// containsPersonalInfo reports whether the password contains the local part of an email or a name
+// (case-insensitive; parts shorter than 3 characters are ignored).
+func containsPersonalInfo(password string, personal []string) bool {
+	lower := strings.ToLower(password)
+	for _, item := range personal {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if at := strings.LastIndex(item, "@"); at >= 0 {
+			item = item[:at]
+		}
+		if len([]rune(item)) >= 3 && strings.Contains(lower, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBreached looks the password's SHA-1 up in a local copy of the Pwned Passwords range files: <dir>/<first 5 hex>.txt
+// holds "SUFFIX:COUNT" lines for the remaining 35 hex digits, the format of the HIBP range API (k-anonymity).
+// A missing or unreadable file counts as not breached, so an incomplete copy never blocks signups.
+func (p PasswordPolicy) isBreached(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	digest := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := digest[:5], digest[5:]
+	f, err := os.Open(filepath.Join(p.BreachedDir, prefix+".txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		f, err = os.Open(filepath.Join(p.BreachedDir, prefix))
+	}
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("reading breached password file failed", "component", "auth", "err", err)
+		}
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		s, countStr, _ := strings.Cut(line, ":")
+		if !strings.EqualFold(s, suffix) {
+			continue
+		}
+		// Padded range responses contain fake suffixes with count 0.
+		count, err := strconv.Atoi(strings.TrimSpace(countStr))
+		return err != nil || count > 0
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	strict := PasswordPolicy{MinLength: 10, RequireUpper: true, RequireLower: true, RequireSymbol: true}
+	for _, tc := range []struct {
+		name     string
+		policy   PasswordPolicy
+		password string
+		personal []string
+		want     []string
+	}{
+		{"good", DefaultPasswordPolicy(), "Correct horse battery 9", nil, nil},
+		{"too short", DefaultPasswordPolicy(), "abc9", nil, []string{ReasonTooShort}},
+		{"length in characters", DefaultPasswordPolicy(), "ñandú9ñandú", nil, nil},
+		{"no digit", DefaultPasswordPolicy(), "Correct horse battery", nil, []string{ReasonMissingDigit}},
+		{"no letter", DefaultPasswordPolicy(), "8675 3092 41", nil, []string{ReasonMissingLetter}},
+		{"repeats", DefaultPasswordPolicy(), "Correct hoooorse 9", nil, []string{ReasonTooManyRepeats}},
+		{"common", DefaultPasswordPolicy(), "password1", nil, []string{ReasonCommonPassword}},
+		{"common with suffix", DefaultPasswordPolicy(), "Password123!", nil, []string{ReasonCommonPassword}},
+		{"email name", DefaultPasswordPolicy(), "Learner 2026 zz", []string{"learner@example.test"}, []string{ReasonPersonalInfo}},
+		{"first name", DefaultPasswordPolicy(), "i am AMINA 42", []string{"", "Amina"}, []string{ReasonPersonalInfo}},
+		{"short name ignored", DefaultPasswordPolicy(), "Correct horse battery 9", []string{"Co"}, nil},
+		{"several reasons", DefaultPasswordPolicy(), "aaaa", nil, []string{ReasonTooShort, ReasonMissingDigit, ReasonTooManyRepeats}},
+		{"strict good", strict, "Tamarind-Sunrise", nil, nil},
+		{"strict", strict, "tamarind sunrise", nil, []string{ReasonMissingUppercase, ReasonMissingSymbol}},
+		{"strict upper only", strict, "TAMARIND-SUNRISE", nil, []string{ReasonMissingLowercase}},
+		{"no rules", PasswordPolicy{}, "a", nil, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.policy.Validate(tc.password, tc.personal...)
+			if tc.want == nil {
+				if err != nil {
+					t.Fatalf("Validate: %v", err)
+				}
+				return
+			}
+			var perr *PasswordPolicyError
+			if !errors.As(err, &perr) || !errors.Is(err, ErrWeakPassword) {
+				t.Fatalf("Validate err = %v, want a PasswordPolicyError", err)
+			}
+			if !slices.Equal(perr.Reasons, tc.want) {
+				t.Fatalf("reasons = %v, want %v", perr.Reasons, tc.want)
+			}
+		})
+	}
+	if err := DefaultPasswordPolicy().Validate(strings.Repeat("Ab9 ", maxPasswordBytes/4+1)); !errors.Is(err, ErrPasswordTooLong) {
+		t.Fatalf("Validate(too long) err = %v, want ErrPasswordTooLong", err)
+	}
+}
+
+func TestPasswordPolicyBreached(t *testing.T) {
+	dir := t.TempDir()
+	sum := sha1.Sum([]byte("Correct horse battery 9"))
+	digest := strings.ToUpper(hex.EncodeToString(sum[:]))
+	// A range file with the password's suffix (lowercased, as some mirrors store it) and a padding entry.
+	content := "0000000000000000000000000000000000A:0\r\n" + strings.ToLower(digest[5:]) + ":12\r\n"
+	if err := os.WriteFile(filepath.Join(dir, digest[:5]+".txt"), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	policy := PasswordPolicy{BreachedDir: dir}
+	var perr *PasswordPolicyError
+	if err := policy.Validate("Correct horse battery 9"); !errors.As(err, &perr) || !slices.Equal(perr.Reasons, []string{ReasonBreachedPassword}) {
+		t.Fatalf("Validate(breached) err = %v, want breached_password", err)
+	}
+	// No range file for the prefix: not breached.
+	if err := policy.Validate("Tamarind sunrise 42"); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	// A padding entry with count 0 doesn't count.
+	sum = sha1.Sum([]byte("Tamarind sunrise 42"))
+	digest = strings.ToUpper(hex.EncodeToString(sum[:]))
+	if err := os.WriteFile(filepath.Join(dir, digest[:5]+".txt"), []byte(digest[5:]+":0\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.Validate("Tamarind sunrise 42"); err != nil {
+		t.Fatalf("Validate(padding entry): %v", err)
+	}
+}
+
+// SignUp and ChangePassword apply the policy with the user's email and names.
+func TestSignUpPasswordPolicy(t *testing.T) {
+	svc, _, _ := newTestService(t, nil)
+	var perr *PasswordPolicyError
+	if _, err := svc.SignUp("Amina", "", "amina@example.test", "Amina rocks 42"); !errors.As(err, &perr) || !slices.Equal(perr.Reasons, []string{ReasonPersonalInfo}) {
+		t.Fatalf("SignUp err = %v, want contains_personal_info", err)
+	}
+	u, err := svc.SignUp("Learner", "", "learner@example.test", "Correct horse battery 9")
+	if err != nil {
+		t.Fatalf("SignUp: %v", err)
+	}
+	claims := NewClaims(u.ID, u.Email, time.Now(), time.Minute)
+	if _, err := svc.ChangePassword(claims, "Correct horse battery 9", "learner 4 ever", SessionInfo{}); !errors.As(err, &perr) || !slices.Equal(perr.Reasons, []string{ReasonPersonalInfo}) {
+		t.Fatalf("ChangePassword err = %v, want contains_personal_info", err)
+	}
+}
@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"time"
+
+	"github.com/bilalabsh/zabaan_backend/internal/mailer"
+)
+
+// ErrPasswordResetTokenInvalid is returned when a reset token is unknown, expired, or already used.
+var ErrPasswordResetTokenInvalid = errors.New("invalid password reset token")
+
+// ForgotPassword emails a single-use reset link if the email has an account.
+// It returns nil for unknown emails, and the email is sent in the background, so neither the response
+// nor its timing reveals whether the address is registered.
+func (s *Service) ForgotPassword(email string) error {
+	email = NormalizeEmail(email)
+	if len(email) > maxEmailLength {
+		return nil
+	}
+	u, _, err := s.userRepo.GetByEmail(email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	token, err := newOpaqueToken()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := s.tokenRepo.CreatePasswordResetToken(u.ID, hashToken(token), now, now.Add(s.passwordResetExpiry)); err != nil {
+		return err
+	}
+	msg := mailer.Message{
+		To:      u.Email,
+		Subject: "Reset your Zabaan password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password for your Zabaan account. To choose a new password, open this link:\n\n%s\n\nThe link expires in %s and works once. If you did not ask for this, you can ignore this email; your password has not changed.\n",
+			u.FirstName, s.appBaseURL+"/reset-password?token="+url.QueryEscape(token), s.passwordResetExpiry),
+	}
+	go func() {
+		if err := s.mailer.Send(msg); err != nil {
+			slog.Error("sending password reset email failed", "component", "auth", "user_id", u.ID, "err", err)
+		}
+	}()
+	return nil
+}
+
+// ResetPassword sets a new password using a reset token and returns the user's id. The token is consumed, other
+// outstanding reset links are invalidated, and every existing token and session of the user is revoked.
+func (s *Service) ResetPassword(token, newPassword string) (uint, error) {
+	stored, err := s.tokenRepo.GetPasswordResetToken(hashToken(token))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrPasswordResetTokenInvalid
+		}
+		return 0, err
+	}
+	now := time.Now()
+	if !stored.UsedAt.IsZero() || !now.Before(stored.ExpiresAt) {
+		return 0, ErrPasswordResetTokenInvalid
+	}
+	u, err := s.userRepo.GetByID(stored.UserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrPasswordResetTokenInvalid
+		}
+		return 0, err
+	}
+	// Checked before the token is consumed so the user can retry with a better password.
+	if err := s.passwordPolicy.Validate(newPassword, u.Email, u.FirstName, u.LastName); err != nil {
+		return 0, err
+	}
+	ok, err := s.tokenRepo.MarkPasswordResetTokenUsed(stored.ID, now)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, ErrPasswordResetTokenInvalid
+	}
+	hash, err := s.hasher.Hash(newPassword)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.userRepo.UpdatePassword(stored.UserID, hash); err != nil {
+		return 0, err
+	}
+	if err := s.tokenRepo.InvalidateUserPasswordResetTokens(stored.UserID, now); err != nil {
+		return 0, err
+	}
+	s.resetLoginAttempts(u.Email)
+	return stored.UserID, s.RevokePreviousTokensAt(stored.UserID, now)
+}
+
+// ChangePassword replaces the password of the token's user after checking the current one (checkCurrentPassword:
+// wrong guesses count towards a lockout like Login's).
+// All existing tokens and sessions are revoked through RevokePreviousTokensAt, and a fresh token pair is
+// returned for the calling device so it stays signed in.
+func (s *Service) ChangePassword(claims *Claims, currentPassword, newPassword string, info SessionInfo) (*TokenPair, error) {
+	userID := UserIDFromClaims(claims)
+	if err := s.checkCurrentPassword(userID, currentPassword); err != nil {
+		return nil, err
+	}
+	u, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.passwordPolicy.Validate(newPassword, u.Email, u.FirstName, u.LastName); err != nil {
+		return nil, err
+	}
+	newHash, err := s.hasher.Hash(newPassword)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.userRepo.UpdatePassword(userID, newHash); err != nil {
+		return nil, err
+	}
+	if info.DeviceName == "" && claims.SessionID != "" {
+		if sess, err := s.tokenRepo.GetSession(claims.SessionID); err == nil {
+			info.DeviceName = sess.DeviceName
+		}
+	}
+	now := time.Now()
+	if err := s.tokenRepo.InvalidateUserPasswordResetTokens(userID, now); err != nil {
+		return nil, err
+	}
+	if err := s.RevokePreviousTokensAt(userID, now); err != nil {
+		return nil, err
+	}
+	return s.IssueTokens(u, now, info)
+}
@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPasswordReset(t *testing.T) {
+	mail := &fakeMailer{}
+	svc, _, tokens := newTestService(t, func(o *Options) {
+		o.Mailer = mail
+		o.PasswordResetExpiry = time.Hour
+		o.Lockout = testLockout
+	})
+	const email, newPassword = "learner@example.test", "Tamarind sunrise 42"
+	u, pair := signUpWithTokens(t, svc)
+
+	if err := svc.ForgotPassword("nobody@example.test"); err != nil {
+		t.Fatalf("ForgotPassword(unknown email): %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := svc.ForgotPassword(" Learner@Example.test "); err != nil {
+			t.Fatalf("ForgotPassword: %v", err)
+		}
+	}
+	// The first email to the address is the signup's verification link.
+	first := linkToken(t, mail.waitFor(t, email, 2), "/reset-password")
+	second := linkToken(t, mail.waitFor(t, email, 3), "/reset-password")
+	if n := mail.count("nobody@example.test"); n != 0 {
+		t.Fatalf("emails to an unknown address = %d, want 0", n)
+	}
+	if _, err := svc.Login(email, "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("Login err = %v, want ErrInvalidCredentials", err)
+	}
+
+	// A password the policy rejects leaves the link usable.
+	if _, err := svc.ResetPassword(first, "learner 2026"); !errors.Is(err, ErrWeakPassword) {
+		t.Fatalf("ResetPassword(weak) err = %v, want ErrWeakPassword", err)
+	}
+	userID, err := svc.ResetPassword(first, newPassword)
+	if err != nil || userID != u.ID {
+		t.Fatalf("ResetPassword = %d, %v", userID, err)
+	}
+	if n := tokens.loginAttempts(email); n != 0 {
+		t.Fatalf("login attempts after the reset = %d, want 0", n)
+	}
+	// The link works once, and the other outstanding link is invalidated.
+	for name, token := range map[string]string{"used": first, "other": second, "unknown": "not-a-token"} {
+		if _, err := svc.ResetPassword(token, "Other tamarind 43"); !errors.Is(err, ErrPasswordResetTokenInvalid) {
+			t.Fatalf("ResetPassword(%s link) err = %v, want ErrPasswordResetTokenInvalid", name, err)
+		}
+	}
+	// Signed-in devices are signed out.
+	if _, err := svc.Refresh(pair.RefreshToken); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Fatalf("Refresh after the reset err = %v, want ErrRefreshTokenInvalid", err)
+	}
+	if _, err := svc.Login(email, "Correct horse battery 9"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("Login(old password) err = %v, want ErrInvalidCredentials", err)
+	}
+	if _, err := svc.Login(email, newPassword); err != nil {
+		t.Fatalf("Login(new password): %v", err)
+	}
+}
+
+func TestPasswordResetExpired(t *testing.T) {
+	mail := &fakeMailer{}
+	svc, _, _ := newTestService(t, func(o *Options) {
+		o.Mailer = mail
+		o.PasswordResetExpiry = -time.Second
+	})
+	signUpWithTokens(t, svc)
+	if err := svc.ForgotPassword("learner@example.test"); err != nil {
+		t.Fatalf("ForgotPassword: %v", err)
+	}
+	token := linkToken(t, mail.waitFor(t, "learner@example.test", 2), "/reset-password")
+	if _, err := svc.ResetPassword(token, "Tamarind sunrise 42"); !errors.Is(err, ErrPasswordResetTokenInvalid) {
+		t.Fatalf("ResetPassword(expired link) err = %v, want ErrPasswordResetTokenInvalid", err)
+	}
+}
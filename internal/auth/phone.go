@@ -0,0 +1,239 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/bilalabsh/zabaan_backend/internal/models"
+	"github.com/bilalabsh/zabaan_backend/internal/sms"
+	"github.com/bilalabsh/zabaan_backend/internal/user"
+)
+
+// ErrInvalidPhone is returned when a phone number can't be normalized to E.164.
+var ErrInvalidPhone = errors.New("invalid phone number")
+
+// ErrPhoneExists is returned when phone signup uses a number that already has an account.
+var ErrPhoneExists = errors.New("phone already exists")
+
+// ErrPhoneCodeInvalid is returned when an SMS code is wrong, expired, already used, or has seen too many wrong attempts.
+var ErrPhoneCodeInvalid = errors.New("invalid phone code")
+
+// Purposes of SMS codes, so a signup code can't be used to log in and vice versa. phonePurposeNotice marks the
+// "you already have an account" message sent instead of a signup code; it can't be verified but counts towards the limits.
+const (
+	phonePurposeSignup = "signup"
+	phonePurposeLogin  = "login"
+	phonePurposeNotice = "notice"
+)
+
+const (
+	maxPhoneCodeAttempts = 5              // codes entered against a code before it stops working
+	phoneCodeResendDelay = time.Minute    // no number gets a message more often than this
+	phoneCodeWindow      = time.Hour      // Options.PhoneCodesPerHour counts messages in this window
+	phoneCodeRetention   = 24 * time.Hour // PrunePhoneCodes deletes codes older than this
+	minPhoneDigits       = 8
+	maxPhoneDigits       = 15 // E.164
+)
+
+// NormalizePhone returns phone in E.164 form (+ and up to 15 digits). Spaces, dashes, dots and parentheses are ignored.
+// Numbers starting with + or 00 are international; anything else is a national number, whose leading 0 (trunk prefix)
+// is dropped before defaultCountryCode (e.g. "92") is added, so "0300 1234567" becomes +923001234567.
+func NormalizePhone(phone, defaultCountryCode string) (string, error) {
+	phone = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '.', '(', ')':
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(phone))
+	var digits string
+	switch {
+	case strings.HasPrefix(phone, "+"):
+		digits = phone[1:]
+	case strings.HasPrefix(phone, "00"):
+		digits = phone[2:]
+	default:
+		if defaultCountryCode == "" {
+			return "", ErrInvalidPhone
+		}
+		digits = defaultCountryCode + strings.TrimPrefix(phone, "0")
+	}
+	if len(digits) < minPhoneDigits || len(digits) > maxPhoneDigits || digits[0] == '0' {
+		return "", ErrInvalidPhone
+	}
+	for i := 0; i < len(digits); i++ {
+		if digits[i] < '0' || digits[i] > '9' {
+			return "", ErrInvalidPhone
+		}
+	}
+	return "+" + digits, nil
+}
+
+// RequestPhoneSignup texts a 6-digit signup code to a number without an account. For a number that already has one it
+// returns ErrPhoneExists, or with AntiEnumeration texts the owner that they already have an account and returns nil.
+// Per-number limits apply either way: within phoneCodeResendDelay of the last message, or after PhoneCodesPerHour
+// messages in the last hour, nothing is sent.
+func (s *Service) RequestPhoneSignup(phone string) error {
+	phone, err := NormalizePhone(phone, s.phoneCountryCode)
+	if err != nil {
+		return err
+	}
+	if _, err := s.userRepo.GetByPhone(phone); err == nil {
+		if !s.antiEnumeration {
+			return ErrPhoneExists
+		}
+		return s.sendPhoneMessage(phone, phonePurposeNotice, "", "You already have a Zabaan account with this number. Log in with your phone number instead of signing up.")
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	return s.sendPhoneCode(phone, phonePurposeSignup)
+}
+
+// VerifyPhoneSignup checks a code sent by RequestPhoneSignup and creates the account. The account has no email or
+// password; the phone number is its username.
+func (s *Service) VerifyPhoneSignup(phone, code, firstName, lastName string) (*models.User, error) {
+	if len(firstName) > maxFirstNameLength {
+		return nil, ErrFirstNameTooLong
+	}
+	if len(lastName) > maxLastNameLength {
+		return nil, ErrLastNameTooLong
+	}
+	phone, err := NormalizePhone(phone, s.phoneCountryCode)
+	if err != nil {
+		return nil, ErrPhoneCodeInvalid
+	}
+	if err := s.usePhoneCode(phone, phonePurposeSignup, code); err != nil {
+		return nil, err
+	}
+	u, err := s.userRepo.CreateWithPhone(phone, phone, firstName, lastName)
+	if err != nil {
+		if errors.Is(err, user.ErrDuplicatePhone) {
+			return nil, ErrPhoneExists
+		}
+		return nil, err
+	}
+	return u, nil
+}
+
+// RequestPhoneLogin texts a 6-digit login code to the account with the number, if there is one. Like RequestEmailLogin
+// it returns nil for unknown numbers; the per-number limits of RequestPhoneSignup apply.
+func (s *Service) RequestPhoneLogin(phone string) error {
+	phone, err := NormalizePhone(phone, s.phoneCountryCode)
+	if err != nil {
+		return err
+	}
+	if _, err := s.userRepo.GetByPhone(phone); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	return s.sendPhoneCode(phone, phonePurposeLogin)
+}
+
+// VerifyPhoneLogin checks a code sent by RequestPhoneLogin and returns the user.
+func (s *Service) VerifyPhoneLogin(phone, code string) (*models.User, error) {
+	phone, err := NormalizePhone(phone, s.phoneCountryCode)
+	if err != nil {
+		return nil, ErrPhoneCodeInvalid
+	}
+	u, err := s.userRepo.GetByPhone(phone)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrPhoneCodeInvalid
+		}
+		return nil, err
+	}
+	if err := s.usePhoneCode(phone, phonePurposeLogin, code); err != nil {
+		return nil, &UserError{UserID: u.ID, Err: err}
+	}
+	return u, nil
+}
+
+// PrunePhoneCodes deletes SMS codes older than phoneCodeRetention and returns how many were deleted.
+func (s *Service) PrunePhoneCodes() (int64, error) {
+	return s.tokenRepo.DeletePhoneCodesBefore(time.Now().Add(-phoneCodeRetention))
+}
+
+// sendPhoneCode stores a new code for the phone and purpose and texts it, subject to the per-number limits.
+func (s *Service) sendPhoneCode(phone, purpose string) error {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return err
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+	return s.sendPhoneMessage(phone, purpose, code, fmt.Sprintf("Your Zabaan code is %s. It expires in %s. Don't share it with anyone.", code, s.phoneCodeExpiry))
+}
+
+// sendPhoneMessage records a message in phone_codes (which doubles as the per-number send log) and texts it in the
+// background. Nothing is sent when the number is over its limits. An empty code stores an unusable random hash.
+func (s *Service) sendPhoneMessage(phone, purpose, code, body string) error {
+	now := time.Now()
+	recent, err := s.tokenRepo.CountPhoneCodesSince(phone, now.Add(-phoneCodeResendDelay))
+	if err != nil {
+		return err
+	}
+	hourly, err := s.tokenRepo.CountPhoneCodesSince(phone, now.Add(-phoneCodeWindow))
+	if err != nil {
+		return err
+	}
+	if recent > 0 || hourly >= s.phoneCodesPerHour {
+		return nil
+	}
+	expiresAt := now.Add(s.phoneCodeExpiry)
+	if code == "" {
+		if code, err = newOpaqueToken(); err != nil {
+			return err
+		}
+		expiresAt = now
+	}
+	if err := s.tokenRepo.CreatePhoneCode(phone, purpose, hashToken(code), now, expiresAt); err != nil {
+		return err
+	}
+	msg := sms.Message{To: phone, Body: body}
+	go func() {
+		if err := s.sms.Send(msg); err != nil {
+			slog.Error("sending sms failed", "component", "auth", "purpose", purpose, "err", err)
+		}
+	}()
+	return nil
+}
+
+// usePhoneCode checks code against the latest code for the phone and purpose and uses it up. Every code entered counts
+// against the stored code, reserved before comparing so parallel guesses are counted too; after maxPhoneCodeAttempts
+// it stops working and a new one has to be requested.
+func (s *Service) usePhoneCode(phone, purpose, code string) error {
+	stored, err := s.tokenRepo.GetLatestPhoneCode(phone, purpose)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrPhoneCodeInvalid
+		}
+		return err
+	}
+	now := time.Now()
+	if !stored.UsedAt.IsZero() || !now.Before(stored.ExpiresAt) || stored.Attempts >= maxPhoneCodeAttempts {
+		return ErrPhoneCodeInvalid
+	}
+	ok, err := s.tokenRepo.ReservePhoneCodeAttempt(stored.ID, maxPhoneCodeAttempts)
+	if err != nil {
+		return err
+	}
+	if !ok || subtle.ConstantTimeCompare([]byte(hashToken(code)), []byte(stored.CodeHash)) != 1 {
+		return ErrPhoneCodeInvalid
+	}
+	ok, err = s.tokenRepo.MarkPhoneCodeUsed(stored.ID, now)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrPhoneCodeInvalid
+	}
+	return nil
+}
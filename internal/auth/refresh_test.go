@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bilalabsh/zabaan_backend/internal/models"
+)
+
+// signUpWithTokens creates a learner and signs in a device.
+func signUpWithTokens(t *testing.T, svc *Service) (*models.User, *TokenPair) {
+	t.Helper()
+	u, err := svc.SignUp("Learner", "", "learner@example.test", "Correct horse battery 9")
+	if err != nil {
+		t.Fatalf("SignUp: %v", err)
+	}
+	tokens, err := svc.IssueTokens(u, time.Now(), SessionInfo{DeviceName: "phone"})
+	if err != nil {
+		t.Fatalf("IssueTokens: %v", err)
+	}
+	return u, tokens
+}
+
+func TestRefreshRotates(t *testing.T) {
+	svc, _, _ := newTestService(t, nil)
+	u, first := signUpWithTokens(t, svc)
+	second, err := svc.Refresh(first.RefreshToken)
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if second.UserID != u.ID || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("Refresh = %+v", second)
+	}
+	claims, err := ValidateToken(svc.keys, second.AccessToken)
+	if err != nil {
+		t.Fatalf("ValidateToken(refreshed access token): %v", err)
+	}
+	firstClaims, _ := ValidateToken(svc.keys, first.AccessToken)
+	if claims.SessionID == "" || claims.SessionID != firstClaims.SessionID {
+		t.Fatalf("session after refresh = %q, want %q", claims.SessionID, firstClaims.SessionID)
+	}
+	if _, err := svc.Refresh(second.RefreshToken); err != nil {
+		t.Fatalf("Refresh(rotated token): %v", err)
+	}
+
+	for name, token := range map[string]string{"empty": "", "unknown": "not-a-refresh-token"} {
+		if _, err := svc.Refresh(token); !errors.Is(err, ErrRefreshTokenInvalid) {
+			t.Fatalf("Refresh(%s) err = %v, want ErrRefreshTokenInvalid", name, err)
+		}
+	}
+}
+
+func TestRefreshExpired(t *testing.T) {
+	svc, _, tokens := newTestService(t, nil)
+	_, pair := signUpWithTokens(t, svc)
+	tokens.expireRefreshTokens()
+	if _, err := svc.Refresh(pair.RefreshToken); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Fatalf("Refresh err = %v, want ErrRefreshTokenInvalid", err)
+	}
+}
+
+// Presenting a rotated refresh token revokes its family, the user's other sessions and access tokens.
+func TestRefreshReuseDetection(t *testing.T) {
+	svc, users, _ := newTestService(t, nil)
+	u, first := signUpWithTokens(t, svc)
+	other, err := svc.IssueTokens(u, time.Now(), SessionInfo{DeviceName: "laptop"})
+	if err != nil {
+		t.Fatalf("IssueTokens: %v", err)
+	}
+	second, err := svc.Refresh(first.RefreshToken)
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+
+	_, err = svc.Refresh(first.RefreshToken)
+	if !errors.Is(err, ErrRefreshTokenReused) || ErrorUserID(err) != u.ID {
+		t.Fatalf("Refresh(reused token) err = %v (user %d), want ErrRefreshTokenReused for user %d", err, ErrorUserID(err), u.ID)
+	}
+	if validAfter, _ := users.GetTokenValidAfter(u.ID); validAfter.IsZero() {
+		t.Fatal("token_valid_after not moved by the reuse")
+	}
+	// The thief's (or the owner's) newer token and the other device are signed out.
+	for name, token := range map[string]string{"newer token": second.RefreshToken, "other session": other.RefreshToken} {
+		if _, err := svc.Refresh(token); !errors.Is(err, ErrRefreshTokenInvalid) {
+			t.Fatalf("Refresh(%s) err = %v, want ErrRefreshTokenInvalid", name, err)
+		}
+	}
+}
+
+// Two refreshes racing with one token: one wins, the other counts as reuse.
+func TestRefreshConcurrentReuse(t *testing.T) {
+	svc, _, _ := newTestService(t, nil)
+	_, pair := signUpWithTokens(t, svc)
+	const callers = 2
+	var wg sync.WaitGroup
+	errs := make([]error, callers)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = svc.Refresh(pair.RefreshToken)
+		}()
+	}
+	wg.Wait()
+	var ok, reused int
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			ok++
+		case errors.Is(err, ErrRefreshTokenReused):
+			reused++
+		default:
+			t.Fatalf("Refresh err = %v", err)
+		}
+	}
+	if ok != 1 || reused != 1 {
+		t.Fatalf("refreshes: %d succeeded, %d reused, want 1 and 1", ok, reused)
+	}
+}
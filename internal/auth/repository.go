@@ -0,0 +1,1266 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// RefreshToken is a stored refresh token. Only the SHA-256 hash of the token is persisted.
+// Tokens issued from the same login share a FamilyID; zero times mean "not set".
+type RefreshToken struct {
+	ID        int64
+	UserID    uint
+	FamilyID  string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	RotatedAt time.Time
+	RevokedAt time.Time
+}
+
+// Session is a signed-in device. Its ID is the "sid" claim of the device's access tokens and the family ID of its refresh tokens.
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     uint      `json:"-"`
+	DeviceName string    `json:"device_name"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	RevokedAt  time.Time `json:"-"`
+	Current    bool      `json:"current"`
+}
+
+// Identity is a Google/Apple account linked to a user.
+type Identity struct {
+	Provider    string    `json:"provider"`
+	Subject     string    `json:"subject"`
+	Email       string    `json:"email"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastLoginAt time.Time `json:"last_login_at"`
+}
+
+// PasswordResetToken is a stored password reset token (hash only). Zero UsedAt means unused.
+type PasswordResetToken struct {
+	ID        int64
+	UserID    uint
+	ExpiresAt time.Time
+	UsedAt    time.Time
+}
+
+// EmailLoginCode is a stored passwordless login code and its magic link (hashes only). Zero UsedAt means unused.
+type EmailLoginCode struct {
+	ID        int64
+	UserID    uint
+	CodeHash  string
+	Attempts  int
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    time.Time
+}
+
+// EmailChange is a requested email change. The confirmation link (sent to NewEmail) and the undo link (sent to
+// OldEmail) are kept as hashes. Zero ConfirmedAt means not applied yet; zero CancelledAt means neither undone nor
+// replaced by a newer request.
+type EmailChange struct {
+	ID            int64
+	UserID        uint
+	OldEmail      string
+	NewEmail      string
+	CreatedAt     time.Time
+	ExpiresAt     time.Time // confirmation link
+	UndoExpiresAt time.Time
+	ConfirmedAt   time.Time
+	CancelledAt   time.Time
+}
+
+// PhoneCode is a stored one-time SMS code (hash only) for signing up or logging in with a phone number.
+// Zero UsedAt means unused.
+type PhoneCode struct {
+	ID        int64
+	Phone     string
+	Purpose   string
+	CodeHash  string
+	Attempts  int
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    time.Time
+}
+
+// APIKey is a stored API key (the secret is kept as a SHA-256 hash; Prefix is its first characters, for display).
+// Nil ExpiresAt means the key doesn't expire; zero RevokedAt means not revoked.
+type APIKey struct {
+	ID         string     `json:"id"`
+	UserID     uint       `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedBy  uint       `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  time.Time  `json:"-"`
+}
+
+// Passkey is a stored WebAuthn credential. CredentialID and PublicKey (COSE_Key) are what the authenticator gave us at
+// registration; SignCount is the last counter value it reported.
+type Passkey struct {
+	ID           string     `json:"id"`
+	UserID       uint       `json:"-"`
+	CredentialID []byte     `json:"-"`
+	PublicKey    []byte     `json:"-"`
+	SignCount    uint32     `json:"-"`
+	Transports   []string   `json:"transports"`
+	Name         string     `json:"name"`
+	AAGUID       string     `json:"aaguid"`
+	Synced       bool       `json:"synced"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsedAt   *time.Time `json:"last_used_at"`
+}
+
+// LegalDocument is a published version of a legal document such as the terms of service (Kind "terms") or privacy
+// policy ("privacy"). The current version of a kind is the one published last, up to now.
+type LegalDocument struct {
+	ID          int64     `json:"-"`
+	Kind        string    `json:"kind"`
+	Version     string    `json:"version"`
+	URL         string    `json:"url"`
+	PublishedAt time.Time `json:"published_at"`
+}
+
+// Consent is a user's acceptance of a legal document version, with the client it was given from.
+type Consent struct {
+	DocumentID int64     `json:"-"`
+	Kind       string    `json:"kind"`
+	Version    string    `json:"version"`
+	AcceptedAt time.Time `json:"accepted_at"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+}
+
+// Repository handles persistence for auth-owned tables (refresh tokens, sessions, revoked token ids, password resets,
+// recovery codes, provider identities, email login codes, API keys, passkeys and their challenges, failed login and
+// second-factor counts, legal documents and consents).
+type Repository struct {
+	db *sql.DB
+}
+
+// NewRepository returns a new auth repository.
+func NewRepository(db *sql.DB) *Repository {
+	return &Repository{db: db}
+}
+
+// CreateRefreshToken stores a refresh token hash in the given family.
+func (r *Repository) CreateRefreshToken(userID uint, familyID, tokenHash string, createdAt, expiresAt time.Time) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	_, err := r.db.Exec("INSERT INTO refresh_tokens (user_id, family_id, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?, ?)", int64(userID), familyID, tokenHash, createdAt, expiresAt)
+	return err
+}
+
+// GetRefreshTokenByHash returns the refresh token with the given hash, or sql.ErrNoRows.
+func (r *Repository) GetRefreshTokenByHash(tokenHash string) (*RefreshToken, error) {
+	if r.db == nil {
+		return nil, sql.ErrNoRows
+	}
+	var t RefreshToken
+	var rotatedAt, revokedAt sql.NullTime
+	err := r.db.QueryRow("SELECT id, user_id, family_id, created_at, expires_at, rotated_at, revoked_at FROM refresh_tokens WHERE token_hash = ?", tokenHash).Scan(&t.ID, &t.UserID, &t.FamilyID, &t.CreatedAt, &t.ExpiresAt, &rotatedAt, &revokedAt)
+	if err != nil {
+		return nil, err
+	}
+	if rotatedAt.Valid {
+		t.RotatedAt = rotatedAt.Time
+	}
+	if revokedAt.Valid {
+		t.RevokedAt = revokedAt.Time
+	}
+	return &t, nil
+}
+
+// MarkRefreshTokenRotated marks the token as used. Returns false if it was already rotated or revoked,
+// so two concurrent refreshes with the same token cannot both succeed.
+func (r *Repository) MarkRefreshTokenRotated(id int64, t time.Time) (bool, error) {
+	if r.db == nil {
+		return false, sql.ErrConnDone
+	}
+	res, err := r.db.Exec("UPDATE refresh_tokens SET rotated_at = ? WHERE id = ? AND rotated_at IS NULL AND revoked_at IS NULL", t, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// RevokeRefreshTokenFamily revokes every refresh token in the family that is not already revoked.
+func (r *Repository) RevokeRefreshTokenFamily(familyID string, t time.Time) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	_, err := r.db.Exec("UPDATE refresh_tokens SET revoked_at = ? WHERE family_id = ? AND revoked_at IS NULL", t, familyID)
+	return err
+}
+
+// RevokeUserRefreshTokens revokes the user's refresh tokens in every family except exceptFamilyID (empty = all).
+func (r *Repository) RevokeUserRefreshTokens(userID uint, exceptFamilyID string, t time.Time) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	_, err := r.db.Exec("UPDATE refresh_tokens SET revoked_at = ? WHERE user_id = ? AND family_id <> ? AND revoked_at IS NULL", t, int64(userID), exceptFamilyID)
+	return err
+}
+
+// CreateSession stores a new session.
+func (r *Repository) CreateSession(s *Session) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	_, err := r.db.Exec("INSERT INTO sessions (id, user_id, device_name, user_agent, ip, created_at, last_seen_at) VALUES (?, ?, ?, ?, ?, ?, ?)", s.ID, int64(s.UserID), s.DeviceName, s.UserAgent, s.IP, s.CreatedAt, s.LastSeenAt)
+	return err
+}
+
+// GetSession returns the session by id, or sql.ErrNoRows.
+func (r *Repository) GetSession(id string) (*Session, error) {
+	if r.db == nil {
+		return nil, sql.ErrNoRows
+	}
+	var s Session
+	var revokedAt sql.NullTime
+	err := r.db.QueryRow("SELECT id, user_id, device_name, user_agent, ip, created_at, last_seen_at, revoked_at FROM sessions WHERE id = ?", id).Scan(&s.ID, &s.UserID, &s.DeviceName, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeenAt, &revokedAt)
+	if err != nil {
+		return nil, err
+	}
+	if revokedAt.Valid {
+		s.RevokedAt = revokedAt.Time
+	}
+	return &s, nil
+}
+
+// ListActiveSessions returns the user's sessions that are not revoked and were seen after since, most recent first.
+func (r *Repository) ListActiveSessions(userID uint, since time.Time) ([]Session, error) {
+	if r.db == nil {
+		return nil, sql.ErrConnDone
+	}
+	rows, err := r.db.Query("SELECT id, user_id, device_name, user_agent, ip, created_at, last_seen_at FROM sessions WHERE user_id = ? AND revoked_at IS NULL AND last_seen_at > ? ORDER BY last_seen_at DESC", int64(userID), since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sessions []Session
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.UserID, &s.DeviceName, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeenAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// ListAllSessions returns every session of the user, including signed-out ones (for data export).
+func (r *Repository) ListAllSessions(userID uint) ([]Session, error) {
+	if r.db == nil {
+		return nil, sql.ErrConnDone
+	}
+	rows, err := r.db.Query("SELECT id, user_id, device_name, user_agent, ip, created_at, last_seen_at, revoked_at FROM sessions WHERE user_id = ? ORDER BY created_at DESC", int64(userID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sessions []Session
+	for rows.Next() {
+		var s Session
+		var revokedAt sql.NullTime
+		if err := rows.Scan(&s.ID, &s.UserID, &s.DeviceName, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeenAt, &revokedAt); err != nil {
+			return nil, err
+		}
+		s.RevokedAt = revokedAt.Time
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// TouchSession sets last_seen_at to t if it is older than staleBefore, so busy sessions don't write on every request.
+func (r *Repository) TouchSession(id string, t, staleBefore time.Time) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	_, err := r.db.Exec("UPDATE sessions SET last_seen_at = ? WHERE id = ? AND last_seen_at < ?", t, id, staleBefore)
+	return err
+}
+
+// RevokeSession marks the session revoked.
+func (r *Repository) RevokeSession(id string, t time.Time) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	_, err := r.db.Exec("UPDATE sessions SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", t, id)
+	return err
+}
+
+// RevokeUserSessions revokes all of the user's sessions except exceptID (empty = all).
+func (r *Repository) RevokeUserSessions(userID uint, exceptID string, t time.Time) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	_, err := r.db.Exec("UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND id <> ? AND revoked_at IS NULL", t, int64(userID), exceptID)
+	return err
+}
+
+// RevokeTokenID adds a token id (jti) to the denylist until expiresAt. Revoking an id twice is a no-op.
+func (r *Repository) RevokeTokenID(jti string, userID uint, expiresAt time.Time) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	_, err := r.db.Exec("INSERT IGNORE INTO revoked_tokens (jti, user_id, expires_at) VALUES (?, ?, ?)", jti, int64(userID), expiresAt)
+	return err
+}
+
+// IsTokenIDRevoked reports whether the token id is on the denylist.
+func (r *Repository) IsTokenIDRevoked(jti string) (bool, error) {
+	if r.db == nil {
+		return false, sql.ErrConnDone
+	}
+	var n int
+	err := r.db.QueryRow("SELECT COUNT(*) FROM revoked_tokens WHERE jti = ?", jti).Scan(&n)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// DeleteExpiredRevokedTokens removes denylist entries whose token has expired by now and returns how many were removed.
+func (r *Repository) DeleteExpiredRevokedTokens(now time.Time) (int64, error) {
+	if r.db == nil {
+		return 0, sql.ErrConnDone
+	}
+	res, err := r.db.Exec("DELETE FROM revoked_tokens WHERE expires_at < ?", now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// CreatePasswordResetToken stores a password reset token hash.
+func (r *Repository) CreatePasswordResetToken(userID uint, tokenHash string, createdAt, expiresAt time.Time) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	_, err := r.db.Exec("INSERT INTO password_reset_tokens (user_id, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?)", int64(userID), tokenHash, createdAt, expiresAt)
+	return err
+}
+
+// GetPasswordResetToken returns the reset token with the given hash, or sql.ErrNoRows.
+func (r *Repository) GetPasswordResetToken(tokenHash string) (*PasswordResetToken, error) {
+	if r.db == nil {
+		return nil, sql.ErrNoRows
+	}
+	var t PasswordResetToken
+	var usedAt sql.NullTime
+	err := r.db.QueryRow("SELECT id, user_id, expires_at, used_at FROM password_reset_tokens WHERE token_hash = ?", tokenHash).Scan(&t.ID, &t.UserID, &t.ExpiresAt, &usedAt)
+	if err != nil {
+		return nil, err
+	}
+	if usedAt.Valid {
+		t.UsedAt = usedAt.Time
+	}
+	return &t, nil
+}
+
+// MarkPasswordResetTokenUsed marks the token used. Returns false if it was already used, so a token works only once.
+func (r *Repository) MarkPasswordResetTokenUsed(id int64, t time.Time) (bool, error) {
+	if r.db == nil {
+		return false, sql.ErrConnDone
+	}
+	res, err := r.db.Exec("UPDATE password_reset_tokens SET used_at = ? WHERE id = ? AND used_at IS NULL", t, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// InvalidateUserPasswordResetTokens marks all of the user's unused reset tokens as used.
+func (r *Repository) InvalidateUserPasswordResetTokens(userID uint, t time.Time) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	_, err := r.db.Exec("UPDATE password_reset_tokens SET used_at = ? WHERE user_id = ? AND used_at IS NULL", t, int64(userID))
+	return err
+}
+
+// ReplaceRecoveryCodes deletes the user's recovery codes and stores the new hashes, atomically.
+func (r *Repository) ReplaceRecoveryCodes(userID uint, codeHashes []string, t time.Time) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", int64(userID)); err != nil {
+		return err
+	}
+	for _, h := range codeHashes {
+		if _, err := tx.Exec("INSERT INTO recovery_codes (user_id, code_hash, created_at) VALUES (?, ?, ?)", int64(userID), h, t); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UseRecoveryCode marks an unused recovery code of the user as used. Returns false if no such unused code exists.
+func (r *Repository) UseRecoveryCode(userID uint, codeHash string, t time.Time) (bool, error) {
+	if r.db == nil {
+		return false, sql.ErrConnDone
+	}
+	res, err := r.db.Exec("UPDATE recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL LIMIT 1", t, int64(userID), codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// ErrIdentityExists is returned when linking a provider identity that is already linked.
+var ErrIdentityExists = errors.New("identity already linked")
+
+// GetIdentityUserID returns the user linked to a provider subject and records the login time.
+// Returns sql.ErrNoRows if the identity isn't linked to any user.
+func (r *Repository) GetIdentityUserID(provider, subject string, t time.Time) (uint, error) {
+	if r.db == nil {
+		return 0, sql.ErrNoRows
+	}
+	var userID int64
+	err := r.db.QueryRow("SELECT user_id FROM user_identities WHERE provider = ? AND subject = ?", provider, subject).Scan(&userID)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := r.db.Exec("UPDATE user_identities SET last_login_at = ? WHERE provider = ? AND subject = ?", t, provider, subject); err != nil {
+		return 0, err
+	}
+	return uint(userID), nil
+}
+
+// ListIdentities returns the provider identities linked to the user.
+func (r *Repository) ListIdentities(userID uint) ([]Identity, error) {
+	if r.db == nil {
+		return nil, sql.ErrConnDone
+	}
+	rows, err := r.db.Query("SELECT provider, subject, email, created_at, last_login_at FROM user_identities WHERE user_id = ? ORDER BY id", int64(userID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var identities []Identity
+	for rows.Next() {
+		var i Identity
+		if err := rows.Scan(&i.Provider, &i.Subject, &i.Email, &i.CreatedAt, &i.LastLoginAt); err != nil {
+			return nil, err
+		}
+		identities = append(identities, i)
+	}
+	return identities, rows.Err()
+}
+
+// CreateIdentity links a provider subject to a user. Returns ErrIdentityExists if the subject is already linked.
+func (r *Repository) CreateIdentity(userID uint, provider, subject, email string, t time.Time) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	_, err := r.db.Exec("INSERT INTO user_identities (user_id, provider, subject, email, created_at, last_login_at) VALUES (?, ?, ?, ?, ?, ?)",
+		int64(userID), provider, subject, email, t, t)
+	if err != nil {
+		var myErr *mysql.MySQLError
+		if errors.As(err, &myErr) && myErr.Number == 1062 {
+			return ErrIdentityExists
+		}
+		return err
+	}
+	return nil
+}
+
+// ReserveLoginAttempt counts a login attempt for the email before the password is checked, so parallel attempts
+// can't get past the lock. Attempts older than windowStart are forgotten, so the count starts again at 1. Once the
+// count reaches threshold the same UPDATE locks the email for baseDelay, doubling with every further attempt up to
+// maxDelay. Returns false, counting nothing, while the email is locked, with the end of the lock.
+func (r *Repository) ReserveLoginAttempt(email string, threshold int, baseDelay, maxDelay time.Duration, t, windowStart time.Time) (bool, time.Time, error) {
+	if r.db == nil {
+		return false, time.Time{}, sql.ErrConnDone
+	}
+	if _, err := r.db.Exec("INSERT IGNORE INTO login_attempts (email, failed_count, last_failed_at) VALUES (?, 0, ?)", email, t); err != nil {
+		return false, time.Time{}, err
+	}
+	// failed_count is assigned first: MySQL evaluates SET left to right, so locked_until sees the new count. The
+	// exponent is capped so POW can't overflow; 2^30 times any base is far above maxDelay.
+	res, err := r.db.Exec(`UPDATE login_attempts SET failed_count = IF(last_failed_at < ?, 1, failed_count + 1),
+		last_failed_at = ?,
+		locked_until = IF(failed_count >= ?, DATE_ADD(?, INTERVAL LEAST(? * POW(2, LEAST(failed_count - ?, 30)), ?) SECOND), locked_until)
+		WHERE email = ? AND (locked_until IS NULL OR locked_until <= ?)`,
+		windowStart, t, threshold, t, baseDelay.Seconds(), threshold, maxDelay.Seconds(), email, t)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	if n == 1 {
+		return true, time.Time{}, nil
+	}
+	var lockedUntil sql.NullTime
+	if err := r.db.QueryRow("SELECT locked_until FROM login_attempts WHERE email = ?", email).Scan(&lockedUntil); err != nil {
+		return false, time.Time{}, err
+	}
+	return false, lockedUntil.Time, nil
+}
+
+// ResetLoginAttempts forgets the login attempts (and any lock) of the email.
+func (r *Repository) ResetLoginAttempts(email string) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	_, err := r.db.Exec("DELETE FROM login_attempts WHERE email = ?", email)
+	return err
+}
+
+// DeleteStaleLoginAttempts deletes entries with no attempt since windowStart and no lock left at now.
+func (r *Repository) DeleteStaleLoginAttempts(windowStart, now time.Time) (int64, error) {
+	if r.db == nil {
+		return 0, sql.ErrConnDone
+	}
+	res, err := r.db.Exec("DELETE FROM login_attempts WHERE last_failed_at < ? AND (locked_until IS NULL OR locked_until < ?)", windowStart, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ReserveMFAAttempt counts a second-factor try of the user before the code is checked, in a window that restarts
+// once windowStart has passed its beginning. Returns false, counting nothing, when the window already holds max tries,
+// with the window's beginning so the caller can tell when it ends. Concurrent tries can't exceed max.
+func (r *Repository) ReserveMFAAttempt(userID uint, max int, t, windowStart time.Time) (bool, time.Time, error) {
+	if r.db == nil {
+		return false, time.Time{}, sql.ErrConnDone
+	}
+	if _, err := r.db.Exec("INSERT IGNORE INTO mfa_attempts (user_id, attempts, window_started_at) VALUES (?, 0, ?)", int64(userID), t); err != nil {
+		return false, time.Time{}, err
+	}
+	// attempts is assigned first: MySQL evaluates SET left to right, so it must see the old window_started_at.
+	res, err := r.db.Exec(`UPDATE mfa_attempts SET attempts = IF(window_started_at < ?, 1, attempts + 1),
+		window_started_at = IF(window_started_at < ?, ?, window_started_at)
+		WHERE user_id = ? AND (window_started_at < ? OR attempts < ?)`,
+		windowStart, windowStart, t, int64(userID), windowStart, max)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	if n == 1 {
+		return true, time.Time{}, nil
+	}
+	var started time.Time
+	if err := r.db.QueryRow("SELECT window_started_at FROM mfa_attempts WHERE user_id = ?", int64(userID)).Scan(&started); err != nil {
+		return false, time.Time{}, err
+	}
+	return false, started, nil
+}
+
+// ResetMFAAttempts forgets the user's second-factor tries (after one succeeds).
+func (r *Repository) ResetMFAAttempts(userID uint) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	_, err := r.db.Exec("DELETE FROM mfa_attempts WHERE user_id = ?", int64(userID))
+	return err
+}
+
+// DeleteStaleMFAAttempts deletes second-factor counts whose window began before windowStart.
+func (r *Repository) DeleteStaleMFAAttempts(windowStart time.Time) (int64, error) {
+	if r.db == nil {
+		return 0, sql.ErrConnDone
+	}
+	res, err := r.db.Exec("DELETE FROM mfa_attempts WHERE window_started_at < ?", windowStart)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// CreateEmailLoginCode stores a login code hash and its magic link hash, invalidating the user's earlier codes. Nothing
+// is stored, and false is returned, if the user's last code is less than resendDelay old or maxPerHour codes were
+// created in the hour before createdAt. The user's row is locked meanwhile, so concurrent requests can't both pass.
+func (r *Repository) CreateEmailLoginCode(userID uint, codeHash, linkHash string, createdAt, expiresAt time.Time, resendDelay time.Duration, maxPerHour int) (bool, error) {
+	if r.db == nil {
+		return false, sql.ErrConnDone
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("SELECT id FROM users WHERE id = ? FOR UPDATE", int64(userID)); err != nil {
+		return false, err
+	}
+	var recent, lastHour int
+	err = tx.QueryRow("SELECT COALESCE(SUM(created_at > ?), 0), COUNT(*) FROM email_login_codes WHERE user_id = ? AND created_at >= ?",
+		createdAt.Add(-resendDelay), int64(userID), createdAt.Add(-time.Hour)).Scan(&recent, &lastHour)
+	if err != nil {
+		return false, err
+	}
+	if recent > 0 || lastHour >= maxPerHour {
+		return false, nil
+	}
+	if _, err := tx.Exec("UPDATE email_login_codes SET used_at = ? WHERE user_id = ? AND used_at IS NULL", createdAt, int64(userID)); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("INSERT INTO email_login_codes (user_id, code_hash, link_hash, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		int64(userID), codeHash, linkHash, createdAt, expiresAt); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+const emailLoginCodeColumns = "id, user_id, code_hash, attempts, created_at, expires_at, used_at"
+
+func scanEmailLoginCode(row *sql.Row) (*EmailLoginCode, error) {
+	var c EmailLoginCode
+	var usedAt sql.NullTime
+	if err := row.Scan(&c.ID, &c.UserID, &c.CodeHash, &c.Attempts, &c.CreatedAt, &c.ExpiresAt, &usedAt); err != nil {
+		return nil, err
+	}
+	if usedAt.Valid {
+		c.UsedAt = usedAt.Time
+	}
+	return &c, nil
+}
+
+// GetLatestEmailLoginCode returns the user's most recent login code, or sql.ErrNoRows.
+func (r *Repository) GetLatestEmailLoginCode(userID uint) (*EmailLoginCode, error) {
+	if r.db == nil {
+		return nil, sql.ErrNoRows
+	}
+	return scanEmailLoginCode(r.db.QueryRow("SELECT "+emailLoginCodeColumns+" FROM email_login_codes WHERE user_id = ? ORDER BY id DESC LIMIT 1", int64(userID)))
+}
+
+// GetEmailLoginCodeByLink returns the login code with the given magic link hash, or sql.ErrNoRows.
+func (r *Repository) GetEmailLoginCodeByLink(linkHash string) (*EmailLoginCode, error) {
+	if r.db == nil {
+		return nil, sql.ErrNoRows
+	}
+	return scanEmailLoginCode(r.db.QueryRow("SELECT "+emailLoginCodeColumns+" FROM email_login_codes WHERE link_hash = ?", linkHash))
+}
+
+// ReserveEmailLoginCodeAttempt counts a try against the login code before it is compared. Returns false, counting
+// nothing, once the code has seen max tries, so concurrent guesses can't exceed the limit.
+func (r *Repository) ReserveEmailLoginCodeAttempt(id int64, max int) (bool, error) {
+	if r.db == nil {
+		return false, sql.ErrConnDone
+	}
+	res, err := r.db.Exec("UPDATE email_login_codes SET attempts = attempts + 1 WHERE id = ? AND attempts < ?", id, max)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// MarkEmailLoginCodeUsed marks the login code used. Returns false if it was already used, so a code works only once.
+func (r *Repository) MarkEmailLoginCodeUsed(id int64, t time.Time) (bool, error) {
+	if r.db == nil {
+		return false, sql.ErrConnDone
+	}
+	res, err := r.db.Exec("UPDATE email_login_codes SET used_at = ? WHERE id = ? AND used_at IS NULL", t, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// CreateEmailChange stores an email change with its link hashes, cancelling the user's earlier unconfirmed changes.
+func (r *Repository) CreateEmailChange(c *EmailChange, confirmHash, undoHash string) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE email_changes SET cancelled_at = ? WHERE user_id = ? AND confirmed_at IS NULL AND cancelled_at IS NULL", c.CreatedAt, int64(c.UserID)); err != nil {
+		return err
+	}
+	res, err := tx.Exec("INSERT INTO email_changes (user_id, old_email, new_email, confirm_hash, undo_hash, created_at, expires_at, undo_expires_at) VALUES (?, NULLIF(?, ''), ?, ?, ?, ?, ?, ?)",
+		int64(c.UserID), c.OldEmail, c.NewEmail, confirmHash, undoHash, c.CreatedAt, c.ExpiresAt, c.UndoExpiresAt)
+	if err != nil {
+		return err
+	}
+	if c.ID, err = res.LastInsertId(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const emailChangeColumns = "id, user_id, old_email, new_email, created_at, expires_at, undo_expires_at, confirmed_at, cancelled_at"
+
+func scanEmailChange(row interface{ Scan(...interface{}) error }) (*EmailChange, error) {
+	var c EmailChange
+	var oldEmail sql.NullString
+	var confirmedAt, cancelledAt sql.NullTime
+	if err := row.Scan(&c.ID, &c.UserID, &oldEmail, &c.NewEmail, &c.CreatedAt, &c.ExpiresAt, &c.UndoExpiresAt, &confirmedAt, &cancelledAt); err != nil {
+		return nil, err
+	}
+	c.OldEmail = oldEmail.String
+	if confirmedAt.Valid {
+		c.ConfirmedAt = confirmedAt.Time
+	}
+	if cancelledAt.Valid {
+		c.CancelledAt = cancelledAt.Time
+	}
+	return &c, nil
+}
+
+// GetEmailChangeByConfirmHash returns the email change with the given confirmation link hash, or sql.ErrNoRows.
+func (r *Repository) GetEmailChangeByConfirmHash(confirmHash string) (*EmailChange, error) {
+	if r.db == nil {
+		return nil, sql.ErrNoRows
+	}
+	return scanEmailChange(r.db.QueryRow("SELECT "+emailChangeColumns+" FROM email_changes WHERE confirm_hash = ?", confirmHash))
+}
+
+// GetEmailChangeByUndoHash returns the email change with the given undo link hash, or sql.ErrNoRows.
+func (r *Repository) GetEmailChangeByUndoHash(undoHash string) (*EmailChange, error) {
+	if r.db == nil {
+		return nil, sql.ErrNoRows
+	}
+	return scanEmailChange(r.db.QueryRow("SELECT "+emailChangeColumns+" FROM email_changes WHERE undo_hash = ?", undoHash))
+}
+
+// MarkEmailChangeConfirmed marks the change applied. Returns false if it was already confirmed or cancelled.
+func (r *Repository) MarkEmailChangeConfirmed(id int64, t time.Time) (bool, error) {
+	if r.db == nil {
+		return false, sql.ErrConnDone
+	}
+	res, err := r.db.Exec("UPDATE email_changes SET confirmed_at = ? WHERE id = ? AND confirmed_at IS NULL AND cancelled_at IS NULL", t, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// MarkEmailChangeCancelled cancels (undoes) the change. Returns false if it was already cancelled, so undo works once.
+func (r *Repository) MarkEmailChangeCancelled(id int64, t time.Time) (bool, error) {
+	if r.db == nil {
+		return false, sql.ErrConnDone
+	}
+	res, err := r.db.Exec("UPDATE email_changes SET cancelled_at = ? WHERE id = ? AND cancelled_at IS NULL", t, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// ListEmailChanges returns every email change of the user, newest first (for data exports).
+func (r *Repository) ListEmailChanges(userID uint) ([]EmailChange, error) {
+	if r.db == nil {
+		return nil, sql.ErrConnDone
+	}
+	rows, err := r.db.Query("SELECT "+emailChangeColumns+" FROM email_changes WHERE user_id = ? ORDER BY id DESC", int64(userID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	changes := []EmailChange{}
+	for rows.Next() {
+		c, err := scanEmailChange(rows)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, *c)
+	}
+	return changes, rows.Err()
+}
+
+// CreatePhoneCode stores a code hash for the phone and purpose, invalidating earlier codes for the same.
+func (r *Repository) CreatePhoneCode(phone, purpose, codeHash string, createdAt, expiresAt time.Time) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE phone_codes SET used_at = ? WHERE phone = ? AND purpose = ? AND used_at IS NULL", createdAt, phone, purpose); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO phone_codes (phone, purpose, code_hash, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		phone, purpose, codeHash, createdAt, expiresAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetLatestPhoneCode returns the most recent code for the phone and purpose, or sql.ErrNoRows.
+func (r *Repository) GetLatestPhoneCode(phone, purpose string) (*PhoneCode, error) {
+	if r.db == nil {
+		return nil, sql.ErrNoRows
+	}
+	var c PhoneCode
+	var usedAt sql.NullTime
+	err := r.db.QueryRow("SELECT id, phone, purpose, code_hash, attempts, created_at, expires_at, used_at FROM phone_codes WHERE phone = ? AND purpose = ? ORDER BY id DESC LIMIT 1",
+		phone, purpose).Scan(&c.ID, &c.Phone, &c.Purpose, &c.CodeHash, &c.Attempts, &c.CreatedAt, &c.ExpiresAt, &usedAt)
+	if err != nil {
+		return nil, err
+	}
+	if usedAt.Valid {
+		c.UsedAt = usedAt.Time
+	}
+	return &c, nil
+}
+
+// CountPhoneCodesSince returns how many codes (for any purpose) were sent to the phone since t.
+func (r *Repository) CountPhoneCodesSince(phone string, t time.Time) (int, error) {
+	if r.db == nil {
+		return 0, sql.ErrConnDone
+	}
+	var n int
+	err := r.db.QueryRow("SELECT COUNT(*) FROM phone_codes WHERE phone = ? AND created_at >= ?", phone, t).Scan(&n)
+	return n, err
+}
+
+// ReservePhoneCodeAttempt counts a try against the phone code before it is compared. Returns false, counting
+// nothing, once the code has seen max tries, so concurrent guesses can't exceed the limit.
+func (r *Repository) ReservePhoneCodeAttempt(id int64, max int) (bool, error) {
+	if r.db == nil {
+		return false, sql.ErrConnDone
+	}
+	res, err := r.db.Exec("UPDATE phone_codes SET attempts = attempts + 1 WHERE id = ? AND attempts < ?", id, max)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// MarkPhoneCodeUsed marks the phone code used. Returns false if it was already used, so a code works only once.
+func (r *Repository) MarkPhoneCodeUsed(id int64, t time.Time) (bool, error) {
+	if r.db == nil {
+		return false, sql.ErrConnDone
+	}
+	res, err := r.db.Exec("UPDATE phone_codes SET used_at = ? WHERE id = ? AND used_at IS NULL", t, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// DeletePhoneCodesBefore deletes phone codes created before t and returns how many were deleted.
+func (r *Repository) DeletePhoneCodesBefore(t time.Time) (int64, error) {
+	if r.db == nil {
+		return 0, sql.ErrConnDone
+	}
+	res, err := r.db.Exec("DELETE FROM phone_codes WHERE created_at < ?", t)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// CreateAPIKey stores an API key.
+func (r *Repository) CreateAPIKey(k *APIKey, secretHash string) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	var expiresAt sql.NullTime
+	if k.ExpiresAt != nil {
+		expiresAt = sql.NullTime{Time: *k.ExpiresAt, Valid: true}
+	}
+	_, err := r.db.Exec("INSERT INTO api_keys (id, user_id, name, prefix, secret_hash, scopes, created_by, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		k.ID, int64(k.UserID), k.Name, k.Prefix, secretHash, strings.Join(k.Scopes, ","), int64(k.CreatedBy), k.CreatedAt, expiresAt)
+	return err
+}
+
+const apiKeyColumns = "id, user_id, name, prefix, scopes, created_by, created_at, expires_at, last_used_at, revoked_at"
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (*APIKey, error) {
+	var k APIKey
+	var scopes string
+	var expiresAt, lastUsedAt, revokedAt sql.NullTime
+	if err := row.Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, &scopes, &k.CreatedBy, &k.CreatedAt, &expiresAt, &lastUsedAt, &revokedAt); err != nil {
+		return nil, err
+	}
+	k.Scopes = []string{}
+	if scopes != "" {
+		k.Scopes = strings.Split(scopes, ",")
+	}
+	if expiresAt.Valid {
+		k.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		k.LastUsedAt = &lastUsedAt.Time
+	}
+	k.RevokedAt = revokedAt.Time
+	return &k, nil
+}
+
+// GetAPIKeyByHash returns the API key with the given secret hash, or sql.ErrNoRows.
+func (r *Repository) GetAPIKeyByHash(secretHash string) (*APIKey, error) {
+	if r.db == nil {
+		return nil, sql.ErrNoRows
+	}
+	return scanAPIKey(r.db.QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE secret_hash = ?", secretHash))
+}
+
+// GetAPIKey returns the API key with the given id, or sql.ErrNoRows.
+func (r *Repository) GetAPIKey(id string) (*APIKey, error) {
+	if r.db == nil {
+		return nil, sql.ErrNoRows
+	}
+	return scanAPIKey(r.db.QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE id = ?", id))
+}
+
+// ListAPIKeys returns the user's keys that are not revoked, newest first.
+func (r *Repository) ListAPIKeys(userID uint) ([]APIKey, error) {
+	if r.db == nil {
+		return nil, sql.ErrConnDone
+	}
+	rows, err := r.db.Query("SELECT "+apiKeyColumns+" FROM api_keys WHERE user_id = ? AND revoked_at IS NULL ORDER BY created_at DESC", int64(userID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *k)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeUserAPIKeys revokes every active API key of the user.
+func (r *Repository) RevokeUserAPIKeys(userID uint, t time.Time) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	_, err := r.db.Exec("UPDATE api_keys SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL", t, int64(userID))
+	return err
+}
+
+// TouchAPIKey records a use of the key, writing at most once per key until staleBefore has passed.
+func (r *Repository) TouchAPIKey(id string, t, staleBefore time.Time) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	_, err := r.db.Exec("UPDATE api_keys SET last_used_at = ? WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ?)", t, id, staleBefore)
+	return err
+}
+
+// RevokeAPIKey revokes the key. Revoking an already revoked key is a no-op.
+func (r *Repository) RevokeAPIKey(id string, t time.Time) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	_, err := r.db.Exec("UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", t, id)
+	return err
+}
+
+// CreatePasskeyChallenge stores the hash of a WebAuthn challenge. userID is 0 for login challenges (the user is
+// not known until the passkey answers).
+func (r *Repository) CreatePasskeyChallenge(challengeHash string, userID uint, purpose string, createdAt, expiresAt time.Time) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	_, err := r.db.Exec("INSERT INTO webauthn_challenges (challenge_hash, user_id, purpose, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		challengeHash, int64(userID), purpose, createdAt, expiresAt)
+	return err
+}
+
+// UsePasskeyChallenge deletes the unexpired challenge with the given hash and purpose and returns its user id.
+// ok is false if there is no such challenge or a concurrent request used it first, so each challenge works once.
+func (r *Repository) UsePasskeyChallenge(challengeHash, purpose string, now time.Time) (userID uint, ok bool, err error) {
+	if r.db == nil {
+		return 0, false, sql.ErrConnDone
+	}
+	err = r.db.QueryRow("SELECT user_id FROM webauthn_challenges WHERE challenge_hash = ? AND purpose = ? AND expires_at > ?", challengeHash, purpose, now).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	res, err := r.db.Exec("DELETE FROM webauthn_challenges WHERE challenge_hash = ?", challengeHash)
+	if err != nil {
+		return 0, false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, false, err
+	}
+	return userID, n == 1, nil
+}
+
+// DeleteExpiredPasskeyChallenges deletes challenges that expired before now and returns how many were deleted.
+func (r *Repository) DeleteExpiredPasskeyChallenges(now time.Time) (int64, error) {
+	if r.db == nil {
+		return 0, sql.ErrConnDone
+	}
+	res, err := r.db.Exec("DELETE FROM webauthn_challenges WHERE expires_at <= ?", now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// CreatePasskey stores a passkey. Returns ErrPasskeyExists if the credential ID is already registered.
+func (r *Repository) CreatePasskey(p *Passkey) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	_, err := r.db.Exec("INSERT INTO webauthn_credentials (id, user_id, credential_id, public_key, sign_count, transports, name, aaguid, synced, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		p.ID, int64(p.UserID), p.CredentialID, p.PublicKey, int64(p.SignCount), strings.Join(p.Transports, ","), p.Name, p.AAGUID, p.Synced, p.CreatedAt)
+	if err != nil {
+		var myErr *mysql.MySQLError
+		if errors.As(err, &myErr) && myErr.Number == 1062 {
+			return ErrPasskeyExists
+		}
+		return err
+	}
+	return nil
+}
+
+const passkeyColumns = "id, user_id, credential_id, public_key, sign_count, transports, name, aaguid, synced, created_at, last_used_at"
+
+func scanPasskey(row interface{ Scan(...interface{}) error }) (*Passkey, error) {
+	var p Passkey
+	var signCount int64
+	var transports string
+	var lastUsedAt sql.NullTime
+	if err := row.Scan(&p.ID, &p.UserID, &p.CredentialID, &p.PublicKey, &signCount, &transports, &p.Name, &p.AAGUID, &p.Synced, &p.CreatedAt, &lastUsedAt); err != nil {
+		return nil, err
+	}
+	p.SignCount = uint32(signCount)
+	p.Transports = []string{}
+	if transports != "" {
+		p.Transports = strings.Split(transports, ",")
+	}
+	if lastUsedAt.Valid {
+		p.LastUsedAt = &lastUsedAt.Time
+	}
+	return &p, nil
+}
+
+// GetPasskeyByCredentialID returns the passkey with the given WebAuthn credential ID, or sql.ErrNoRows.
+func (r *Repository) GetPasskeyByCredentialID(credentialID []byte) (*Passkey, error) {
+	if r.db == nil {
+		return nil, sql.ErrNoRows
+	}
+	return scanPasskey(r.db.QueryRow("SELECT "+passkeyColumns+" FROM webauthn_credentials WHERE credential_id = ?", credentialID))
+}
+
+// ListPasskeys returns the user's passkeys, newest first.
+func (r *Repository) ListPasskeys(userID uint) ([]Passkey, error) {
+	if r.db == nil {
+		return nil, sql.ErrConnDone
+	}
+	rows, err := r.db.Query("SELECT "+passkeyColumns+" FROM webauthn_credentials WHERE user_id = ? ORDER BY created_at DESC", int64(userID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	passkeys := []Passkey{}
+	for rows.Next() {
+		p, err := scanPasskey(rows)
+		if err != nil {
+			return nil, err
+		}
+		passkeys = append(passkeys, *p)
+	}
+	return passkeys, rows.Err()
+}
+
+// UpdatePasskeyUse stores the new sign count and last use. Returns false if the stored count is no longer oldCount,
+// so two concurrent logins with the same assertion can't both succeed.
+func (r *Repository) UpdatePasskeyUse(id string, oldCount, newCount uint32, t time.Time) (bool, error) {
+	if r.db == nil {
+		return false, sql.ErrConnDone
+	}
+	res, err := r.db.Exec("UPDATE webauthn_credentials SET sign_count = ?, last_used_at = ? WHERE id = ? AND sign_count = ?", int64(newCount), t, id, int64(oldCount))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// DeletePasskey deletes the user's passkey. Returns false if it doesn't exist or belongs to someone else.
+func (r *Repository) DeletePasskey(id string, userID uint) (bool, error) {
+	if r.db == nil {
+		return false, sql.ErrConnDone
+	}
+	res, err := r.db.Exec("DELETE FROM webauthn_credentials WHERE id = ? AND user_id = ?", id, int64(userID))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// ListCurrentLegalDocuments returns the current version of each kind of legal document: the one with the latest
+// published_at not after now (the highest id on a tie), ordered by kind.
+func (r *Repository) ListCurrentLegalDocuments(now time.Time) ([]LegalDocument, error) {
+	if r.db == nil {
+		return nil, sql.ErrConnDone
+	}
+	rows, err := r.db.Query(`SELECT d.id, d.kind, d.version, d.url, d.published_at FROM legal_documents d
+		WHERE d.published_at <= ? AND NOT EXISTS (
+			SELECT 1 FROM legal_documents n WHERE n.kind = d.kind AND n.published_at <= ?
+			AND (n.published_at > d.published_at OR (n.published_at = d.published_at AND n.id > d.id)))
+		ORDER BY d.kind`, now, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	docs := []LegalDocument{}
+	for rows.Next() {
+		var d LegalDocument
+		if err := rows.Scan(&d.ID, &d.Kind, &d.Version, &d.URL, &d.PublishedAt); err != nil {
+			return nil, err
+		}
+		docs = append(docs, d)
+	}
+	return docs, rows.Err()
+}
+
+// ListConsents returns every document version the user accepted, newest first.
+func (r *Repository) ListConsents(userID uint) ([]Consent, error) {
+	if r.db == nil {
+		return nil, sql.ErrConnDone
+	}
+	rows, err := r.db.Query(`SELECT c.document_id, d.kind, d.version, c.accepted_at, c.ip, c.user_agent
+		FROM user_consents c JOIN legal_documents d ON d.id = c.document_id
+		WHERE c.user_id = ? ORDER BY c.accepted_at DESC, c.id DESC`, int64(userID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	consents := []Consent{}
+	for rows.Next() {
+		var c Consent
+		if err := rows.Scan(&c.DocumentID, &c.Kind, &c.Version, &c.AcceptedAt, &c.IP, &c.UserAgent); err != nil {
+			return nil, err
+		}
+		consents = append(consents, c)
+	}
+	return consents, rows.Err()
+}
+
+// CountConsents returns how many of the documents the user accepted.
+func (r *Repository) CountConsents(userID uint, documentIDs []int64) (int, error) {
+	if r.db == nil {
+		return 0, sql.ErrConnDone
+	}
+	if len(documentIDs) == 0 {
+		return 0, nil
+	}
+	args := []interface{}{int64(userID)}
+	for _, id := range documentIDs {
+		args = append(args, id)
+	}
+	var n int
+	err := r.db.QueryRow("SELECT COUNT(*) FROM user_consents WHERE user_id = ? AND document_id IN (?"+strings.Repeat(", ?", len(documentIDs)-1)+")",
+		args...).Scan(&n)
+	return n, err
+}
+
+// CreateConsents records that the user accepted the documents, atomically. Documents already accepted keep their
+// original acceptance.
+func (r *Repository) CreateConsents(userID uint, documentIDs []int64, t time.Time, ip, userAgent string) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, id := range documentIDs {
+		if _, err := tx.Exec("INSERT INTO user_consents (user_id, document_id, accepted_at, ip, user_agent) VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE id = id",
+			int64(userID), id, t, ip, userAgent); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// userAuthTables are the auth tables with rows keyed by user_id.
+var userAuthTables = []string{
+	"refresh_tokens", "sessions", "revoked_tokens", "password_reset_tokens", "recovery_codes",
+	"user_identities", "email_login_codes", "email_changes", "api_keys", "webauthn_credentials", "webauthn_challenges",
+	"user_consents", "mfa_attempts",
+}
+
+// DeleteUserAuthData deletes every auth row of the user (tokens, sessions, codes, identities, API keys, passkeys), atomically.
+func (r *Repository) DeleteUserAuthData(userID uint) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range userAuthTables {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE user_id = ?", int64(userID)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -1,17 +1,24 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"log/slog"
 	"net/mail"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
-	"unicode"
 
+	"github.com/bilalabsh/zabaan_backend/internal/mailer"
 	"github.com/bilalabsh/zabaan_backend/internal/models"
+	"github.com/bilalabsh/zabaan_backend/internal/sms"
 	"github.com/bilalabsh/zabaan_backend/internal/user"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/bilalabsh/zabaan_backend/internal/webauthn"
 )
 
 // ErrInvalidCredentials is returned when login fails.
@@ -23,10 +30,11 @@ var ErrEmailExists = errors.New("email already exists")
 // ErrInvalidEmail is returned when the email format is invalid.
 var ErrInvalidEmail = errors.New("invalid email format")
 
-// ErrWeakPassword is returned when the password does not meet policy (min length, letter, number).
+// ErrWeakPassword is returned when the password does not meet the password policy; the concrete error is a
+// *PasswordPolicyError listing the reasons.
 var ErrWeakPassword = errors.New("password does not meet requirements")
 
-// ErrPasswordTooLong is returned when the password exceeds bcrypt's 72-byte limit.
+// ErrPasswordTooLong is returned when the password exceeds maxPasswordBytes, or bcrypt's 72-byte limit when hashing with bcrypt.
 var ErrPasswordTooLong = errors.New("password too long")
 
 // ErrEmailTooLong is returned when the email exceeds the maximum allowed length.
@@ -41,9 +49,34 @@ var ErrLastNameTooLong = errors.New("last_name too long")
 // ErrTokenRevoked is returned when the token was valid but has been revoked (e.g. after GetToken).
 var ErrTokenRevoked = errors.New("token revoked")
 
+// Revocation reasons carried by RevokedError.
+const (
+	RevocationAllTokens      = "all_tokens_revoked" // every token of the user was revoked (getToken, password change, refresh token reuse)
+	RevocationLoggedOut      = "logged_out"         // this token was revoked by POST /logout
+	RevocationSessionRevoked = "session_revoked"    // the token's session was signed out
+)
+
+// RevokedError is returned by ValidateTokenFull for a revoked token. errors.Is(err, ErrTokenRevoked) holds.
+type RevokedError struct {
+	Reason string
+}
+
+func (e *RevokedError) Error() string { return "token revoked: " + e.Reason }
+
+func (e *RevokedError) Is(target error) bool { return target == ErrTokenRevoked }
+
+// ErrTokenNotRevocable is returned when a token carries neither a token id nor a session id, so it can't be revoked on its own.
+var ErrTokenNotRevocable = errors.New("token cannot be revoked individually")
+
+// ErrRefreshTokenInvalid is returned when a refresh token is unknown, expired, or revoked.
+var ErrRefreshTokenInvalid = errors.New("invalid refresh token")
+
+// ErrRefreshTokenReused is returned when an already-rotated refresh token is presented again.
+// The whole token family and all of the user's access tokens are revoked when this happens.
+var ErrRefreshTokenReused = errors.New("refresh token reused")
+
 const minPasswordLength = 8
-const maxPasswordBytes = 72 // bcrypt truncates at 72 bytes
-const bcryptCost = 12
+const maxPasswordBytes = 128 // upper bound so hashing stays cheap to reject; bcrypt still stops at 72
 const maxEmailLength = 255
 const maxFirstNameLength = 100
 const maxLastNameLength = 100
@@ -53,30 +86,274 @@ type TokenValidator interface {
 	ValidateTokenFull(tokenString string) (*Claims, error)
 }
 
+// PrincipalValidator validates Bearer tokens and API keys. Used by middleware.RequireAuthOrAPIKey.
+type PrincipalValidator interface {
+	TokenValidator
+	ValidateAPIKey(key string) (*Claims, error)
+}
+
+// ConsentChecker reports whether a user accepted the current legal documents. Used by middleware.RequireConsent.
+type ConsentChecker interface {
+	HasCurrentConsents(userID uint) (bool, error)
+}
+
 // UserRepository is the subset of user persistence needed by the auth service. Accepting an interface allows tests to use a mock.
 type UserRepository interface {
 	CreateWithPassword(email, username, firstName, lastName, passwordHash string) (*models.User, error)
+	GetByID(id uint) (*models.User, error)
 	GetByEmail(email string) (*models.User, string, error)
+	GetByPhone(phone string) (*models.User, error)
+	CreateWithPhone(phone, username, firstName, lastName string) (*models.User, error)
 	GetTokenValidAfter(userID uint) (time.Time, error)
 	UpdateTokenValidAfter(userID uint, t time.Time) error
+	MarkEmailVerified(userID uint, t time.Time) error
+	UpdateEmail(userID uint, email string, t time.Time) error
+	GetPasswordHash(userID uint) (string, error)
+	UpdatePassword(userID uint, passwordHash string) error
+	GetTOTP(userID uint) (secret string, enabled bool, lastStep int64, err error)
+	SetPendingTOTPSecret(userID uint, secret string) error
+	EnableTOTP(userID uint, t time.Time) error
+	UpdateTOTPLastStep(userID uint, step int64) (bool, error)
+	AddRole(userID uint, role string) error
+	CreateGuest(username string, t time.Time) (*models.User, error)
+	UpgradeGuest(id uint, email, username, firstName, lastName, passwordHash string) (bool, error)
+	SetGuestProfile(id uint, firstName, lastName, passwordHash string) (bool, error)
+	TouchGuest(id uint, t time.Time) error
+	ListStaleGuests(before time.Time, limit int) ([]uint, error)
+	DeleteStaleGuest(id uint, before time.Time) (bool, error)
+	ScheduleDeletion(id uint, t time.Time) error
+	CancelDeletion(id uint, t time.Time) (bool, error)
+	ListDueDeletions(t time.Time, limit int) ([]models.User, error)
+	DeleteScheduled(id uint, t time.Time) (bool, error)
+}
+
+// TokenRepository is the persistence needed for refresh tokens, sessions, the token denylist, password resets,
+// recovery codes, linked provider identities, login attempt counts, email and phone login codes, API keys, passkeys
+// and legal consents. Implemented by Repository.
+type TokenRepository interface {
+	CreateRefreshToken(userID uint, familyID, tokenHash string, createdAt, expiresAt time.Time) error
+	GetRefreshTokenByHash(tokenHash string) (*RefreshToken, error)
+	MarkRefreshTokenRotated(id int64, t time.Time) (bool, error)
+	RevokeRefreshTokenFamily(familyID string, t time.Time) error
+	RevokeUserRefreshTokens(userID uint, exceptFamilyID string, t time.Time) error
+	CreateSession(s *Session) error
+	GetSession(id string) (*Session, error)
+	ListActiveSessions(userID uint, since time.Time) ([]Session, error)
+	TouchSession(id string, t, staleBefore time.Time) error
+	RevokeSession(id string, t time.Time) error
+	RevokeUserSessions(userID uint, exceptID string, t time.Time) error
+	RevokeTokenID(jti string, userID uint, expiresAt time.Time) error
+	IsTokenIDRevoked(jti string) (bool, error)
+	DeleteExpiredRevokedTokens(now time.Time) (int64, error)
+	CreatePasswordResetToken(userID uint, tokenHash string, createdAt, expiresAt time.Time) error
+	GetPasswordResetToken(tokenHash string) (*PasswordResetToken, error)
+	MarkPasswordResetTokenUsed(id int64, t time.Time) (bool, error)
+	InvalidateUserPasswordResetTokens(userID uint, t time.Time) error
+	ReplaceRecoveryCodes(userID uint, codeHashes []string, t time.Time) error
+	UseRecoveryCode(userID uint, codeHash string, t time.Time) (bool, error)
+	GetIdentityUserID(provider, subject string, t time.Time) (uint, error)
+	CreateIdentity(userID uint, provider, subject, email string, t time.Time) error
+	ReserveLoginAttempt(email string, threshold int, baseDelay, maxDelay time.Duration, t, windowStart time.Time) (bool, time.Time, error)
+	ResetLoginAttempts(email string) error
+	DeleteStaleLoginAttempts(windowStart, now time.Time) (int64, error)
+	ReserveMFAAttempt(userID uint, max int, t, windowStart time.Time) (bool, time.Time, error)
+	ResetMFAAttempts(userID uint) error
+	DeleteStaleMFAAttempts(windowStart time.Time) (int64, error)
+	CreateEmailLoginCode(userID uint, codeHash, linkHash string, createdAt, expiresAt time.Time, resendDelay time.Duration, maxPerHour int) (bool, error)
+	GetLatestEmailLoginCode(userID uint) (*EmailLoginCode, error)
+	GetEmailLoginCodeByLink(linkHash string) (*EmailLoginCode, error)
+	ReserveEmailLoginCodeAttempt(id int64, max int) (bool, error)
+	MarkEmailLoginCodeUsed(id int64, t time.Time) (bool, error)
+	CreateEmailChange(c *EmailChange, confirmHash, undoHash string) error
+	GetEmailChangeByConfirmHash(confirmHash string) (*EmailChange, error)
+	GetEmailChangeByUndoHash(undoHash string) (*EmailChange, error)
+	MarkEmailChangeConfirmed(id int64, t time.Time) (bool, error)
+	MarkEmailChangeCancelled(id int64, t time.Time) (bool, error)
+	ListEmailChanges(userID uint) ([]EmailChange, error)
+	CreatePhoneCode(phone, purpose, codeHash string, createdAt, expiresAt time.Time) error
+	GetLatestPhoneCode(phone, purpose string) (*PhoneCode, error)
+	CountPhoneCodesSince(phone string, t time.Time) (int, error)
+	ReservePhoneCodeAttempt(id int64, max int) (bool, error)
+	MarkPhoneCodeUsed(id int64, t time.Time) (bool, error)
+	DeletePhoneCodesBefore(t time.Time) (int64, error)
+	CreateAPIKey(k *APIKey, secretHash string) error
+	GetAPIKeyByHash(secretHash string) (*APIKey, error)
+	GetAPIKey(id string) (*APIKey, error)
+	ListAPIKeys(userID uint) ([]APIKey, error)
+	TouchAPIKey(id string, t, staleBefore time.Time) error
+	RevokeAPIKey(id string, t time.Time) error
+	DeleteUserAuthData(userID uint) error
+	ListAllSessions(userID uint) ([]Session, error)
+	ListIdentities(userID uint) ([]Identity, error)
+	RevokeUserAPIKeys(userID uint, t time.Time) error
+	CreatePasskeyChallenge(challengeHash string, userID uint, purpose string, createdAt, expiresAt time.Time) error
+	UsePasskeyChallenge(challengeHash, purpose string, now time.Time) (uint, bool, error)
+	DeleteExpiredPasskeyChallenges(now time.Time) (int64, error)
+	CreatePasskey(p *Passkey) error
+	GetPasskeyByCredentialID(credentialID []byte) (*Passkey, error)
+	ListPasskeys(userID uint) ([]Passkey, error)
+	UpdatePasskeyUse(id string, oldCount, newCount uint32, t time.Time) (bool, error)
+	DeletePasskey(id string, userID uint) (bool, error)
+	ListCurrentLegalDocuments(now time.Time) ([]LegalDocument, error)
+	ListConsents(userID uint) ([]Consent, error)
+	CountConsents(userID uint, documentIDs []int64) (int, error)
+	CreateConsents(userID uint, documentIDs []int64, t time.Time, ip, userAgent string) error
+}
+
+// Options configures the auth service.
+type Options struct {
+	Keys                *KeySet       // signs and verifies access tokens
+	TokenExpiry         time.Duration // access token lifetime
+	RefreshTokenExpiry  time.Duration // refresh token lifetime
+	RevocationTolerance time.Duration // tolerance when comparing token iat to token_valid_after
+
+	Mailer                  mailer.Mailer
+	AppBaseURL              string        // base URL of the app, used to build links in emails
+	EmailVerification       string        // EmailVerificationOff, EmailVerificationLogin or EmailVerificationProtected
+	VerificationTokenExpiry time.Duration // lifetime of email verification links
+	PasswordResetExpiry     time.Duration // lifetime of password reset links
+	EmailLoginCodeExpiry    time.Duration // lifetime of passwordless login codes and magic links
+	EmailChangeExpiry       time.Duration // lifetime of the link that confirms a new email
+	EmailChangeUndoExpiry   time.Duration // how long the old address can undo an email change
+
+	SMS                     sms.SMSSender
+	PhoneDefaultCountryCode string        // country calling code added to national numbers, e.g. "92"
+	PhoneCodeExpiry         time.Duration // lifetime of SMS signup and login codes
+	PhoneCodesPerHour       int           // messages a number can receive per hour
+
+	IdentityVerifier IdentityVerifier       // verifies Google/Apple ID tokens; nil disables OIDC login
+	Passkeys         *webauthn.RelyingParty // WebAuthn relying party for passkeys; nil disables them
+	Lockout          LockoutPolicy          // per-account lockout after failed logins
+	Hasher           PasswordHasher         // hashes new passwords; nil means bcrypt with cost 12
+	PasswordPolicy   *PasswordPolicy        // rules for new passwords; nil means DefaultPasswordPolicy
+	AdminEmails      []string               // verified users with these emails are made admins when they sign in
+	GuestAccountTTL  time.Duration          // guests not seen for this long are deleted by PruneGuests; 0 keeps them
+	DeletionGrace    time.Duration          // time between DELETE /me and the purge; logging in meanwhile cancels it
+	UserDataStores   []UserDataStore        // other modules' data about users, included in exports and deletions
+
+	IntrospectionClients map[string]string // client id → secret of services allowed to call POST /oauth/introspect
+	ImpersonationExpiry  time.Duration     // lifetime of tokens from POST /admin/users/{id}/impersonate
+	AntiEnumeration      bool              // signup and login don't reveal whether an email has an account
 }
 
-// Service holds auth use-case logic (signup, login).
+// Service holds auth use-case logic (signup, login, tokens).
 type Service struct {
 	userRepo            UserRepository
-	jwtSecret           string
+	tokenRepo           TokenRepository
+	keys                *KeySet
 	tokenExpiry         time.Duration
+	refreshTokenExpiry  time.Duration
 	revocationTolerance time.Duration
+
+	mailer                  mailer.Mailer
+	appBaseURL              string
+	emailVerification       string
+	verificationTokenExpiry time.Duration
+	passwordResetExpiry     time.Duration
+	emailLoginCodeExpiry    time.Duration
+	emailChangeExpiry       time.Duration
+	emailChangeUndoExpiry   time.Duration
+
+	sms               sms.SMSSender
+	phoneCountryCode  string
+	phoneCodeExpiry   time.Duration
+	phoneCodesPerHour int
+
+	identityVerifier IdentityVerifier
+	passkeys         *webauthn.RelyingParty
+	lockout          LockoutPolicy
+	hasher           PasswordHasher
+	passwordPolicy   PasswordPolicy
+	adminEmails      map[string]bool
+	guestAccountTTL  time.Duration
+	deletionGrace    time.Duration
+	userDataStores   []UserDataStore
+
+	introspectionClients map[string]string
+	impersonationExpiry  time.Duration
+	antiEnumeration      bool
+	dummyHashOnce        sync.Once
+	dummyHash            string
+	legalDocuments       legalDocumentsCache
 }
 
-// NewService returns a new auth service. tokenExpiry is the JWT lifetime (e.g. 24h); revocationTolerance is the time tolerance when comparing token iat to token_valid_after.
-func NewService(userRepo UserRepository, jwtSecret string, tokenExpiry, revocationTolerance time.Duration) *Service {
+// NewService returns a new auth service.
+func NewService(userRepo UserRepository, tokenRepo TokenRepository, opts Options) *Service {
+	hasher := opts.Hasher
+	if hasher == nil {
+		hasher, _ = NewPasswordHasher(HasherConfig{Algorithm: HashBcrypt, BcryptCost: 12})
+	}
+	adminEmails := make(map[string]bool)
+	for _, email := range opts.AdminEmails {
+		adminEmails[NormalizeEmail(email)] = true
+	}
+	policy := DefaultPasswordPolicy()
+	if opts.PasswordPolicy != nil {
+		policy = *opts.PasswordPolicy
+	}
 	return &Service{
 		userRepo:            userRepo,
-		jwtSecret:           jwtSecret,
-		tokenExpiry:         tokenExpiry,
-		revocationTolerance: revocationTolerance,
+		tokenRepo:           tokenRepo,
+		keys:                opts.Keys,
+		tokenExpiry:         opts.TokenExpiry,
+		refreshTokenExpiry:  opts.RefreshTokenExpiry,
+		revocationTolerance: opts.RevocationTolerance,
+
+		mailer:                  opts.Mailer,
+		appBaseURL:              strings.TrimRight(opts.AppBaseURL, "/"),
+		emailVerification:       opts.EmailVerification,
+		verificationTokenExpiry: opts.VerificationTokenExpiry,
+		passwordResetExpiry:     opts.PasswordResetExpiry,
+		emailLoginCodeExpiry:    opts.EmailLoginCodeExpiry,
+		emailChangeExpiry:       opts.EmailChangeExpiry,
+		emailChangeUndoExpiry:   opts.EmailChangeUndoExpiry,
+
+		sms:               opts.SMS,
+		phoneCountryCode:  opts.PhoneDefaultCountryCode,
+		phoneCodeExpiry:   opts.PhoneCodeExpiry,
+		phoneCodesPerHour: opts.PhoneCodesPerHour,
+
+		identityVerifier: opts.IdentityVerifier,
+		passkeys:         opts.Passkeys,
+		lockout:          opts.Lockout,
+		hasher:           hasher,
+		passwordPolicy:   policy,
+		adminEmails:      adminEmails,
+		guestAccountTTL:  opts.GuestAccountTTL,
+		deletionGrace:    opts.DeletionGrace,
+		userDataStores:   opts.UserDataStores,
+
+		introspectionClients: opts.IntrospectionClients,
+		impersonationExpiry:  opts.ImpersonationExpiry,
+		antiEnumeration:      opts.AntiEnumeration,
+	}
+}
+
+// UserError attaches the affected user to an error (e.g. a reused refresh token or a wrong 2FA code) so handlers
+// can record it in the audit log. errors.Is and errors.As see the wrapped error.
+type UserError struct {
+	UserID uint
+	Err    error
+}
+
+func (e *UserError) Error() string { return e.Err.Error() }
+
+func (e *UserError) Unwrap() error { return e.Err }
+
+// ErrorUserID returns the user attached to err with UserError, or 0.
+func ErrorUserID(err error) uint {
+	var ue *UserError
+	if errors.As(err, &ue) {
+		return ue.UserID
 	}
+	return 0
+}
+
+// TokenPair is a short-lived access token (JWT) and the opaque refresh token that renews it.
+type TokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	UserID       uint // user the tokens were issued to
 }
 
 // NormalizeEmail returns email trimmed and lowercased for storage and lookup.
@@ -97,107 +374,306 @@ func ValidateEmail(email string) error {
 	return nil
 }
 
-// ValidatePassword returns ErrWeakPassword if the password does not meet policy, or ErrPasswordTooLong if over 72 bytes (bcrypt limit).
-func ValidatePassword(password string) error {
-	if len(password) < minPasswordLength {
-		return ErrWeakPassword
-	}
-	if len(password) > maxPasswordBytes {
-		return ErrPasswordTooLong
+// SignUp registers a user and returns the created user.
+// Email is normalized (trimmed, lowercased) for storage and uniqueness. With AntiEnumeration, an existing email
+// still gets ErrEmailExists but its owner is emailed about the attempt, and emails are sent in the background
+// so both cases take as long; the handler then answers them the same way.
+func (s *Service) SignUp(firstName, lastName, email, password string) (*models.User, error) {
+	email, hash, err := s.prepareSignUp(firstName, lastName, email, password)
+	if err != nil {
+		return nil, err
 	}
-	var hasLetter, hasNumber bool
-	for _, r := range password {
-		if unicode.IsLetter(r) {
-			hasLetter = true
-		}
-		if unicode.IsNumber(r) {
-			hasNumber = true
-		}
-		if hasLetter && hasNumber {
-			break
+	username := email
+	u, err := s.userRepo.CreateWithPassword(email, username, firstName, lastName, hash)
+	if err != nil {
+		if errors.Is(err, user.ErrDuplicateEmail) {
+			if s.antiEnumeration {
+				s.sendAccountExistsEmail(email)
+			}
+			return nil, ErrEmailExists
 		}
+		return nil, err
 	}
-	if !hasLetter || !hasNumber {
-		return ErrWeakPassword
+	if s.antiEnumeration {
+		go s.sendSignUpVerificationEmail(u)
+	} else {
+		s.sendSignUpVerificationEmail(u)
 	}
-	return nil
+	return u, nil
 }
 
-// SignUp registers a user and returns the created user.
-// Email is normalized (trimmed, lowercased) for storage and uniqueness.
-func (s *Service) SignUp(firstName, lastName, email, password string) (*models.User, error) {
+// sendSignUpVerificationEmail sends the verification link for a new account, logging failures.
+func (s *Service) sendSignUpVerificationEmail(u *models.User) {
+	if err := s.sendVerificationEmail(u); err != nil {
+		// The account exists either way; the user can ask for a new link via /verify-email/resend.
+		slog.Error("sending verification email failed", "component", "auth", "user_id", u.ID, "err", err)
+	}
+}
+
+// prepareSignUp validates signup fields (also used when a guest upgrades) and returns the normalized email and the password hash.
+func (s *Service) prepareSignUp(firstName, lastName, email, password string) (string, string, error) {
 	email = NormalizeEmail(email)
 	if err := ValidateEmail(email); err != nil {
-		return nil, err
+		return "", "", err
 	}
 	if len(email) > maxEmailLength {
-		return nil, ErrEmailTooLong
+		return "", "", ErrEmailTooLong
 	}
 	if len(firstName) > maxFirstNameLength {
-		return nil, ErrFirstNameTooLong
+		return "", "", ErrFirstNameTooLong
 	}
 	if len(lastName) > maxLastNameLength {
-		return nil, ErrLastNameTooLong
-	}
-	if err := ValidatePassword(password); err != nil {
-		return nil, err
+		return "", "", ErrLastNameTooLong
 	}
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
-	if err != nil {
-		return nil, err
+	if err := s.passwordPolicy.Validate(password, email, firstName, lastName); err != nil {
+		return "", "", err
 	}
-	username := email
-	u, err := s.userRepo.CreateWithPassword(email, username, firstName, lastName, string(hash))
+	hash, err := s.hasher.Hash(password)
 	if err != nil {
-		if errors.Is(err, user.ErrDuplicateEmail) {
-			return nil, ErrEmailExists
-		}
-		return nil, err
+		return "", "", err
 	}
-	return u, nil
+	return email, hash, nil
 }
 
 // Login validates credentials and returns the user.
-// Email is normalized (trimmed, lowercased) for lookup.
+// Email is normalized (trimmed, lowercased) for lookup. Every attempt counts towards the per-email lockout before
+// the password is checked, and a successful one clears the count; while locked, a *LockedError is returned without
+// checking the password. With AntiEnumeration, unknown emails still go through a (dummy) password check so they
+// take as long as a wrong password, and an unverified email gets ErrInvalidCredentials like a wrong password
+// rather than ErrEmailNotVerified.
 func (s *Service) Login(email, password string) (*models.User, error) {
 	email = NormalizeEmail(email)
 	if len(email) > maxEmailLength {
 		return nil, ErrEmailTooLong
 	}
+	if err := s.reserveLoginAttempt(email); err != nil {
+		return nil, err
+	}
 	u, hash, err := s.userRepo.GetByEmail(email)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
+			if s.antiEnumeration {
+				s.dummyVerify(password)
+			}
 			return nil, ErrInvalidCredentials
 		}
 		return nil, err
 	}
+	// Accounts without a password (created through Google/Apple sign-in) can't log in with one.
 	if hash == "" {
+		if s.antiEnumeration {
+			s.dummyVerify(password)
+		}
+		return nil, ErrInvalidCredentials
+	}
+	ok, err := s.hasher.Verify(hash, password)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
 		return nil, ErrInvalidCredentials
 	}
-	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+	if s.antiEnumeration && emailUnverified(u) {
+		// Whoever signed up with someone else's email knows the password they chose: telling them the email is
+		// unverified (or letting them in) would reveal that the address had no account. The attempt stays
+		// counted like a wrong password so the lockout doesn't tell either.
 		return nil, ErrInvalidCredentials
 	}
+	if !u.TwoFactorEnabled {
+		// With 2FA the lockout is only cleared once the second factor succeeds (CompleteMFALogin).
+		s.resetLoginAttempts(email)
+	}
+	s.rehashIfNeeded(u.ID, hash, password)
+	if s.emailVerification == EmailVerificationLogin && !u.EmailVerified {
+		return nil, ErrEmailNotVerified
+	}
 	return u, nil
 }
 
 // CreateToken issues a JWT for the user.
 func (s *Service) CreateToken(userID uint, email string) (string, error) {
-	return CreateToken(s.jwtSecret, userID, email, s.tokenExpiry)
+	return CreateToken(s.keys, userID, email, s.tokenExpiry)
 }
 
 // CreateTokenWithIssuedAt issues a JWT with the given IssuedAt (use with RevokePreviousTokensAt so the new token is not revoked).
 func (s *Service) CreateTokenWithIssuedAt(userID uint, email string, issuedAt time.Time) (string, error) {
-	return CreateTokenWithIssuedAt(s.jwtSecret, userID, email, issuedAt, s.tokenExpiry)
+	return CreateTokenWithIssuedAt(s.keys, userID, email, issuedAt, s.tokenExpiry)
 }
 
-// RevokePreviousTokensAt invalidates all tokens issued before t. Use the same t when creating the new token so the new token is valid.
+// RevokePreviousTokensAt invalidates all tokens issued before t, signs out every existing session and revokes
+// every API key. Use the same t when creating the new token so the new token is valid.
 func (s *Service) RevokePreviousTokensAt(userID uint, t time.Time) error {
-	return s.userRepo.UpdateTokenValidAfter(userID, t)
+	if err := s.userRepo.UpdateTokenValidAfter(userID, t); err != nil {
+		return err
+	}
+	if err := s.tokenRepo.RevokeUserAPIKeys(userID, t); err != nil {
+		return err
+	}
+	return s.tokenRepo.RevokeUserSessions(userID, "", t)
+}
+
+// IssueTokens starts a new session for the device described by info and returns its first token pair.
+// Signing in cancels a deletion scheduled with DELETE /me.
+// Pass the same issuedAt as RevokePreviousTokensAt so neither token is considered revoked.
+// Returns ErrEmailNotVerified when verification is required for login and the user has an unverified email.
+func (s *Service) IssueTokens(u *models.User, issuedAt time.Time, info SessionInfo) (*TokenPair, error) {
+	if s.emailVerification == EmailVerificationLogin && emailUnverified(u) {
+		return nil, ErrEmailNotVerified
+	}
+	if err := s.grantBootstrapAdmin(u); err != nil {
+		return nil, err
+	}
+	if err := s.cancelDeletion(u); err != nil {
+		return nil, err
+	}
+	sessionID, err := s.createSession(u.ID, info, issuedAt)
+	if err != nil {
+		return nil, err
+	}
+	return s.issueTokensInFamily(u, sessionID, issuedAt)
+}
+
+// grantBootstrapAdmin makes u an admin if its email is in AdminEmails and verified, so the first admins exist
+// without editing the database. Later admins are managed through PUT /users/{id}/roles.
+func (s *Service) grantBootstrapAdmin(u *models.User) error {
+	if !u.EmailVerified || !s.adminEmails[u.Email] {
+		return nil
+	}
+	for _, role := range u.Roles {
+		if role == models.RoleAdmin {
+			return nil
+		}
+	}
+	if err := s.userRepo.AddRole(u.ID, models.RoleAdmin); err != nil {
+		return err
+	}
+	if len(u.Roles) == 1 && u.Roles[0] == models.RoleLearner {
+		// The implicit learner role was never stored; adding admin replaces it.
+		u.Roles = nil
+	}
+	u.Roles = append(u.Roles, models.RoleAdmin)
+	return nil
+}
+
+// issueTokensInFamily issues an access token bound to the session and a refresh token in the session's family.
+func (s *Service) issueTokensInFamily(u *models.User, familyID string, issuedAt time.Time) (*TokenPair, error) {
+	userID := u.ID
+	claims := NewClaims(userID, u.Email, issuedAt, s.tokenExpiry)
+	claims.EmailVerified = u.EmailVerified
+	claims.PhoneVerified = u.Phone != ""
+	claims.SessionID = familyID
+	claims.Roles = u.Roles
+	claims.Guest = u.IsGuest
+	if u.IsGuest {
+		if err := s.userRepo.TouchGuest(userID, issuedAt); err != nil {
+			return nil, err
+		}
+	}
+	accessToken, err := SignToken(s.keys, claims)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := newOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.tokenRepo.CreateRefreshToken(userID, familyID, hashToken(refreshToken), issuedAt, issuedAt.Add(s.refreshTokenExpiry)); err != nil {
+		return nil, err
+	}
+	return &TokenPair{AccessToken: accessToken, RefreshToken: refreshToken, UserID: userID}, nil
+}
+
+// Refresh exchanges a refresh token for a new token pair. The presented token is rotated and can't be used again.
+// Presenting an already-rotated token is treated as theft: the whole family is revoked, along with every
+// access token of the user (via token_valid_after), and ErrRefreshTokenReused is returned.
+func (s *Service) Refresh(refreshToken string) (*TokenPair, error) {
+	if refreshToken == "" {
+		return nil, ErrRefreshTokenInvalid
+	}
+	stored, err := s.tokenRepo.GetRefreshTokenByHash(hashToken(refreshToken))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRefreshTokenInvalid
+		}
+		return nil, err
+	}
+	now := time.Now()
+	if !stored.RevokedAt.IsZero() {
+		return nil, ErrRefreshTokenInvalid
+	}
+	if !stored.RotatedAt.IsZero() {
+		return nil, s.revokeReusedFamily(stored, now)
+	}
+	if !now.Before(stored.ExpiresAt) {
+		return nil, ErrRefreshTokenInvalid
+	}
+	revoked, err := s.issuedBeforeValidAfter(stored.UserID, stored.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrRefreshTokenInvalid
+	}
+	sess, err := s.tokenRepo.GetSession(stored.FamilyID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRefreshTokenInvalid
+		}
+		return nil, err
+	}
+	if sess.UserID != stored.UserID || !sess.RevokedAt.IsZero() {
+		return nil, ErrRefreshTokenInvalid
+	}
+	ok, err := s.tokenRepo.MarkRefreshTokenRotated(stored.ID, now)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// Lost a race with another refresh using the same token: that is reuse too.
+		return nil, s.revokeReusedFamily(stored, now)
+	}
+	u, err := s.userRepo.GetByID(stored.UserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRefreshTokenInvalid
+		}
+		return nil, err
+	}
+	if err := s.tokenRepo.TouchSession(stored.FamilyID, now, now); err != nil {
+		return nil, err
+	}
+	return s.issueTokensInFamily(u, stored.FamilyID, now)
+}
+
+// revokeReusedFamily revokes the refresh token family and all tokens and sessions of its user, then returns ErrRefreshTokenReused.
+func (s *Service) revokeReusedFamily(stored *RefreshToken, now time.Time) error {
+	if err := s.tokenRepo.RevokeRefreshTokenFamily(stored.FamilyID, now); err != nil {
+		return err
+	}
+	if err := s.RevokePreviousTokensAt(stored.UserID, now); err != nil {
+		return err
+	}
+	return &UserError{UserID: stored.UserID, Err: ErrRefreshTokenReused}
+}
+
+// issuedBeforeValidAfter reports whether a token issued at issuedAt predates the user's token_valid_after.
+func (s *Service) issuedBeforeValidAfter(userID uint, issuedAt time.Time) (bool, error) {
+	validAfter, err := s.userRepo.GetTokenValidAfter(userID)
+	if err != nil {
+		return false, err
+	}
+	if validAfter.IsZero() {
+		return false, nil
+	}
+	tokenSec := issuedAt.Truncate(time.Second)
+	validSec := validAfter.Truncate(time.Second)
+	return tokenSec.Add(s.revocationTolerance).Before(validSec), nil
 }
 
 // ValidateTokenFull validates the JWT and checks revocation (only tokens issued after token_valid_after are valid).
+// Revoked tokens return a *RevokedError with the reason.
 func (s *Service) ValidateTokenFull(tokenString string) (*Claims, error) {
-	claims, err := ValidateToken(s.jwtSecret, tokenString)
+	claims, err := ValidateToken(s.keys, tokenString)
 	if err != nil {
 		return nil, err
 	}
@@ -205,23 +681,123 @@ func (s *Service) ValidateTokenFull(tokenString string) (*Claims, error) {
 	if err != nil {
 		return nil, ErrTokenInvalid
 	}
-	validAfter, err := s.userRepo.GetTokenValidAfter(uint(userID64))
-	if err != nil {
-		return nil, err
+	if claims.IssuedAt != nil {
+		revoked, err := s.issuedBeforeValidAfter(uint(userID64), claims.IssuedAt.Time)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, &RevokedError{Reason: RevocationAllTokens}
+		}
+	}
+	if claims.Actor != nil {
+		// An impersonation token dies with the admin's tokens too (e.g. after a password change or GetToken).
+		actorID := ImpersonatorID(claims)
+		if actorID == 0 || claims.IssuedAt == nil {
+			return nil, ErrTokenInvalid
+		}
+		revoked, err := s.issuedBeforeValidAfter(actorID, claims.IssuedAt.Time)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, &RevokedError{Reason: RevocationAllTokens}
+		}
+	}
+	if claims.ID != "" {
+		denied, err := s.tokenRepo.IsTokenIDRevoked(claims.ID)
+		if err != nil {
+			return nil, err
+		}
+		if denied {
+			return nil, &RevokedError{Reason: RevocationLoggedOut}
+		}
 	}
-	if !validAfter.IsZero() && claims.IssuedAt != nil {
-		tokenSec := claims.IssuedAt.Time.Truncate(time.Second)
-		validSec := validAfter.Truncate(time.Second)
-		if tokenSec.Add(s.revocationTolerance).Before(validSec) {
-			return nil, ErrTokenRevoked
+	if claims.SessionID != "" {
+		if err := s.checkSession(uint(userID64), claims.SessionID); err != nil {
+			return nil, err
 		}
 	}
 	return claims, nil
 }
 
+// Logout revokes the presented token: its id is denylisted until it expires and its session (if any) is signed out,
+// so the device's refresh token stops working too. Other devices stay signed in.
+func (s *Service) Logout(claims *Claims) error {
+	userID := UserIDFromClaims(claims)
+	if claims.ID == "" && claims.SessionID == "" {
+		return ErrTokenNotRevocable
+	}
+	if claims.ID != "" {
+		expiresAt := time.Now().Add(s.tokenExpiry)
+		if claims.ExpiresAt != nil {
+			expiresAt = claims.ExpiresAt.Time
+		}
+		if err := s.tokenRepo.RevokeTokenID(claims.ID, userID, expiresAt); err != nil {
+			return err
+		}
+	}
+	if claims.SessionID != "" {
+		if err := s.RevokeSession(userID, claims.SessionID); err != nil && !errors.Is(err, ErrSessionNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// JWKS returns the public keys that verify access tokens, for publishing at /.well-known/jwks.json.
+func (s *Service) JWKS() JWKS {
+	return s.keys.JWKS()
+}
+
+// PruneRevokedTokens deletes denylist entries for tokens that have expired anyway. Returns the number removed.
+func (s *Service) PruneRevokedTokens() (int64, error) {
+	return s.tokenRepo.DeleteExpiredRevokedTokens(time.Now())
+}
+
 // ValidateBearer returns nil if the token is valid (including revocation check).
 func (s *Service) ValidateBearer(tokenString string) error {
 	_, err := s.ValidateTokenFull(tokenString)
 	return err
 }
 
+// rehashIfNeeded replaces a hash made with an outdated algorithm or parameters, using the password that just matched it.
+// Failures are only logged: the login itself succeeded.
+func (s *Service) rehashIfNeeded(userID uint, hash, password string) {
+	if !s.hasher.NeedsRehash(hash) {
+		return
+	}
+	newHash, err := s.hasher.Hash(password)
+	if err != nil {
+		// e.g. a >72-byte password can't move to bcrypt; keep the old hash.
+		slog.Warn("password rehash failed", "component", "auth", "user_id", userID, "err", err)
+		return
+	}
+	if err := s.userRepo.UpdatePassword(userID, newHash); err != nil {
+		slog.Error("storing rehashed password failed", "component", "auth", "user_id", userID, "err", err)
+	}
+}
+
+// newOpaqueToken returns a random URL-safe token with 256 bits of entropy.
+func newOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// newRandomID returns a random 128-bit identifier as 32 hex characters.
+func newRandomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken returns the hex SHA-256 of an opaque token. Tokens are high-entropy, so a fast hash is enough for storage.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
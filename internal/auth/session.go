@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrSessionNotFound is returned when a session does not exist or belongs to another user.
+var ErrSessionNotFound = errors.New("session not found")
+
+// sessionTouchInterval is how stale last_seen_at must be before a request updates it.
+const sessionTouchInterval = time.Minute
+
+const maxDeviceNameLength = 255
+const maxUserAgentLength = 512
+
+// SessionInfo describes the device a session is created for.
+type SessionInfo struct {
+	DeviceName string
+	UserAgent  string
+	IP         string
+}
+
+// createSession stores a new session for the user and returns its id.
+func (s *Service) createSession(userID uint, info SessionInfo, t time.Time) (string, error) {
+	id, err := newRandomID()
+	if err != nil {
+		return "", err
+	}
+	err = s.tokenRepo.CreateSession(&Session{
+		ID:         id,
+		UserID:     userID,
+		DeviceName: truncate(info.DeviceName, maxDeviceNameLength),
+		UserAgent:  truncate(info.UserAgent, maxUserAgentLength),
+		IP:         info.IP,
+		CreatedAt:  t,
+		LastSeenAt: t,
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// checkSession returns a *RevokedError unless the session exists, belongs to the user, and is not revoked.
+// It also records activity on the session (at most once per sessionTouchInterval).
+func (s *Service) checkSession(userID uint, sessionID string) error {
+	sess, err := s.tokenRepo.GetSession(sessionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &RevokedError{Reason: RevocationSessionRevoked}
+		}
+		return err
+	}
+	if sess.UserID != userID || !sess.RevokedAt.IsZero() {
+		return &RevokedError{Reason: RevocationSessionRevoked}
+	}
+	now := time.Now()
+	return s.tokenRepo.TouchSession(sessionID, now, now.Add(-sessionTouchInterval))
+}
+
+// ListSessions returns the user's active sessions. The session with id currentID is marked as current.
+func (s *Service) ListSessions(userID uint, currentID string) ([]Session, error) {
+	// A session idle for longer than the refresh token lifetime can't be renewed, so it is no longer signed in.
+	sessions, err := s.tokenRepo.ListActiveSessions(userID, time.Now().Add(-s.refreshTokenExpiry))
+	if err != nil {
+		return nil, err
+	}
+	if sessions == nil {
+		sessions = []Session{}
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == currentID
+	}
+	return sessions, nil
+}
+
+// RevokeSession signs out one of the user's sessions: its access tokens and refresh tokens stop working.
+func (s *Service) RevokeSession(userID uint, sessionID string) error {
+	sess, err := s.tokenRepo.GetSession(sessionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrSessionNotFound
+		}
+		return err
+	}
+	if sess.UserID != userID {
+		return ErrSessionNotFound
+	}
+	now := time.Now()
+	if err := s.tokenRepo.RevokeSession(sessionID, now); err != nil {
+		return err
+	}
+	return s.tokenRepo.RevokeRefreshTokenFamily(sessionID, now)
+}
+
+// RevokeOtherSessions signs out all of the user's sessions except keepID (empty = all sessions).
+func (s *Service) RevokeOtherSessions(userID uint, keepID string) error {
+	now := time.Now()
+	if err := s.tokenRepo.RevokeUserSessions(userID, keepID, now); err != nil {
+		return err
+	}
+	return s.tokenRepo.RevokeUserRefreshTokens(userID, keepID, now)
+}
+
+// truncate returns s cut to at most max bytes without splitting a UTF-8 sequence.
+func truncate(s string, max int) string {
+	if len(s) > max {
+		return strings.ToValidUTF8(s[:max], "")
+	}
+	return s
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B, SHA1. The RFC lists 8-digit codes; with 6 digits they are the last six.
+var rfc6238Vectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+var rfc6238Secret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	key := []byte("12345678901234567890")
+	for _, v := range rfc6238Vectors {
+		if got := totpCode(key, uint64(v.unix/totpPeriod)); got != v.code {
+			t.Errorf("totpCode at %d = %s, want %s", v.unix, got, v.code)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	for _, v := range rfc6238Vectors {
+		at := time.Unix(v.unix, 0)
+		step, ok := verifyTOTP(rfc6238Secret, v.code, at, 0)
+		if !ok || step != v.unix/totpPeriod {
+			t.Fatalf("verifyTOTP at %d = %d, %v, want step %d", v.unix, step, ok, v.unix/totpPeriod)
+		}
+		// The step is remembered: the same code (or an earlier one) is a replay.
+		if _, ok := verifyTOTP(rfc6238Secret, v.code, at, step); ok {
+			t.Fatalf("verifyTOTP accepted a replayed code at %d", v.unix)
+		}
+	}
+
+	at := time.Unix(1234567890, 0)
+	for _, tc := range []struct {
+		name string
+		at   time.Time
+		code string
+		ok   bool
+	}{
+		{"lowercase secret and spaces", at, "005 924", true},
+		{"code one step old", at.Add(totpPeriod * time.Second), "005924", true},
+		{"code one step ahead", at.Add(-totpPeriod * time.Second), "005924", true},
+		{"code two steps old", at.Add(2 * totpPeriod * time.Second), "005924", false},
+		{"wrong code", at, "005925", false},
+		{"too short", at, "05924", false},
+		{"too long", at, "0005924", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, ok := verifyTOTP(strings.ToLower(rfc6238Secret), tc.code, tc.at, 0); ok != tc.ok {
+				t.Fatalf("verifyTOTP = %v, want %v", ok, tc.ok)
+			}
+		})
+	}
+	if _, ok := verifyTOTP("not base32!", "005924", at, 0); ok {
+		t.Fatal("verifyTOTP accepted an invalid secret")
+	}
+}
+
+func TestNewTOTPSecret(t *testing.T) {
+	a, err := newTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := totpEncoding.DecodeString(a)
+	if err != nil || len(key) != totpSecretSize || a == b {
+		t.Fatalf("newTOTPSecret = %q, %q (%d bytes, %v)", a, b, len(key), err)
+	}
+	uri := totpURI(a, "learner@example.test")
+	if !strings.HasPrefix(uri, "otpauth://totp/Zabaan:learner@example.test?") || !strings.Contains(uri, "secret="+a) {
+		t.Fatalf("totpURI = %s", uri)
+	}
+}
@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/bilalabsh/zabaan_backend/internal/mailer"
+	"github.com/bilalabsh/zabaan_backend/internal/models"
+)
+
+// Email verification modes (config EMAIL_VERIFICATION).
+const (
+	EmailVerificationOff       = "off"       // verification is offered but never required
+	EmailVerificationLogin     = "login"     // unverified accounts cannot log in or receive tokens
+	EmailVerificationProtected = "protected" // unverified accounts get tokens but protected routes return 403
+)
+
+// PurposeVerifyEmail is the Purpose claim of email verification tokens.
+const PurposeVerifyEmail = "verify_email"
+
+// ErrEmailNotVerified is returned when the account must verify its email before continuing.
+var ErrEmailNotVerified = errors.New("email not verified")
+
+// ErrVerificationTokenInvalid is returned when a verification token is malformed, expired, already used, or for another email.
+var ErrVerificationTokenInvalid = errors.New("invalid verification token")
+
+// emailUnverified reports whether u has an email it hasn't verified. Guests and phone-only accounts have no email to verify.
+func emailUnverified(u *models.User) bool {
+	return u.Email != "" && !u.EmailVerified
+}
+
+// EmailVerificationMode returns the configured email verification mode.
+func (s *Service) EmailVerificationMode() string {
+	return s.emailVerification
+}
+
+// sendVerificationEmail emails the user a signed, single-use link to verify their address.
+func (s *Service) sendVerificationEmail(u *models.User) error {
+	claims := NewClaims(u.ID, u.Email, time.Now(), s.verificationTokenExpiry)
+	claims.Purpose = PurposeVerifyEmail
+	token, err := SignPurposeToken(s.keys, claims)
+	if err != nil {
+		return err
+	}
+	link := s.appBaseURL + "/verify-email?token=" + url.QueryEscape(token)
+	return s.mailer.Send(mailer.Message{
+		To:      u.Email,
+		Subject: "Verify your email for Zabaan",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by opening this link:\n\n%s\n\nThe link expires in %s. If you did not sign up for Zabaan, you can ignore this email.\n",
+			u.FirstName, link, s.verificationTokenExpiry),
+	})
+}
+
+// VerifyEmail marks the token's user as verified. Each token works once and only while the account still has the email it was sent to.
+// Links from a guest upgrade with AntiEnumeration finish that upgrade instead (completeGuestUpgrade).
+func (s *Service) VerifyEmail(token string) error {
+	claims, err := ValidatePurposeToken(s.keys, token, PurposeVerifyEmail, PurposeGuestUpgrade)
+	if err != nil || claims.ID == "" {
+		return ErrVerificationTokenInvalid
+	}
+	used, err := s.tokenRepo.IsTokenIDRevoked(claims.ID)
+	if err != nil {
+		return err
+	}
+	if used {
+		return ErrVerificationTokenInvalid
+	}
+	u, err := s.userRepo.GetByID(UserIDFromClaims(claims))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrVerificationTokenInvalid
+		}
+		return err
+	}
+	if claims.Purpose == PurposeGuestUpgrade {
+		if err := s.completeGuestUpgrade(u, claims); err != nil {
+			return err
+		}
+	} else if u.Email != claims.Email {
+		return ErrVerificationTokenInvalid
+	} else if !u.EmailVerified {
+		if err := s.userRepo.MarkEmailVerified(u.ID, time.Now()); err != nil {
+			return err
+		}
+	}
+	return s.tokenRepo.RevokeTokenID(claims.ID, u.ID, claims.ExpiresAt.Time)
+}
+
+// ResendVerification sends a new verification link if the email belongs to an unverified account.
+// It returns nil for unknown or already verified emails so callers can't tell which addresses have accounts.
+func (s *Service) ResendVerification(email string) error {
+	email = NormalizeEmail(email)
+	if len(email) > maxEmailLength {
+		return nil
+	}
+	u, _, err := s.userRepo.GetByEmail(email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	if u.EmailVerified {
+		return nil
+	}
+	return s.sendVerificationEmail(u)
+}
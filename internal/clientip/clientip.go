@@ -0,0 +1,34 @@
+// Package clientip resolves the client IP address of an HTTP request.
+package clientip
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// FromRequest returns the client IP. When trustProxy is true, uses X-Real-IP or the first IP in X-Forwarded-For;
+// set it only when running behind a trusted reverse proxy, otherwise clients can spoof these headers.
+func FromRequest(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if s := strings.TrimSpace(r.Header.Get("X-Real-IP")); s != "" {
+			if net.ParseIP(s) != nil {
+				return s
+			}
+		}
+		if s := strings.TrimSpace(r.Header.Get("X-Forwarded-For")); s != "" {
+			first := s
+			if idx := strings.Index(s, ","); idx >= 0 {
+				first = strings.TrimSpace(s[:idx])
+			}
+			if first != "" && net.ParseIP(first) != nil {
+				return first
+			}
+		}
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
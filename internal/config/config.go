@@ -2,7 +2,9 @@ package config
 
 import (
 	"errors"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -11,14 +13,103 @@ import (
 
 const defaultJWTSecret = "your-secret-key"
 
+// minClientSecretLength is the shortest secret accepted in INTROSPECTION_CLIENTS.
+const minClientSecretLength = 32
+
 type Config struct {
 	Port                 string
 	DatabaseURL          string
 	JWTSecret            string
+	JWTSigningAlg        string   // HS256 (JWT_SECRET), RS256 or EdDSA (JWT_PRIVATE_KEY_FILE)
+	JWTPrivateKeyFile    string   // PEM private key for RS256/EdDSA
+	JWTKeyID             string   // kid of the signing key; derived from the key when empty
+	JWTVerifyKeyFiles    []string // extra PEM public keys accepted during rotation ("path" or "kid=path")
 	Environment          string
 	TrustProxy           bool          // if true, rate limiting uses X-Real-IP / X-Forwarded-For for client IP (set when behind a trusted reverse proxy)
-	TokenExpiry          time.Duration // JWT token lifetime (e.g. 24h)
+	TokenExpiry          time.Duration // access token (JWT) lifetime; keep short and renew with a refresh token
+	RefreshTokenExpiry   time.Duration // refresh token lifetime (e.g. 720h)
 	RevocationTolerance  time.Duration // tolerance when comparing token iat to token_valid_after (DB precision, timezone)
+
+	AppBaseURL              string        // base URL used in links sent by email (e.g. https://app.zabaan.com)
+	EmailVerification       string        // off, login (unverified can't log in) or protected (unverified get 403 on protected routes)
+	VerificationTokenExpiry time.Duration // lifetime of email verification links
+	PasswordResetExpiry     time.Duration // lifetime of password reset links
+	EmailLoginCodeExpiry    time.Duration // lifetime of passwordless login codes and magic links
+	EmailChangeExpiry       time.Duration // lifetime of the link that confirms a new email
+	EmailChangeUndoExpiry   time.Duration // how long the old email's link can undo an email change
+
+	Mailer       string // smtp or log
+	MailFrom     string
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+	MailLogFile  string // log mailer only: also append messages to this file
+
+	// Phone signup and login with SMS codes. The routes are only registered when PhoneLoginEnabled.
+	PhoneLoginEnabled       bool
+	SMSProvider             string        // log (the only provider so far)
+	SMSLogFile              string        // log provider only: also append messages to this file
+	PhoneDefaultCountryCode string        // added to national numbers, so 0300 1234567 becomes +923001234567
+	PhoneCodeExpiry         time.Duration // lifetime of SMS codes
+	PhoneCodesPerHour       int           // messages one number can receive per hour
+
+	// Sign in with Google / Apple. A provider is enabled when its client IDs (accepted ID token audiences) are set;
+	// issuers and JWKS URL default to the real providers and can point at a local stub for testing.
+	OIDCGoogleClientIDs []string
+	OIDCGoogleIssuers   []string
+	OIDCGoogleJWKSURL   string
+	OIDCAppleClientIDs  []string
+	OIDCAppleIssuers    []string
+	OIDCAppleJWKSURL    string
+
+	// Per-account login lockout: after LoginLockoutThreshold failures in a row (within LoginLockoutWindow) the email is
+	// locked for LoginLockoutBase, doubling with every further failure up to LoginLockoutMax. Threshold 0 disables it.
+	LoginLockoutThreshold int
+	LoginLockoutBase      time.Duration
+	LoginLockoutMax       time.Duration
+	LoginLockoutWindow    time.Duration
+
+	// Password hashing for new and rehashed passwords. Existing hashes of either algorithm keep verifying and are
+	// rehashed on the next successful login when the algorithm or parameters differ.
+	PasswordHashAlg   string // argon2id or bcrypt
+	BcryptCost        int
+	Argon2Memory      int // KiB
+	Argon2Iterations  int
+	Argon2Parallelism int
+
+	// Password policy for new passwords (signup, reset, change).
+	PasswordMinLength      int
+	PasswordRequireLetter  bool
+	PasswordRequireDigit   bool
+	PasswordRequireUpper   bool
+	PasswordRequireLower   bool
+	PasswordRequireSymbol  bool
+	PasswordMaxRepeats     int    // most identical characters in a row; 0 = no limit
+	PasswordRejectCommon   bool   // bundled common-password list
+	PasswordRejectPersonal bool   // email name, first or last name
+	PasswordBreachedDir    string // optional local Pwned Passwords range files (<PREFIX>.txt)
+
+	AdminEmails []string // verified users with these emails become admins when they sign in
+
+	GuestAccountTTL      time.Duration // guest accounts not seen for this long are deleted; 0 keeps them
+	AccountDeletionGrace time.Duration // time between DELETE /me and the purge; signing in meanwhile cancels it
+
+	IntrospectionClients []string // "client_id:secret" pairs allowed to call POST /oauth/introspect
+
+	ImpersonationExpiry time.Duration // lifetime of admin impersonation tokens
+
+	AntiEnumeration bool // signup and login responses don't reveal whether an email has an account
+
+	RequireConsent bool // protected routes answer 403 until the user accepts the current legal documents
+
+	// Passkeys (WebAuthn). The RP ID defaults to the host of AppBaseURL and the origins to AppBaseURL itself;
+	// mobile apps add their origins (e.g. android:apk-key-hash:...) to WebAuthnOrigins.
+	PasskeysEnabled bool
+	WebAuthnRPID    string
+	WebAuthnRPName  string
+	WebAuthnOrigins []string
+	WebAuthnTimeout time.Duration // how long a registration or login ceremony may take
 }
 
 func Load() *Config {
@@ -27,10 +118,86 @@ func Load() *Config {
 		Port:                getEnv("PORT", "8080"),
 		DatabaseURL:         getEnv("DATABASE_URL", ""),
 		JWTSecret:           getEnv("JWT_SECRET", defaultJWTSecret),
+		JWTSigningAlg:       getEnv("JWT_SIGNING_ALG", "HS256"),
+		JWTPrivateKeyFile:   getEnv("JWT_PRIVATE_KEY_FILE", ""),
+		JWTKeyID:            getEnv("JWT_KEY_ID", ""),
+		JWTVerifyKeyFiles:   getEnvList("JWT_VERIFY_KEY_FILES"),
 		Environment:        getEnv("ENVIRONMENT", "development"),
 		TrustProxy:          getEnv("TRUST_PROXY", "") == "true" || getEnv("TRUST_PROXY", "") == "1",
-		TokenExpiry:         getEnvDuration("JWT_EXPIRY", 24*time.Hour),
+		TokenExpiry:         getEnvDuration("JWT_EXPIRY", 15*time.Minute),
+		RefreshTokenExpiry:  getEnvDuration("REFRESH_TOKEN_EXPIRY", 30*24*time.Hour),
 		RevocationTolerance: getEnvDuration("REVOCATION_TOLERANCE", 2*time.Second),
+
+		AppBaseURL:              getEnv("APP_BASE_URL", "http://localhost:8080"),
+		EmailVerification:       strings.ToLower(getEnv("EMAIL_VERIFICATION", "off")),
+		VerificationTokenExpiry: getEnvDuration("EMAIL_VERIFICATION_EXPIRY", 24*time.Hour),
+		PasswordResetExpiry:     getEnvDuration("PASSWORD_RESET_EXPIRY", time.Hour),
+		EmailLoginCodeExpiry:    getEnvDuration("EMAIL_LOGIN_CODE_EXPIRY", 10*time.Minute),
+		EmailChangeExpiry:       getEnvDuration("EMAIL_CHANGE_EXPIRY", 24*time.Hour),
+		EmailChangeUndoExpiry:   getEnvDuration("EMAIL_CHANGE_UNDO_EXPIRY", 7*24*time.Hour),
+
+		Mailer:       strings.ToLower(getEnv("MAILER", "log")),
+		MailFrom:     getEnv("MAIL_FROM", "Zabaan <no-reply@zabaan.local>"),
+		SMTPHost:     getEnv("SMTP_HOST", ""),
+		SMTPPort:     getEnv("SMTP_PORT", "587"),
+		SMTPUsername: getEnv("SMTP_USERNAME", ""),
+		SMTPPassword: getEnv("SMTP_PASSWORD", ""),
+		MailLogFile:  getEnv("MAIL_LOG_FILE", ""),
+
+		PhoneLoginEnabled:       getEnvBool("PHONE_LOGIN_ENABLED", false),
+		SMSProvider:             strings.ToLower(getEnv("SMS_PROVIDER", "log")),
+		SMSLogFile:              getEnv("SMS_LOG_FILE", ""),
+		PhoneDefaultCountryCode: strings.TrimPrefix(getEnv("PHONE_DEFAULT_COUNTRY_CODE", "92"), "+"),
+		PhoneCodeExpiry:         getEnvDuration("PHONE_CODE_EXPIRY", 10*time.Minute),
+		PhoneCodesPerHour:       getEnvInt("PHONE_CODES_PER_HOUR", 5),
+
+		OIDCGoogleClientIDs: getEnvList("OIDC_GOOGLE_CLIENT_IDS"),
+		OIDCGoogleIssuers:   getEnvListDefault("OIDC_GOOGLE_ISSUERS", []string{"https://accounts.google.com", "accounts.google.com"}),
+		OIDCGoogleJWKSURL:   getEnv("OIDC_GOOGLE_JWKS_URL", "https://www.googleapis.com/oauth2/v3/certs"),
+		OIDCAppleClientIDs:  getEnvList("OIDC_APPLE_CLIENT_IDS"),
+		OIDCAppleIssuers:    getEnvListDefault("OIDC_APPLE_ISSUERS", []string{"https://appleid.apple.com"}),
+		OIDCAppleJWKSURL:    getEnv("OIDC_APPLE_JWKS_URL", "https://appleid.apple.com/auth/keys"),
+
+		LoginLockoutThreshold: getEnvInt("LOGIN_LOCKOUT_THRESHOLD", 5),
+		LoginLockoutBase:      getEnvDuration("LOGIN_LOCKOUT_BASE", time.Minute),
+		LoginLockoutMax:       getEnvDuration("LOGIN_LOCKOUT_MAX", time.Hour),
+		LoginLockoutWindow:    getEnvDuration("LOGIN_LOCKOUT_WINDOW", 24*time.Hour),
+
+		PasswordHashAlg:   strings.ToLower(getEnv("PASSWORD_HASH_ALG", "argon2id")),
+		BcryptCost:        getEnvInt("BCRYPT_COST", 12),
+		Argon2Memory:      getEnvInt("ARGON2_MEMORY_KIB", 19*1024),
+		Argon2Iterations:  getEnvInt("ARGON2_ITERATIONS", 2),
+		Argon2Parallelism: getEnvInt("ARGON2_PARALLELISM", 1),
+
+		PasswordMinLength:      getEnvInt("PASSWORD_MIN_LENGTH", 8),
+		PasswordRequireLetter:  getEnvBool("PASSWORD_REQUIRE_LETTER", true),
+		PasswordRequireDigit:   getEnvBool("PASSWORD_REQUIRE_DIGIT", true),
+		PasswordRequireUpper:   getEnvBool("PASSWORD_REQUIRE_UPPER", false),
+		PasswordRequireLower:   getEnvBool("PASSWORD_REQUIRE_LOWER", false),
+		PasswordRequireSymbol:  getEnvBool("PASSWORD_REQUIRE_SYMBOL", false),
+		PasswordMaxRepeats:     getEnvInt("PASSWORD_MAX_REPEATS", 3),
+		PasswordRejectCommon:   getEnvBool("PASSWORD_REJECT_COMMON", true),
+		PasswordRejectPersonal: getEnvBool("PASSWORD_REJECT_PERSONAL", true),
+		PasswordBreachedDir:    getEnv("PASSWORD_BREACHED_DIR", ""),
+
+		AdminEmails: getEnvList("ADMIN_EMAILS"),
+
+		GuestAccountTTL:      getEnvDuration("GUEST_ACCOUNT_TTL", 30*24*time.Hour),
+		AccountDeletionGrace: getEnvDuration("ACCOUNT_DELETION_GRACE", 30*24*time.Hour),
+
+		IntrospectionClients: getEnvList("INTROSPECTION_CLIENTS"),
+
+		ImpersonationExpiry: getEnvDuration("IMPERSONATION_TOKEN_EXPIRY", 15*time.Minute),
+
+		AntiEnumeration: getEnvBool("ANTI_ENUMERATION", false),
+
+		RequireConsent: getEnvBool("REQUIRE_CONSENT", false),
+
+		PasskeysEnabled: getEnvBool("PASSKEYS_ENABLED", true),
+		WebAuthnRPID:    getEnv("WEBAUTHN_RP_ID", ""),
+		WebAuthnRPName:  getEnv("WEBAUTHN_RP_NAME", "Zabaan"),
+		WebAuthnOrigins: getEnvList("WEBAUTHN_ORIGINS"),
+		WebAuthnTimeout: getEnvDuration("WEBAUTHN_TIMEOUT", 5*time.Minute),
 	}
 }
 
@@ -46,20 +213,187 @@ func getEnvDuration(key string, defaultVal time.Duration) time.Duration {
 	return d
 }
 
+func getEnvInt(key string, defaultVal int) int {
+	n, err := strconv.Atoi(getEnv(key, ""))
+	if err != nil {
+		return defaultVal
+	}
+	return n
+}
+
+// getEnvBool accepts true/1 and false/0; anything else (or unset) gives defaultVal.
+func getEnvBool(key string, defaultVal bool) bool {
+	switch strings.ToLower(getEnv(key, "")) {
+	case "true", "1":
+		return true
+	case "false", "0":
+		return false
+	}
+	return defaultVal
+}
+
 // Validate returns an error if config is unsafe for the current environment (e.g. missing required values in production).
 func (c *Config) Validate() error {
+	switch c.EmailVerification {
+	case "off", "login", "protected":
+	default:
+		return errors.New("EMAIL_VERIFICATION must be off, login or protected")
+	}
+	if c.AntiEnumeration && c.EmailVerification != "login" {
+		// Otherwise signing up with someone's email and logging in tells whether the address was free.
+		return errors.New("ANTI_ENUMERATION=true requires EMAIL_VERIFICATION=login")
+	}
+	for _, client := range c.IntrospectionClients {
+		id, secret, ok := strings.Cut(client, ":")
+		if !ok || id == "" || len(secret) < minClientSecretLength {
+			return errors.New("INTROSPECTION_CLIENTS entries must be client_id:secret with a secret of at least 32 characters")
+		}
+	}
+	if c.EmailChangeExpiry <= 0 || c.EmailChangeUndoExpiry < c.EmailChangeExpiry {
+		return errors.New("EMAIL_CHANGE_EXPIRY must be positive and not above EMAIL_CHANGE_UNDO_EXPIRY")
+	}
+	if c.ImpersonationExpiry <= 0 || c.ImpersonationExpiry > time.Hour {
+		return errors.New("IMPERSONATION_TOKEN_EXPIRY must be positive and at most 1h")
+	}
+	if c.GuestAccountTTL < 0 {
+		return errors.New("GUEST_ACCOUNT_TTL must not be negative")
+	}
+	if c.AccountDeletionGrace < 0 {
+		return errors.New("ACCOUNT_DELETION_GRACE must not be negative")
+	}
+	if c.PasskeysEnabled {
+		if c.WebAuthnTimeout <= 0 {
+			return errors.New("WEBAUTHN_TIMEOUT must be positive")
+		}
+		rpID, origins := c.WebAuthnRelyingParty()
+		if rpID == "" {
+			return errors.New("passkeys require WEBAUTHN_RP_ID or an APP_BASE_URL with a host")
+		}
+		for _, origin := range origins {
+			u, err := url.Parse(origin)
+			if err != nil {
+				return errors.New("WEBAUTHN_ORIGINS entries must be origins like https://app.zabaan.com")
+			}
+			if (u.Scheme == "http" || u.Scheme == "https") && u.Hostname() != rpID && !strings.HasSuffix(u.Hostname(), "."+rpID) {
+				return errors.New("WEBAUTHN_RP_ID must be the host of every web origin in WEBAUTHN_ORIGINS or a parent domain of it")
+			}
+		}
+	}
+	if c.Mailer == "smtp" && c.SMTPHost == "" {
+		return errors.New("MAILER=smtp requires SMTP_HOST")
+	}
+	if c.SMSProvider != "log" {
+		return errors.New("SMS_PROVIDER must be log")
+	}
+	if !validCountryCode(c.PhoneDefaultCountryCode) {
+		return errors.New("PHONE_DEFAULT_COUNTRY_CODE must be 1-3 digits, like 92")
+	}
+	if c.PhoneCodeExpiry <= 0 || c.PhoneCodesPerHour < 1 {
+		return errors.New("PHONE_CODE_EXPIRY and PHONE_CODES_PER_HOUR must be positive")
+	}
+	if c.LoginLockoutThreshold > 0 && (c.LoginLockoutBase <= 0 || c.LoginLockoutMax < c.LoginLockoutBase) {
+		return errors.New("LOGIN_LOCKOUT_BASE must be positive and not above LOGIN_LOCKOUT_MAX")
+	}
+	if c.Argon2Memory < 0 || c.Argon2Iterations < 0 || c.Argon2Parallelism < 0 || c.Argon2Parallelism > 255 {
+		return errors.New("ARGON2_MEMORY_KIB, ARGON2_ITERATIONS and ARGON2_PARALLELISM must be positive (parallelism at most 255)")
+	}
+	if c.PasswordMinLength < 1 || c.PasswordMinLength > 128 {
+		return errors.New("PASSWORD_MIN_LENGTH must be between 1 and 128")
+	}
+	if c.PasswordBreachedDir != "" {
+		if info, err := os.Stat(c.PasswordBreachedDir); err != nil || !info.IsDir() {
+			return errors.New("PASSWORD_BREACHED_DIR must be an existing directory")
+		}
+	}
 	if strings.ToLower(c.Environment) != "production" {
 		return nil
 	}
-	if c.JWTSecret == "" || c.JWTSecret == defaultJWTSecret {
+	if c.JWTSigningAlg == "HS256" && (c.JWTSecret == "" || c.JWTSecret == defaultJWTSecret) {
 		return errors.New("production requires JWT_SECRET to be set and not the default value")
 	}
+	if c.JWTSigningAlg != "HS256" && c.JWTPrivateKeyFile == "" {
+		return errors.New("production requires JWT_PRIVATE_KEY_FILE when JWT_SIGNING_ALG is not HS256")
+	}
 	if c.DatabaseURL == "" {
 		return errors.New("production requires DATABASE_URL to be set")
 	}
+	if c.PhoneLoginEnabled && c.SMSProvider == "log" {
+		// The log provider prints login codes, so whoever reads the logs could sign in as any phone user.
+		return errors.New("production requires PHONE_LOGIN_ENABLED=false while SMS_PROVIDER is log")
+	}
+	if c.Mailer == "log" {
+		// Emails carry verification links, reset links and login codes; they must not end up in log files.
+		return errors.New("production requires MAILER=smtp")
+	}
 	return nil
 }
 
+// IntrospectionClientSecrets returns INTROSPECTION_CLIENTS as client id → secret (entries are checked by Validate).
+func (c *Config) IntrospectionClientSecrets() map[string]string {
+	clients := make(map[string]string)
+	for _, client := range c.IntrospectionClients {
+		if id, secret, ok := strings.Cut(client, ":"); ok {
+			clients[id] = secret
+		}
+	}
+	return clients
+}
+
+// JWTLegacySecret returns the secret that still verifies HS256 tokens once JWT_SIGNING_ALG is RS256 or EdDSA, so
+// switching doesn't sign everyone out: JWT_SECRET if it was set. Empty with HS256, where JWT_SECRET signs.
+func (c *Config) JWTLegacySecret() string {
+	if c.JWTSigningAlg == "HS256" || c.JWTSecret == defaultJWTSecret {
+		return ""
+	}
+	return c.JWTSecret
+}
+
+// WebAuthnRelyingParty returns the passkey RP ID and accepted origins, defaulting both from AppBaseURL.
+func (c *Config) WebAuthnRelyingParty() (rpID string, origins []string) {
+	rpID, origins = c.WebAuthnRPID, c.WebAuthnOrigins
+	if rpID == "" {
+		if u, err := url.Parse(c.AppBaseURL); err == nil {
+			rpID = u.Hostname()
+		}
+	}
+	if len(origins) == 0 {
+		origins = []string{strings.TrimRight(c.AppBaseURL, "/")}
+	}
+	return rpID, origins
+}
+
+// validCountryCode reports whether code is a country calling code: 1-3 digits, not starting with 0.
+func validCountryCode(code string) bool {
+	if len(code) < 1 || len(code) > 3 || code[0] == '0' {
+		return false
+	}
+	for i := 0; i < len(code); i++ {
+		if code[i] < '0' || code[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// getEnvList returns a comma-separated env var as a list, skipping empty items.
+func getEnvList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(getEnv(key, ""), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getEnvListDefault is getEnvList with a default for an unset or empty variable.
+func getEnvListDefault(key string, defaultVal []string) []string {
+	if list := getEnvList(key); len(list) > 0 {
+		return list
+	}
+	return defaultVal
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
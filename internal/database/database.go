@@ -39,6 +39,7 @@ func Init(cfg *config.Config) {
 	DB.SetConnMaxLifetime(5 * time.Minute)
 	DB.SetMaxIdleConns(2)
 	createUsersTable()
+	createAuthTables()
 	ensureAuthColumns()
 	slog.Info("database connected", "component", "database")
 }
@@ -59,12 +60,215 @@ func createUsersTable() {
 	}
 }
 
+// createAuthTables creates tables owned by the auth module (refresh tokens, sessions, revoked token ids, password resets, recovery codes,
+// passkeys) and the security audit log.
+func createAuthTables() {
+	for _, q := range []string{
+		`CREATE TABLE IF NOT EXISTS refresh_tokens (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			family_id CHAR(32) NOT NULL,
+			token_hash CHAR(64) NOT NULL UNIQUE,
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL,
+			rotated_at DATETIME DEFAULT NULL,
+			revoked_at DATETIME DEFAULT NULL,
+			INDEX idx_refresh_tokens_user (user_id),
+			INDEX idx_refresh_tokens_family (family_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS sessions (
+			id CHAR(32) PRIMARY KEY,
+			user_id INT NOT NULL,
+			device_name VARCHAR(255) NOT NULL DEFAULT '',
+			user_agent VARCHAR(512) NOT NULL DEFAULT '',
+			ip VARCHAR(45) NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			last_seen_at DATETIME NOT NULL,
+			revoked_at DATETIME DEFAULT NULL,
+			INDEX idx_sessions_user (user_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS revoked_tokens (
+			jti VARCHAR(64) PRIMARY KEY,
+			user_id INT NOT NULL,
+			expires_at DATETIME NOT NULL,
+			INDEX idx_revoked_tokens_expires (expires_at)
+		)`,
+		`CREATE TABLE IF NOT EXISTS password_reset_tokens (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			token_hash CHAR(64) NOT NULL UNIQUE,
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL,
+			used_at DATETIME DEFAULT NULL,
+			INDEX idx_password_reset_tokens_user (user_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS email_changes (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			old_email VARCHAR(255) NULL,
+			new_email VARCHAR(255) NOT NULL,
+			confirm_hash CHAR(64) NOT NULL UNIQUE,
+			undo_hash CHAR(64) NOT NULL UNIQUE,
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL,
+			undo_expires_at DATETIME NOT NULL,
+			confirmed_at DATETIME DEFAULT NULL,
+			cancelled_at DATETIME DEFAULT NULL,
+			INDEX idx_email_changes_user (user_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS recovery_codes (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			code_hash CHAR(64) NOT NULL,
+			created_at DATETIME NOT NULL,
+			used_at DATETIME DEFAULT NULL,
+			INDEX idx_recovery_codes_user (user_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS user_identities (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			provider VARCHAR(32) NOT NULL,
+			subject VARCHAR(255) NOT NULL,
+			email VARCHAR(255) NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			last_login_at DATETIME NOT NULL,
+			UNIQUE KEY uq_user_identities_provider_subject (provider, subject),
+			INDEX idx_user_identities_user (user_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS email_login_codes (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			code_hash CHAR(64) NOT NULL,
+			link_hash CHAR(64) NOT NULL UNIQUE,
+			attempts INT NOT NULL DEFAULT 0,
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL,
+			used_at DATETIME DEFAULT NULL,
+			INDEX idx_email_login_codes_user (user_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS phone_codes (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			phone VARCHAR(16) NOT NULL,
+			purpose VARCHAR(16) NOT NULL,
+			code_hash CHAR(64) NOT NULL,
+			attempts INT NOT NULL DEFAULT 0,
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL,
+			used_at DATETIME DEFAULT NULL,
+			INDEX idx_phone_codes_phone (phone, created_at)
+		)`,
+		`CREATE TABLE IF NOT EXISTS user_roles (
+			user_id INT NOT NULL,
+			role VARCHAR(32) NOT NULL,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (user_id, role)
+		)`,
+		`CREATE TABLE IF NOT EXISTS api_keys (
+			id CHAR(32) PRIMARY KEY,
+			user_id INT NOT NULL,
+			name VARCHAR(100) NOT NULL DEFAULT '',
+			prefix VARCHAR(16) NOT NULL,
+			secret_hash CHAR(64) NOT NULL UNIQUE,
+			scopes VARCHAR(255) NOT NULL DEFAULT '',
+			created_by INT NOT NULL,
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME DEFAULT NULL,
+			last_used_at DATETIME DEFAULT NULL,
+			revoked_at DATETIME DEFAULT NULL,
+			INDEX idx_api_keys_user (user_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS webauthn_credentials (
+			id CHAR(32) PRIMARY KEY,
+			user_id INT NOT NULL,
+			credential_id VARBINARY(1023) NOT NULL,
+			public_key BLOB NOT NULL,
+			sign_count BIGINT NOT NULL DEFAULT 0,
+			transports VARCHAR(255) NOT NULL DEFAULT '',
+			name VARCHAR(100) NOT NULL DEFAULT '',
+			aaguid CHAR(32) NOT NULL DEFAULT '',
+			synced BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at DATETIME NOT NULL,
+			last_used_at DATETIME DEFAULT NULL,
+			UNIQUE KEY uq_webauthn_credentials_credential (credential_id),
+			INDEX idx_webauthn_credentials_user (user_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS webauthn_challenges (
+			challenge_hash CHAR(64) PRIMARY KEY,
+			user_id INT NOT NULL DEFAULT 0,
+			purpose VARCHAR(16) NOT NULL,
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL,
+			INDEX idx_webauthn_challenges_expires (expires_at)
+		)`,
+		`CREATE TABLE IF NOT EXISTS legal_documents (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			kind VARCHAR(32) NOT NULL,
+			version VARCHAR(64) NOT NULL,
+			url VARCHAR(2048) NOT NULL DEFAULT '',
+			published_at DATETIME NOT NULL,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE KEY uq_legal_documents_kind_version (kind, version),
+			INDEX idx_legal_documents_kind_published (kind, published_at)
+		)`,
+		`CREATE TABLE IF NOT EXISTS user_consents (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			document_id BIGINT NOT NULL,
+			accepted_at DATETIME NOT NULL,
+			ip VARCHAR(45) NOT NULL DEFAULT '',
+			user_agent VARCHAR(512) NOT NULL DEFAULT '',
+			UNIQUE KEY uq_user_consents_user_document (user_id, document_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS audit_events (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			type VARCHAR(64) NOT NULL,
+			actor_id INT DEFAULT NULL,
+			user_id INT DEFAULT NULL,
+			email VARCHAR(255) NOT NULL DEFAULT '',
+			ip VARCHAR(45) NOT NULL DEFAULT '',
+			user_agent VARCHAR(512) NOT NULL DEFAULT '',
+			details TEXT,
+			created_at DATETIME NOT NULL,
+			INDEX idx_audit_events_user (user_id, id),
+			INDEX idx_audit_events_type (type, id),
+			INDEX idx_audit_events_created (created_at)
+		)`,
+		`CREATE TABLE IF NOT EXISTS login_attempts (
+			email VARCHAR(255) PRIMARY KEY,
+			failed_count INT NOT NULL DEFAULT 0,
+			last_failed_at DATETIME NOT NULL,
+			locked_until DATETIME DEFAULT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS mfa_attempts (
+			user_id INT PRIMARY KEY,
+			attempts INT NOT NULL DEFAULT 0,
+			window_started_at DATETIME NOT NULL
+		)`,
+	} {
+		if _, err := DB.Exec(q); err != nil {
+			slog.Error("database create auth tables failed", "component", "database", "err", err)
+			os.Exit(1)
+		}
+	}
+}
+
 func ensureAuthColumns() {
 	for _, q := range []string{
 		"ALTER TABLE users ADD COLUMN first_name VARCHAR(255) DEFAULT ''",
 		"ALTER TABLE users ADD COLUMN last_name VARCHAR(255) DEFAULT ''",
 		"ALTER TABLE users ADD COLUMN password_hash VARCHAR(255) DEFAULT ''",
 		"ALTER TABLE users ADD COLUMN token_valid_after DATETIME DEFAULT NULL",
+		"ALTER TABLE users ADD COLUMN email_verified_at DATETIME DEFAULT NULL",
+		"ALTER TABLE users ADD COLUMN totp_secret VARCHAR(64) NOT NULL DEFAULT ''",
+		"ALTER TABLE users ADD COLUMN totp_enabled_at DATETIME DEFAULT NULL",
+		"ALTER TABLE users ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0",
+		// Guest accounts have no email until they are upgraded.
+		"ALTER TABLE users MODIFY COLUMN email VARCHAR(255) NULL",
+		"ALTER TABLE users ADD COLUMN is_guest BOOLEAN NOT NULL DEFAULT FALSE",
+		"ALTER TABLE users ADD COLUMN last_seen_at DATETIME DEFAULT NULL",
+		"ALTER TABLE users ADD COLUMN deletion_scheduled_at DATETIME DEFAULT NULL",
+		// E.164 numbers have at most 15 digits after the "+".
+		"ALTER TABLE users ADD COLUMN phone VARCHAR(16) NULL UNIQUE",
 	} {
 		_, err := DB.Exec(q)
 		if err != nil && !strings.Contains(err.Error(), "Duplicate column") {
@@ -0,0 +1,118 @@
+// Package mailer sends transactional email (verification links, password resets) through SMTP or, in development, a log.
+package mailer
+
+import (
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email. Accepting an interface lets services use the log mailer in development and a mock in tests.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// Config selects and configures a mailer.
+type Config struct {
+	Driver   string // "smtp" or "log"
+	From     string
+	SMTPHost string
+	SMTPPort string
+	Username string
+	Password string
+	LogFile  string // log driver only: if set, messages are also appended to this file
+}
+
+// New returns the mailer selected by cfg.Driver. Unknown drivers fall back to the log mailer.
+func New(cfg Config) Mailer {
+	if strings.ToLower(cfg.Driver) == "smtp" {
+		return NewSMTPMailer(cfg.SMTPHost, cfg.SMTPPort, cfg.Username, cfg.Password, cfg.From)
+	}
+	return NewLogMailer(cfg.LogFile)
+}
+
+// SMTPMailer sends email through an SMTP server (STARTTLS is used when the server offers it).
+type SMTPMailer struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+}
+
+// NewSMTPMailer returns a mailer for host:port. Authentication is skipped when username is empty.
+func NewSMTPMailer(host, port, username, password, from string) *SMTPMailer {
+	return &SMTPMailer{
+		addr:     net.JoinHostPort(host, port),
+		host:     host,
+		username: username,
+		password: password,
+		from:     from,
+	}
+}
+
+// Send delivers msg via SMTP.
+func (m *SMTPMailer) Send(msg Message) error {
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+	return smtp.SendMail(m.addr, auth, m.from, []string{msg.To}, formatMessage(m.from, msg))
+}
+
+// LogMailer logs messages instead of sending them. Use in development with a file to read links from.
+type LogMailer struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewLogMailer returns a log mailer. If path is non-empty, each message is also appended to that file.
+func NewLogMailer(path string) *LogMailer {
+	return &LogMailer{path: path}
+}
+
+// Send logs the recipient and subject of msg and appends the whole message to the log file, if configured. The body
+// (links and codes) is never logged.
+func (m *LogMailer) Send(msg Message) error {
+	slog.Info("email (not sent, log mailer)", "component", "mailer", "to", msg.To, "subject", msg.Subject)
+	if m.path == "" {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "%s\n\n", formatMessage("", msg))
+	return err
+}
+
+// formatMessage renders msg as an RFC 5322 message with a UTF-8 plain-text body.
+func formatMessage(from string, msg Message) []byte {
+	var b strings.Builder
+	if from != "" {
+		fmt.Fprintf(&b, "From: %s\r\n", from)
+	}
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
@@ -1,7 +1,6 @@
 package middleware
 
 import (
-	"context"
 	"encoding/json"
 	"errors"
 	"log/slog"
@@ -9,15 +8,20 @@ import (
 	"strings"
 
 	"github.com/bilalabsh/zabaan_backend/internal/auth"
+	"github.com/bilalabsh/zabaan_backend/internal/models"
 )
 
-type contextKey string
-
-const claimsContextKey contextKey = "claims"
+// AuditRecorder records security events for a request. Implemented by audit.Recorder.
+type AuditRecorder interface {
+	Record(r *http.Request, e models.AuditEvent)
+}
 
 // RequireAuth wraps a handler and returns 401 if the request has no valid Bearer token (including revocation check).
-// On success, the JWT claims are stored in the request context; use GetClaimsFromRequest to read them.
-func RequireAuth(v auth.TokenValidator, next http.HandlerFunc) http.HandlerFunc {
+// On success, the JWT claims are stored in the request context; use GetClaimsFromRequest to read them, and
+// GetImpersonatorFromRequest for the admin behind an impersonation token. Every impersonated request is recorded
+// with rec (method and path; the recorder adds the admin, the user and the IP); with a nil rec they are refused,
+// since they couldn't be audited.
+func RequireAuth(v auth.TokenValidator, rec AuditRecorder, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		if v == nil {
@@ -34,8 +38,9 @@ func RequireAuth(v auth.TokenValidator, next http.HandlerFunc) http.HandlerFunc
 		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 		claims, err := v.ValidateTokenFull(tokenString)
 		if err != nil {
-			if errors.Is(err, auth.ErrTokenRevoked) {
-				slog.Info("auth rejected", "component", "RequireAuth", "reason", "token revoked")
+			var revoked *auth.RevokedError
+			if errors.As(err, &revoked) {
+				slog.Info("auth rejected", "component", "RequireAuth", "reason", "token revoked", "revocation", revoked.Reason)
 			} else if errors.Is(err, auth.ErrTokenInvalid) {
 				slog.Info("auth rejected", "component", "RequireAuth", "reason", "invalid token", "err", err)
 			} else {
@@ -45,13 +50,163 @@ func RequireAuth(v auth.TokenValidator, next http.HandlerFunc) http.HandlerFunc
 			json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired token"})
 			return
 		}
-		ctx := context.WithValue(r.Context(), claimsContextKey, claims)
-		next(w, r.WithContext(ctx))
+		r = r.WithContext(auth.WithClaims(r.Context(), claims))
+		if actorID := auth.ImpersonatorID(claims); actorID != 0 {
+			if rec == nil {
+				slog.Error("impersonated request without an audit recorder", "component", "RequireAuth", "path", r.URL.Path)
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]string{"error": "audit not configured"})
+				return
+			}
+			userID := auth.UserIDFromClaims(claims)
+			slog.Info("impersonated request", "component", "RequireAuth", "actor_id", actorID, "user_id", userID, "method", r.Method, "path", r.URL.Path)
+			rec.Record(r, models.AuditEvent{
+				Type:    models.AuditImpersonatedRequest,
+				ActorID: actorID,
+				UserID:  userID,
+				Details: map[string]string{"method": r.Method, "path": r.URL.Path},
+			})
+		}
+		next(w, r)
 	}
 }
 
 // GetClaimsFromRequest returns the JWT claims from the request context, or nil if not authenticated.
 func GetClaimsFromRequest(r *http.Request) *auth.Claims {
-	c, _ := r.Context().Value(claimsContextKey).(*auth.Claims)
-	return c
+	return auth.ClaimsFromContext(r.Context())
+}
+
+// GetImpersonatorFromRequest returns the id of the admin impersonating the authenticated user, or 0 if the request
+// isn't made with an impersonation token.
+func GetImpersonatorFromRequest(r *http.Request) uint {
+	return auth.ImpersonatorID(GetClaimsFromRequest(r))
+}
+
+// RejectImpersonation returns 403 for impersonation tokens. Use it on sensitive routes (password, email, 2FA, passkeys,
+// API keys, account deletion and export) so support can look but not take over the account.
+func RejectImpersonation(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if GetImpersonatorFromRequest(r) != 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "not allowed while impersonating"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// RequireVerifiedEmail returns 403 unless the authenticated token says the user's email is verified, or the user
+// signed up with a phone number and has no email. Wrap it inside RequireAuth, e.g. RequireAuth(v, rec, RequireVerifiedEmail(next)).
+func RequireVerifiedEmail(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims := GetClaimsFromRequest(r)
+		if claims == nil || !(claims.EmailVerified || (claims.Email == "" && claims.PhoneVerified)) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "email not verified"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// RequireConsent returns 403 with code auth.ConsentRequiredCode until the authenticated user has accepted the current
+// version of every legal document (POST /me/consents), so publishing a new version re-prompts everyone.
+// Wrap it inside RequireAuth; leave it off the routes the client needs to show and accept the documents.
+func RequireConsent(c auth.ConsentChecker, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := auth.UserIDFromClaims(GetClaimsFromRequest(r))
+		ok := false
+		if userID != 0 {
+			var err error
+			if ok, err = c.HasCurrentConsents(userID); err != nil {
+				slog.Error("consent check failed", "component", "RequireConsent", "err", err)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+				return
+			}
+		}
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "the current legal documents must be accepted", "code": auth.ConsentRequiredCode})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// RequireFullAccount returns 403 for guest tokens. Use it on account management routes (password, 2FA, API keys)
+// that need an email; guests sign up through /guest/upgrade first.
+func RequireFullAccount(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims := GetClaimsFromRequest(r)
+		if claims == nil || claims.Guest {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "guest accounts must sign up first"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// RequireRole returns 403 unless the authenticated token carries at least one of roles.
+// Wrap it inside RequireAuth, e.g. RequireAuth(v, rec, RequireRole(next, models.RoleAdmin)).
+// Roles are read from the token, so a role change applies once the user's access token is refreshed.
+func RequireRole(next http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims := GetClaimsFromRequest(r)
+		if claims == nil || !claims.HasRole(roles...) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "forbidden"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// RequireAuthOrAPIKey is RequireAuth that also accepts "Authorization: ApiKey <key>". An API key puts a principal
+// equivalent to its user's access token in the context (same subject, email and roles) plus the key's scopes,
+// so handlers and RequireRole work unchanged; combine it with RequireScope to limit what keys can call.
+func RequireAuthOrAPIKey(v auth.PrincipalValidator, rec AuditRecorder, next http.HandlerFunc) http.HandlerFunc {
+	bearer := RequireAuth(v, rec, next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		authHeader := r.Header.Get("Authorization")
+		if !strings.HasPrefix(authHeader, "ApiKey ") {
+			bearer(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		claims, err := v.ValidateAPIKey(strings.TrimPrefix(authHeader, "ApiKey "))
+		if err != nil {
+			if errors.Is(err, auth.ErrAPIKeyInvalid) {
+				slog.Info("auth rejected", "component", "RequireAuthOrAPIKey", "reason", "invalid api key")
+			} else {
+				slog.Error("api key validation failed", "component", "RequireAuthOrAPIKey", "err", err)
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired api key"})
+			return
+		}
+		next(w, r.WithContext(auth.WithClaims(r.Context(), claims)))
+	}
+}
+
+// RequireScope returns 403 when the request is authenticated with an API key that lacks scope.
+// Bearer tokens always pass. Wrap it inside RequireAuthOrAPIKey.
+func RequireScope(next http.HandlerFunc, scope string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims := GetClaimsFromRequest(r)
+		if claims == nil || !claims.HasScope(scope) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "insufficient scope"})
+			return
+		}
+		next(w, r)
+	}
 }
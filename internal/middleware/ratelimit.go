@@ -2,11 +2,11 @@ package middleware
 
 import (
 	"encoding/json"
-	"net"
 	"net/http"
-	"strings"
 	"sync"
 	"time"
+
+	"github.com/bilalabsh/zabaan_backend/internal/clientip"
 )
 
 // AuthRateLimiter limits requests per IP for auth endpoints (signup, login, getToken).
@@ -92,25 +92,5 @@ func (l *AuthRateLimiter) pruneIdleKeys(now time.Time, cutoff time.Time) {
 
 // clientIP returns the client IP for rate limiting. When trustProxy is true, uses X-Real-IP or the first IP in X-Forwarded-For.
 func (l *AuthRateLimiter) clientIP(r *http.Request) string {
-	if l.trustProxy {
-		if s := strings.TrimSpace(r.Header.Get("X-Real-IP")); s != "" {
-			if net.ParseIP(s) != nil {
-				return s
-			}
-		}
-		if s := strings.TrimSpace(r.Header.Get("X-Forwarded-For")); s != "" {
-			first := s
-			if idx := strings.Index(s, ","); idx >= 0 {
-				first = strings.TrimSpace(s[:idx])
-			}
-			if first != "" && net.ParseIP(first) != nil {
-				return first
-			}
-		}
-	}
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return r.RemoteAddr
-	}
-	return ip
+	return clientip.FromRequest(r, l.trustProxy)
 }
@@ -1,13 +1,80 @@
 package models
 
+// Roles a user can hold. A user with no stored roles is a learner.
+const (
+	RoleLearner       = "learner"
+	RoleTeacher       = "teacher"
+	RoleContentEditor = "content_editor"
+	RoleAdmin         = "admin"
+)
+
+// ValidRole reports whether role is one of the known roles.
+func ValidRole(role string) bool {
+	switch role {
+	case RoleLearner, RoleTeacher, RoleContentEditor, RoleAdmin:
+		return true
+	}
+	return false
+}
 
 type User struct {
-	ID        uint   `json:"id" gorm:"primaryKey"`
-	Email     string `json:"email" gorm:"unique;not null"`
-	Username  string `json:"username" gorm:"unique;not null"`
-	FirstName string `json:"first_name"`
-	LastName  string `json:"last_name"`
-	CreatedAt string `json:"created_at"`
-	UpdatedAt string `json:"updated_at"`
+	ID               uint     `json:"id" gorm:"primaryKey"`
+	Email            string   `json:"email" gorm:"unique;not null"`
+	Phone            string   `json:"phone,omitempty"` // verified mobile number in E.164 form (+923001234567); empty if none
+	Username         string   `json:"username" gorm:"unique;not null"`
+	FirstName        string   `json:"first_name"`
+	LastName         string   `json:"last_name"`
+	EmailVerified    bool     `json:"email_verified"`
+	TwoFactorEnabled bool     `json:"two_factor_enabled"`
+	Roles            []string `json:"roles"`
+	IsGuest          bool     `json:"is_guest"`
+	// DeletionScheduledAt is when the account will be purged after DELETE /me (RFC 3339); empty if not scheduled.
+	DeletionScheduledAt string `json:"deletion_scheduled_at,omitempty"`
+	CreatedAt           string `json:"created_at"`
+	UpdatedAt           string `json:"updated_at"`
 }
 
+// Security audit event types (see AuditEvent).
+const (
+	AuditSignup             = "signup"
+	AuditLoginSucceeded     = "login_succeeded"
+	AuditLoginFailed        = "login_failed"
+	AuditTokenRefreshed     = "token_refreshed"
+	AuditTokenReuseDetected = "token_reuse_detected"
+	AuditTokensRevoked      = "tokens_revoked"
+	AuditSessionRevoked     = "session_revoked"
+	AuditPasswordChanged    = "password_changed"
+	AuditPasswordReset      = "password_reset"
+	AuditEmailChangeStarted = "email_change_started"
+	AuditEmailChanged       = "email_changed"
+	AuditEmailChangeUndone  = "email_change_undone"
+	AuditTwoFactorEnabled   = "two_factor_enabled"
+	AuditAPIKeyCreated      = "api_key_created"
+	AuditAPIKeyRevoked      = "api_key_revoked"
+	AuditPasskeyAdded       = "passkey_added"
+	AuditPasskeyRemoved     = "passkey_removed"
+	AuditGuestUpgraded      = "guest_upgraded"
+	AuditRolesChanged       = "roles_changed"
+	AuditDeletionScheduled  = "deletion_scheduled"
+	AuditDataExported       = "data_exported"
+	AuditConsentAccepted    = "consent_accepted"
+	// AuditImpersonationStarted is an admin getting a token for another user; events recorded with that token have
+	// the admin as actor and an "impersonated_user_id" detail.
+	AuditImpersonationStarted = "impersonation_started"
+	// AuditImpersonatedRequest is a request made with an impersonation token, with "method" and "path" details.
+	AuditImpersonatedRequest = "impersonated_request"
+)
+
+// AuditEvent is one entry of the security audit log. ActorID is who did it (0 when anonymous, e.g. a failed login);
+// UserID is the account it concerns (0 when unknown). Email is the address given when there is no user yet.
+type AuditEvent struct {
+	ID        int64             `json:"id"`
+	Type      string            `json:"type"`
+	ActorID   uint              `json:"actor_id,omitempty"`
+	UserID    uint              `json:"user_id,omitempty"`
+	Email     string            `json:"email,omitempty"`
+	IP        string            `json:"ip"`
+	UserAgent string            `json:"user_agent"`
+	Details   map[string]string `json:"details,omitempty"`
+	CreatedAt string            `json:"created_at"`
+}
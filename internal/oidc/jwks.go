@@ -0,0 +1,196 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How long fetched keys are trusted, and how often an unknown kid may trigger a refetch (providers rotate keys).
+const (
+	jwksMaxAge          = time.Hour
+	jwksMinRefetchDelay = time.Minute
+	maxJWKSBytes        = 1 << 20
+)
+
+// keyCache caches the public keys of each JWKS URL. The lock is not held while fetching: concurrent misses for one
+// URL share a single request (see jwksFetch), and other URLs are served meanwhile.
+type keyCache struct {
+	client *http.Client
+
+	mu      sync.Mutex
+	entries map[string]*jwksEntry
+	fetches map[string]*jwksFetch // in flight, by URL
+}
+
+type jwksEntry struct {
+	keys      map[string]interface{}
+	fetchedAt time.Time
+}
+
+// jwksFetch is a request for a JWKS in flight. keys and err are set before done is closed.
+type jwksFetch struct {
+	done chan struct{}
+	keys map[string]interface{}
+	err  error
+}
+
+func newKeyCache(client *http.Client) *keyCache {
+	return &keyCache{client: client, entries: make(map[string]*jwksEntry), fetches: make(map[string]*jwksFetch)}
+}
+
+// get returns the key with the given kid, fetching the JWKS when it is missing, stale, or doesn't have that kid.
+func (c *keyCache) get(ctx context.Context, url, kid string) (interface{}, error) {
+	c.mu.Lock()
+	e := c.entries[url]
+	if e != nil {
+		age := time.Since(e.fetchedAt)
+		if key, ok := e.keys[kid]; ok && age < jwksMaxAge {
+			c.mu.Unlock()
+			return key, nil
+		}
+		if age < jwksMinRefetchDelay {
+			c.mu.Unlock()
+			return nil, errors.New("unknown key id")
+		}
+	}
+	f := c.fetches[url]
+	if f == nil {
+		f = &jwksFetch{done: make(chan struct{})}
+		c.fetches[url] = f
+		// Detached from ctx so that one caller giving up doesn't fail the others waiting for the same fetch;
+		// the client's timeout bounds it.
+		go c.refresh(context.WithoutCancel(ctx), url, f)
+	}
+	c.mu.Unlock()
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if f.err != nil {
+		if e != nil {
+			// Keep serving the old keys if the provider is briefly unreachable.
+			if key, ok := e.keys[kid]; ok {
+				return key, nil
+			}
+		}
+		return nil, f.err
+	}
+	key, ok := f.keys[kid]
+	if !ok {
+		return nil, errors.New("unknown key id")
+	}
+	return key, nil
+}
+
+// refresh runs f: it fetches the JWKS at url and caches it on success.
+func (c *keyCache) refresh(ctx context.Context, url string, f *jwksFetch) {
+	keys, err := c.fetch(ctx, url)
+	c.mu.Lock()
+	if err == nil {
+		c.entries[url] = &jwksEntry{keys: keys, fetchedAt: time.Now()}
+	}
+	delete(c.fetches, url)
+	c.mu.Unlock()
+	f.keys, f.err = keys, err
+	close(f.done)
+}
+
+func (c *keyCache) fetch(ctx context.Context, url string) (map[string]interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch jwks: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch jwks: status %d", resp.StatusCode)
+	}
+	var doc jwksDocument
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSBytes)).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("decode jwks: %w", err)
+	}
+	keys := make(map[string]interface{})
+	for _, raw := range doc.Keys {
+		kid, key, err := parseJWK(raw)
+		if err != nil {
+			// Skip key types we don't use rather than failing the whole set.
+			continue
+		}
+		keys[kid] = key
+	}
+	return keys, nil
+}
+
+// jwk holds the JWK fields of the RSA and P-256 keys providers use for ID tokens.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func parseJWK(raw json.RawMessage) (string, interface{}, error) {
+	var k jwk
+	if err := json.Unmarshal(raw, &k); err != nil {
+		return "", nil, err
+	}
+	if k.Use != "" && k.Use != "sig" {
+		return "", nil, errors.New("not a signing key")
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return "", nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return "", nil, err
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() > 1<<31-1 {
+			return "", nil, errors.New("invalid RSA exponent")
+		}
+		return k.Kid, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return "", nil, errors.New("unsupported curve")
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return "", nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(x) != 32 || len(y) != 32 {
+			return "", nil, errors.New("invalid EC point")
+		}
+		pub, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(append([]byte{4}, x...), y...))
+		if err != nil {
+			return "", nil, err
+		}
+		return k.Kid, pub, nil
+	}
+	return "", nil, errors.New("unsupported key type")
+}
@@ -0,0 +1,145 @@
+// Package oidc verifies ID tokens issued by OpenID Connect providers (Sign in with Google / Apple).
+// Only the ID token is checked: the mobile or web client runs the provider's sign-in flow and sends us the token.
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Provider names used in POST /auth/oidc/{provider}.
+const (
+	ProviderGoogle = "google"
+	ProviderApple  = "apple"
+)
+
+// ErrUnknownProvider is returned for a provider that is not configured.
+var ErrUnknownProvider = errors.New("unknown identity provider")
+
+// ErrInvalidToken is returned when an ID token is malformed, expired, or fails signature, issuer or audience checks.
+var ErrInvalidToken = errors.New("invalid id token")
+
+// Provider is the configuration of one OpenID Connect provider.
+type Provider struct {
+	Name      string
+	Issuers   []string // accepted "iss" values (Google uses both https://accounts.google.com and accounts.google.com)
+	Audiences []string // our client IDs; the token's "aud" must contain one of them
+	JWKSURL   string   // where the provider publishes its signing keys
+}
+
+// Identity is the verified result of an ID token.
+type Identity struct {
+	Provider      string
+	Subject       string // stable user id at the provider
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// idTokenClaims are the ID token claims we read. Apple sends email_verified as the string "true", Google as a boolean.
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	Email         string   `json:"email"`
+	EmailVerified flexBool `json:"email_verified"`
+	Name          string   `json:"name"`
+}
+
+type flexBool bool
+
+func (b *flexBool) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	*b = flexBool(s == "true")
+	return nil
+}
+
+// Verifier checks ID tokens against the configured providers, caching each provider's JWKS.
+type Verifier struct {
+	providers map[string]Provider
+	keys      *keyCache
+	leeway    time.Duration
+}
+
+// NewVerifier returns a verifier for the given providers. Providers without audiences are skipped (not configured).
+// client is used to fetch JWKS documents; nil means a client with a 10s timeout.
+func NewVerifier(providers []Provider, client *http.Client) *Verifier {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	v := &Verifier{
+		providers: make(map[string]Provider),
+		keys:      newKeyCache(client),
+		leeway:    time.Minute,
+	}
+	for _, p := range providers {
+		if len(p.Audiences) == 0 || p.JWKSURL == "" {
+			continue
+		}
+		v.providers[p.Name] = p
+	}
+	return v
+}
+
+// Providers returns the names of the configured providers.
+func (v *Verifier) Providers() []string {
+	names := make([]string, 0, len(v.providers))
+	for name := range v.providers {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Verify checks the ID token's signature, issuer, audience and expiry and returns the identity it asserts.
+func (v *Verifier) Verify(ctx context.Context, provider, rawToken string) (*Identity, error) {
+	p, ok := v.providers[provider]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	var claims idTokenClaims
+	_, err := jwt.ParseWithClaims(rawToken, &claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.keys.get(ctx, p.JWKSURL, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "ES256"}),
+		jwt.WithAudience(p.Audiences...),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(v.leeway),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if !containsString(p.Issuers, claims.Issuer) {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, claims.Issuer)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidToken)
+	}
+	return &Identity{
+		Provider:      p.Name,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: bool(claims.EmailVerified),
+		Name:          claims.Name,
+	}, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// jwksDocument is the JSON Web Key Set format providers publish.
+type jwksDocument struct {
+	Keys []json.RawMessage `json:"keys"`
+}
@@ -0,0 +1,239 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testIssuer   = "https://accounts.example.test"
+	testAudience = "client-123"
+)
+
+// jwksServer publishes the public keys of its signing keys, counting requests. If block is set, requests wait
+// until it is closed.
+type jwksServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	keys     map[string]*rsa.PrivateKey
+	requests atomic.Int32
+	block    chan struct{}
+}
+
+func newJWKSServer(t *testing.T) *jwksServer {
+	t.Helper()
+	s := &jwksServer{keys: make(map[string]*rsa.PrivateKey)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
+		if s.block != nil {
+			<-s.block
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		var doc struct {
+			Keys []jwk `json:"keys"`
+		}
+		for kid, key := range s.keys {
+			doc.Keys = append(doc.Keys, jwk{
+				Kty: "RSA",
+				Kid: kid,
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(doc)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// addKey generates a signing key published under kid and returns it.
+func (s *jwksServer) addKey(t *testing.T, kid string) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	s.keys[kid] = key
+	s.mu.Unlock()
+	return key
+}
+
+func (s *jwksServer) verifier() *Verifier {
+	return NewVerifier([]Provider{{Name: ProviderGoogle, Issuers: []string{testIssuer}, Audiences: []string{testAudience}, JWKSURL: s.URL}}, s.Client())
+}
+
+func validClaims() idTokenClaims {
+	now := time.Now()
+	return idTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    testIssuer,
+			Subject:   "10769150350006150715113082367",
+			Audience:  jwt.ClaimStrings{testAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+		},
+		Email:         "learner@example.test",
+		EmailVerified: true,
+		Name:          "Learner",
+	}
+}
+
+func signToken(t *testing.T, key *rsa.PrivateKey, kid string, claims idTokenClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	raw, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestVerifyValidToken(t *testing.T) {
+	srv := newJWKSServer(t)
+	key := srv.addKey(t, "k1")
+	v := srv.verifier()
+	id, err := v.Verify(context.Background(), ProviderGoogle, signToken(t, key, "k1", validClaims()))
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	want := Identity{Provider: ProviderGoogle, Subject: "10769150350006150715113082367", Email: "learner@example.test", EmailVerified: true, Name: "Learner"}
+	if *id != want {
+		t.Fatalf("identity = %+v, want %+v", *id, want)
+	}
+	// The second token is checked with the cached keys.
+	if _, err := v.Verify(context.Background(), ProviderGoogle, signToken(t, key, "k1", validClaims())); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if n := srv.requests.Load(); n != 1 {
+		t.Fatalf("jwks requests = %d, want 1", n)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	srv := newJWKSServer(t)
+	key := srv.addKey(t, "k1")
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := srv.verifier()
+	for _, tc := range []struct {
+		name   string
+		key    *rsa.PrivateKey
+		mutate func(c *idTokenClaims)
+	}{
+		{"wrong issuer", key, func(c *idTokenClaims) { c.Issuer = "https://evil.test" }},
+		{"wrong audience", key, func(c *idTokenClaims) { c.Audience = jwt.ClaimStrings{"someone-else"} }},
+		{"expired", key, func(c *idTokenClaims) {
+			c.IssuedAt = jwt.NewNumericDate(time.Now().Add(-3 * time.Hour))
+			c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-2 * time.Hour))
+		}},
+		{"no expiry", key, func(c *idTokenClaims) { c.ExpiresAt = nil }},
+		{"no subject", key, func(c *idTokenClaims) { c.Subject = "" }},
+		{"bad signature", other, func(c *idTokenClaims) {}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			claims := validClaims()
+			tc.mutate(&claims)
+			if _, err := v.Verify(context.Background(), ProviderGoogle, signToken(t, tc.key, "k1", claims)); !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("Verify err = %v, want ErrInvalidToken", err)
+			}
+		})
+	}
+	if _, err := v.Verify(context.Background(), ProviderApple, signToken(t, key, "k1", validClaims())); !errors.Is(err, ErrUnknownProvider) {
+		t.Fatalf("Verify err = %v, want ErrUnknownProvider", err)
+	}
+}
+
+func TestVerifyUnknownKidRefetches(t *testing.T) {
+	srv := newJWKSServer(t)
+	key1 := srv.addKey(t, "k1")
+	v := srv.verifier()
+	if _, err := v.Verify(context.Background(), ProviderGoogle, signToken(t, key1, "k1", validClaims())); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	// The provider rotates in a new key. Right after a fetch an unknown kid doesn't refetch.
+	key2 := srv.addKey(t, "k2")
+	token := signToken(t, key2, "k2", validClaims())
+	if _, err := v.Verify(context.Background(), ProviderGoogle, token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("Verify err = %v, want ErrInvalidToken", err)
+	}
+	if n := srv.requests.Load(); n != 1 {
+		t.Fatalf("jwks requests = %d, want 1", n)
+	}
+
+	// Once jwksMinRefetchDelay has passed it does.
+	v.keys.mu.Lock()
+	v.keys.entries[srv.URL].fetchedAt = time.Now().Add(-jwksMinRefetchDelay)
+	v.keys.mu.Unlock()
+	if _, err := v.Verify(context.Background(), ProviderGoogle, token); err != nil {
+		t.Fatalf("Verify after refetch: %v", err)
+	}
+	if n := srv.requests.Load(); n != 2 {
+		t.Fatalf("jwks requests = %d, want 2", n)
+	}
+}
+
+func TestKeyCacheSharesFetch(t *testing.T) {
+	srv := newJWKSServer(t)
+	key := srv.addKey(t, "k1")
+	srv.block = make(chan struct{})
+	cached := newJWKSServer(t)
+	cached.addKey(t, "c1")
+	c := newKeyCache(srv.Client())
+	if _, err := c.get(context.Background(), cached.URL, "c1"); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+
+	const callers = 10
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			got, err := c.get(context.Background(), srv.URL, "k1")
+			if err == nil && !got.(*rsa.PublicKey).Equal(&key.PublicKey) {
+				err = errors.New("wrong key")
+			}
+			errs <- err
+		}()
+	}
+	// While the fetch is blocked, other URLs are served and a caller that gives up returns.
+	for srv.requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := c.get(context.Background(), cached.URL, "c1"); err != nil {
+		t.Fatalf("get cached url during fetch: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.get(ctx, srv.URL, "k1"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("get with cancelled context err = %v, want context.Canceled", err)
+	}
+
+	close(srv.block)
+	for i := 0; i < callers; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("get: %v", err)
+		}
+	}
+	if n := srv.requests.Load(); n != 1 {
+		t.Fatalf("jwks requests = %d, want 1", n)
+	}
+}
@@ -0,0 +1,62 @@
+// Package sms sends text messages (phone login codes) through a provider or, in development, a log.
+package sms
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a plain-text SMS. To is an E.164 number such as +923001234567.
+type Message struct {
+	To   string
+	Body string
+}
+
+// SMSSender sends text messages. Accepting an interface lets services use the log sender in development, a real
+// provider in production and a mock in tests.
+type SMSSender interface {
+	Send(msg Message) error
+}
+
+// Config selects and configures an SMS sender.
+type Config struct {
+	Driver  string // "log"; providers are added as drivers
+	LogFile string // log driver only: if set, messages are also appended to this file
+}
+
+// New returns the sender selected by cfg.Driver. Unknown drivers fall back to the log sender.
+func New(cfg Config) SMSSender {
+	return NewLogSender(cfg.LogFile)
+}
+
+// LogSender logs messages instead of sending them. Use in development to read codes from the console or a file.
+type LogSender struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewLogSender returns a log sender. If path is non-empty, each message is also appended to that file.
+func NewLogSender(path string) *LogSender {
+	return &LogSender{path: path}
+}
+
+// Send logs msg and appends it to the log file, if configured.
+func (s *LogSender) Send(msg Message) error {
+	slog.Info("sms (not sent, log sender)", "component", "sms", "to", msg.To, "body", msg.Body)
+	if s.path == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "To: %s\nDate: %s\n\n%s\n\n", msg.To, time.Now().Format(time.RFC1123Z), strings.TrimRight(msg.Body, "\n"))
+	return err
+}
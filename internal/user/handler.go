@@ -7,23 +7,42 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+
+	"github.com/bilalabsh/zabaan_backend/internal/models"
 )
 
+// AuditRecorder records security events for a request. Implemented by audit.Recorder.
+type AuditRecorder interface {
+	Record(r *http.Request, e models.AuditEvent)
+}
+
 // Handler handles user HTTP endpoints.
 type Handler struct {
-	svc *Service
+	svc   *Service
+	audit AuditRecorder
 }
 
-// NewHandler returns a new user handler.
-func NewHandler(svc *Service) *Handler {
-	return &Handler{svc: svc}
+// NewHandler returns a new user handler. Role changes are recorded with audit.
+func NewHandler(svc *Service, audit AuditRecorder) *Handler {
+	return &Handler{svc: svc, audit: audit}
 }
 
-// Users handles /users and /users/:id (GET list, GET one, POST create).
+// Users handles /users, /users/:id and /users/:id/roles (GET list, GET one, POST create, PUT roles).
+// Main restricts these routes to admins.
 func (h *Handler) Users(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	path := strings.TrimPrefix(r.URL.Path, "/users")
 	path = strings.TrimPrefix(path, "/")
+	if idPart, ok := strings.CutSuffix(path, "/roles"); ok {
+		id, err := strconv.ParseUint(idPart, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "not found"})
+			return
+		}
+		h.roles(w, r, uint(id))
+		return
+	}
 	if path != "" {
 		id, err := strconv.ParseUint(path, 10, 64)
 		if err != nil {
@@ -87,3 +106,39 @@ func (h *Handler) Users(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
 	}
 }
+
+// roles handles PUT /users/:id/roles with body {"roles": ["teacher", "content_editor"]}, replacing the user's roles.
+// Added roles are in the user's access tokens from their next refresh; removing a role signs the user out everywhere.
+func (h *Handler) roles(w http.ResponseWriter, r *http.Request, id uint) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+	var body struct {
+		Roles []string `json:"roles"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid JSON"})
+		return
+	}
+	user, err := h.svc.SetRoles(id, body.Roles)
+	if err != nil {
+		if errors.Is(err, ErrInvalidRole) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid role"})
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "user not found"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	h.audit.Record(r, models.AuditEvent{Type: models.AuditRolesChanged, UserID: user.ID, Details: map[string]string{"roles": strings.Join(user.Roles, ",")}})
+	json.NewEncoder(w).Encode(user)
+}
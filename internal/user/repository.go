@@ -3,6 +3,7 @@ package user
 import (
 	"database/sql"
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/bilalabsh/zabaan_backend/internal/models"
@@ -12,6 +13,44 @@ import (
 // ErrDuplicateEmail is returned when signup uses an email or username that already exists.
 var ErrDuplicateEmail = errors.New("email already exists")
 
+// ErrDuplicatePhone is returned when a phone signup uses a number that already has an account.
+var ErrDuplicatePhone = errors.New("phone already exists")
+
+// userColumns is the column list read by scanUser. Roles come from user_roles as a comma-separated list.
+const userColumns = "id, email, phone, username, first_name, last_name, email_verified_at, totp_enabled_at, is_guest, deletion_scheduled_at, created_at, updated_at, " +
+	"(SELECT GROUP_CONCAT(role ORDER BY role) FROM user_roles WHERE user_roles.user_id = users.id)"
+
+// rowScanner is implemented by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanUser scans a row selected with userColumns (plus any extra trailing destinations).
+func scanUser(row rowScanner, extra ...interface{}) (*models.User, error) {
+	var u models.User
+	var createdAt, updatedAt time.Time
+	var emailVerifiedAt, totpEnabledAt, deletionScheduledAt sql.NullTime
+	var email, phone, roles sql.NullString
+	dest := append([]interface{}{&u.ID, &email, &phone, &u.Username, &u.FirstName, &u.LastName, &emailVerifiedAt, &totpEnabledAt, &u.IsGuest, &deletionScheduledAt, &createdAt, &updatedAt, &roles}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	u.Email = email.String
+	u.Phone = phone.String
+	u.Roles = []string{models.RoleLearner}
+	if roles.Valid && roles.String != "" {
+		u.Roles = strings.Split(roles.String, ",")
+	}
+	u.EmailVerified = emailVerifiedAt.Valid
+	u.TwoFactorEnabled = totpEnabledAt.Valid
+	if deletionScheduledAt.Valid {
+		u.DeletionScheduledAt = deletionScheduledAt.Time.Format(time.RFC3339)
+	}
+	u.CreatedAt = createdAt.Format(time.RFC3339)
+	u.UpdatedAt = updatedAt.Format(time.RFC3339)
+	return &u, nil
+}
+
 // Repository handles user persistence.
 type Repository struct {
 	db *sql.DB
@@ -27,21 +66,18 @@ func (r *Repository) List() ([]models.User, error) {
 	if r.db == nil {
 		return nil, sql.ErrConnDone
 	}
-	rows, err := r.db.Query("SELECT id, email, username, first_name, last_name, created_at, updated_at FROM users ORDER BY id")
+	rows, err := r.db.Query("SELECT " + userColumns + " FROM users ORDER BY id")
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	var users []models.User
 	for rows.Next() {
-		var u models.User
-		var createdAt, updatedAt time.Time
-		if err := rows.Scan(&u.ID, &u.Email, &u.Username, &u.FirstName, &u.LastName, &createdAt, &updatedAt); err != nil {
+		u, err := scanUser(rows)
+		if err != nil {
 			return nil, err
 		}
-		u.CreatedAt = createdAt.Format(time.RFC3339)
-		u.UpdatedAt = updatedAt.Format(time.RFC3339)
-		users = append(users, u)
+		users = append(users, *u)
 	}
 	return users, rows.Err()
 }
@@ -51,15 +87,7 @@ func (r *Repository) GetByID(id uint) (*models.User, error) {
 	if r.db == nil {
 		return nil, sql.ErrNoRows
 	}
-	var u models.User
-	var createdAt, updatedAt time.Time
-	err := r.db.QueryRow("SELECT id, email, username, first_name, last_name, created_at, updated_at FROM users WHERE id = ?", int64(id)).Scan(&u.ID, &u.Email, &u.Username, &u.FirstName, &u.LastName, &createdAt, &updatedAt)
-	if err != nil {
-		return nil, err
-	}
-	u.CreatedAt = createdAt.Format(time.RFC3339)
-	u.UpdatedAt = updatedAt.Format(time.RFC3339)
-	return &u, nil
+	return scanUser(r.db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", int64(id)))
 }
 
 // GetByEmail returns the user and password hash for login.
@@ -67,16 +95,20 @@ func (r *Repository) GetByEmail(email string) (*models.User, string, error) {
 	if r.db == nil {
 		return nil, "", sql.ErrNoRows
 	}
-	var u models.User
-	var createdAt, updatedAt time.Time
 	var passwordHash string
-	err := r.db.QueryRow("SELECT id, email, username, first_name, last_name, password_hash, created_at, updated_at FROM users WHERE email = ?", email).Scan(&u.ID, &u.Email, &u.Username, &u.FirstName, &u.LastName, &passwordHash, &createdAt, &updatedAt)
+	u, err := scanUser(r.db.QueryRow("SELECT "+userColumns+", password_hash FROM users WHERE email = ?", email), &passwordHash)
 	if err != nil {
 		return nil, "", err
 	}
-	u.CreatedAt = createdAt.Format(time.RFC3339)
-	u.UpdatedAt = updatedAt.Format(time.RFC3339)
-	return &u, passwordHash, nil
+	return u, passwordHash, nil
+}
+
+// GetByPhone returns one user by E.164 phone number.
+func (r *Repository) GetByPhone(phone string) (*models.User, error) {
+	if r.db == nil {
+		return nil, sql.ErrNoRows
+	}
+	return scanUser(r.db.QueryRow("SELECT "+userColumns+" FROM users WHERE phone = ?", phone))
 }
 
 // Create inserts a user (email, username only).
@@ -115,6 +147,198 @@ func (r *Repository) CreateWithPassword(email, username, firstName, lastName, pa
 	return r.GetByID(uint(id))
 }
 
+// CreateWithPhone inserts a user who signed up with a verified phone number: no email or password.
+func (r *Repository) CreateWithPhone(phone, username, firstName, lastName string) (*models.User, error) {
+	if r.db == nil {
+		return nil, sql.ErrConnDone
+	}
+	res, err := r.db.Exec("INSERT INTO users (email, phone, username, first_name, last_name) VALUES (NULL, ?, ?, ?, ?)", phone, username, firstName, lastName)
+	if err != nil {
+		var myErr *mysql.MySQLError
+		if errors.As(err, &myErr) && myErr.Number == 1062 {
+			return nil, ErrDuplicatePhone
+		}
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return r.GetByID(uint(id))
+}
+
+// CreateGuest inserts a guest user: no email or password, only a generated username.
+func (r *Repository) CreateGuest(username string, t time.Time) (*models.User, error) {
+	if r.db == nil {
+		return nil, sql.ErrConnDone
+	}
+	res, err := r.db.Exec("INSERT INTO users (email, username, is_guest, last_seen_at) VALUES (NULL, ?, TRUE, ?)", username, t)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return r.GetByID(uint(id))
+}
+
+// UpgradeGuest turns a guest into a full account in place, so rows keyed by the user id are kept.
+// Returns false if the user is not (or no longer) a guest, and ErrDuplicateEmail if the email is taken.
+func (r *Repository) UpgradeGuest(id uint, email, username, firstName, lastName, passwordHash string) (bool, error) {
+	if r.db == nil {
+		return false, sql.ErrConnDone
+	}
+	res, err := r.db.Exec("UPDATE users SET email = ?, username = ?, first_name = ?, last_name = ?, password_hash = ?, is_guest = FALSE WHERE id = ? AND is_guest",
+		email, username, firstName, lastName, passwordHash, int64(id))
+	if err != nil {
+		var myErr *mysql.MySQLError
+		if errors.As(err, &myErr) && myErr.Number == 1062 {
+			return false, ErrDuplicateEmail
+		}
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// SetGuestProfile stores names and a password hash on a guest without upgrading it (the email comes later, with
+// UpgradeGuest). Returns false if the user is not a guest.
+func (r *Repository) SetGuestProfile(id uint, firstName, lastName, passwordHash string) (bool, error) {
+	if r.db == nil {
+		return false, sql.ErrConnDone
+	}
+	res, err := r.db.Exec("UPDATE users SET first_name = ?, last_name = ?, password_hash = ? WHERE id = ? AND is_guest",
+		firstName, lastName, passwordHash, int64(id))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// TouchGuest records guest activity at t; stale guests are those not seen for a while.
+func (r *Repository) TouchGuest(id uint, t time.Time) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	_, err := r.db.Exec("UPDATE users SET last_seen_at = ? WHERE id = ? AND is_guest", t, int64(id))
+	return err
+}
+
+// ListStaleGuests returns up to limit guest ids not seen since before.
+func (r *Repository) ListStaleGuests(before time.Time, limit int) ([]uint, error) {
+	if r.db == nil {
+		return nil, sql.ErrConnDone
+	}
+	rows, err := r.db.Query("SELECT id FROM users WHERE is_guest AND COALESCE(last_seen_at, created_at) < ? ORDER BY id LIMIT ?", before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []uint
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, uint(id))
+	}
+	return ids, rows.Err()
+}
+
+// DeleteStaleGuest deletes a guest and its roles if it is still a guest not seen since before,
+// so a guest that was upgraded or came back meanwhile is kept. Returns whether it was deleted.
+func (r *Repository) DeleteStaleGuest(id uint, before time.Time) (bool, error) {
+	if r.db == nil {
+		return false, sql.ErrConnDone
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("DELETE FROM users WHERE id = ? AND is_guest AND COALESCE(last_seen_at, created_at) < ?", int64(id), before)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if _, err := tx.Exec("DELETE FROM user_roles WHERE user_id = ?", int64(id)); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// ScheduleDeletion marks the user for deletion at t.
+func (r *Repository) ScheduleDeletion(id uint, t time.Time) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	_, err := r.db.Exec("UPDATE users SET deletion_scheduled_at = ? WHERE id = ?", t, int64(id))
+	return err
+}
+
+// CancelDeletion clears a deletion scheduled after t. Returns false if none was scheduled, or if it is already due:
+// the purge may have started deleting the user's data.
+func (r *Repository) CancelDeletion(id uint, t time.Time) (bool, error) {
+	if r.db == nil {
+		return false, sql.ErrConnDone
+	}
+	res, err := r.db.Exec("UPDATE users SET deletion_scheduled_at = NULL WHERE id = ? AND deletion_scheduled_at > ?", int64(id), t)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ListDueDeletions returns up to limit users whose scheduled deletion is at or before t.
+func (r *Repository) ListDueDeletions(t time.Time, limit int) ([]models.User, error) {
+	if r.db == nil {
+		return nil, sql.ErrConnDone
+	}
+	rows, err := r.db.Query("SELECT "+userColumns+" FROM users WHERE deletion_scheduled_at <= ? ORDER BY deletion_scheduled_at LIMIT ?", t, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []models.User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *u)
+	}
+	return users, rows.Err()
+}
+
+// DeleteScheduled deletes the user and its roles if its deletion is still scheduled at or before t, so a deletion
+// cancelled meanwhile is kept. Returns whether it was deleted.
+func (r *Repository) DeleteScheduled(id uint, t time.Time) (bool, error) {
+	if r.db == nil {
+		return false, sql.ErrConnDone
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("DELETE FROM users WHERE id = ? AND deletion_scheduled_at <= ?", int64(id), t)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if _, err := tx.Exec("DELETE FROM user_roles WHERE user_id = ?", int64(id)); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
 // GetTokenValidAfter returns the time after which only newly issued tokens are valid (zero = no revocation).
 func (r *Repository) GetTokenValidAfter(userID uint) (time.Time, error) {
 	if r.db == nil {
@@ -152,3 +376,129 @@ func (r *Repository) UpdateTokenValidAfter(userID uint, t time.Time) error {
 	}
 	return tx.Commit()
 }
+
+// MarkEmailVerified records that the user proved ownership of their email at t.
+func (r *Repository) MarkEmailVerified(userID uint, t time.Time) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	_, err := r.db.Exec("UPDATE users SET email_verified_at = ? WHERE id = ?", t, int64(userID))
+	return err
+}
+
+// UpdateEmail sets the user's email, verified at t. A username that was the old email follows it (signup uses the email
+// as username), so the old address isn't left behind. Returns ErrDuplicateEmail if another account has the email.
+func (r *Repository) UpdateEmail(userID uint, email string, t time.Time) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	// MySQL assigns left to right, so username is compared with the email before it changes.
+	_, err := r.db.Exec("UPDATE users SET username = IF(username = email, ?, username), email = ?, email_verified_at = ? WHERE id = ?",
+		email, email, t, int64(userID))
+	if err != nil {
+		var myErr *mysql.MySQLError
+		if errors.As(err, &myErr) && myErr.Number == 1062 {
+			return ErrDuplicateEmail
+		}
+		return err
+	}
+	return nil
+}
+
+// GetPasswordHash returns the user's password hash ("" if the account has no password).
+func (r *Repository) GetPasswordHash(userID uint) (string, error) {
+	if r.db == nil {
+		return "", sql.ErrNoRows
+	}
+	var hash string
+	err := r.db.QueryRow("SELECT password_hash FROM users WHERE id = ?", int64(userID)).Scan(&hash)
+	return hash, err
+}
+
+// UpdatePassword replaces the user's password hash.
+func (r *Repository) UpdatePassword(userID uint, passwordHash string) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	_, err := r.db.Exec("UPDATE users SET password_hash = ? WHERE id = ?", passwordHash, int64(userID))
+	return err
+}
+
+// GetTOTP returns the user's TOTP secret ("" if never set up), whether 2FA is enabled, and the last accepted time step.
+func (r *Repository) GetTOTP(userID uint) (secret string, enabled bool, lastStep int64, err error) {
+	if r.db == nil {
+		return "", false, 0, sql.ErrNoRows
+	}
+	var enabledAt sql.NullTime
+	err = r.db.QueryRow("SELECT totp_secret, totp_enabled_at, totp_last_step FROM users WHERE id = ?", int64(userID)).Scan(&secret, &enabledAt, &lastStep)
+	if err != nil {
+		return "", false, 0, err
+	}
+	return secret, enabledAt.Valid, lastStep, nil
+}
+
+// SetPendingTOTPSecret stores a TOTP secret that is not active until EnableTOTP. It never replaces an enabled secret.
+func (r *Repository) SetPendingTOTPSecret(userID uint, secret string) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	_, err := r.db.Exec("UPDATE users SET totp_secret = ?, totp_last_step = 0 WHERE id = ? AND totp_enabled_at IS NULL", secret, int64(userID))
+	return err
+}
+
+// EnableTOTP activates the pending TOTP secret.
+func (r *Repository) EnableTOTP(userID uint, t time.Time) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	_, err := r.db.Exec("UPDATE users SET totp_enabled_at = ? WHERE id = ?", t, int64(userID))
+	return err
+}
+
+// UpdateTOTPLastStep records the time step of an accepted code. Returns false if an equal or later step was already
+// recorded, so the same code can't be used twice even by concurrent requests.
+func (r *Repository) UpdateTOTPLastStep(userID uint, step int64) (bool, error) {
+	if r.db == nil {
+		return false, sql.ErrConnDone
+	}
+	res, err := r.db.Exec("UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?", step, int64(userID), step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// SetRoles replaces the user's roles. An empty list leaves the user a plain learner.
+func (r *Repository) SetRoles(userID uint, roles []string) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM user_roles WHERE user_id = ?", int64(userID)); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, role := range roles {
+		if _, err := tx.Exec("INSERT IGNORE INTO user_roles (user_id, role, created_at) VALUES (?, ?, ?)", int64(userID), role, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// AddRole grants the user a role, keeping the ones they have.
+func (r *Repository) AddRole(userID uint, role string) error {
+	if r.db == nil {
+		return sql.ErrConnDone
+	}
+	_, err := r.db.Exec("INSERT IGNORE INTO user_roles (user_id, role, created_at) VALUES (?, ?, ?)", int64(userID), role, time.Now())
+	return err
+}
@@ -1,17 +1,30 @@
 package user
 
 import (
+	"errors"
+	"slices"
+	"time"
+
 	"github.com/bilalabsh/zabaan_backend/internal/models"
 )
 
+// ErrInvalidRole is returned when assigning a role that doesn't exist.
+var ErrInvalidRole = errors.New("invalid role")
+
+// TokenRevoker revokes every token, session and API key of a user issued before t. Implemented by auth.Service.
+type TokenRevoker interface {
+	RevokePreviousTokensAt(userID uint, t time.Time) error
+}
+
 // Service holds user use-case logic.
 type Service struct {
-	repo *Repository
+	repo    *Repository
+	revoker TokenRevoker
 }
 
-// NewService returns a new user service.
-func NewService(repo *Repository) *Service {
-	return &Service{repo: repo}
+// NewService returns a new user service. Taking roles away from a user revokes their tokens with revoker.
+func NewService(repo *Repository, revoker TokenRevoker) *Service {
+	return &Service{repo: repo, revoker: revoker}
 }
 
 // List returns all users.
@@ -35,3 +48,40 @@ func (s *Service) GetByID(id uint) (*models.User, error) {
 func (s *Service) Create(email, username string) (*models.User, error) {
 	return s.repo.Create(email, username)
 }
+
+// SetRoles replaces the roles of the user and returns the updated user. If a role was taken away, every token,
+// session and API key of the user is revoked, since access tokens carry the roles they were issued with; added
+// roles only show up from the next refresh.
+func (s *Service) SetRoles(id uint, roles []string) (*models.User, error) {
+	for _, role := range roles {
+		if !models.ValidRole(role) {
+			return nil, ErrInvalidRole
+		}
+	}
+	u, err := s.repo.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.repo.SetRoles(id, roles); err != nil {
+		return nil, err
+	}
+	if rolesRemoved(u.Roles, roles) {
+		if err := s.revoker.RevokePreviousTokensAt(id, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	return s.repo.GetByID(id)
+}
+
+// rolesRemoved reports whether some role in before is not in after. No roles means learner.
+func rolesRemoved(before, after []string) bool {
+	if len(after) == 0 {
+		after = []string{models.RoleLearner}
+	}
+	for _, role := range before {
+		if !slices.Contains(after, role) {
+			return true
+		}
+	}
+	return false
+}
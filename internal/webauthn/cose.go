@@ -0,0 +1,112 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+// COSE algorithms (RFC 9053) accepted for passkeys, in order of preference.
+const (
+	AlgEdDSA = -8
+	AlgES256 = -7
+	AlgRS256 = -257
+)
+
+// SupportedAlgorithms are offered in pubKeyCredParams when registering a passkey.
+var SupportedAlgorithms = []int{AlgEdDSA, AlgES256, AlgRS256}
+
+// COSE_Key labels and values used below.
+const (
+	coseKeyType    = 1
+	coseAlg        = 3
+	coseCurve      = -1 // EC2/OKP
+	coseX          = -2 // EC2/OKP
+	coseY          = -3 // EC2
+	coseRSAN       = -1
+	coseRSAE       = -2
+	coseKtyOKP     = 1
+	coseKtyEC2     = 2
+	coseKtyRSA     = 3
+	coseCrvP256    = 1
+	coseCrvEd25519 = 6
+	minRSAKeyBits  = 2048
+)
+
+var errUnsupportedKey = errors.New("unsupported credential public key")
+
+// parsePublicKey decodes a COSE_Key and returns the public key with its algorithm. Only SupportedAlgorithms are accepted.
+func parsePublicKey(coseKey []byte) (crypto.PublicKey, int64, error) {
+	v, rest, err := decodeCBOR(coseKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok || len(rest) != 0 {
+		return nil, 0, errUnsupportedKey
+	}
+	kty, _ := m[int64(coseKeyType)].(int64)
+	alg, _ := m[int64(coseAlg)].(int64)
+	switch {
+	case kty == coseKtyOKP && alg == AlgEdDSA:
+		crv, _ := m[int64(coseCurve)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		if crv != coseCrvEd25519 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, errUnsupportedKey
+		}
+		return ed25519.PublicKey(append([]byte(nil), x...)), alg, nil
+	case kty == coseKtyEC2 && alg == AlgES256:
+		crv, _ := m[int64(coseCurve)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		y, _ := m[int64(coseY)].([]byte)
+		if crv != coseCrvP256 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, errUnsupportedKey
+		}
+		point := append(append([]byte{4}, x...), y...)
+		pub, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point)
+		if err != nil {
+			return nil, 0, errUnsupportedKey
+		}
+		return pub, alg, nil
+	case kty == coseKtyRSA && alg == AlgRS256:
+		n, _ := m[int64(coseRSAN)].([]byte)
+		e, _ := m[int64(coseRSAE)].([]byte)
+		if len(e) == 0 || len(e) > 4 {
+			return nil, 0, errUnsupportedKey
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if pub.N.BitLen() < minRSAKeyBits || pub.E < 3 || pub.E%2 == 0 {
+			return nil, 0, errUnsupportedKey
+		}
+		return pub, alg, nil
+	}
+	return nil, 0, errUnsupportedKey
+}
+
+// verifySignature checks sig over data with the COSE public key.
+func verifySignature(coseKey, data, sig []byte) error {
+	pub, alg, err := parsePublicKey(coseKey)
+	if err != nil {
+		return err
+	}
+	ok := false
+	switch alg {
+	case AlgEdDSA:
+		ok = ed25519.Verify(pub.(ed25519.PublicKey), data, sig)
+	case AlgES256:
+		digest := sha256.Sum256(data)
+		ok = ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), digest[:], sig)
+	case AlgRS256:
+		digest := sha256.Sum256(data)
+		ok = rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], sig) == nil
+	}
+	if !ok {
+		return errors.New("signature does not verify")
+	}
+	return nil
+}
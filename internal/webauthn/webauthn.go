@@ -0,0 +1,341 @@
+// Package webauthn runs the server side of WebAuthn (passkey) registration and login ceremonies.
+// The browser or mobile OS talks to the authenticator; we hand out options with a challenge and verify what comes back.
+// Attestation statements are not checked: we ask for "none" and don't restrict which authenticators can be used.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInvalidResponse is returned when an authenticator response is malformed, for another challenge, origin or
+// relying party, lacks user verification, has a bad signature, or its sign count went backwards (a cloned authenticator).
+var ErrInvalidResponse = errors.New("invalid webauthn response")
+
+// MaxCredentialIDLength is the longest credential ID accepted (WebAuthn allows at most 1023 bytes).
+const MaxCredentialIDLength = 1023
+
+// Authenticator data flags.
+const (
+	flagUserPresent            = 0x01
+	flagUserVerified           = 0x04
+	flagBackupEligible         = 0x08
+	flagAttestedCredentialData = 0x40
+	flagExtensionData          = 0x80
+)
+
+// Client data types.
+const (
+	typeCreate = "webauthn.create"
+	typeGet    = "webauthn.get"
+)
+
+// RelyingParty is us, as the authenticator sees it.
+type RelyingParty struct {
+	ID      string        // domain passkeys are bound to, e.g. zabaan.com
+	Name    string        // shown by the authenticator, e.g. Zabaan
+	Origins []string      // accepted origins, e.g. https://app.zabaan.com or android:apk-key-hash:...
+	Timeout time.Duration // how long the client may take; also how long a challenge should stay valid
+}
+
+// User describes the account a passkey is created for. ID is the user handle returned on login; it must not contain
+// personal data.
+type User struct {
+	ID          []byte
+	Name        string
+	DisplayName string
+}
+
+// Credential is a verified new passkey.
+type Credential struct {
+	ID             []byte
+	PublicKey      []byte // COSE_Key
+	SignCount      uint32
+	AAGUID         []byte // authenticator model; all zeros when the authenticator doesn't say
+	BackupEligible bool   // synced passkey (e.g. iCloud Keychain, Google Password Manager)
+}
+
+// CreationOptions are the PublicKeyCredentialCreationOptions (JSON form) passed to navigator.credentials.create.
+type CreationOptions struct {
+	Challenge              string                 `json:"challenge"`
+	RP                     rpEntity               `json:"rp"`
+	User                   userEntity             `json:"user"`
+	PubKeyCredParams       []credentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection authenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions are the PublicKeyCredentialRequestOptions (JSON form) passed to navigator.credentials.get.
+type RequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	Timeout          int64                  `json:"timeout"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// CredentialDescriptor names an existing credential (base64url ID).
+type CredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+type rpEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type userEntity struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type credentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type authenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	RequireResident  bool   `json:"requireResidentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// NewChallenge returns a random challenge, base64url encoded as it appears in options and client data.
+func NewChallenge() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// NewCredentialDescriptor returns the descriptor of a stored credential.
+func NewCredentialDescriptor(id []byte, transports []string) CredentialDescriptor {
+	return CredentialDescriptor{Type: "public-key", ID: base64.RawURLEncoding.EncodeToString(id), Transports: transports}
+}
+
+// CreationOptions returns the options for registering a passkey for user. exclude lists the user's existing passkeys,
+// so an authenticator that already has one doesn't create a second. Passkeys are discoverable and user-verified.
+func (rp *RelyingParty) CreationOptions(challenge string, user User, exclude []CredentialDescriptor) CreationOptions {
+	params := make([]credentialParameter, 0, len(SupportedAlgorithms))
+	for _, alg := range SupportedAlgorithms {
+		params = append(params, credentialParameter{Type: "public-key", Alg: alg})
+	}
+	if exclude == nil {
+		exclude = []CredentialDescriptor{}
+	}
+	return CreationOptions{
+		Challenge:          challenge,
+		RP:                 rpEntity{ID: rp.ID, Name: rp.Name},
+		User:               userEntity{ID: base64.RawURLEncoding.EncodeToString(user.ID), Name: user.Name, DisplayName: user.DisplayName},
+		PubKeyCredParams:   params,
+		Timeout:            rp.Timeout.Milliseconds(),
+		ExcludeCredentials: exclude,
+		AuthenticatorSelection: authenticatorSelection{
+			ResidentKey:      "required",
+			RequireResident:  true,
+			UserVerification: "required",
+		},
+		Attestation: "none",
+	}
+}
+
+// RequestOptions returns the options for signing in with a passkey. With no allowed credentials the authenticator
+// offers every passkey it has for us (discoverable credentials), so the user doesn't type an email first.
+func (rp *RelyingParty) RequestOptions(challenge string, allow []CredentialDescriptor) RequestOptions {
+	if allow == nil {
+		allow = []CredentialDescriptor{}
+	}
+	return RequestOptions{
+		Challenge:        challenge,
+		Timeout:          rp.Timeout.Milliseconds(),
+		RPID:             rp.ID,
+		AllowCredentials: allow,
+		UserVerification: "required",
+	}
+}
+
+// clientData is the part of clientDataJSON we check.
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// ChallengeOf returns the challenge in clientDataJSON, so the caller can look up the challenge it issued before
+// verifying the response against it.
+func ChallengeOf(clientDataJSON []byte) (string, error) {
+	var cd clientData
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil || cd.Challenge == "" {
+		return "", fmt.Errorf("%w: malformed client data", ErrInvalidResponse)
+	}
+	return cd.Challenge, nil
+}
+
+// VerifyRegistration checks the response of navigator.credentials.create to CreationOptions with challenge and
+// returns the new credential.
+func (rp *RelyingParty) VerifyRegistration(clientDataJSON, attestationObject []byte, challenge string) (*Credential, error) {
+	if err := rp.checkClientData(clientDataJSON, typeCreate, challenge); err != nil {
+		return nil, err
+	}
+	v, rest, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+	att, ok := v.(map[interface{}]interface{})
+	if !ok || len(rest) != 0 {
+		return nil, fmt.Errorf("%w: malformed attestation object", ErrInvalidResponse)
+	}
+	raw, ok := att["authData"].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("%w: missing authenticator data", ErrInvalidResponse)
+	}
+	ad, err := rp.checkAuthenticatorData(raw)
+	if err != nil {
+		return nil, err
+	}
+	if ad.flags&flagAttestedCredentialData == 0 {
+		return nil, fmt.Errorf("%w: no credential in authenticator data", ErrInvalidResponse)
+	}
+	if _, _, err := parsePublicKey(ad.publicKey); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+	return &Credential{
+		ID:             append([]byte(nil), ad.credentialID...),
+		PublicKey:      append([]byte(nil), ad.publicKey...),
+		SignCount:      ad.signCount,
+		AAGUID:         append([]byte(nil), ad.aaguid...),
+		BackupEligible: ad.flags&flagBackupEligible != 0,
+	}, nil
+}
+
+// VerifyAssertion checks the response of navigator.credentials.get to RequestOptions with challenge, made with the
+// credential whose COSE public key and last sign count are given, and returns the new sign count to store.
+// Authenticators that don't count (synced passkeys) always report 0; otherwise the count must go up.
+func (rp *RelyingParty) VerifyAssertion(publicKey []byte, signCount uint32, clientDataJSON, authenticatorData, signature []byte, challenge string) (uint32, error) {
+	if err := rp.checkClientData(clientDataJSON, typeGet, challenge); err != nil {
+		return 0, err
+	}
+	ad, err := rp.checkAuthenticatorData(authenticatorData)
+	if err != nil {
+		return 0, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), authenticatorData...), clientDataHash[:]...)
+	if err := verifySignature(publicKey, signed, signature); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+	if (ad.signCount != 0 || signCount != 0) && ad.signCount <= signCount {
+		return 0, fmt.Errorf("%w: sign count did not increase (cloned authenticator?)", ErrInvalidResponse)
+	}
+	return ad.signCount, nil
+}
+
+func (rp *RelyingParty) checkClientData(raw []byte, typ, challenge string) error {
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return fmt.Errorf("%w: malformed client data", ErrInvalidResponse)
+	}
+	if cd.Type != typ {
+		return fmt.Errorf("%w: unexpected type %q", ErrInvalidResponse, cd.Type)
+	}
+	if subtle.ConstantTimeCompare([]byte(cd.Challenge), []byte(challenge)) != 1 {
+		return fmt.Errorf("%w: challenge mismatch", ErrInvalidResponse)
+	}
+	if cd.CrossOrigin {
+		return fmt.Errorf("%w: cross-origin request", ErrInvalidResponse)
+	}
+	for _, origin := range rp.Origins {
+		if cd.Origin == origin {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: unexpected origin %q", ErrInvalidResponse, cd.Origin)
+}
+
+// authenticatorData is a parsed authenticator data structure (WebAuthn §6.1).
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	aaguid       []byte
+	credentialID []byte
+	publicKey    []byte
+}
+
+// checkAuthenticatorData parses raw and checks it is for our RP ID with the user present and verified.
+func (rp *RelyingParty) checkAuthenticatorData(raw []byte) (*authenticatorData, error) {
+	ad, err := parseAuthenticatorData(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(ad.rpIDHash, rpIDHash[:]) {
+		return nil, fmt.Errorf("%w: credential is for another relying party", ErrInvalidResponse)
+	}
+	if ad.flags&flagUserPresent == 0 || ad.flags&flagUserVerified == 0 {
+		return nil, fmt.Errorf("%w: user not verified", ErrInvalidResponse)
+	}
+	return ad, nil
+}
+
+func parseAuthenticatorData(raw []byte) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, errors.New("authenticator data too short")
+	}
+	ad := &authenticatorData{rpIDHash: raw[:32], flags: raw[32], signCount: binary.BigEndian.Uint32(raw[33:37])}
+	rest := raw[37:]
+	if ad.flags&flagAttestedCredentialData != 0 {
+		if len(rest) < 18 {
+			return nil, errors.New("attested credential data too short")
+		}
+		ad.aaguid = rest[:16]
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if n == 0 || n > MaxCredentialIDLength || n > len(rest) {
+			return nil, errors.New("invalid credential id length")
+		}
+		ad.credentialID, rest = rest[:n], rest[n:]
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, err
+		}
+		ad.publicKey, rest = rest[:len(rest)-len(after)], after
+	}
+	if ad.flags&flagExtensionData != 0 {
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, err
+		}
+		rest = after
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("trailing bytes in authenticator data")
+	}
+	return ad, nil
+}
+
+// FormatAAGUID returns aaguid as lowercase hex, or "" when the authenticator didn't identify its model.
+func FormatAAGUID(aaguid []byte) string {
+	for _, b := range aaguid {
+		if b != 0 {
+			return hex.EncodeToString(aaguid)
+		}
+	}
+	return ""
+}
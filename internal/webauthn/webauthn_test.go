@@ -0,0 +1,388 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+const (
+	testRPID   = "zabaan.test"
+	testOrigin = "https://app.zabaan.test"
+)
+
+func testRP() *RelyingParty {
+	return &RelyingParty{ID: testRPID, Name: "Zabaan", Origins: []string{testOrigin}, Timeout: time.Minute}
+}
+
+// cborPair is a map entry; maps are encoded from a slice so the byte order is fixed.
+type cborPair struct {
+	key, value interface{}
+}
+
+// encodeCBOR encodes the subset of CBOR decodeCBOR reads: ints, byte and text strings, arrays and maps.
+func encodeCBOR(v interface{}) []byte {
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case []interface{}:
+		b := cborHead(4, uint64(len(v)))
+		for _, item := range v {
+			b = append(b, encodeCBOR(item)...)
+		}
+		return b
+	case []cborPair:
+		b := cborHead(5, uint64(len(v)))
+		for _, p := range v {
+			b = append(b, encodeCBOR(p.key)...)
+			b = append(b, encodeCBOR(p.value)...)
+		}
+		return b
+	}
+	panic("encodeCBOR: unsupported type")
+}
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+	}
+	return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, n)
+}
+
+// softAuthenticator is a software passkey: it builds the attestation objects, authenticator data and signatures a
+// real authenticator would return.
+type softAuthenticator struct {
+	credentialID []byte
+	ecKey        *ecdsa.PrivateKey  // ES256
+	edKey        ed25519.PrivateKey // EdDSA
+}
+
+func newSoftAuthenticator(t *testing.T, alg int) *softAuthenticator {
+	t.Helper()
+	a := &softAuthenticator{credentialID: make([]byte, 16)}
+	rand.Read(a.credentialID)
+	var err error
+	switch alg {
+	case AlgES256:
+		a.ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, a.edKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		t.Fatalf("unsupported algorithm %d", alg)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// coseKey returns the credential public key as a COSE_Key.
+func (a *softAuthenticator) coseKey() []byte {
+	if a.edKey != nil {
+		return encodeCBOR([]cborPair{
+			{coseKeyType, coseKtyOKP},
+			{coseAlg, AlgEdDSA},
+			{coseCurve, coseCrvEd25519},
+			{coseX, []byte(a.edKey.Public().(ed25519.PublicKey))},
+		})
+	}
+	point, err := a.ecKey.PublicKey.Bytes()
+	if err != nil {
+		panic(err)
+	}
+	return encodeCBOR([]cborPair{
+		{coseKeyType, coseKtyEC2},
+		{coseAlg, AlgES256},
+		{coseCurve, coseCrvP256},
+		{coseX, point[1:33]},
+		{coseY, point[33:65]},
+	})
+}
+
+// authData returns authenticator data for rpID, with the attested credential when flags has
+// flagAttestedCredentialData.
+func (a *softAuthenticator) authData(rpID string, flags byte, signCount uint32) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	b := append(rpIDHash[:], flags)
+	b = binary.BigEndian.AppendUint32(b, signCount)
+	if flags&flagAttestedCredentialData != 0 {
+		b = append(b, make([]byte, 16)...) // AAGUID
+		b = binary.BigEndian.AppendUint16(b, uint16(len(a.credentialID)))
+		b = append(b, a.credentialID...)
+		b = append(b, a.coseKey()...)
+	}
+	return b
+}
+
+func (a *softAuthenticator) sign(data []byte) []byte {
+	if a.edKey != nil {
+		return ed25519.Sign(a.edKey, data)
+	}
+	digest := sha256.Sum256(data)
+	sig, err := ecdsa.SignASN1(rand.Reader, a.ecKey, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return sig
+}
+
+// ceremony is what the client sends; the zero value of each field takes the valid default.
+type ceremony struct {
+	typ       string
+	challenge string
+	origin    string
+	rpID      string
+	flags     byte
+	signCount uint32
+}
+
+func (c ceremony) clientDataJSON() []byte {
+	b, err := json.Marshal(map[string]interface{}{"type": c.typ, "challenge": c.challenge, "origin": c.origin})
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func (c ceremony) withDefaults(typ, challenge string) ceremony {
+	if c.typ == "" {
+		c.typ = typ
+	}
+	if c.challenge == "" {
+		c.challenge = challenge
+	}
+	if c.origin == "" {
+		c.origin = testOrigin
+	}
+	if c.rpID == "" {
+		c.rpID = testRPID
+	}
+	if c.flags == 0 {
+		c.flags = flagUserPresent | flagUserVerified
+	}
+	return c
+}
+
+// register returns the clientDataJSON and attestationObject of navigator.credentials.create.
+func (a *softAuthenticator) register(c ceremony) ([]byte, []byte) {
+	authData := a.authData(c.rpID, c.flags|flagAttestedCredentialData, c.signCount)
+	att := encodeCBOR([]cborPair{{"fmt", "none"}, {"attStmt", []cborPair{}}, {"authData", authData}})
+	return c.clientDataJSON(), att
+}
+
+// assert returns the clientDataJSON, authenticatorData and signature of navigator.credentials.get.
+func (a *softAuthenticator) assert(c ceremony) ([]byte, []byte, []byte) {
+	clientDataJSON := c.clientDataJSON()
+	authData := a.authData(c.rpID, c.flags, c.signCount)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	return clientDataJSON, authData, a.sign(append(append([]byte(nil), authData...), clientDataHash[:]...))
+}
+
+func TestRegistrationAndAssertion(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		alg  int
+	}{{"ES256", AlgES256}, {"EdDSA", AlgEdDSA}} {
+		t.Run(tc.name, func(t *testing.T) {
+			rp := testRP()
+			a := newSoftAuthenticator(t, tc.alg)
+			challenge, err := NewChallenge()
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientDataJSON, att := a.register(ceremony{flags: flagUserPresent | flagUserVerified | flagBackupEligible}.withDefaults(typeCreate, challenge))
+			if got, err := ChallengeOf(clientDataJSON); err != nil || got != challenge {
+				t.Fatalf("ChallengeOf = %q, %v; want %q", got, err, challenge)
+			}
+			cred, err := rp.VerifyRegistration(clientDataJSON, att, challenge)
+			if err != nil {
+				t.Fatalf("VerifyRegistration: %v", err)
+			}
+			if !bytes.Equal(cred.ID, a.credentialID) || !bytes.Equal(cred.PublicKey, a.coseKey()) {
+				t.Fatalf("credential = %x / %x, want %x / %x", cred.ID, cred.PublicKey, a.credentialID, a.coseKey())
+			}
+			if !cred.BackupEligible || cred.SignCount != 0 || FormatAAGUID(cred.AAGUID) != "" {
+				t.Fatalf("credential = %+v", cred)
+			}
+
+			signCount := cred.SignCount
+			for i := uint32(1); i <= 2; i++ {
+				challenge, _ := NewChallenge()
+				clientDataJSON, authData, sig := a.assert(ceremony{signCount: i}.withDefaults(typeGet, challenge))
+				got, err := rp.VerifyAssertion(cred.PublicKey, signCount, clientDataJSON, authData, sig, challenge)
+				if err != nil {
+					t.Fatalf("VerifyAssertion %d: %v", i, err)
+				}
+				if got != i {
+					t.Fatalf("sign count = %d, want %d", got, i)
+				}
+				signCount = got
+			}
+		})
+	}
+}
+
+func TestVerifyRegistrationRejects(t *testing.T) {
+	rp := testRP()
+	a := newSoftAuthenticator(t, AlgES256)
+	challenge, _ := NewChallenge()
+	for _, tc := range []struct {
+		name string
+		c    ceremony
+	}{
+		{"wrong origin", ceremony{origin: "https://evil.test"}},
+		{"wrong challenge", ceremony{challenge: "c29tZXRoaW5nIGVsc2U"}},
+		{"wrong type", ceremony{typ: typeGet}},
+		{"wrong rp id hash", ceremony{rpID: "evil.test"}},
+		{"user not present", ceremony{flags: flagUserVerified}},
+		{"missing uv flag", ceremony{flags: flagUserPresent}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clientDataJSON, att := a.register(tc.c.withDefaults(typeCreate, challenge))
+			if _, err := rp.VerifyRegistration(clientDataJSON, att, challenge); !errors.Is(err, ErrInvalidResponse) {
+				t.Fatalf("VerifyRegistration err = %v, want ErrInvalidResponse", err)
+			}
+		})
+	}
+}
+
+func TestVerifyAssertionRejects(t *testing.T) {
+	rp := testRP()
+	a := newSoftAuthenticator(t, AlgEdDSA)
+	other := newSoftAuthenticator(t, AlgEdDSA)
+	challenge, _ := NewChallenge()
+	const stored = 10
+	for _, tc := range []struct {
+		name   string
+		c      ceremony
+		signer *softAuthenticator
+	}{
+		{"wrong origin", ceremony{origin: "https://evil.test", signCount: stored + 1}, a},
+		{"wrong challenge", ceremony{challenge: "c29tZXRoaW5nIGVsc2U", signCount: stored + 1}, a},
+		{"wrong type", ceremony{typ: typeCreate, signCount: stored + 1}, a},
+		{"wrong rp id hash", ceremony{rpID: "evil.test", signCount: stored + 1}, a},
+		{"missing uv flag", ceremony{flags: flagUserPresent, signCount: stored + 1}, a},
+		{"sign count went backwards", ceremony{signCount: stored - 1}, a},
+		{"sign count unchanged", ceremony{signCount: stored}, a},
+		{"sign count reset to zero", ceremony{}, a},
+		{"signed by another key", ceremony{signCount: stored + 1}, other},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clientDataJSON, authData, sig := tc.signer.assert(tc.c.withDefaults(typeGet, challenge))
+			if _, err := rp.VerifyAssertion(a.coseKey(), stored, clientDataJSON, authData, sig, challenge); !errors.Is(err, ErrInvalidResponse) {
+				t.Fatalf("VerifyAssertion err = %v, want ErrInvalidResponse", err)
+			}
+		})
+	}
+}
+
+func TestVerifyAssertionWithoutSignCount(t *testing.T) {
+	// Synced passkeys always report 0.
+	rp := testRP()
+	a := newSoftAuthenticator(t, AlgES256)
+	challenge, _ := NewChallenge()
+	clientDataJSON, authData, sig := a.assert(ceremony{}.withDefaults(typeGet, challenge))
+	if got, err := rp.VerifyAssertion(a.coseKey(), 0, clientDataJSON, authData, sig, challenge); err != nil || got != 0 {
+		t.Fatalf("VerifyAssertion = %d, %v; want 0, nil", got, err)
+	}
+}
+
+// nested returns depth one-element arrays around 0.
+func nested(depth int) []byte {
+	return append(bytes.Repeat([]byte{0x81}, depth), 0x00)
+}
+
+func TestDecodeCBORMalformed(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"truncated argument", []byte{0x19, 0x01}},
+		{"byte string longer than input", []byte{0x45, 0x01, 0x02}},
+		{"huge array length", []byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"huge map length", []byte{0xba, 0xff, 0xff, 0xff, 0xff}},
+		{"integer overflow", []byte{0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"indefinite length", []byte{0x5f, 0x41, 0x00, 0xff}},
+		{"tag", []byte{0xc0, 0x60}},
+		{"float", []byte{0xf9, 0x3c, 0x00}},
+		{"array map key", []byte{0xa1, 0x80, 0x00}},
+		{"duplicate map key", []byte{0xa2, 0x01, 0x00, 0x01, 0x00}},
+		{"missing map value", []byte{0xa1, 0x01}},
+		{"deeply nested", nested(maxCBORDepth + 1)},
+		{"very deeply nested", nested(100000)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if v, _, err := decodeCBOR(tc.data); err == nil {
+				t.Fatalf("decodeCBOR(%x) = %v, want error", tc.data, v)
+			}
+		})
+	}
+	if _, rest, err := decodeCBOR(nested(maxCBORDepth)); err != nil || len(rest) != 0 {
+		t.Fatalf("decodeCBOR at max depth: rest %x, err %v", rest, err)
+	}
+}
+
+func TestVerifyRegistrationMalformedAttestation(t *testing.T) {
+	rp := testRP()
+	a := newSoftAuthenticator(t, AlgES256)
+	challenge, _ := NewChallenge()
+	clientDataJSON, att := a.register(ceremony{}.withDefaults(typeCreate, challenge))
+	authData := a.authData(testRPID, flagUserPresent|flagUserVerified|flagAttestedCredentialData, 0)
+	for _, tc := range []struct {
+		name string
+		att  []byte
+	}{
+		{"truncated", att[:len(att)-1]},
+		{"trailing bytes", append(append([]byte(nil), att...), 0x00)},
+		{"not a map", encodeCBOR([]interface{}{"authData"})},
+		{"deeply nested", nested(100000)},
+		{"nested in attStmt", nestedAttStmt(authData)},
+		{"authData too short", encodeCBOR([]cborPair{{"fmt", "none"}, {"authData", authData[:36]}})},
+		{"authData trailing bytes", encodeCBOR([]cborPair{{"fmt", "none"}, {"authData", append(append([]byte(nil), authData...), 0x00)}})},
+		{"authData credential id too long", encodeCBOR([]cborPair{{"fmt", "none"}, {"authData", lengthenCredentialID(authData)}})},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := rp.VerifyRegistration(clientDataJSON, tc.att, challenge); !errors.Is(err, ErrInvalidResponse) {
+				t.Fatalf("VerifyRegistration err = %v, want ErrInvalidResponse", err)
+			}
+		})
+	}
+}
+
+// lengthenCredentialID returns authData with a credential ID length past the end of the data.
+func lengthenCredentialID(authData []byte) []byte {
+	b := append([]byte(nil), authData...)
+	binary.BigEndian.PutUint16(b[37+16:], uint16(len(b)))
+	return b
+}
+
+// nestedAttStmt returns an attestation object whose attStmt nests one level deeper than decodeCBOR allows.
+func nestedAttStmt(authData []byte) []byte {
+	b := append([]byte{0xa2}, encodeCBOR("attStmt")...)
+	b = append(b, nested(maxCBORDepth)...)
+	b = append(b, encodeCBOR("authData")...)
+	return append(b, encodeCBOR(authData)...)
+}
@@ -19,12 +19,18 @@ import (
 	"time"
 
 	_ "github.com/bilalabsh/zabaan_backend/docs"
+	"github.com/bilalabsh/zabaan_backend/internal/audit"
 	"github.com/bilalabsh/zabaan_backend/internal/auth"
 	"github.com/bilalabsh/zabaan_backend/internal/config"
 	"github.com/bilalabsh/zabaan_backend/internal/database"
 	"github.com/bilalabsh/zabaan_backend/internal/health"
+	"github.com/bilalabsh/zabaan_backend/internal/mailer"
 	"github.com/bilalabsh/zabaan_backend/internal/middleware"
+	"github.com/bilalabsh/zabaan_backend/internal/models"
+	"github.com/bilalabsh/zabaan_backend/internal/oidc"
+	"github.com/bilalabsh/zabaan_backend/internal/sms"
 	"github.com/bilalabsh/zabaan_backend/internal/user"
+	"github.com/bilalabsh/zabaan_backend/internal/webauthn"
 	httpSwagger "github.com/swaggo/http-swagger"
 )
 
@@ -44,32 +50,270 @@ func main() {
 	defer database.Close()
 
 	// Wire modules: repository → service → handler
+	auditRepo := audit.NewRepository(database.DB)
+	auditRecorder := audit.NewRecorder(auditRepo, cfg.TrustProxy)
+	auditHandler := audit.NewHandler(auditRepo)
+
 	userRepo := user.NewRepository(database.DB)
-	userSvc := user.NewService(userRepo)
-	userHandler := user.NewHandler(userSvc)
 
-	authSvc := auth.NewService(userRepo, cfg.JWTSecret, cfg.TokenExpiry, cfg.RevocationTolerance)
-	authHandler := auth.NewHandler(authSvc)
+	jwtKeys, err := auth.LoadKeySet(auth.KeyConfig{
+		Algorithm:      cfg.JWTSigningAlg,
+		Secret:         cfg.JWTSecret,
+		PrivateKeyFile: cfg.JWTPrivateKeyFile,
+		KeyID:          cfg.JWTKeyID,
+		VerifyKeyFiles: cfg.JWTVerifyKeyFiles,
+		LegacySecret:   cfg.JWTLegacySecret(),
+	})
+	if err != nil {
+		slog.Error("loading JWT keys failed", "err", err)
+		os.Exit(1)
+	}
+	mail := mailer.New(mailer.Config{
+		Driver:   cfg.Mailer,
+		From:     cfg.MailFrom,
+		SMTPHost: cfg.SMTPHost,
+		SMTPPort: cfg.SMTPPort,
+		Username: cfg.SMTPUsername,
+		Password: cfg.SMTPPassword,
+		LogFile:  cfg.MailLogFile,
+	})
+	smsSender := sms.New(sms.Config{
+		Driver:  cfg.SMSProvider,
+		LogFile: cfg.SMSLogFile,
+	})
+	identityVerifier := oidc.NewVerifier([]oidc.Provider{
+		{Name: oidc.ProviderGoogle, Issuers: cfg.OIDCGoogleIssuers, Audiences: cfg.OIDCGoogleClientIDs, JWKSURL: cfg.OIDCGoogleJWKSURL},
+		{Name: oidc.ProviderApple, Issuers: cfg.OIDCAppleIssuers, Audiences: cfg.OIDCAppleClientIDs, JWKSURL: cfg.OIDCAppleJWKSURL},
+	}, nil)
+	var passkeyRP *webauthn.RelyingParty
+	if cfg.PasskeysEnabled {
+		rpID, origins := cfg.WebAuthnRelyingParty()
+		passkeyRP = &webauthn.RelyingParty{ID: rpID, Name: cfg.WebAuthnRPName, Origins: origins, Timeout: cfg.WebAuthnTimeout}
+	}
+	passwordHasher, err := auth.NewPasswordHasher(auth.HasherConfig{
+		Algorithm:         cfg.PasswordHashAlg,
+		BcryptCost:        cfg.BcryptCost,
+		Argon2Memory:      uint32(cfg.Argon2Memory),
+		Argon2Iterations:  uint32(cfg.Argon2Iterations),
+		Argon2Parallelism: uint8(cfg.Argon2Parallelism),
+	})
+	if err != nil {
+		slog.Error("password hasher config invalid", "err", err)
+		os.Exit(1)
+	}
+	authRepo := auth.NewRepository(database.DB)
+	authSvc := auth.NewService(userRepo, authRepo, auth.Options{
+		Keys:                jwtKeys,
+		TokenExpiry:         cfg.TokenExpiry,
+		RefreshTokenExpiry:  cfg.RefreshTokenExpiry,
+		RevocationTolerance: cfg.RevocationTolerance,
+
+		Mailer:                  mail,
+		AppBaseURL:              cfg.AppBaseURL,
+		EmailVerification:       cfg.EmailVerification,
+		VerificationTokenExpiry: cfg.VerificationTokenExpiry,
+		PasswordResetExpiry:     cfg.PasswordResetExpiry,
+		EmailLoginCodeExpiry:    cfg.EmailLoginCodeExpiry,
+		EmailChangeExpiry:       cfg.EmailChangeExpiry,
+		EmailChangeUndoExpiry:   cfg.EmailChangeUndoExpiry,
+
+		SMS:                     smsSender,
+		PhoneDefaultCountryCode: cfg.PhoneDefaultCountryCode,
+		PhoneCodeExpiry:         cfg.PhoneCodeExpiry,
+		PhoneCodesPerHour:       cfg.PhoneCodesPerHour,
+
+		IdentityVerifier: identityVerifier,
+		Passkeys:         passkeyRP,
+		Lockout: auth.LockoutPolicy{
+			Threshold: cfg.LoginLockoutThreshold,
+			BaseDelay: cfg.LoginLockoutBase,
+			MaxDelay:  cfg.LoginLockoutMax,
+			Window:    cfg.LoginLockoutWindow,
+		},
+		Hasher: passwordHasher,
+		PasswordPolicy: &auth.PasswordPolicy{
+			MinLength:      cfg.PasswordMinLength,
+			RequireLetter:  cfg.PasswordRequireLetter,
+			RequireDigit:   cfg.PasswordRequireDigit,
+			RequireUpper:   cfg.PasswordRequireUpper,
+			RequireLower:   cfg.PasswordRequireLower,
+			RequireSymbol:  cfg.PasswordRequireSymbol,
+			MaxRepeats:     cfg.PasswordMaxRepeats,
+			RejectCommon:   cfg.PasswordRejectCommon,
+			BreachedDir:    cfg.PasswordBreachedDir,
+			RejectPersonal: cfg.PasswordRejectPersonal,
+		},
+		AdminEmails:     cfg.AdminEmails,
+		GuestAccountTTL: cfg.GuestAccountTTL,
+		DeletionGrace:   cfg.AccountDeletionGrace,
+		UserDataStores:  []auth.UserDataStore{auditRepo},
+
+		IntrospectionClients: cfg.IntrospectionClientSecrets(),
+		ImpersonationExpiry:  cfg.ImpersonationExpiry,
+		AntiEnumeration:      cfg.AntiEnumeration,
+	})
+	authHandler := auth.NewHandler(authSvc, cfg.TrustProxy, auditRecorder)
+	userSvc := user.NewService(userRepo, authSvc)
+	userHandler := user.NewHandler(userSvc, auditRecorder)
 	authRateLimiter := middleware.NewAuthRateLimiter(time.Minute, 10, cfg.TrustProxy)
 
+	// Background maintenance
+	go runPeriodically("prune revoked tokens", time.Hour, func() error {
+		n, err := authSvc.PruneRevokedTokens()
+		if err == nil && n > 0 {
+			slog.Info("pruned revoked tokens", "component", "maintenance", "count", n)
+		}
+		return err
+	})
+	go runPeriodically("prune passkey challenges", time.Hour, func() error {
+		n, err := authSvc.PrunePasskeyChallenges()
+		if err == nil && n > 0 {
+			slog.Info("pruned passkey challenges", "component", "maintenance", "count", n)
+		}
+		return err
+	})
+	go runPeriodically("prune phone codes", time.Hour, func() error {
+		n, err := authSvc.PrunePhoneCodes()
+		if err == nil && n > 0 {
+			slog.Info("pruned phone codes", "component", "maintenance", "count", n)
+		}
+		return err
+	})
+	go runPeriodically("prune login attempts", time.Hour, func() error {
+		n, err := authSvc.PruneLoginAttempts()
+		if err == nil && n > 0 {
+			slog.Info("pruned login attempts", "component", "maintenance", "count", n)
+		}
+		return err
+	})
+
+	go runPeriodically("purge deleted accounts", time.Hour, func() error {
+		n, err := authSvc.PurgeDeletedAccounts()
+		if err == nil && n > 0 {
+			slog.Info("purged deleted accounts", "component", "maintenance", "count", n)
+		}
+		return err
+	})
+	go runPeriodically("prune guest accounts", time.Hour, func() error {
+		n, err := authSvc.PruneGuests()
+		if err == nil && n > 0 {
+			slog.Info("pruned guest accounts", "component", "maintenance", "count", n)
+		}
+		return err
+	})
+
+	// protected requires a valid token of a full (non-guest) account and, when EMAIL_VERIFICATION=protected,
+	// a verified email. With REQUIRE_CONSENT it also requires the current legal documents to be accepted.
+	protected := func(next http.HandlerFunc) http.HandlerFunc {
+		if cfg.RequireConsent {
+			next = middleware.RequireConsent(authSvc, next)
+		}
+		next = middleware.RequireFullAccount(next)
+		if cfg.EmailVerification == auth.EmailVerificationProtected {
+			next = middleware.RequireVerifiedEmail(next)
+		}
+		return middleware.RequireAuth(authSvc, auditRecorder, next)
+	}
+
+	// sensitive is protected, and also refused to admins impersonating the user.
+	sensitive := func(next http.HandlerFunc) http.HandlerFunc {
+		return protected(middleware.RejectImpersonation(next))
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", health.Check)
-	mux.HandleFunc("/users", middleware.RequireAuth(authSvc, userHandler.Users))
-	mux.HandleFunc("/users/", middleware.RequireAuth(authSvc, userHandler.Users))
+	// usersAPI admits admins with a Bearer token, or with an API key scoped users:read (GET) or users:write (others).
+	usersAPI := func(next http.HandlerFunc) http.HandlerFunc {
+		next = middleware.RequireRole(next, models.RoleAdmin)
+		read, write := middleware.RequireScope(next, auth.ScopeUsersRead), middleware.RequireScope(next, auth.ScopeUsersWrite)
+		next = func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet {
+				read(w, r)
+				return
+			}
+			write(w, r)
+		}
+		if cfg.EmailVerification == auth.EmailVerificationProtected {
+			next = middleware.RequireVerifiedEmail(next)
+		}
+		return middleware.RequireAuthOrAPIKey(authSvc, auditRecorder, next)
+	}
+	mux.HandleFunc("/users", usersAPI(userHandler.Users))
+	mux.HandleFunc("/users/", usersAPI(userHandler.Users))
 	mux.HandleFunc("/signup", authRateLimiter.Wrap(authHandler.Signup))
 	mux.HandleFunc("/signup/", authRateLimiter.Wrap(authHandler.Signup))
+	mux.HandleFunc("/guest", authRateLimiter.Wrap(authHandler.Guest))
+	mux.HandleFunc("/guest/upgrade", authRateLimiter.Wrap(middleware.RequireAuth(authSvc, auditRecorder, middleware.RejectImpersonation(authHandler.GuestUpgrade))))
 	mux.HandleFunc("/login", authRateLimiter.Wrap(authHandler.Login))
 	mux.HandleFunc("/login/", authRateLimiter.Wrap(authHandler.Login))
+	mux.HandleFunc("/login/2fa", authRateLimiter.Wrap(authHandler.LoginTwoFactor))
+	mux.HandleFunc("/login/email-code", authRateLimiter.Wrap(authHandler.EmailLoginRequest))
+	mux.HandleFunc("/login/email-code/verify", authRateLimiter.Wrap(authHandler.EmailLoginVerify))
+	routes := "/signup, /guest, /guest/upgrade, /login, /login/2fa, /login/email-code, /login/passkey/begin, /login/passkey/finish, /getToken, /auth/oidc/{provider}, /token/refresh, /logout, /sessions, /verify-email, /email-change/confirm, /email-change/undo, /password/forgot, /password/reset, /me, /me/export, /me/password, /me/email, /me/2fa/setup, /me/2fa/confirm, /me/passkeys, /me/passkeys/register/begin, /me/passkeys/register/finish, /me/api-keys, /me/security-events, /me/consents, /legal-documents, /admin/security-events, /admin/users/{id}/impersonate, /users, /.well-known/jwks.json, /oauth/introspect, /health"
+	if cfg.PhoneLoginEnabled {
+		mux.HandleFunc("/signup/phone", authRateLimiter.Wrap(authHandler.PhoneSignupRequest))
+		mux.HandleFunc("/signup/phone/verify", authRateLimiter.Wrap(authHandler.PhoneSignupVerify))
+		mux.HandleFunc("/login/phone", authRateLimiter.Wrap(authHandler.PhoneLoginRequest))
+		mux.HandleFunc("/login/phone/verify", authRateLimiter.Wrap(authHandler.PhoneLoginVerify))
+		routes += ", /signup/phone, /signup/phone/verify, /login/phone, /login/phone/verify"
+	}
+	mux.HandleFunc("/login/passkey/begin", authRateLimiter.Wrap(authHandler.PasskeyLoginBegin))
+	mux.HandleFunc("/login/passkey/finish", authRateLimiter.Wrap(authHandler.PasskeyLoginFinish))
 	mux.HandleFunc("/getToken", authRateLimiter.Wrap(authHandler.GetToken))
 	mux.HandleFunc("/getToken/", authRateLimiter.Wrap(authHandler.GetToken))
+	mux.HandleFunc("/auth/oidc/", authRateLimiter.Wrap(authHandler.OIDCLogin))
+	mux.HandleFunc("/token/refresh", authRateLimiter.Wrap(authHandler.Refresh))
+	mux.HandleFunc("/verify-email", authRateLimiter.Wrap(authHandler.VerifyEmail))
+	mux.HandleFunc("/verify-email/resend", authRateLimiter.Wrap(authHandler.ResendVerification))
+	mux.HandleFunc("/email-change/confirm", authRateLimiter.Wrap(authHandler.ConfirmEmailChange))
+	mux.HandleFunc("/email-change/undo", authRateLimiter.Wrap(authHandler.UndoEmailChange))
+	mux.HandleFunc("/me", sensitive(authHandler.Me))
+	mux.HandleFunc("/me/export", sensitive(authHandler.Export))
+	mux.HandleFunc("/me/password", authRateLimiter.Wrap(sensitive(authHandler.ChangePassword)))
+	mux.HandleFunc("/me/email", authRateLimiter.Wrap(sensitive(authHandler.EmailChange)))
+	mux.HandleFunc("/me/2fa/setup", sensitive(authHandler.TwoFactorSetup))
+	mux.HandleFunc("/me/2fa/confirm", sensitive(authHandler.TwoFactorConfirm))
+	mux.HandleFunc("/me/passkeys", sensitive(authHandler.Passkeys))
+	mux.HandleFunc("/me/passkeys/", sensitive(authHandler.Passkeys))
+	mux.HandleFunc("/me/passkeys/register/begin", sensitive(authHandler.PasskeyRegisterBegin))
+	mux.HandleFunc("/me/passkeys/register/finish", sensitive(authHandler.PasskeyRegisterFinish))
+	mux.HandleFunc("/me/api-keys", sensitive(authHandler.APIKeys))
+	mux.HandleFunc("/me/api-keys/", sensitive(authHandler.APIKeys))
+	mux.HandleFunc("/me/security-events", protected(auditHandler.MyEvents))
+	// Outside protected, so users can accept new documents while RequireConsent blocks everything else.
+	mux.HandleFunc("/me/consents", middleware.RequireAuth(authSvc, auditRecorder, middleware.RejectImpersonation(authHandler.Consents)))
+	mux.HandleFunc("/legal-documents", authHandler.LegalDocuments)
+	mux.HandleFunc("/admin/users/", sensitive(middleware.RequireRole(authHandler.Impersonate, models.RoleAdmin)))
+	mux.HandleFunc("/admin/security-events", protected(middleware.RequireRole(auditHandler.Events, models.RoleAdmin)))
+	mux.HandleFunc("/password/forgot", authRateLimiter.Wrap(authHandler.ForgotPassword))
+	mux.HandleFunc("/password/reset", authRateLimiter.Wrap(authHandler.ResetPassword))
+	mux.HandleFunc("/.well-known/jwks.json", authHandler.JWKS)
+	mux.HandleFunc("/oauth/introspect", authHandler.Introspect)
+	mux.HandleFunc("/logout", middleware.RequireAuth(authSvc, auditRecorder, authHandler.Logout))
+	mux.HandleFunc("/sessions", middleware.RequireAuth(authSvc, auditRecorder, middleware.RejectImpersonation(authHandler.Sessions)))
+	mux.HandleFunc("/sessions/", middleware.RequireAuth(authSvc, auditRecorder, middleware.RejectImpersonation(authHandler.Sessions)))
 	mux.HandleFunc("/docs/", httpSwagger.WrapHandler)
 	mux.HandleFunc("/", health.Root)
 
 	serverAddr := ":" + cfg.Port
-	slog.Info("server listening", "addr", serverAddr, "routes", "/signup, /login, /getToken, /users, /health")
+	slog.Info("server listening", "addr", serverAddr, "routes", routes)
 
 	if err := http.ListenAndServe(serverAddr, mux); err != nil {
 		slog.Error("server failed to start", "err", err)
 		os.Exit(1)
 	}
 }
+
+// runPeriodically calls fn every interval until the process exits, logging failures. The first run happens after one interval.
+func runPeriodically(name string, interval time.Duration, fn func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if database.DB == nil {
+			continue
+		}
+		if err := fn(); err != nil {
+			slog.Error("background job failed", "component", "maintenance", "job", name, "err", err)
+		}
+	}
+}